@@ -4,6 +4,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"net"
 	"os"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,10 +33,13 @@ type dptr1Adapter struct {
 	lut       map[schdlSerial]pckt1ShortAddress
 	lutLock   *sync.Mutex
 	lastSeen  time.Time
+	linkLock  *sync.Mutex // Guards the handle & the last contact (shared by the routines of the adapter)
+	settled   int32       // Set (atomically) once the last probe found every fixture with an address of its own
 }
 
 const (
 	dptr1CommandTimeout   = 10 * time.Second
+	dptr1BroadcastWait    = time.Second // Replies to broadcasts are not awaited (they are verified afterwards)
 	dptr1ReconnectTimeout = 2 * dscvr1DiscoveryInterval
 )
 
@@ -57,6 +62,8 @@ func dptr1Init(logger *log.Logger, address net.IP, port int) *dptr1Adapter {
 		make(map[schdlSerial]pckt1ShortAddress),
 		&sync.Mutex{},
 		time.Now(),
+		&sync.Mutex{},
+		0,
 	}
 }
 
@@ -71,8 +78,8 @@ func (adapter *dptr1Adapter) dptr1Activate(conditioning bool) {
 
 func (adapter *dptr1Adapter) dptr1Connector() {
 	var octets bytes.Buffer
-	for time.Now().Before(adapter.lastSeen.Add(dptr1ReconnectTimeout)) {
-		handle := adapter.handle
+	for adapter.dptr1Alive() {
+		handle := adapter.dptr1Handle()
 		if handle != nil {
 			adapter.dptr1Close(handle)
 		}
@@ -80,15 +87,19 @@ func (adapter *dptr1Adapter) dptr1Connector() {
 		if fail != nil {
 			time.Sleep(time.Second)
 			adapter.logger.Printf("INFO: [%s] Retrying adapter connection", adapter.adapterID)
+			mtrcAdd(mtrcReconnects, 1, "adapter", string(adapter.adapterID))
 			continue
 		}
+		adapter.linkLock.Lock()
 		adapter.handle = handle
-		for time.Now().Before(adapter.lastSeen.Add(dptr1ReconnectTimeout)) {
+		adapter.linkLock.Unlock()
+		for adapter.dptr1Alive() {
 			if fail := adapter.dptr1Process(handle, &octets); fail != nil {
 				adapter.logger.Printf("ERROR: [%s] Failed to process octets coming (%s)", adapter.adapterID, fail)
 				adapter.dptr1Close(handle)
 				time.Sleep(time.Second)
 				adapter.logger.Printf("INFO: [%s] Retrying connection", adapter.adapterID)
+				mtrcAdd(mtrcReconnects, 1, "adapter", string(adapter.adapterID))
 				break
 			}
 		}
@@ -132,12 +143,16 @@ func (adapter *dptr1Adapter) dptr1Transmit(packet pckt1Packet) error {
 	return nil
 }
 
-// Issues command and collects reply/replies
-func (adapter *dptr1Adapter) dptr1Exchange(command pckt1Packet, timeout time.Duration) ([]pckt1Packet, error) {
-	// Open transaction
+// Issues command and collects reply/replies (stops waiting when canceled)
+func (adapter *dptr1Adapter) dptr1Exchange(ctx context.Context, command pckt1Packet, timeout time.Duration) ([]pckt1Packet, error) {
+	if fail := ctx.Err(); fail != nil {
+		return nil, fail
+	}
+	// Open transaction (closed once done)
 	inbox := make(chan pckt1Packet, 256)
 	transaction := command.Header.SequenceNumber
 	adapter.inbox.Store(transaction, inbox)
+	defer adapter.inbox.Delete(transaction)
 	// Send the command
 	adapter.logger.Printf("INFO: [%s] <- %s", adapter.adapterID, pckt1ToString(command))
 	if fail := adapter.dptr1Transmit(command); fail != nil {
@@ -149,13 +164,20 @@ func (adapter *dptr1Adapter) dptr1Exchange(command pckt1Packet, timeout time.Dur
 		// Wait for replies
 		if command.Header.ShortAddress == pckt1ShortAddressBroadcast {
 			// Expecting more replies so wait full timeout
-			time.Sleep(timeout)
+			select {
+			case <-time.After(timeout):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		} else {
 			// Expecting <=1 reply, wait for it no longer than timeout
 			select {
 			case reply := <-inbox:
 				replies = append(replies, reply)
 			case <-time.After(timeout):
+				mtrcAdd(mtrcCommandTimeouts, 1, "adapter", string(adapter.adapterID), "function_code", mtrcCode(command.Header.FunctionCode))
+			case <-ctx.Done():
+				return nil, ctx.Err()
 			}
 		}
 		// Collect all (remaining) replies
@@ -166,16 +188,28 @@ func (adapter *dptr1Adapter) dptr1Exchange(command pckt1Packet, timeout time.Dur
 			adapter.logger.Printf("INFO: [%s] -> %s", adapter.adapterID, pckt1ToString(reply))
 		}
 	} else {
-		time.Sleep(timeout)
+		select {
+		case <-time.After(timeout):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	// Close transaction
-	adapter.inbox.Delete(transaction)
 	// Return replies
 	return replies, nil
 }
 
 // Assembles a command and runs the packet exchange
 func (adapter *dptr1Adapter) dptr1AssembleAndExchange(shortAddress pckt1ShortAddress, functionCode pckt1FunctionCode, payload pckt1Payload) ([]pckt1Packet, error) {
+	return adapter.dptr1AssembleAndExchangeContext(context.Background(), shortAddress, functionCode, payload)
+}
+
+// Assembles a command and runs the packet exchange (until canceled)
+func (adapter *dptr1Adapter) dptr1AssembleAndExchangeContext(ctx context.Context, shortAddress pckt1ShortAddress, functionCode pckt1FunctionCode, payload pckt1Payload) ([]pckt1Packet, error) {
+	return adapter.dptr1AssembleAndExchangeTimeout(ctx, shortAddress, functionCode, payload, dptr1CommandTimeout)
+}
+
+// Assembles a command and runs the packet exchange waiting for the replies no longer than the timeout (until canceled)
+func (adapter *dptr1Adapter) dptr1AssembleAndExchangeTimeout(ctx context.Context, shortAddress pckt1ShortAddress, functionCode pckt1FunctionCode, payload pckt1Payload, timeout time.Duration) ([]pckt1Packet, error) {
 	switch functionCode {
 	case pckt1FunctionCodeSetShortAddress, pckt1FunctionCodeGetShortAddress:
 		shortAddress = pckt1ShortAddressBroadcast
@@ -191,10 +225,20 @@ func (adapter *dptr1Adapter) dptr1AssembleAndExchange(shortAddress pckt1ShortAdd
 		},
 		payload,
 	}
-	replies, fail := adapter.dptr1Exchange(packet, dptr1CommandTimeout)
+	serial := adapter.dptr1SerialOf(shortAddress)
+	evntPublish(evntTopicCommandSent, adapter.adapterID, serial, packet)
+	started := time.Now()
+	replies, fail := adapter.dptr1Exchange(ctx, packet, timeout)
+	mtrcObserve(mtrcCommandDuration, time.Since(started).Seconds(), "function_code", mtrcCode(functionCode), "broadcast", strconv.FormatBool(shortAddress == pckt1ShortAddressBroadcast))
 	if fail != nil {
+		evntPublish(evntTopicCommandFailed, adapter.adapterID, serial, evntFailure{shortAddress, functionCode, fail.Error()})
 		return nil, fail
 	}
+	for _, reply := range replies {
+		replier := adapter.dptr1SerialOf(reply.Header.ShortAddress)
+		evntPublish(evntTopicCommandReplied, adapter.adapterID, replier, reply)
+		adapter.dptr1Measure(replier, reply)
+	}
 	if fail := dptr1CheckReplies(functionCode, replies); fail == nil {
 		switch functionCode {
 		case pckt1FunctionCodeSetSerialNumber:
@@ -206,6 +250,7 @@ func (adapter *dptr1Adapter) dptr1AssembleAndExchange(shortAddress pckt1ShortAdd
 		}
 	} else {
 		adapter.logger.Printf("ERROR: [%s] Failure reported in received replies (%s)", adapter.adapterID, fail)
+		evntPublish(evntTopicCommandFailed, adapter.adapterID, serial, evntFailure{shortAddress, functionCode, fail.Error()})
 	}
 	return replies, nil
 }
@@ -223,7 +268,9 @@ func (adapter *dptr1Adapter) dptr1Process(handle *net.TCPConn, octets *bytes.Buf
 	}
 	if read != 0 {
 		octets.Write(octet)
+		adapter.linkLock.Lock()
 		adapter.lastSeen = time.Now()
+		adapter.linkLock.Unlock()
 		replies := pckt1Parse(octets, string(adapter.adapterID), adapter.logger)
 		for _, reply := range replies {
 			queue, present := adapter.inbox.Load(reply.Header.SequenceNumber)
@@ -237,6 +284,25 @@ func (adapter *dptr1Adapter) dptr1Process(handle *net.TCPConn, octets *bytes.Buf
 	return nil
 }
 
+// Returns the socket connected to the adapter (nil until connected)
+func (adapter *dptr1Adapter) dptr1Handle() *net.TCPConn {
+	adapter.linkLock.Lock()
+	defer adapter.linkLock.Unlock()
+	return adapter.handle
+}
+
+// Tells when the adapter made contact last
+func (adapter *dptr1Adapter) dptr1LastSeen() time.Time {
+	adapter.linkLock.Lock()
+	defer adapter.linkLock.Unlock()
+	return adapter.lastSeen
+}
+
+// Tells if the adapter made contact recently enough to keep its routines running
+func (adapter *dptr1Adapter) dptr1Alive() bool {
+	return time.Now().Before(adapter.dptr1LastSeen().Add(dptr1ReconnectTimeout))
+}
+
 // Closes the socket used by the thread
 func (adapter *dptr1Adapter) dptr1Close(handle *net.TCPConn) {
 	if fail := handle.Close(); fail != nil {
@@ -284,29 +350,87 @@ func (adapter *dptr1Adapter) dptr1LookUp(serial schdlSerial) pckt1ShortAddress {
 	return shortAddress
 }
 
+// Looks up the serial number assigned to the given address (zero if none or broadcast)
+func (adapter *dptr1Adapter) dptr1SerialOf(shortAddress pckt1ShortAddress) schdlSerial {
+	adapter.lutLock.Lock()
+	defer adapter.lutLock.Unlock()
+	for serial, other := range adapter.lut {
+		if other == shortAddress {
+			return serial
+		}
+	}
+	return 0
+}
+
 // Reassociates address with serial
 func (adapter *dptr1Adapter) dptr1ReassociateSingle(serial schdlSerial, shortAddress pckt1ShortAddress) {
 	adapter.lutLock.Lock()
-	for other := range adapter.lut {
-		if adapter.lut[other] == shortAddress {
-			delete(adapter.lut, other)
+	previous := adapter.lut
+	adapter.lut = make(map[schdlSerial]pckt1ShortAddress, len(previous))
+	for other, otherAddress := range previous {
+		if otherAddress != shortAddress {
+			adapter.lut[other] = otherAddress
 		}
 	}
 	adapter.lut[serial] = shortAddress
+	current := adapter.lut
 	adapter.lutLock.Unlock()
+	adapter.dptr1PublishChanges(previous, current)
 }
 
 // Reassociates addresses with serials
 func (adapter *dptr1Adapter) dptr1ReassociateAll(lut map[schdlSerial]pckt1ShortAddress) {
 	adapter.lutLock.Lock()
+	previous := adapter.lut
 	adapter.lut = lut
 	adapter.lutLock.Unlock()
+	adapter.dptr1PublishChanges(previous, lut)
+}
+
+// Publishes the fixtures seen, lost & readdressed between two associations
+func (adapter *dptr1Adapter) dptr1PublishChanges(previous, current map[schdlSerial]pckt1ShortAddress) {
+	for serial, shortAddress := range current {
+		if previousAddress, present := previous[serial]; !present {
+			evntPublish(evntTopicFixtureSeen, adapter.adapterID, serial, evntAddress{shortAddress, 0})
+		} else if previousAddress != shortAddress {
+			evntPublish(evntTopicFixtureReaddressed, adapter.adapterID, serial, evntAddress{shortAddress, previousAddress})
+		}
+	}
+	for serial, shortAddress := range previous {
+		if _, present := current[serial]; !present {
+			evntPublish(evntTopicFixtureLost, adapter.adapterID, serial, evntAddress{shortAddress, 0})
+			mtrcForget("adapter", string(adapter.adapterID), "serial", fmt.Sprint(serial))
+		}
+	}
+}
+
+// Records the metrics carried by a reply (NACKs, temperatures & clock drift)
+func (adapter *dptr1Adapter) dptr1Measure(serial schdlSerial, reply pckt1Packet) {
+	adapterID, functionCode := string(adapter.adapterID), mtrcCode(reply.Header.FunctionCode)
+	switch payload := reply.Payload.(type) {
+	case *pckt1ReplyPayloadGenericNOK:
+		mtrcAdd(mtrcCommandNACKs, 1, "adapter", adapterID, "function_code", functionCode)
+	case *pckt1ReplyPayloadToggleCalibration:
+		if !payload.Ack {
+			mtrcAdd(mtrcCommandNACKs, 1, "adapter", adapterID, "function_code", functionCode)
+		}
+	case *pckt1ReplyPayloadGetModuleTemperature:
+		evntPublish(evntTopicTemperature, adapter.adapterID, serial, payload)
+		for module, temperatures := range [][6]float32{payload.Temperatures0, payload.Temperatures1} {
+			for sensor, temperature := range temperatures {
+				mtrcSet(mtrcTemperature, float64(temperature), "adapter", adapterID, "serial", fmt.Sprint(serial), "module", strconv.Itoa(module), "sensor", strconv.Itoa(sensor))
+			}
+		}
+	case *pckt1ReplyPayloadGetTimeReference:
+		drift := int64(payload.LinuxEpoch) - time.Now().Unix()
+		mtrcSet(mtrcClockDrift, float64(drift), "adapter", adapterID, "serial", fmt.Sprint(serial))
+	}
 }
 
 // Checks if all replies succeeded
 func dptr1CheckReplies(functionCode pckt1FunctionCode, replies []pckt1Packet) error {
 	switch functionCode {
-	case pckt1FunctionCodeSetModuleCalibration, pckt1FunctionCodeSetSerialNumber, pckt1FunctionCodeSetShortAddress, pckt1FunctionCodeSetGroupID, pckt1FunctionCodeSetFixtureInfo, pckt1FunctionCodeSetTimeReference, pckt1FunctionCodeSetSchedule, pckt1FunctionCodeDeleteSchedule, pckt1FunctionCodeDeleteAllSchedules, pckt1FunctionCodeStopScheduling, pckt1FunctionCodeResumeScheduling, pckt1FunctionCodeSetIlluminanceConfiguration, pckt1FunctionCodeResetForFirmwareUpdate:
+	case pckt1FunctionCodeSetModuleCalibration, pckt1FunctionCodeSetSerialNumber, pckt1FunctionCodeSetShortAddress, pckt1FunctionCodeSetGroupID, pckt1FunctionCodeSetFixtureInfo, pckt1FunctionCodeSetTimeReference, pckt1FunctionCodeSetSchedule, pckt1FunctionCodeGetSchedule, pckt1FunctionCodeDeleteSchedule, pckt1FunctionCodeDeleteAllSchedules, pckt1FunctionCodeStopScheduling, pckt1FunctionCodeResumeScheduling, pckt1FunctionCodeSetIlluminanceConfiguration, pckt1FunctionCodeResetForFirmwareUpdate:
 		result := ""
 		for _, reply := range replies {
 			switch reply.Payload.(type) {
@@ -347,11 +471,12 @@ func dptr1CheckReplies(functionCode pckt1FunctionCode, replies []pckt1Packet) er
 
 // Used by the adapter object to send periodically a search request
 func (adapter *dptr1Adapter) dptr1Probe() {
-	for time.Now().Before(adapter.lastSeen.Add(dptr1ReconnectTimeout)) {
+	for adapter.dptr1Alive() {
 		replies, fail := adapter.dptr1AssembleAndExchange(
 			pckt1ShortAddressBroadcast, pckt1FunctionCodeGetSerialNumber, &pckt1CommandPayloadGetSerialNumber{true})
 		if fail != nil {
 			adapter.logger.Printf("ERROR: [%s] Could not communicate (%s)", adapter.adapterID, fail)
+			atomic.StoreInt32(&adapter.settled, 0)
 			time.Sleep(time.Second)
 			continue
 		}
@@ -360,6 +485,10 @@ func (adapter *dptr1Adapter) dptr1Probe() {
 		duplicated := dptr1ProbeCollectDuplicated(replies)
 		unused := dptr1ProbeCollectUnused(replies)
 		unassigned = append(unassigned, duplicated...)
+		settled := int32(0)
+		if len(unassigned) == 0 {
+			settled = 1
+		}
 		for _, serial := range unassigned {
 			if len(unused) == 0 {
 				adapter.logger.Printf("ERROR: [%s] Could not find available address", adapter.adapterID)
@@ -378,10 +507,16 @@ func (adapter *dptr1Adapter) dptr1Probe() {
 			}
 		}
 		adapter.dptr1ReassociateAll(lut)
+		atomic.StoreInt32(&adapter.settled, settled) // Once the fixtures found are published
 		time.Sleep(8 * time.Second)
 	}
 }
 
+// Tells if the last probe found every fixture on the bus with an address of its own (none unassigned or duplicated)
+func (adapter *dptr1Adapter) dptr1Settled() bool {
+	return atomic.LoadInt32(&adapter.settled) == 1
+}
+
 // Collects addresses assigned to each serial number
 func dptr1ProbeCollectEach(replies []pckt1Packet) map[schdlSerial]pckt1ShortAddress {
 	each := make(map[schdlSerial]pckt1ShortAddress)
@@ -444,8 +579,8 @@ func dptr1ProbeCollectUnused(replies []pckt1Packet) []pckt1ShortAddress {
 
 // Decouples the threads sending packets from the socket
 func (adapter *dptr1Adapter) dptr1Conduit() {
-	for time.Now().Before(adapter.lastSeen.Add(dptr1ReconnectTimeout)) {
-		handle := adapter.handle
+	for adapter.dptr1Alive() {
+		handle := adapter.dptr1Handle()
 		if handle == nil {
 			time.Sleep(2 * time.Second)
 			continue
@@ -473,63 +608,74 @@ func (adapter *dptr1Adapter) dptr1Conduit() {
 
 // Conditions fixtures
 func (adapter *dptr1Adapter) dptr1Conditioner() {
-	for time.Now().Before(adapter.lastSeen.Add(dptr1ReconnectTimeout)) {
+	for adapter.dptr1Alive() {
 		for _, serial := range adapter.dptr1ListSeenSerials() {
 			adapter.logger.Printf("INFO: [%s] conditioning %d", adapter.adapterID, serial)
 			shortAddress := adapter.dptr1LookUp(serial)
 			if shortAddress == pckt1ShortAddressUnassigned {
 				continue
 			}
-			adapter.dptr1ConditionerSync(shortAddress)
-			adapter.dptr1ConditionerToggle(shortAddress)
-			adapter.dptr1ConditionerScale(shortAddress)
+			outcome := evntConditioning{}
+			for _, fail := range []error{adapter.dptr1ConditionerSync(shortAddress), adapter.dptr1ConditionerToggle(shortAddress), adapter.dptr1ConditionerScale(shortAddress)} {
+				if fail != nil {
+					outcome.Errors = append(outcome.Errors, fail.Error())
+				}
+			}
+			evntPublish(evntTopicConditioning, adapter.adapterID, serial, outcome)
 		}
 		adapter.logger.Printf("INFO: [%s] conditioned", adapter.adapterID)
 		time.Sleep(10 * time.Minute)
 	}
 }
 
-// Syncs time
-func (adapter *dptr1Adapter) dptr1ConditionerSync(shortAddress pckt1ShortAddress) {
+// Syncs time (reports the failure) - the time is read first to measure the clock drift
+func (adapter *dptr1Adapter) dptr1ConditionerSync(shortAddress pckt1ShortAddress) error {
+	replies, fail := adapter.dptr1AssembleAndExchange(shortAddress, pckt1FunctionCodeGetTimeReference, nil)
+	if fail := dptr1CheckResult(pckt1FunctionCodeGetTimeReference, replies, fail); fail != nil {
+		adapter.logger.Printf("WARNING: [%s] Failure to read time from %d (%s)", adapter.adapterID, shortAddress, fail)
+	}
 	now := uint32(time.Now().Unix())
 	payload := &pckt1CommandPayloadSetTimeReference{now}
-	replies, fail := adapter.dptr1AssembleAndExchange(shortAddress, pckt1FunctionCodeSetTimeReference, payload)
+	replies, fail = adapter.dptr1AssembleAndExchange(shortAddress, pckt1FunctionCodeSetTimeReference, payload)
 	if fail := dptr1CheckResult(pckt1FunctionCodeSetTimeReference, replies, fail); fail != nil {
 		adapter.logger.Printf("ERROR: [%s] Failure to sync time from %d (%s)", adapter.adapterID, shortAddress, fail)
+		return fail
 	}
+	return nil
 }
 
-// Toggles scheduling state
-func (adapter *dptr1Adapter) dptr1ConditionerToggle(shortAddress pckt1ShortAddress) {
+// Toggles scheduling state (reports the failure)
+func (adapter *dptr1Adapter) dptr1ConditionerToggle(shortAddress pckt1ShortAddress) error {
 	replies, fail := adapter.dptr1AssembleAndExchange(shortAddress, pckt1FunctionCodeGetScheduleCount, nil)
 	if fail := dptr1CheckResult(pckt1FunctionCodeGetScheduleCount, replies, fail); fail != nil {
 		adapter.logger.Printf("ERROR: [%s] Failure when counting schedules from %d (%s)", adapter.adapterID, shortAddress, fail)
+		return fail
+	}
+	count := replies[0].Payload.(*pckt1ReplyPayloadGetScheduleCount).ScheduleCount
+	var functionCode pckt1FunctionCode
+	if count != 0 {
+		functionCode = pckt1FunctionCodeResumeScheduling
 	} else {
-		count := replies[0].Payload.(*pckt1ReplyPayloadGetScheduleCount).ScheduleCount
-		var functionCode pckt1FunctionCode
-		if count != 0 {
-			functionCode = pckt1FunctionCodeResumeScheduling
-		} else {
-			functionCode = pckt1FunctionCodeStopScheduling
-		}
-		if fail := dptr1CheckResult(functionCode, replies, fail); fail != nil {
-			adapter.logger.Printf("ERROR: [%s] Failure to toggle scheduling from %d (%s)", adapter.adapterID, shortAddress, fail)
-			return
-		}
+		functionCode = pckt1FunctionCodeStopScheduling
+	}
+	if fail := dptr1CheckResult(functionCode, replies, fail); fail != nil {
+		adapter.logger.Printf("ERROR: [%s] Failure to toggle scheduling from %d (%s)", adapter.adapterID, shortAddress, fail)
+		return fail
 	}
+	return nil
 }
 
-// Scales illuminance
-func (adapter *dptr1Adapter) dptr1ConditionerScale(shortAddress pckt1ShortAddress) {
+// Scales illuminance (reports the failure)
+func (adapter *dptr1Adapter) dptr1ConditionerScale(shortAddress pckt1ShortAddress) error {
 	replies0, fail0 := adapter.dptr1AssembleAndExchange(shortAddress, pckt1FunctionCodeGetModuleCalibration, &pckt1CommandPayloadGetModuleCalibration{0})
 	if fail0 := dptr1CheckResult(pckt1FunctionCodeGetModuleCalibration, replies0, fail0); fail0 != nil {
 		adapter.logger.Printf("ERROR: [%s] Failure when fetching module 0 calibration from %d (%s)", adapter.adapterID, shortAddress, fail0)
-		return
+		return fail0
 	}
 	replies1, fail1 := adapter.dptr1AssembleAndExchange(shortAddress, pckt1FunctionCodeGetModuleCalibration, &pckt1CommandPayloadGetModuleCalibration{1})
 	if fail1 := dptr1CheckResult(pckt1FunctionCodeGetModuleCalibration, replies1, fail1); fail1 != nil {
 		adapter.logger.Printf("ERROR: [%s] Failure when fetching module 1 calibration from %d (%s)", adapter.adapterID, shortAddress, fail1)
-		return
+		return fail1
 	}
 	calibration0 := replies0[0].Payload.(*pckt1ReplyPayloadGetModuleCalibration).Calibration
 	calibration1 := replies1[0].Payload.(*pckt1ReplyPayloadGetModuleCalibration).Calibration
@@ -538,7 +684,9 @@ func (adapter *dptr1Adapter) dptr1ConditionerScale(shortAddress pckt1ShortAddres
 		shortAddress, pckt1FunctionCodeSetIlluminanceConfiguration, &pckt1CommandPayloadSetIlluminanceConfiguration{configuration})
 	if fail := dptr1CheckResult(pckt1FunctionCodeSetIlluminanceConfiguration, replies, fail); fail != nil {
 		adapter.logger.Printf("ERROR: [%s] Failure when setting illuminance configuration from %d (%s)", adapter.adapterID, shortAddress, fail)
+		return fail
 	}
+	return nil
 }
 
 // Calculates illuminance configuration coefficients
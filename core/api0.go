@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -81,7 +82,7 @@ func (api *api0) api0ScheduleAdd(jsonArguments []byte) ([]byte, error) {
 	if !api.controller.ctrl0WaitForSerials(schdlSerials{arguments.Serial}, time.Minute) {
 		return nil, fmt.Errorf("Failed to locate the fixture (to add schedule), seen - %v", api.controller.ctrl0GetSerials())
 	}
-	schedule := schdlDetached{schdlTiming{arguments.Payload.Start, arguments.Payload.Stop}, arguments.Payload.Levels}
+	schedule := schdlDetached{schdlTiming: schdlTiming{arguments.Payload.Start, arguments.Payload.Stop}, Levels: arguments.Payload.Levels}
 	if !api.controller.ctrl0TransmitScheduleAddRequest(arguments.Serial, schedule, arguments.Payload.ScheduleID) {
 		return nil, fmt.Errorf("Failed to communicate with the fixture (to add schedule)")
 	}
@@ -124,7 +125,7 @@ func (api *api0) api0ImportSchedules(jsonArguments []byte) ([]byte, error) {
 }
 
 // Dispatches API function call
-func (api *api0) api0Dispatch(name string, jsonArguments []byte) ([]byte, error) {
+func (api *api0) api0Dispatch(ctx context.Context, name string, jsonArguments []byte) ([]byte, error) {
 	switch name {
 	case "set-leds":
 		return api.api0SetLeds(jsonArguments)
@@ -141,7 +142,7 @@ func (api *api0) api0Dispatch(name string, jsonArguments []byte) ([]byte, error)
 }
 
 // Launches a web server for PHYTOFY RL v0
-func (api *api0) api0Launch(port uint16, includeUI bool) error {
+func (api *api0) api0Launch(address string, includeUI bool) error {
 	routes := []webRoute{
 		{"set-leds", http.MethodPost, "/v0/set-leds", api.api0Dispatch},
 		{"schedule-add", http.MethodPost, "/v0/schedule-add", api.api0Dispatch},
@@ -150,5 +151,5 @@ func (api *api0) api0Launch(port uint16, includeUI bool) error {
 		{"get-serials", http.MethodGet, "/api/get-serials", api.api0Dispatch},
 		{"import-schedules", http.MethodPost, "/api/import-schedules", api.api0Dispatch},
 	}
-	return webLaunch(port, routes, includeUI, api.logger)
+	return webLaunch(address, routes, nil, includeUI, api.logger)
 }
@@ -3,44 +3,204 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type api1 struct {
 	logger     *log.Logger
 	controller *ctrl1Controller
+	scheduler  *hschScheduler
+	loops      *clpController
+	stager     *stgStager
+	jobs       *jobRunner
 }
 
 type api1GenericArguments struct {
 	Serial  schdlSerial     `json:"serial"`
 	Payload json.RawMessage `json:"payload,omitempty"`
+	Recipe  string          `json:"recipe,omitempty"`
+	Units   string          `json:"units,omitempty"`
 }
 
 type api1GenericResult struct {
 	Replies []pckt1Packet `json:"replies"`
+	Levels  []phtnReport  `json:"levels,omitempty"`
 	Error   string        `json:"error,omitempty"`
 }
 
+type api1BatchArguments struct {
+	Serials  schdlSerials                    `json:"serials,omitempty"`
+	All      bool                            `json:"all,omitempty"`
+	Command  string                          `json:"command"`
+	Payload  json.RawMessage                 `json:"payload,omitempty"`
+	Payloads map[schdlSerial]json.RawMessage `json:"payloads,omitempty"`
+	Recipe   string                          `json:"recipe,omitempty"`
+	Units    string                          `json:"units,omitempty"`
+}
+
+type api1BatchResult struct {
+	Results   map[schdlSerial]api1GenericResult `json:"results"`
+	Succeeded schdlSerials                      `json:"succeeded"`
+	Failed    schdlSerials                      `json:"failed"`
+}
+
+type api1StartJobArguments struct {
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type api1JobArguments struct {
+	ID json.Number `json:"id"`
+}
+
+// Commands (besides the fixture ones) which can run as jobs
+var api1JobCommands = map[string]bool{
+	"batch":            true,
+	"import-schedules": true,
+	"export-schedules": true,
+	"import-plan":      true,
+	"rollback-version": true,
+}
+
 type api1GetSerialsResult struct {
 	Serials schdlSerials `json:"serials"`
 }
 
 type api1ImportSchedulesArguments struct {
-	Schedules []schdlAttached `json:"schedules"`
+	Schedules  []schdlAttached `json:"schedules"`
+	DryRun     bool            `json:"dry_run,omitempty"`
+	Activation string          `json:"activation,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	Author     string          `json:"author,omitempty"`
 }
 
 type api1ImportSchedulesResult struct {
-	Error string `json:"error,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	Validation *schdlValidation    `json:"validation,omitempty"`
+	Deployment *stgDeployment      `json:"deployment,omitempty"`
+	Fixtures   ctrl1ImportOutcomes `json:"fixtures,omitempty"`
+}
+
+type api1DeploymentArguments struct {
+	ID json.Number `json:"id"`
+}
+
+type api1VersionArguments struct {
+	Version json.Number `json:"version"`
+	DryRun  bool        `json:"dry_run,omitempty"`
+	Author  string      `json:"author,omitempty"`
+}
+
+type api1DiffVersionsArguments struct {
+	From json.Number `json:"from"`
+	To   json.Number `json:"to,omitempty"`
+}
+
+type api1RollbackResult struct {
+	Reconciliation hstrReconciliation  `json:"reconciliation"`
+	Version        *hstrVersion        `json:"version,omitempty"`
+	Fixtures       ctrl1ImportOutcomes `json:"fixtures,omitempty"`
+}
+
+type api1ExportSchedulesArguments struct {
+	Serials schdlSerials `json:"serials,omitempty"`
+	Units   string       `json:"units,omitempty"`
+}
+
+type api1ExportSchedulesResult struct {
+	Schedules []schdlAttached `json:"schedules"`
+	CSV       string          `json:"csv"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type api1RecipeArguments struct {
+	Name string `json:"name"`
+}
+
+type api1ListRecipesResult struct {
+	Recipes []rcpRecipe `json:"recipes"`
+}
+
+type api1TimelineArguments struct {
+	Serials string `json:"serials,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	At      string `json:"at,omitempty"`
+	Source  string `json:"source,omitempty"`
+}
+
+type api1TimelineResult struct {
+	From      uint32         `json:"from"`
+	To        uint32         `json:"to"`
+	Source    string         `json:"source"`
+	Timelines []tmlnTimeline `json:"timelines"`
+}
+
+type api1PushReadingsArguments struct {
+	Readings []clpReading `json:"readings"`
+}
+
+type api1PushReadingsResult struct {
+	Recorded int `json:"recorded"`
+}
+
+type api1ImportPlanResult struct {
+	Schedules []schdlAttached     `json:"schedules"`
+	Error     string              `json:"error,omitempty"`
+	Fixtures  ctrl1ImportOutcomes `json:"fixtures,omitempty"`
 }
 
 func api1Init(logger *log.Logger, conditioning bool) *api1 {
-	return &api1{
+	controller := ctrl1Init(logger, conditioning)
+	api := &api1{
 		logger,
-		ctrl1Init(logger, conditioning),
+		controller,
+		hschInit(logger, controller),
+		clpInit(logger, controller),
+		nil,
+		jobInit(logger),
+	}
+	api.stager = stgInit(logger, controller, func(schedules []schdlAttached) error {
+		_, fail := api.api1Apply(context.Background(), schedules)
+		return fail
+	})
+	return api
+}
+
+// Applies schedules to the fixtures (the experiment plan no longer matches them)
+func (api *api1) api1Apply(ctx context.Context, schedules []schdlAttached) (ctrl1ImportOutcomes, error) {
+	outcomes, fail := api.controller.ctrl1ImportSchedules(ctx, schedules)
+	if fail != nil {
+		return outcomes, fail
+	}
+	if fail := planDetach(); fail != nil {
+		api.logger.Printf("ERROR: Failed to detach the experiment plan (%s)", fail)
+	}
+	return outcomes, nil
+}
+
+// Applies schedules to the fixtures and records a version
+func (api *api1) api1ApplySchedules(ctx context.Context, schedules []schdlAttached, source, author string) (ctrl1ImportOutcomes, error) {
+	release, fail := stgLockImports()
+	if fail != nil {
+		return nil, fail
+	}
+	defer release()
+	outcomes, fail := api.api1Apply(ctx, schedules)
+	if fail != nil {
+		return outcomes, fail
+	}
+	if _, fail := hstrRecord(schedules, source, author); fail != nil {
+		api.logger.Printf("ERROR: Failed to record the schedules in the history (%s)", fail)
 	}
+	return outcomes, nil
 }
 
 // Handles the "get-serials" command
@@ -53,15 +213,106 @@ func (api *api1) api1GetSerials(jsonArguments []byte) ([]byte, error) {
 	return jsonResult, nil
 }
 
+// Handles the "batch" command (the same or per fixture payload sent to many fixtures - all seen if requested)
+func (api *api1) api1Batch(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	var arguments api1BatchArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	if _, present := ctrl1NameToFunctionCode[arguments.Command]; !present {
+		return nil, fmt.Errorf("Unknown command - %s", arguments.Command)
+	}
+	if fail := authAuthoriseContext(ctx, arguments.Command, nil); fail != nil {
+		return nil, fail
+	}
+	serials := arguments.Serials
+	switch {
+	case arguments.All:
+		serials = api.controller.ctrl1GetSerials()
+	case len(serials) == 0:
+		for serial := range arguments.Payloads {
+			serials = append(serials, serial)
+		}
+	}
+	serials = planUniqueSerials(serials)
+	if len(serials) == 0 {
+		return nil, fmt.Errorf("No fixtures to send the command to")
+	}
+	switch arguments.Command {
+	case "set-serial-number", "set-short-address":
+		// Sending the same addressing to many fixtures would leave them indistinguishable
+		for _, serial := range serials {
+			if _, present := arguments.Payloads[serial]; !present {
+				return nil, fmt.Errorf("Command %s requires a payload per fixture (missing for %d)", arguments.Command, serial)
+			}
+		}
+	}
+	outcomes := api.controller.ctrl1DispatchBatch(ctx, serials, func(serial schdlSerial) (pckt1FunctionCode, pckt1Payload, error) {
+		payload, present := arguments.Payloads[serial]
+		if !present {
+			payload = arguments.Payload
+		}
+		jsonGeneric, fail := json.Marshal(&api1GenericArguments{serial, payload, arguments.Recipe, arguments.Units})
+		if fail != nil {
+			return 0, nil, fail
+		}
+		_, functionCode, parsed, fail := ctrl1ParseGenericArguments(arguments.Command, jsonGeneric)
+		if fail != nil {
+			return 0, nil, fail
+		}
+		return functionCode, parsed, api.controller.ctrl1CheckPayloadLimits(serial, parsed)
+	})
+	result := api1BatchResult{make(map[schdlSerial]api1GenericResult), schdlSerials{}, schdlSerials{}}
+	for index, serial := range serials {
+		outcome := outcomes[index]
+		generic := api1GenericResult{outcome.Replies, ctrl1ReportLevels(outcome.Replies), ""}
+		if generic.Replies == nil {
+			generic.Replies = []pckt1Packet{}
+		}
+		if outcome.Error != nil {
+			generic.Error = outcome.Error.Error()
+			result.Failed = append(result.Failed, serial)
+		} else {
+			result.Succeeded = append(result.Succeeded, serial)
+		}
+		result.Results[serial] = generic
+	}
+	jobLogf(ctx, api.logger, "INFO: Batch %s succeeded for %d fixtures and failed for %d", arguments.Command, len(result.Succeeded), len(result.Failed))
+	return json.Marshal(&result)
+}
+
 // Handles the "import-schedules" command
-func (api *api1) api1ImportSchedules(jsonArguments []byte) ([]byte, error) {
+func (api *api1) api1ImportSchedules(ctx context.Context, jsonArguments []byte) ([]byte, error) {
 	var arguments api1ImportSchedulesArguments
 	var result api1ImportSchedulesResult
 	var fail error
 	if fail = json.Unmarshal(jsonArguments, &arguments); fail != nil {
-		result = api1ImportSchedulesResult{fail.Error()}
-	} else if fail = api.controller.ctrl1ImportSchedules(arguments.Schedules); fail != nil {
-		result = api1ImportSchedulesResult{fail.Error()}
+		result = api1ImportSchedulesResult{fail.Error(), nil, nil, nil}
+	} else if arguments.DryRun {
+		validation := api.api1ValidateSchedules(arguments.Schedules, nil)
+		result = api1ImportSchedulesResult{"", &validation, nil, nil}
+	} else if arguments.Schedules, fail = rcpResolveSchedules(arguments.Schedules); fail != nil {
+		result = api1ImportSchedulesResult{fail.Error(), nil, nil, nil}
+	} else if arguments.Schedules, fail = phtnResolveSchedules(arguments.Schedules); fail != nil {
+		result = api1ImportSchedulesResult{fail.Error(), nil, nil, nil}
+	} else if len(arguments.Activation) != 0 {
+		var activation uint32
+		var deployment *stgDeployment
+		if activation, fail = tmlnParseTime(arguments.Activation); fail == nil {
+			deployment, fail = api.stager.stgStage(arguments.Schedules, activation, arguments.Source, authAuthor(ctx, arguments.Author))
+		}
+		if fail != nil {
+			result = api1ImportSchedulesResult{fail.Error(), nil, nil, nil}
+		} else {
+			result = api1ImportSchedulesResult{"", nil, deployment, nil}
+		}
+	} else {
+		var outcomes ctrl1ImportOutcomes
+		outcomes, fail = api.api1ApplySchedules(ctx, arguments.Schedules, arguments.Source, authAuthor(ctx, arguments.Author))
+		result = api1ImportSchedulesResult{"", nil, nil, outcomes}
+		if fail != nil {
+			result.Error = fail.Error()
+		}
 	}
 	jsonResult, critical := json.Marshal(&result)
 	if critical != nil {
@@ -70,20 +321,520 @@ func (api *api1) api1ImportSchedules(jsonArguments []byte) ([]byte, error) {
 	return jsonResult, fail
 }
 
-// Dispatches API function call
+// Handles the "export-schedules" command
+func (api *api1) api1ExportSchedules(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	var arguments api1ExportSchedulesArguments
+	result := api1ExportSchedulesResult{[]schdlAttached{}, "", ""}
+	var fail error
+	if len(jsonArguments) != 0 {
+		fail = json.Unmarshal(jsonArguments, &arguments)
+	}
+	if fail != nil {
+		result.Error = fail.Error()
+	} else if units, failUnits := phtnParseUnits(arguments.Units); failUnits != nil {
+		fail = failUnits
+		result.Error = fail.Error()
+	} else if schedules, failExport := api.controller.ctrl1ExportSchedules(ctx, arguments.Serials); failExport != nil {
+		fail = failExport
+		result.Error = fail.Error()
+	} else {
+		for index, schedule := range schedules {
+			if units == phtnUnitsPhotons && schdlModeOf(schedule.schdlDetached) == schdlModeIrradiance {
+				schedules[index].Levels, _ = phtnConvert(schedule.Levels, phtnUnitsEnergy, units)
+				schedules[index].Units = units
+			}
+		}
+		result.Schedules = schedules
+		result.CSV = strings.Join(schdlCSVFormat(schedules, 6), "\n")
+	}
+	jsonResult, critical := json.Marshal(&result)
+	if critical != nil {
+		return nil, critical
+	}
+	return jsonResult, fail
+}
+
+// Validates schedules without changing anything on the fixtures (only their limits are queried)
+func (api *api1) api1ValidateSchedules(schedules []schdlAttached, problems []string) schdlValidation {
+	// Schedules referring to unknown recipes (or units) stay unresolved and get reported as invalid
+	resolved, _ := rcpResolveSchedules(schedules)
+	resolved, _ = phtnResolveSchedules(resolved)
+	validation := schdlValidate(resolved, api.controller.ctrl1GetSerials(), problems)
+	missing := make(map[schdlSerial]struct{})
+	for _, serial := range validation.Missing {
+		missing[serial] = struct{}{}
+	}
+	for _, schedule := range validation.Flattened {
+		for _, serial := range schedule.Serials {
+			if _, present := missing[serial]; present {
+				continue
+			}
+			fail := api.controller.ctrl1CheckLimits(serial, schdlModeOf(schedule.schdlDetached), schedule.Levels)
+			if violations, isViolation := fail.(lmtViolations); isViolation {
+				validation.Violations = append(validation.Violations, violations...)
+				for _, violation := range violations {
+					validation.Problems = append(validation.Problems, violation.String())
+				}
+			} else if fail != nil {
+				validation.Problems = append(validation.Problems, fmt.Sprintf("Fixture %d: %s", serial, fail))
+			}
+		}
+	}
+	validation.Valid = len(validation.Problems) == 0
+	return validation
+}
+
+// Handles the "import-plan" command
+func (api *api1) api1ImportPlan(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	result := api1ImportPlanResult{[]schdlAttached{}, "", nil}
+	plan, fail := planParse(jsonArguments)
+	if fail == nil {
+		var schedules []schdlAttached
+		if schedules, fail = planCompile(plan); fail == nil {
+			result.Schedules = schedules
+			var release func()
+			if release, fail = stgLockImports(); fail == nil {
+				defer release()
+				if result.Fixtures, fail = api.controller.ctrl1ImportSchedules(ctx, schedules); fail == nil {
+					if failStore := planStore(plan, schedules); failStore != nil {
+						api.logger.Printf("ERROR: Failed to store the experiment plan (%s)", failStore)
+					}
+					if _, failRecord := hstrRecord(schedules, fmt.Sprintf("plan %s", plan.Name), authAuthor(ctx, "")); failRecord != nil {
+						api.logger.Printf("ERROR: Failed to record the schedules in the history (%s)", failRecord)
+					}
+				}
+			}
+		}
+	}
+	if fail != nil {
+		result.Error = fail.Error()
+	}
+	jsonResult, critical := json.Marshal(&result)
+	if critical != nil {
+		return nil, critical
+	}
+	return jsonResult, fail
+}
+
+// Handles the "get-plan" command
+func (api *api1) api1GetPlan(jsonArguments []byte) ([]byte, error) {
+	attached, fail := planLoad()
+	if fail != nil {
+		return nil, fmt.Errorf("No experiment plan attached to the uploaded schedules (%s)", fail)
+	}
+	return json.Marshal(attached)
+}
+
+// Handles the "get-timeline" command
+func (api *api1) api1GetTimeline(jsonArguments []byte) ([]byte, error) {
+	var arguments api1TimelineArguments
+	if len(jsonArguments) != 0 {
+		if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+			return nil, fail
+		}
+	}
+	serials, fail := tmlnParseSerials(arguments.Serials)
+	if fail != nil {
+		return nil, fail
+	}
+	from, to, fail := tmlnParseRange(arguments.From, arguments.To, arguments.At, uint32(time.Now().Unix()))
+	if fail != nil {
+		return nil, fail
+	}
+	var aggregated schdlAggregated
+	switch arguments.Source {
+	case "", tmlnSourceFixtures:
+		arguments.Source = tmlnSourceFixtures
+		if aggregated, fail = api.controller.ctrl1ReadBackSchedules(context.Background(), serials); fail != nil {
+			return nil, fail
+		}
+	case tmlnSourcePlan:
+		attached, fail := planLoad()
+		if fail != nil {
+			return nil, fmt.Errorf("No experiment plan attached to the uploaded schedules (%s)", fail)
+		}
+		if aggregated, fail = schdlAggregateSchedules(attached.Schedules, false); fail != nil {
+			return nil, fail
+		}
+	default:
+		return nil, fmt.Errorf("Unknown timeline source - %s", arguments.Source)
+	}
+	result := api1TimelineResult{from, to, arguments.Source, tmlnQuery(aggregated, serials, from, to)}
+	return json.Marshal(&result)
+}
+
+// Handles the "randomise-design" command
+func (api *api1) api1RandomiseDesign(jsonArguments []byte) ([]byte, error) {
+	var design dsgnDesign
+	if fail := json.Unmarshal(jsonArguments, &design); fail != nil {
+		return nil, fail
+	}
+	outcome, fail := dsgnRandomise(design, api.controller.ctrl1GetSerials())
+	if fail != nil {
+		return nil, fail
+	}
+	if fail := dsgnStore(outcome); fail != nil {
+		api.logger.Printf("ERROR: Failed to store the experimental design (%s)", fail)
+	}
+	return json.Marshal(outcome)
+}
+
+// Handles the "get-design" command
+func (api *api1) api1GetDesign(jsonArguments []byte) ([]byte, error) {
+	outcome, fail := dsgnLoad()
+	if fail != nil {
+		return nil, fmt.Errorf("No experimental design randomised yet (%s)", fail)
+	}
+	return json.Marshal(outcome)
+}
+
+// Handles the "get-channels" command
+func (api *api1) api1GetChannels(jsonArguments []byte) ([]byte, error) {
+	return json.Marshal(&phtnChannels)
+}
+
+// Handles the "start-scheduler" command
+func (api *api1) api1StartScheduler(jsonArguments []byte) ([]byte, error) {
+	var program hschProgram
+	if fail := json.Unmarshal(jsonArguments, &program); fail != nil {
+		return nil, fail
+	}
+	driven := make(map[schdlSerial]struct{})
+	for _, serial := range api.loops.clpDriven() {
+		driven[serial] = struct{}{}
+	}
+	for _, serial := range hschSerials(&program) {
+		if _, present := driven[serial]; present {
+			return nil, fmt.Errorf("Fixture %d is driven by the closed-loop control", serial)
+		}
+	}
+	if fail := api.scheduler.hschStart(program); fail != nil {
+		return nil, fail
+	}
+	status := api.scheduler.hschStatus()
+	return json.Marshal(&status)
+}
+
+// Handles the "get-scheduler" command
+func (api *api1) api1GetScheduler(jsonArguments []byte) ([]byte, error) {
+	status := api.scheduler.hschStatus()
+	return json.Marshal(&status)
+}
+
+// Handles the "stop-scheduler" command
+func (api *api1) api1StopScheduler(jsonArguments []byte) ([]byte, error) {
+	if fail := api.scheduler.hschStop(); fail != nil {
+		return nil, fail
+	}
+	status := api.scheduler.hschStatus()
+	return json.Marshal(&status)
+}
+
+// Handles the "start-closed-loop" command
+func (api *api1) api1StartClosedLoop(jsonArguments []byte) ([]byte, error) {
+	var configuration clpConfiguration
+	if fail := json.Unmarshal(jsonArguments, &configuration); fail != nil {
+		return nil, fail
+	}
+	if fail := api.loops.clpStart(configuration, api.scheduler.hschDriven()); fail != nil {
+		return nil, fail
+	}
+	status := api.loops.clpStatus()
+	return json.Marshal(&status)
+}
+
+// Handles the "get-closed-loop" command
+func (api *api1) api1GetClosedLoop(jsonArguments []byte) ([]byte, error) {
+	status := api.loops.clpStatus()
+	return json.Marshal(&status)
+}
+
+// Handles the "stop-closed-loop" command
+func (api *api1) api1StopClosedLoop(jsonArguments []byte) ([]byte, error) {
+	if fail := api.loops.clpStop(); fail != nil {
+		return nil, fail
+	}
+	status := api.loops.clpStatus()
+	return json.Marshal(&status)
+}
+
+// Handles the "push-readings" command
+func (api *api1) api1PushReadings(jsonArguments []byte) ([]byte, error) {
+	var arguments api1PushReadingsArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	if fail := api.loops.clpRecord(arguments.Readings); fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&api1PushReadingsResult{len(arguments.Readings)})
+}
+
+// Handles the "list-deployments" command
+func (api *api1) api1ListDeployments(jsonArguments []byte) ([]byte, error) {
+	deployments, fail := api.stager.stgList()
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&deployments)
+}
+
+// Handles the "get-deployment", "cancel-deployment" & "apply-deployment" commands
+func (api *api1) api1Deployment(name string, jsonArguments []byte) ([]byte, error) {
+	var arguments api1DeploymentArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	id, fail := strconv.ParseUint(arguments.ID.String(), 10, 32)
+	if fail != nil {
+		return nil, fmt.Errorf("Invalid deployment ID %q", arguments.ID)
+	}
+	var deployment *stgDeployment
+	switch name {
+	case "get-deployment":
+		deployment, fail = api.stager.stgGet(uint32(id))
+	case "cancel-deployment":
+		deployment, fail = api.stager.stgCancel(uint32(id))
+	case "apply-deployment":
+		deployment, fail = api.stager.stgApplyNow(uint32(id))
+	}
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(deployment)
+}
+
+// Parses a version number (the latest version if empty)
+func api1ParseVersion(number json.Number) (uint32, error) {
+	if len(number) == 0 {
+		return 0, nil
+	}
+	version, fail := strconv.ParseUint(number.String(), 10, 32)
+	if fail != nil {
+		return 0, fmt.Errorf("Invalid version %q", number)
+	}
+	return uint32(version), nil
+}
+
+// Handles the "list-versions" command
+func (api *api1) api1ListVersions(jsonArguments []byte) ([]byte, error) {
+	summaries, fail := hstrList()
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&summaries)
+}
+
+// Handles the "get-version" command
+func (api *api1) api1GetVersion(jsonArguments []byte) ([]byte, error) {
+	var arguments api1VersionArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	number, fail := api1ParseVersion(arguments.Version)
+	if fail != nil {
+		return nil, fail
+	}
+	version, fail := hstrLoad(number)
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(version)
+}
+
+// Handles the "diff-versions" command (against the latest version if no target is given)
+func (api *api1) api1DiffVersions(jsonArguments []byte) ([]byte, error) {
+	var arguments api1DiffVersionsArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	versions := make([]*hstrVersion, 0, 2)
+	for _, number := range []json.Number{arguments.From, arguments.To} {
+		parsed, fail := api1ParseVersion(number)
+		if fail != nil {
+			return nil, fail
+		}
+		version, fail := hstrLoad(parsed)
+		if fail != nil {
+			return nil, fail
+		}
+		versions = append(versions, version)
+	}
+	diff := hstrCompareVersions(versions[0], versions[1])
+	return json.Marshal(&diff)
+}
+
+// Handles the "rollback-version" command (only the fixtures not matching the version get their schedules replaced)
+func (api *api1) api1RollbackVersion(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	var arguments api1VersionArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	arguments.Author = authAuthor(ctx, arguments.Author)
+	number, fail := api1ParseVersion(arguments.Version)
+	if fail != nil || number == 0 {
+		return nil, fmt.Errorf("Invalid version %q", arguments.Version)
+	}
+	target, fail := hstrLoad(number)
+	if fail != nil {
+		return nil, fail
+	}
+	latest, fail := hstrLoad(0)
+	if fail != nil {
+		return nil, fail
+	}
+	if !arguments.DryRun {
+		// Reconciled under the lock so no other import modifies the fixtures meanwhile
+		release, fail := stgLockImports()
+		if fail != nil {
+			return nil, fail
+		}
+		defer release()
+	}
+	result := api1RollbackResult{hstrReconcile(ctx, api.controller, target.Programme, latest.Programme), nil, nil}
+	if arguments.DryRun {
+		return json.Marshal(&result)
+	}
+	subset := make(schdlAggregated)
+	for _, serial := range result.Reconciliation.Apply {
+		subset[serial] = target.Programme[serial]
+	}
+	for _, serial := range result.Reconciliation.Clear {
+		subset[serial] = []schdlDetached{}
+	}
+	if len(subset) != 0 {
+		if result.Fixtures, fail = api.controller.ctrl1ImportProgramme(ctx, subset); fail != nil {
+			jsonResult, critical := json.Marshal(&result)
+			if critical != nil {
+				return nil, critical
+			}
+			return jsonResult, fail
+		}
+	}
+	if fail := planDetach(); fail != nil {
+		api.logger.Printf("ERROR: Failed to detach the experiment plan (%s)", fail)
+	}
+	if result.Version, fail = hstrStore(target.Programme, true, fmt.Sprintf("rollback to version %d", number), arguments.Author); fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&result)
+}
+
+// Handles the "list-recipes" command
+func (api *api1) api1ListRecipes(jsonArguments []byte) ([]byte, error) {
+	recipes, fail := rcpList()
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&api1ListRecipesResult{recipes})
+}
+
+// Handles the "get-recipe" command
+func (api *api1) api1GetRecipe(jsonArguments []byte) ([]byte, error) {
+	var arguments api1RecipeArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	recipe, fail := rcpGet(arguments.Name)
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&recipe)
+}
+
+// Handles the "save-recipe" command
+func (api *api1) api1SaveRecipe(jsonArguments []byte) ([]byte, error) {
+	var recipe rcpRecipe
+	if fail := json.Unmarshal(jsonArguments, &recipe); fail != nil {
+		return nil, fail
+	}
+	if fail := rcpSave(recipe); fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&recipe)
+}
+
+// Handles the "delete-recipe" command
+func (api *api1) api1DeleteRecipe(jsonArguments []byte) ([]byte, error) {
+	var arguments api1RecipeArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	if fail := rcpDelete(arguments.Name); fail != nil {
+		return nil, fail
+	}
+	return []byte("{}"), nil
+}
+
+// Handles the "start-job" command (runs a long command in the background)
+func (api *api1) api1StartJob(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	var arguments api1StartJobArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	if _, present := ctrl1NameToFunctionCode[arguments.Command]; !present && !api1JobCommands[arguments.Command] {
+		return nil, fmt.Errorf("Command %s cannot run as a job", arguments.Command)
+	}
+	// The job runs on behalf of the client (so the nested command gets authorised too)
+	job := api.jobs.jobStart(arguments.Command, func(jobCtx context.Context) ([]byte, error) {
+		return api.api1DispatchContext(authCarry(jobCtx, ctx), arguments.Command, arguments.Arguments)
+	})
+	return json.Marshal(&job)
+}
+
+// Handles the "list-jobs" command
+func (api *api1) api1ListJobs(jsonArguments []byte) ([]byte, error) {
+	return json.Marshal(api.jobs.jobList())
+}
+
+// Handles the "get-job" & "cancel-job" commands
+func (api *api1) api1Job(name string, jsonArguments []byte) ([]byte, error) {
+	var arguments api1JobArguments
+	if fail := json.Unmarshal(jsonArguments, &arguments); fail != nil {
+		return nil, fail
+	}
+	id, fail := strconv.ParseUint(arguments.ID.String(), 10, 32)
+	if fail != nil {
+		return nil, fmt.Errorf("Invalid job ID %q", arguments.ID)
+	}
+	var job jobJob
+	switch name {
+	case "get-job":
+		job, fail = api.jobs.jobGet(uint32(id))
+	case "cancel-job":
+		job, fail = api.jobs.jobCancel(uint32(id))
+	}
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&job)
+}
+
+// Dispatches API function call (from the CLI)
 func (api *api1) api1Dispatch(name string, jsonArguments []byte) ([]byte, error) {
+	return api.api1DispatchContext(context.Background(), name, jsonArguments)
+}
+
+// Dispatches API function call (the long ones stop when canceled) once the client is authorised
+func (api *api1) api1DispatchContext(ctx context.Context, name string, jsonArguments []byte) ([]byte, error) {
+	if fail := authAuthoriseContext(ctx, name, jsonArguments); fail != nil {
+		return []byte{}, fail
+	}
 	switch name {
 	case "set-module-calibration", "get-module-calibration", "set-serial-number", "get-serial-number", "set-short-address", "get-short-address", "set-group-id", "get-group-id", "set-fixture-info", "get-fixture-info", "set-time-reference", "get-time-reference", "set-leds-pwm", "set-leds-irradiance", "get-leds", "set-schedule-pwm", "set-schedule-irradiance", "get-schedule", "get-schedule-count", "get-scheduling-state", "delete-schedule", "delete-all-schedules", "stop-scheduling", "resume-scheduling", "set-illuminance-configuration", "get-illuminance-configuration", "get-module-temperature", "toggle-calibration", "reset-for-firmware-update", "confirm-reset-for-firmware-update":
 		serial, functionCode, payload, fail := ctrl1ParseGenericArguments(name, jsonArguments)
 		if fail != nil {
 			return []byte{}, fail
 		}
-		replies, fail := api.controller.ctrl1Dispatch(serial, functionCode, payload)
+		if fail := api.controller.ctrl1CheckPayloadLimits(serial, payload); fail != nil {
+			return []byte{}, fail
+		}
+		replies, fail := api.controller.ctrl1DispatchContext(ctx, serial, functionCode, payload)
 		errorMessage := ""
 		if fail != nil {
 			errorMessage = fail.Error()
 		}
-		result := api1GenericResult{replies, errorMessage}
+		result := api1GenericResult{replies, ctrl1ReportLevels(replies), errorMessage}
 		jsonResult, critical := json.Marshal(&result)
 		if critical != nil {
 			return []byte{}, critical
@@ -91,48 +842,151 @@ func (api *api1) api1Dispatch(name string, jsonArguments []byte) ([]byte, error)
 		return jsonResult, fail
 	case "get-serials":
 		return api.api1GetSerials(jsonArguments)
+	case "batch":
+		return api.api1Batch(ctx, jsonArguments)
 	case "import-schedules":
-		return api.api1ImportSchedules(jsonArguments)
+		return api.api1ImportSchedules(ctx, jsonArguments)
+	case "export-schedules":
+		return api.api1ExportSchedules(ctx, jsonArguments)
+	case "import-plan":
+		return api.api1ImportPlan(ctx, jsonArguments)
+	case "get-plan":
+		return api.api1GetPlan(jsonArguments)
+	case "get-timeline":
+		return api.api1GetTimeline(jsonArguments)
+	case "randomise-design":
+		return api.api1RandomiseDesign(jsonArguments)
+	case "get-design":
+		return api.api1GetDesign(jsonArguments)
+	case "get-channels":
+		return api.api1GetChannels(jsonArguments)
+	case "start-scheduler":
+		return api.api1StartScheduler(jsonArguments)
+	case "get-scheduler":
+		return api.api1GetScheduler(jsonArguments)
+	case "stop-scheduler":
+		return api.api1StopScheduler(jsonArguments)
+	case "start-closed-loop":
+		return api.api1StartClosedLoop(jsonArguments)
+	case "get-closed-loop":
+		return api.api1GetClosedLoop(jsonArguments)
+	case "stop-closed-loop":
+		return api.api1StopClosedLoop(jsonArguments)
+	case "push-readings":
+		return api.api1PushReadings(jsonArguments)
+	case "list-deployments":
+		return api.api1ListDeployments(jsonArguments)
+	case "get-deployment", "cancel-deployment", "apply-deployment":
+		return api.api1Deployment(name, jsonArguments)
+	case "list-versions":
+		return api.api1ListVersions(jsonArguments)
+	case "get-version":
+		return api.api1GetVersion(jsonArguments)
+	case "diff-versions":
+		return api.api1DiffVersions(jsonArguments)
+	case "rollback-version":
+		return api.api1RollbackVersion(ctx, jsonArguments)
+	case "list-recipes":
+		return api.api1ListRecipes(jsonArguments)
+	case "get-recipe":
+		return api.api1GetRecipe(jsonArguments)
+	case "save-recipe":
+		return api.api1SaveRecipe(jsonArguments)
+	case "delete-recipe":
+		return api.api1DeleteRecipe(jsonArguments)
+	case "start-job":
+		return api.api1StartJob(ctx, jsonArguments)
+	case "list-jobs":
+		return api.api1ListJobs(jsonArguments)
+	case "get-job", "cancel-job":
+		return api.api1Job(name, jsonArguments)
 	}
 	return []byte{}, fmt.Errorf("Unknown API function - %s", name)
 }
 
-// Launches a web server for PHYTOFY RL v1
-func (api *api1) api1Launch(port uint16, includeUI bool) error {
+// Lists the routes of PHYTOFY RL v1
+func (api *api1) api1Routes() []webRoute {
 	routes := []webRoute{
-		{"set-module-calibration", http.MethodPost, "/v1/set-module-calibration", api.api1Dispatch},
-		{"get-module-calibration", http.MethodPost, "/v1/get-module-calibration", api.api1Dispatch},
-		{"set-serial-number", http.MethodPost, "/v1/set-serial-number", api.api1Dispatch},
-		{"get-serial-number", http.MethodPost, "/v1/get-serial-number", api.api1Dispatch},
-		{"set-short-address", http.MethodPost, "/v1/set-short-address", api.api1Dispatch},
-		{"get-short-address", http.MethodPost, "/v1/get-short-address", api.api1Dispatch},
-		{"set-group-id", http.MethodPost, "/v1/set-group-id", api.api1Dispatch},
-		{"get-group-id", http.MethodPost, "/v1/get-group-id", api.api1Dispatch},
-		{"set-fixture-info", http.MethodPost, "/v1/set-fixture-info", api.api1Dispatch},
-		{"get-fixture-info", http.MethodPost, "/v1/get-fixture-info", api.api1Dispatch},
-		{"set-time-reference", http.MethodPost, "/v1/set-time-reference", api.api1Dispatch},
-		{"get-time-reference", http.MethodPost, "/v1/get-time-reference", api.api1Dispatch},
-		{"set-leds-pwm", http.MethodPost, "/v1/set-leds-pwm", api.api1Dispatch},
-		{"set-leds-irradiance", http.MethodPost, "/v1/set-leds-irradiance", api.api1Dispatch},
-		{"get-leds", http.MethodPost, "/v1/get-leds", api.api1Dispatch},
-		{"set-schedule-pwm", http.MethodPost, "/v1/set-schedule-pwm", api.api1Dispatch},
-		{"set-schedule-irradiance", http.MethodPost, "/v1/set-schedule-irradiance", api.api1Dispatch},
-		{"get-schedule", http.MethodPost, "/v1/get-schedule", api.api1Dispatch},
-		{"get-schedule-count", http.MethodPost, "/v1/get-schedule-count", api.api1Dispatch},
-		{"get-scheduling-state", http.MethodPost, "/v1/get-scheduling-state", api.api1Dispatch},
-		{"delete-schedule", http.MethodPost, "/v1/delete-schedule", api.api1Dispatch},
-		{"delete-all-schedules", http.MethodPost, "/v1/delete-all-schedules", api.api1Dispatch},
-		{"stop-scheduling", http.MethodPost, "/v1/stop-scheduling", api.api1Dispatch},
-		{"resume-scheduling", http.MethodPost, "/v1/resume-scheduling", api.api1Dispatch},
-		{"set-illuminance-configuration", http.MethodPost, "/v1/set-illuminance-configuration", api.api1Dispatch},
-		{"get-illuminance-configuration", http.MethodPost, "/v1/get-illuminance-configuration", api.api1Dispatch},
-		{"get-module-temperature", http.MethodPost, "/v1/get-module-temperature", api.api1Dispatch},
-		{"toggle-calibration", http.MethodPost, "/v1/toggle-calibration", api.api1Dispatch},
-		{"reset-for-firmware-update", http.MethodPost, "/v1/reset-for-firmware-update", api.api1Dispatch},
-		{"confirm-reset-for-firmware-update", http.MethodPost, "/v1/confirm-reset-for-firmware-update", api.api1Dispatch},
-		{"get-serials", http.MethodGet, "/v1/get-serials", api.api1Dispatch},
-		{"get-serials", http.MethodGet, "/api/get-serials", api.api1Dispatch},
-		{"import-schedules", http.MethodPost, "/api/import-schedules", api.api1Dispatch},
-	}
-	return webLaunch(port, routes, includeUI, api.logger)
+		{"set-module-calibration", http.MethodPost, "/v1/set-module-calibration", api.api1DispatchContext},
+		{"get-module-calibration", http.MethodPost, "/v1/get-module-calibration", api.api1DispatchContext},
+		{"set-serial-number", http.MethodPost, "/v1/set-serial-number", api.api1DispatchContext},
+		{"get-serial-number", http.MethodPost, "/v1/get-serial-number", api.api1DispatchContext},
+		{"set-short-address", http.MethodPost, "/v1/set-short-address", api.api1DispatchContext},
+		{"get-short-address", http.MethodPost, "/v1/get-short-address", api.api1DispatchContext},
+		{"set-group-id", http.MethodPost, "/v1/set-group-id", api.api1DispatchContext},
+		{"get-group-id", http.MethodPost, "/v1/get-group-id", api.api1DispatchContext},
+		{"set-fixture-info", http.MethodPost, "/v1/set-fixture-info", api.api1DispatchContext},
+		{"get-fixture-info", http.MethodPost, "/v1/get-fixture-info", api.api1DispatchContext},
+		{"set-time-reference", http.MethodPost, "/v1/set-time-reference", api.api1DispatchContext},
+		{"get-time-reference", http.MethodPost, "/v1/get-time-reference", api.api1DispatchContext},
+		{"set-leds-pwm", http.MethodPost, "/v1/set-leds-pwm", api.api1DispatchContext},
+		{"set-leds-irradiance", http.MethodPost, "/v1/set-leds-irradiance", api.api1DispatchContext},
+		{"get-leds", http.MethodPost, "/v1/get-leds", api.api1DispatchContext},
+		{"set-schedule-pwm", http.MethodPost, "/v1/set-schedule-pwm", api.api1DispatchContext},
+		{"set-schedule-irradiance", http.MethodPost, "/v1/set-schedule-irradiance", api.api1DispatchContext},
+		{"get-schedule", http.MethodPost, "/v1/get-schedule", api.api1DispatchContext},
+		{"get-schedule-count", http.MethodPost, "/v1/get-schedule-count", api.api1DispatchContext},
+		{"get-scheduling-state", http.MethodPost, "/v1/get-scheduling-state", api.api1DispatchContext},
+		{"delete-schedule", http.MethodPost, "/v1/delete-schedule", api.api1DispatchContext},
+		{"delete-all-schedules", http.MethodPost, "/v1/delete-all-schedules", api.api1DispatchContext},
+		{"stop-scheduling", http.MethodPost, "/v1/stop-scheduling", api.api1DispatchContext},
+		{"resume-scheduling", http.MethodPost, "/v1/resume-scheduling", api.api1DispatchContext},
+		{"set-illuminance-configuration", http.MethodPost, "/v1/set-illuminance-configuration", api.api1DispatchContext},
+		{"get-illuminance-configuration", http.MethodPost, "/v1/get-illuminance-configuration", api.api1DispatchContext},
+		{"get-module-temperature", http.MethodPost, "/v1/get-module-temperature", api.api1DispatchContext},
+		{"toggle-calibration", http.MethodPost, "/v1/toggle-calibration", api.api1DispatchContext},
+		{"reset-for-firmware-update", http.MethodPost, "/v1/reset-for-firmware-update", api.api1DispatchContext},
+		{"confirm-reset-for-firmware-update", http.MethodPost, "/v1/confirm-reset-for-firmware-update", api.api1DispatchContext},
+		{"get-serials", http.MethodGet, "/v1/get-serials", api.api1DispatchContext},
+		{"get-serials", http.MethodGet, "/api/get-serials", api.api1DispatchContext},
+		{"batch", http.MethodPost, "/api/batch", api.api1DispatchContext},
+		{"import-schedules", http.MethodPost, "/api/import-schedules", api.api1DispatchContext},
+		{"export-schedules", http.MethodGet, "/api/export-schedules", api.api1DispatchContext},
+		{"export-schedules", http.MethodPost, "/api/export-schedules", api.api1DispatchContext},
+		{"import-plan", http.MethodPost, "/api/import-plan", api.api1DispatchContext},
+		{"get-plan", http.MethodGet, "/api/plan", api.api1DispatchContext},
+		{"get-timeline", http.MethodGet, "/api/timeline", api.api1DispatchContext},
+		{"randomise-design", http.MethodPost, "/api/design", api.api1DispatchContext},
+		{"get-design", http.MethodGet, "/api/design", api.api1DispatchContext},
+		{"get-channels", http.MethodGet, "/api/channels", api.api1DispatchContext},
+		{"start-scheduler", http.MethodPost, "/api/scheduler", api.api1DispatchContext},
+		{"get-scheduler", http.MethodGet, "/api/scheduler", api.api1DispatchContext},
+		{"stop-scheduler", http.MethodDelete, "/api/scheduler", api.api1DispatchContext},
+		{"start-closed-loop", http.MethodPost, "/api/closed-loop", api.api1DispatchContext},
+		{"get-closed-loop", http.MethodGet, "/api/closed-loop", api.api1DispatchContext},
+		{"stop-closed-loop", http.MethodDelete, "/api/closed-loop", api.api1DispatchContext},
+		{"push-readings", http.MethodPost, "/api/readings", api.api1DispatchContext},
+		{"list-deployments", http.MethodGet, "/api/deployments", api.api1DispatchContext},
+		{"import-schedules", http.MethodPost, "/api/deployments", api.api1DispatchContext},
+		{"get-deployment", http.MethodGet, "/api/deployments/{id}", api.api1DispatchContext},
+		{"cancel-deployment", http.MethodDelete, "/api/deployments/{id}", api.api1DispatchContext},
+		{"apply-deployment", http.MethodPost, "/api/deployments/{id}/apply", api.api1DispatchContext},
+		{"list-versions", http.MethodGet, "/api/history", api.api1DispatchContext},
+		{"diff-versions", http.MethodGet, "/api/history/diff", api.api1DispatchContext},
+		{"get-version", http.MethodGet, "/api/history/{version}", api.api1DispatchContext},
+		{"rollback-version", http.MethodPost, "/api/history/{version}/rollback", api.api1DispatchContext},
+		{"list-recipes", http.MethodGet, "/api/recipes", api.api1DispatchContext},
+		{"save-recipe", http.MethodPost, "/api/recipes", api.api1DispatchContext},
+		{"get-recipe", http.MethodGet, "/api/recipes/{name}", api.api1DispatchContext},
+		{"save-recipe", http.MethodPut, "/api/recipes/{name}", api.api1DispatchContext},
+		{"delete-recipe", http.MethodDelete, "/api/recipes/{name}", api.api1DispatchContext},
+		{"start-job", http.MethodPost, "/api/jobs", api.api1DispatchContext},
+		{"list-jobs", http.MethodGet, "/api/jobs", api.api1DispatchContext},
+		{"get-job", http.MethodGet, "/api/jobs/{id}", api.api1DispatchContext},
+		{"cancel-job", http.MethodDelete, "/api/jobs/{id}", api.api1DispatchContext},
+	}
+	return append(routes, api.rest1Routes()...)
+}
+
+// Launches a web server for PHYTOFY RL v1
+func (api *api1) api1Launch(address string, includeUI bool) error {
+	spec, fail := oapiLoad()
+	if fail != nil {
+		return fmt.Errorf("Failed to load the API specification (%s)", fail)
+	}
+	go api.scheduler.hschRecover()
+	go api.loops.clpRecover()
+	go api.stager.stgRun()
+	go api.controller.ctrl1Poll()
+	return webLaunch(address, api.api1Routes(), spec, includeUI, api.logger)
 }
@@ -0,0 +1,314 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code authenticates the API clients (API tokens or HTTP basic auth) and authorises them by role
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type authRole int
+
+const (
+	authRoleNone authRole = iota
+	authRoleViewer
+	authRoleOperator
+	authRoleAdmin
+)
+
+const (
+	authFile          = "auth.json"
+	authIterations    = 20000 // PBKDF2 iterations of new password hashes
+	authPasswordKind  = "pbkdf2-sha256"
+	authTokenKind     = "sha256"
+	authTokenLength   = 32
+	authRealm         = "PHYTOFY"
+	authQueryVariable = "access_token" // Lets the clients unable to set headers (e.g. EventSource) pass a token
+	authNesting       = 2              // Commands nested deeper (e.g. a batch run as a job) require the admin role
+)
+
+var authRoleNames = map[string]authRole{
+	"viewer":   authRoleViewer,
+	"operator": authRoleOperator,
+	"admin":    authRoleAdmin,
+}
+
+// Commands which require the admin role (whether sent on their own, as a batch or as a job)
+var authAdminCommands = map[string]bool{
+	"exit":                              true,
+	"set-serial-number":                 true,
+	"set-short-address":                 true,
+	"set-module-calibration":            true,
+	"toggle-calibration":                true,
+	"reset-for-firmware-update":         true,
+	"confirm-reset-for-firmware-update": true,
+}
+
+// Holds a user logging in with HTTP basic auth
+type authUser struct {
+	Name     string `json:"name"`
+	Password string `json:"password"` // Hash produced by v1-hash-password
+	Role     string `json:"role"`
+}
+
+// Holds an API token (sent as a bearer token)
+type authToken struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"` // Hash produced by v1-generate-token
+	Role string `json:"role"`
+}
+
+// Holds a client authenticating with a TLS client certificate (matched by its common name)
+type authClient struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Holds the authentication configuration (read from a local file)
+type authConfig struct {
+	Users   []authUser   `json:"users"`
+	Tokens  []authToken  `json:"tokens"`
+	Clients []authClient `json:"clients,omitempty"`
+}
+
+// Holds the identity of an authenticated client
+type authIdentity struct {
+	name string
+	role authRole
+}
+
+// Links the identity of the client to the context of its request
+type authContextKey struct{}
+
+// Returns the path of the authentication configuration
+func authPath() string {
+	if configured := os.Getenv("PHYTOFY_AUTH_FILE"); len(configured) != 0 {
+		return configured
+	}
+	return path.Join(dataBase(), authFile)
+}
+
+// Loads the authentication configuration (nil if there is none - the API is open then)
+func authLoad(logger *log.Logger) (*authConfig, error) {
+	content, fail := ioutil.ReadFile(authPath())
+	if os.IsNotExist(fail) {
+		logger.Printf("WARNING: No authentication configured (%s missing) - the API is open to anyone", authPath())
+		return nil, nil
+	}
+	if fail != nil {
+		return nil, fail
+	}
+	var config authConfig
+	if fail := json.Unmarshal(content, &config); fail != nil {
+		return nil, fmt.Errorf("Failed to parse %s (%s)", authPath(), fail)
+	}
+	for _, user := range config.Users {
+		if _, present := authRoleNames[user.Role]; !present {
+			return nil, fmt.Errorf("Unknown role %q of user %s", user.Role, user.Name)
+		}
+		if !strings.HasPrefix(user.Password, authPasswordKind+"$") {
+			return nil, fmt.Errorf("Password of user %s is not hashed (use v1-hash-password)", user.Name)
+		}
+	}
+	for _, token := range config.Tokens {
+		if _, present := authRoleNames[token.Role]; !present {
+			return nil, fmt.Errorf("Unknown role %q of token %s", token.Role, token.Name)
+		}
+		if !strings.HasPrefix(token.Hash, authTokenKind+"$") {
+			return nil, fmt.Errorf("Token %s is not hashed (use v1-generate-token)", token.Name)
+		}
+	}
+	for _, client := range config.Clients {
+		if _, present := authRoleNames[client.Role]; !present {
+			return nil, fmt.Errorf("Unknown role %q of client %s", client.Role, client.Name)
+		}
+	}
+	logger.Printf("INFO: Authentication configured with %d users, %d tokens and %d clients", len(config.Users), len(config.Tokens), len(config.Clients))
+	return &config, nil
+}
+
+// Derives a key from a password (PBKDF2 with HMAC-SHA256, a single block)
+func authDerive(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	block := mac.Sum(nil)
+	key := append([]byte{}, block...)
+	for iteration := 1; iteration < iterations; iteration++ {
+		mac.Reset()
+		mac.Write(block)
+		block = mac.Sum(block[:0])
+		for index := range key {
+			key[index] ^= block[index]
+		}
+	}
+	return key
+}
+
+// Hashes a password with a random salt
+func authHashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, fail := rand.Read(salt); fail != nil {
+		return "", fail
+	}
+	key := authDerive([]byte(password), salt, authIterations)
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("%s$%d$%s$%s", authPasswordKind, authIterations, encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// Checks a password against its hash
+func authCheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != authPasswordKind {
+		return false
+	}
+	iterations, fail := strconv.Atoi(parts[1])
+	if fail != nil || iterations < 1 {
+		return false
+	}
+	encoding := base64.RawStdEncoding
+	salt, failSalt := encoding.DecodeString(parts[2])
+	key, failKey := encoding.DecodeString(parts[3])
+	if failSalt != nil || failKey != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(authDerive([]byte(password), salt, iterations), key) == 1
+}
+
+// Hashes a token (tokens are random so a plain digest is enough)
+func authHashToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return authTokenKind + "$" + hex.EncodeToString(digest[:])
+}
+
+// Generates a random token along with its hash
+func authGenerateToken() (string, string, error) {
+	random := make([]byte, authTokenLength)
+	if _, fail := rand.Read(random); fail != nil {
+		return "", "", fail
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	return token, authHashToken(token), nil
+}
+
+// Authenticates the client of a request (the token in the query is accepted only if allowed)
+func (config *authConfig) authAuthenticate(request *http.Request, allowQuery bool) (authIdentity, error) {
+	if request.TLS != nil && len(request.TLS.VerifiedChains) != 0 {
+		name := request.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, client := range config.Clients {
+			if client.Name == name {
+				return authIdentity{client.Name, authRoleNames[client.Role]}, nil
+			}
+		}
+	}
+	token := ""
+	if header := request.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	} else if name, password, present := request.BasicAuth(); present {
+		for _, user := range config.Users {
+			if user.Name == name && authCheckPassword(user.Password, password) {
+				return authIdentity{user.Name, authRoleNames[user.Role]}, nil
+			}
+		}
+		return authIdentity{}, webFail(http.StatusUnauthorized, "Invalid user name or password")
+	} else if allowQuery {
+		token = request.URL.Query().Get(authQueryVariable)
+	}
+	if len(token) == 0 {
+		return authIdentity{}, webFail(http.StatusUnauthorized, "Authentication required")
+	}
+	hash := authHashToken(token)
+	for _, known := range config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(known.Hash), []byte(hash)) == 1 {
+			return authIdentity{known.Name, authRoleNames[known.Role]}, nil
+		}
+	}
+	return authIdentity{}, webFail(http.StatusUnauthorized, "Invalid token")
+}
+
+// Works out the role a command requires (the commands nested in a batch or a job count too)
+func authCommandRole(name string, jsonArguments []byte, depth int) authRole {
+	if authAdminCommands[name] || depth > authNesting {
+		return authRoleAdmin
+	}
+	required := authRoleOperator
+	for _, prefix := range []string{"get-", "list-", "export-", "diff-", "v2-get-", "v2-list-"} {
+		if strings.HasPrefix(name, prefix) {
+			required = authRoleViewer
+		}
+	}
+	switch name {
+	case "batch", "start-job":
+		var arguments struct {
+			Command   string          `json:"command"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if json.Unmarshal(jsonArguments, &arguments) == nil && len(arguments.Command) != 0 {
+			if nested := authCommandRole(arguments.Command, arguments.Arguments, depth+1); nested > required {
+				required = nested
+			}
+		}
+	}
+	return required
+}
+
+// Works out the role a route requires (reading is open to the viewers)
+func authRequiredRole(name, method string, jsonArguments []byte) authRole {
+	required := authCommandRole(name, jsonArguments, 0)
+	if method == http.MethodGet && required == authRoleOperator {
+		required = authRoleViewer
+	}
+	return required
+}
+
+// Checks whether the identity holds (at least) the required role
+func (identity authIdentity) authAuthorise(required authRole) error {
+	if identity.role < required {
+		return webFail(http.StatusForbidden, "Permission denied for %s", identity.name)
+	}
+	return nil
+}
+
+// Attaches the identity of the client to a context
+func authWithIdentity(ctx context.Context, identity authIdentity) context.Context {
+	return context.WithValue(ctx, authContextKey{}, identity)
+}
+
+// Passes the identity of the client on to another context (e.g. of a job started by the client)
+func authCarry(ctx, from context.Context) context.Context {
+	if identity, present := from.Value(authContextKey{}).(authIdentity); present {
+		return authWithIdentity(ctx, identity)
+	}
+	return ctx
+}
+
+// Checks whether the client the context belongs to may run a command (internal callers carry no identity)
+func authAuthoriseContext(ctx context.Context, name string, jsonArguments []byte) error {
+	identity, present := ctx.Value(authContextKey{}).(authIdentity)
+	if !present {
+		return nil
+	}
+	return identity.authAuthorise(authCommandRole(name, jsonArguments, 0))
+}
+
+// Tells who runs a command - the authenticated client if any (the given author otherwise)
+func authAuthor(ctx context.Context, author string) string {
+	if identity, present := ctx.Value(authContextKey{}).(authIdentity); present {
+		return identity.name
+	}
+	return author
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAuthRequiredRole(t *testing.T) {
+	cases := []struct {
+		name      string
+		method    string
+		arguments string
+		required  authRole
+	}{
+		{"get-serials", http.MethodGet, "", authRoleViewer},
+		{"get-leds", http.MethodPost, `{"serial": 1}`, authRoleViewer},
+		{"set-leds-pwm", http.MethodPost, `{"serial": 1}`, authRoleOperator},
+		{"exit", http.MethodGet, "", authRoleAdmin},
+		{"batch", http.MethodPost, `{"command": "get-leds", "all": true}`, authRoleOperator},
+		{"batch", http.MethodPost, `{"command": "set-serial-number", "payloads": {}}`, authRoleAdmin},
+		{"start-job", http.MethodPost, `{"command": "import-schedules", "arguments": {}}`, authRoleOperator},
+		{"start-job", http.MethodPost, `{"command": "set-short-address", "arguments": {"serial": 1}}`, authRoleAdmin},
+		{"start-job", http.MethodPost, `{"command": "batch", "arguments": {"command": "set-serial-number", "payloads": {}}}`, authRoleAdmin},
+		{"start-job", http.MethodPost, `{"command": "start-job", "arguments": {"command": "batch", "arguments": {"command": "get-leds"}}}`, authRoleAdmin},
+	}
+	for _, tested := range cases {
+		if required := authRequiredRole(tested.name, tested.method, []byte(tested.arguments)); required != tested.required {
+			t.Errorf("%s %s: required role %d (expecting %d)", tested.name, tested.arguments, required, tested.required)
+		}
+	}
+}
+
+func TestAuthAuthoriseContext(t *testing.T) {
+	batch := []byte(`{"command": "set-serial-number", "payloads": {}}`)
+	if fail := authAuthoriseContext(context.Background(), "batch", batch); fail != nil {
+		t.Errorf("Internal caller refused (%s)", fail)
+	}
+	operator := authWithIdentity(context.Background(), authIdentity{"bob", authRoleOperator})
+	if fail := authAuthoriseContext(operator, "batch", batch); fail == nil {
+		t.Errorf("Operator allowed to readdress fixtures")
+	}
+	job := authCarry(context.Background(), operator)
+	if fail := authAuthoriseContext(job, "set-serial-number", nil); fail == nil {
+		t.Errorf("Operator allowed to readdress fixtures from a job")
+	}
+	if author := authAuthor(job, "mallory"); author != "bob" {
+		t.Errorf("Author %q (expecting the authenticated client)", author)
+	}
+	if author := authAuthor(context.Background(), "alice"); author != "alice" {
+		t.Errorf("Author %q (expecting the given author)", author)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code sets up TLS for the web server (supplied or self-signed certificates & client certificates)
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	crtSelfSignedCertificate = "tls-cert.pem"
+	crtSelfSignedKey         = "tls-key.pem"
+	crtSelfSignedValidity    = 10 * 365 * 24 * time.Hour
+)
+
+// Tells if TLS is requested (explicitly or by supplying a certificate)
+func crtEnabled() bool {
+	enabled, fail := strconv.ParseBool(os.Getenv("PHYTOFY_TLS"))
+	return (fail == nil && enabled) || len(os.Getenv("PHYTOFY_TLS_CERT")) != 0
+}
+
+// Prepares the TLS configuration (nil if TLS is not requested)
+func crtConfigure(address string, logger *log.Logger) (*tls.Config, error) {
+	if !crtEnabled() {
+		return nil, nil
+	}
+	certificateFile, keyFile := os.Getenv("PHYTOFY_TLS_CERT"), os.Getenv("PHYTOFY_TLS_KEY")
+	if len(certificateFile) == 0 {
+		// Self-signed certificate generated on the first start (next to the authentication configuration)
+		certificateFile = path.Join(path.Dir(authPath()), crtSelfSignedCertificate)
+		keyFile = path.Join(path.Dir(authPath()), crtSelfSignedKey)
+		if _, fail := os.Stat(certificateFile); os.IsNotExist(fail) {
+			if fail := crtGenerate(certificateFile, keyFile, address); fail != nil {
+				return nil, fmt.Errorf("Failed to generate a self-signed certificate (%s)", fail)
+			}
+			logger.Printf("INFO: Generated a self-signed certificate %s", certificateFile)
+		}
+	} else if len(keyFile) == 0 {
+		return nil, fmt.Errorf("PHYTOFY_TLS_KEY is required along with PHYTOFY_TLS_CERT")
+	}
+	certificate, fail := tls.LoadX509KeyPair(certificateFile, keyFile)
+	if fail != nil {
+		return nil, fmt.Errorf("Failed to load the certificate %s (%s)", certificateFile, fail)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if authorities := os.Getenv("PHYTOFY_TLS_CLIENT_CA"); len(authorities) != 0 {
+		content, fail := ioutil.ReadFile(authorities)
+		if fail != nil {
+			return nil, fail
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("No certificates found in %s", authorities)
+		}
+		switch mode := os.Getenv("PHYTOFY_TLS_CLIENT_AUTH"); mode {
+		case "", "required":
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("Unknown client certificate mode %q", mode)
+		}
+	}
+	logger.Printf("INFO: Serving over TLS with the certificate %s", certificateFile)
+	return config, nil
+}
+
+// Generates a self-signed certificate (valid for the local host names & the bind address)
+func crtGenerate(certificateFile, keyFile, address string) error {
+	key, fail := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if fail != nil {
+		return fail
+	}
+	serial, fail := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if fail != nil {
+		return fail
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"PHYTOFY"}, CommonName: "PHYTOFY RL"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(crtSelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, fail := os.Hostname(); fail == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, fail := net.SplitHostPort(address); fail == nil && len(host) != 0 {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsLoopback() && !ip.IsUnspecified() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	certificate, fail := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if fail != nil {
+		return fail
+	}
+	privateKey, fail := x509.MarshalECPrivateKey(key)
+	if fail != nil {
+		return fail
+	}
+	if fail := os.MkdirAll(path.Dir(certificateFile), 0755); fail != nil {
+		return fail
+	}
+	if fail := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privateKey}), 0600); fail != nil {
+		return fail
+	}
+	return ioutil.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0644)
+}
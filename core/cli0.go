@@ -3,9 +3,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
-	"strconv"
 	"time"
 )
 
@@ -14,7 +14,7 @@ func cli0Wrapper(command string, argument string, logger *log.Logger) (string, e
 	if command == "v0-get-serials" {
 		api.controller.ctrl0WaitForAnySerials(ctrl0HeartbeatInterval)
 	}
-	result, fail := api.api0Dispatch(command[3:], []byte(argument))
+	result, fail := api.api0Dispatch(context.Background(), command[3:], []byte(argument))
 	time.Sleep(5 * time.Second) // Wait until the commands are flushed (a consequence of protocol design)
 	return string(result), fail
 }
@@ -36,12 +36,12 @@ func cli0ImportSchedules(command string, argument string, logger *log.Logger) (s
 
 func cli0Web(includeUI bool) cliFunction {
 	return func(command string, argument string, logger *log.Logger) (string, error) {
-		api := api0Init(logger)
-		port, fail := strconv.ParseUint(argument, 10, 16)
+		address, fail := webParseAddress(argument)
 		if fail != nil {
 			return "", fail
 		}
-		return "", api.api0Launch(uint16(port), includeUI)
+		api := api0Init(logger)
+		return "", api.api0Launch(address, includeUI)
 	}
 }
 
@@ -53,7 +53,7 @@ func cli0Commands() []cliCommand {
 		{"v0-schedules-clear", "JSON", "JSON-formatted input for the command", cli0Wrapper},
 		{"v0-get-serials", "JSON", "JSON-formatted input for the command", cli0Wrapper},
 		{"v0-import-schedules", "CSV", "CSV file with schedules & recipes", cli0ImportSchedules},
-		{"v0-api", "PORT", "TCP port to expose API on", cli0Web(false)},
-		{"v0-app", "PORT", "TCP port to expose API & UI on", cli0Web(true)},
+		{"v0-api", "PORT", "TCP port (or address & port) to expose API on", cli0Web(false)},
+		{"v0-app", "PORT", "TCP port (or address & port) to expose API & UI on", cli0Web(true)},
 	}
 }
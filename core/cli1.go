@@ -3,15 +3,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func cli1Wrapper(command string, argument string, logger *log.Logger) (string, error) {
 	api := api1Init(logger, false)
 	if command == "v1-get-serials" {
-		api.controller.discoverer.dscvr1WaitForAnySerials(dscvr1DiscoveryInterval)
+		api.controller.discoverer.dscvr1WaitForAnySerials(context.Background(), dscvr1DiscoveryInterval)
 	}
 	result, fail := api.api1Dispatch(command[3:], []byte(argument))
 	return string(result), fail
@@ -22,23 +27,279 @@ func cli1ImportSchedules(command string, argument string, logger *log.Logger) (s
 	if fail != nil {
 		return "", fail
 	}
-	jsonSchedules, fail := json.Marshal(&schedules)
+	jsonArguments, fail := json.Marshal(&api1ImportSchedulesArguments{schedules, false, "", argument, hstrAuthor("")})
 	if fail != nil {
 		return "", fail
 	}
 	api := api1Init(logger, false)
-	result, fail := api.api1ImportSchedules(jsonSchedules)
+	result, fail := api.api1ImportSchedules(context.Background(), jsonArguments)
 	return string(result), fail
 }
 
+func cli1StageSchedules(command string, argument string, logger *log.Logger) (string, error) {
+	var staging struct {
+		File       string `json:"file"`
+		Activation string `json:"activation"`
+	}
+	if fail := json.Unmarshal([]byte(argument), &staging); fail != nil {
+		return "", fail
+	}
+	schedules, fail := schdlReadSchedulesFromFile(staging.File, 6)
+	if fail != nil {
+		return "", fail
+	}
+	arguments := api1ImportSchedulesArguments{schedules, false, staging.Activation, staging.File, hstrAuthor("")}
+	if len(arguments.Activation) == 0 {
+		return "", fmt.Errorf("No activation time given")
+	}
+	jsonArguments, fail := json.Marshal(&arguments)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	result, fail := api.api1ImportSchedules(context.Background(), jsonArguments)
+	return string(result), fail
+}
+
+func cli1ApplyDeployment(command string, argument string, logger *log.Logger) (string, error) {
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	result, fail := api.api1Dispatch("apply-deployment", []byte(argument))
+	if fail != nil {
+		return string(result), fail
+	}
+	var deployment stgDeployment
+	if fail := json.Unmarshal(result, &deployment); fail != nil {
+		return "", fail
+	}
+	api.stager.stgAttempt(deployment.ID) // No loop runs here (waits if the API is applying the deployments meanwhile)
+	result, fail = api.api1Dispatch("get-deployment", []byte(fmt.Sprintf(`{"id": %d}`, deployment.ID)))
+	return string(result), fail
+}
+
+func cli1Batch(command string, argument string, logger *log.Logger) (string, error) {
+	var arguments api1BatchArguments
+	if fail := json.Unmarshal([]byte(argument), &arguments); fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	if arguments.All {
+		api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	}
+	result, fail := api.api1Dispatch("batch", []byte(argument))
+	return string(result), fail
+}
+
+func cli1RollbackVersion(command string, argument string, logger *log.Logger) (string, error) {
+	var arguments api1VersionArguments
+	if fail := json.Unmarshal([]byte(argument), &arguments); fail != nil {
+		return "", fail
+	}
+	arguments.Author = hstrAuthor(arguments.Author)
+	jsonArguments, fail := json.Marshal(&arguments)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	result, fail := api.api1RollbackVersion(context.Background(), jsonArguments)
+	return string(result), fail
+}
+
+func cli1HashPassword(command string, argument string, logger *log.Logger) (string, error) {
+	return authHashPassword(argument)
+}
+
+func cli1GenerateToken(command string, argument string, logger *log.Logger) (string, error) {
+	var entry authToken
+	if fail := json.Unmarshal([]byte(argument), &entry); fail != nil {
+		return "", fail
+	}
+	if _, present := authRoleNames[entry.Role]; !present {
+		return "", fmt.Errorf("Unknown role %q", entry.Role)
+	}
+	token, hash, fail := authGenerateToken()
+	if fail != nil {
+		return "", fail
+	}
+	entry.Hash = hash
+	jsonEntry, fail := json.Marshal(&entry)
+	if fail != nil {
+		return "", fail
+	}
+	return fmt.Sprintf("Token (shown only once): %s\nEntry for the tokens of %s: %s", token, authPath(), jsonEntry), nil
+}
+
+func cli1CheckAPI(command string, argument string, logger *log.Logger) (string, error) {
+	spec, fail := oapiLoad()
+	if fail != nil {
+		return "", fail
+	}
+	api := &api1{}
+	if missing := spec.oapiMissingRoutes(append(webCommonRoutes(logger), api.api1Routes()...)); len(missing) != 0 {
+		return "", fmt.Errorf("Routes missing from the API specification: %s", strings.Join(missing, ", "))
+	}
+	switch argument {
+	case "yaml":
+		return string(spec.yaml), nil
+	case "json":
+		return string(spec.json), nil
+	}
+	return "", fmt.Errorf("Unknown format %q (expecting yaml or json)", argument)
+}
+
+func cli1ValidateSchedules(command string, argument string, logger *log.Logger) (string, error) {
+	lines, fail := schdlReadLinesFromFile(argument)
+	if fail != nil {
+		return "", fail
+	}
+	schedules, issues := schdlCSVParse(lines, 6)
+	problems := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		problems = append(problems, issue.String())
+	}
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	validation := api.api1ValidateSchedules(schedules, problems)
+	result, fail := json.MarshalIndent(&validation, "", "  ")
+	return string(result), fail
+}
+
+func cli1ImportPlan(command string, argument string, logger *log.Logger) (string, error) {
+	plan, fail := ioutil.ReadFile(argument)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	result, fail := api.api1ImportPlan(context.Background(), plan)
+	return string(result), fail
+}
+
+func cli1ExportSchedules(command string, argument string, logger *log.Logger) (string, error) {
+	// Either the file alone (all the fixtures seen get exported) or the file along with the serials
+	export := struct {
+		File    string `json:"file"`
+		Serials string `json:"serials"`
+	}{File: argument}
+	if strings.HasPrefix(strings.TrimSpace(argument), "{") {
+		if fail := json.Unmarshal([]byte(argument), &export); fail != nil {
+			return "", fail
+		}
+	}
+	if len(export.File) == 0 {
+		return "", fmt.Errorf("No file given")
+	}
+	serials, fail := tmlnParseSerials(export.Serials)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	if len(serials) == 0 {
+		api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	}
+	schedules, fail := api.controller.ctrl1ExportSchedules(context.Background(), serials)
+	if fail != nil {
+		return "", fail
+	}
+	if strings.HasSuffix(strings.ToLower(export.File), ".json") {
+		jsonSchedules, fail := json.MarshalIndent(&schedules, "", "  ")
+		if fail != nil {
+			return "", fail
+		}
+		if fail := ioutil.WriteFile(export.File, jsonSchedules, 0644); fail != nil {
+			return "", fail
+		}
+	} else if fail := schdlWriteSchedulesToFile(export.File, schedules, 6); fail != nil {
+		return "", fail
+	}
+	return fmt.Sprintf("Exported %d schedules to %s", len(schedules), export.File), nil
+}
+
+func cli1RandomiseDesign(command string, argument string, logger *log.Logger) (string, error) {
+	design, fail := ioutil.ReadFile(argument)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	jsonOutcome, fail := api.api1RandomiseDesign(design)
+	if fail != nil {
+		return "", fail
+	}
+	var outcome dsgnOutcome
+	if fail := json.Unmarshal(jsonOutcome, &outcome); fail != nil {
+		return "", fail
+	}
+	lines := append(dsgnDescribe(&outcome), schdlCSVFormat(outcome.Schedules, 6)...)
+	return strings.Join(lines, "\n"), nil
+}
+
+func cli1HostScheduler(command string, argument string, logger *log.Logger) (string, error) {
+	program, fail := ioutil.ReadFile(argument)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	api.scheduler.hschRecover()
+	if _, fail := api.api1StartScheduler(program); fail != nil {
+		return "", fail
+	}
+	select {} // Stopped by the exit hooks on interrupt
+}
+
+func cli1SchedulerWatchdog(command string, argument string, logger *log.Logger) (string, error) {
+	seconds, fail := strconv.ParseUint(argument, 10, 32)
+	if fail != nil || seconds == 0 {
+		return "", fmt.Errorf("Invalid number of seconds %q", argument)
+	}
+	var api *api1
+	hschWatch(logger, time.Duration(seconds)*time.Second, func(serials schdlSerials) error {
+		if api == nil {
+			api = api1Init(logger, false)
+		}
+		api.controller.discoverer.dscvr1WaitForSerials(context.Background(), serials, time.Minute)
+		return api.controller.ctrl1ToggleScheduling(serials, true)
+	})
+	return "", nil
+}
+
+func cli1ClosedLoop(command string, argument string, logger *log.Logger) (string, error) {
+	configuration, fail := ioutil.ReadFile(argument)
+	if fail != nil {
+		return "", fail
+	}
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	api.loops.clpRecover()
+	if _, fail := api.api1StartClosedLoop(configuration); fail != nil {
+		return "", fail
+	}
+	select {} // Stopped by the exit hooks on interrupt
+}
+
+func cli1Timeline(command string, argument string, logger *log.Logger) (string, error) {
+	api := api1Init(logger, false)
+	api.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+	jsonResult, fail := api.api1GetTimeline([]byte(argument))
+	if fail != nil {
+		return "", fail
+	}
+	var result api1TimelineResult
+	if fail := json.Unmarshal(jsonResult, &result); fail != nil {
+		return "", fail
+	}
+	return tmlnSummarize(result.Timelines), nil
+}
+
 func cli1Web(includeUI bool) cliFunction {
 	return func(command string, argument string, logger *log.Logger) (string, error) {
-		api := api1Init(logger, includeUI)
-		port, fail := strconv.ParseUint(argument, 10, 16)
+		address, fail := webParseAddress(argument)
 		if fail != nil {
 			return "", fail
 		}
-		return "", api.api1Launch(uint16(port), includeUI)
+		api := api1Init(logger, includeUI)
+		return "", api.api1Launch(address, includeUI)
 	}
 }
 
@@ -73,8 +334,32 @@ func cli1Commands() []cliCommand {
 		{"v1-get-illuminance-configuration", "JSON", "JSON-formatted input for the command", cli1Wrapper},
 		{"v1-get-module-temperature", "JSON", "JSON-formatted input for the command", cli1Wrapper},
 		{"v1-get-serials", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-batch", "JSON", "JSON-formatted command & payload(s) for many fixtures (serials or all)", cli1Batch},
 		{"v1-import-schedules", "CSV", "CSV file with schedules & recipes", cli1ImportSchedules},
-		{"v1-api", "PORT", "TCP port to expose API on", cli1Web(false)},
-		{"v1-app", "PORT", "TCP port to expose API & UI on", cli1Web(true)},
+		{"v1-list-recipes", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-get-recipe", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-save-recipe", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-delete-recipe", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-validate-schedules", "CSV", "CSV file with schedules & recipes", cli1ValidateSchedules},
+		{"v1-import-plan", "FILE", "JSON or YAML file with an experiment plan", cli1ImportPlan},
+		{"v1-export-schedules", "FILE|JSON", "CSV (or JSON if ending with .json) file to write schedules to (or JSON with the file & the serials to export, e.g. 206001-206024,206030)", cli1ExportSchedules},
+		{"v1-randomise-design", "FILE", "JSON file with an experimental design (prints the schedules to import)", cli1RandomiseDesign},
+		{"v1-timeline", "JSON", "JSON-formatted query (serials, from, to, at & source)", cli1Timeline},
+		{"v1-host-scheduler", "FILE", "JSON file with a host scheduler program (runs until interrupted)", cli1HostScheduler},
+		{"v1-scheduler-watchdog", "SECONDS", "Seconds between the checks of the host scheduler heartbeat (resumes the fixture-resident scheduling once its lease lapses - runs until interrupted)", cli1SchedulerWatchdog},
+		{"v1-closed-loop", "FILE", "JSON file with a closed-loop control configuration (runs until interrupted)", cli1ClosedLoop},
+		{"v1-stage-schedules", "JSON", "JSON-formatted CSV file & activation time of a staged deployment", cli1StageSchedules},
+		{"v1-list-deployments", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-cancel-deployment", "JSON", "JSON-formatted ID of the deployment", cli1Wrapper},
+		{"v1-apply-deployment", "JSON", "JSON-formatted ID of the deployment (applied right away)", cli1ApplyDeployment},
+		{"v1-list-versions", "JSON", "JSON-formatted input for the command", cli1Wrapper},
+		{"v1-get-version", "JSON", "JSON-formatted version number", cli1Wrapper},
+		{"v1-diff-versions", "JSON", "JSON-formatted version numbers (from & to, the latest by default)", cli1Wrapper},
+		{"v1-rollback-version", "JSON", "JSON-formatted version number (& dry_run) to roll the fixtures back to", cli1RollbackVersion},
+		{"v1-hash-password", "PASSWORD", "Password to hash for a user of the API", cli1HashPassword},
+		{"v1-generate-token", "JSON", "JSON-formatted name & role of a new API token", cli1GenerateToken},
+		{"v1-check-api", "FORMAT", "Format (yaml or json) to print the merged API specification in (fails if any route is missing from it)", cli1CheckAPI},
+		{"v1-api", "PORT", "TCP port (or address & port) to expose API on", cli1Web(false)},
+		{"v1-app", "PORT", "TCP port (or address & port) to expose API & UI on", cli1Web(true)},
 	}
 }
@@ -0,0 +1,526 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for topping up the light to a target PPFD based on sensor readings (PI control)
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clpStorage         = "closed-loop.json"
+	clpDefaultInterval = 10
+	clpDefaultStale    = 300
+	clpDefaultPeriod   = 600
+)
+
+// Holds a reading of a PAR sensor (PPFD in µmol/m²/s)
+type clpReading struct {
+	Sensor string  `json:"sensor"`
+	Value  float64 `json:"value"`
+	Time   uint32  `json:"time,omitempty"`
+}
+
+// Holds a control loop - the sensors (averaged) measuring the light of the fixtures (serials and/or groups)
+// and the PI controller setting the supplemental PPFD (with the spectrum given by relative photon flux per channel)
+type clpLoop struct {
+	Name         string       `json:"name"`
+	Sensors      []string     `json:"sensors"`
+	Serials      schdlSerials `json:"serials,omitempty"`
+	Groups       []uint32     `json:"groups,omitempty"`
+	Target       float64      `json:"target"`
+	Spectrum     schdlLevels  `json:"spectrum"`
+	Modules      schdlModules `json:"modules,omitempty"`
+	Proportional float64      `json:"kp"`
+	Integral     float64      `json:"ki"`
+	Minimum      float64      `json:"minimum"`
+	Maximum      float64      `json:"maximum"`
+	Rate         float64      `json:"rate,omitempty"`
+}
+
+// Simulates the PAR sensors (for trying out the loops) - the sunlight varies as a sine wave and the sensors of a loop
+// measure it along with the supplemental PPFD of the loop (scaled by the gain)
+type clpSimulation struct {
+	Sunlight  float64 `json:"sunlight"`
+	Amplitude float64 `json:"amplitude,omitempty"`
+	Period    uint32  `json:"period,omitempty"`
+	Gain      float64 `json:"gain,omitempty"`
+}
+
+// Holds the configuration of the control loops (readings are pushed over the API, appended to the watched file or simulated)
+type clpConfiguration struct {
+	Interval   uint32         `json:"interval,omitempty"`
+	Stale      uint32         `json:"stale,omitempty"`
+	File       string         `json:"file,omitempty"`
+	Simulation *clpSimulation `json:"simulation,omitempty"`
+	Loops      []clpLoop      `json:"loops"`
+}
+
+// Holds the state of a control loop
+type clpLoopState struct {
+	Name      string                 `json:"name"`
+	Serials   schdlSerials           `json:"serials"`
+	Measured  float64                `json:"measured"`
+	Measuring uint32                 `json:"measuring,omitempty"`
+	Stale     bool                   `json:"stale"`
+	Error     float64                `json:"error"`
+	Integral  float64                `json:"integral"`
+	Output    float64                `json:"output"`
+	Saturated bool                   `json:"saturated"`
+	Levels    schdlLevels            `json:"levels"`
+	Updated   uint32                 `json:"updated,omitempty"`
+	Errors    map[schdlSerial]string `json:"errors"`
+}
+
+// Holds the state of the closed-loop control
+type clpStatus struct {
+	Active        bool                  `json:"active"`
+	Configuration *clpConfiguration     `json:"configuration,omitempty"`
+	Started       uint32                `json:"started,omitempty"`
+	Loops         []clpLoopState        `json:"loops"`
+	Sensors       map[string]clpReading `json:"sensors"`
+}
+
+// Runs the control loops
+type clpController struct {
+	logger     *log.Logger
+	controller *ctrl1Controller
+	lock       sync.Mutex
+	status     clpStatus
+	offset     int64
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Creates an instance of the closed-loop control (stopped on exit to restore the fixture-resident schedules)
+func clpInit(logger *log.Logger, controller *ctrl1Controller) *clpController {
+	loops := &clpController{logger: logger, controller: controller}
+	loops.status = clpStatus{Loops: []clpLoopState{}, Sensors: map[string]clpReading{}}
+	exitRegister(func() {
+		if fail := loops.clpStop(); fail != nil {
+			logger.Printf("ERROR: Failed to stop the closed-loop control on exit (%s)", fail)
+		}
+	})
+	return loops
+}
+
+// Checks the configuration reporting the first problem found
+func clpCheck(configuration *clpConfiguration) error {
+	if len(configuration.Loops) == 0 {
+		return fmt.Errorf("Configuration has no loops")
+	}
+	if simulation := configuration.Simulation; simulation != nil && (simulation.Sunlight < 0 || simulation.Amplitude < 0 || simulation.Gain < 0) {
+		return fmt.Errorf("Simulation must have non-negative sunlight, amplitude & gain")
+	}
+	names := make(map[string]struct{})
+	for index, loop := range configuration.Loops {
+		if _, present := names[loop.Name]; present || len(loop.Name) == 0 {
+			return fmt.Errorf("Loop #%d: Names must be unique and not empty (got %q)", index+1, loop.Name)
+		}
+		names[loop.Name] = struct{}{}
+		switch {
+		case len(loop.Sensors) == 0:
+			return fmt.Errorf("Loop %s has no sensors", loop.Name)
+		case len(loop.Serials) == 0 && len(loop.Groups) == 0:
+			return fmt.Errorf("Loop %s has neither serials nor groups", loop.Name)
+		case len(loop.Spectrum) != 6:
+			return fmt.Errorf("Loop %s must have a spectrum of 6 channels (has %d)", loop.Name, len(loop.Spectrum))
+		case clpPPFDPerUnit(loop.Spectrum) <= 0:
+			return fmt.Errorf("Loop %s has a spectrum without PAR photons", loop.Name)
+		case loop.Target <= 0:
+			return fmt.Errorf("Loop %s must have a positive target", loop.Name)
+		case loop.Minimum < 0 || loop.Maximum <= loop.Minimum:
+			return fmt.Errorf("Loop %s must have bounds 0 <= minimum < maximum (got %g & %g)", loop.Name, loop.Minimum, loop.Maximum)
+		case loop.Proportional < 0 || loop.Integral < 0 || loop.Rate < 0:
+			return fmt.Errorf("Loop %s must have non-negative gains & rate", loop.Name)
+		}
+		for _, share := range loop.Spectrum {
+			if share < 0 {
+				return fmt.Errorf("Loop %s has a negative spectrum share", loop.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Calculates the PPFD of the spectrum given by relative photon flux per channel
+func clpPPFDPerUnit(spectrum schdlLevels) float64 {
+	ppfd := 0.0
+	for channel, share := range spectrum {
+		if channel < len(phtnChannels) {
+			ppfd += share * phtnChannels[channel].PARFraction
+		}
+	}
+	return ppfd
+}
+
+// Calculates the levels (W/m²) emitting the supplemental PPFD with the spectrum of the loop
+func clpLevels(loop clpLoop, output float64) schdlLevels {
+	scale := output / clpPPFDPerUnit(loop.Spectrum)
+	photons := make(schdlLevels, len(loop.Spectrum))
+	for channel, share := range loop.Spectrum {
+		photons[channel] = share * scale
+	}
+	levels, _ := phtnConvert(photons, phtnUnitsPhotons, phtnUnitsEnergy)
+	return levels
+}
+
+// Steps the PI controller (the output is bounded & rate limited, the integral tracks the limited output to avoid windup)
+func clpStep(loop clpLoop, state *clpLoopState, measured, elapsed float64) {
+	state.Error = loop.Target - measured
+	proportional := loop.Proportional * state.Error
+	integral := state.Integral + loop.Integral*state.Error*elapsed
+	output := math.Max(loop.Minimum, math.Min(loop.Maximum, proportional+integral))
+	if loop.Rate > 0 {
+		step := loop.Rate * elapsed
+		output = math.Max(state.Output-step, math.Min(state.Output+step, output))
+	}
+	state.Saturated = output != proportional+integral
+	if state.Saturated {
+		integral = output - proportional
+	}
+	state.Integral = integral
+	state.Output = output
+}
+
+// Starts the control loops (the driven fixtures must not be driven otherwise)
+func (loops *clpController) clpStart(configuration clpConfiguration, driven schdlSerials) error {
+	if fail := clpCheck(&configuration); fail != nil {
+		return fail
+	}
+	if configuration.Interval == 0 {
+		configuration.Interval = clpDefaultInterval
+	}
+	if configuration.Stale == 0 {
+		configuration.Stale = clpDefaultStale
+	}
+	if simulation := configuration.Simulation; simulation != nil {
+		if simulation.Period == 0 {
+			simulation.Period = clpDefaultPeriod
+		}
+		if simulation.Gain == 0 {
+			simulation.Gain = 1
+		}
+	}
+	loops.lock.Lock()
+	defer loops.lock.Unlock()
+	if loops.status.Active {
+		return fmt.Errorf("Closed-loop control is already running (stop it first)")
+	}
+	busy := make(map[schdlSerial]string)
+	for _, serial := range driven {
+		busy[serial] = "the host scheduler"
+	}
+	states := make([]clpLoopState, 0, len(configuration.Loops))
+	serials := make(schdlSerials, 0)
+	for _, loop := range configuration.Loops {
+		grouped, fail := loops.controller.ctrl1SerialsOfGroups(loop.Groups)
+		if fail != nil {
+			return fail
+		}
+		members := planUniqueSerials(append(append(schdlSerials{}, loop.Serials...), grouped...))
+		if len(members) == 0 {
+			return fmt.Errorf("Loop %s has no fixtures in groups %v", loop.Name, loop.Groups)
+		}
+		for _, serial := range members {
+			if owner, present := busy[serial]; present {
+				return fmt.Errorf("Loop %s drives fixture %d driven by %s", loop.Name, serial, owner)
+			}
+			busy[serial] = "loop " + loop.Name
+		}
+		serials = append(serials, members...)
+		states = append(states, clpLoopState{loop.Name, members, 0, 0, true, 0, loop.Minimum, loop.Minimum, false, nil, 0, map[schdlSerial]string{}})
+	}
+	if fail := loops.controller.ctrl1ToggleScheduling(serials, false); fail != nil {
+		loops.controller.ctrl1ToggleScheduling(serials, true)
+		return fail
+	}
+	loops.status.Active = true
+	loops.status.Configuration = &configuration
+	loops.status.Started = uint32(time.Now().Unix())
+	loops.status.Loops = states
+	loops.offset = 0
+	if info, fail := os.Stat(configuration.File); fail == nil && len(configuration.File) != 0 {
+		loops.offset = info.Size() // Only readings appended from now on matter
+	}
+	if fail := dataWrite(clpStorage, &loops.status); fail != nil {
+		loops.logger.Printf("ERROR: Failed to store the closed-loop control state (%s)", fail)
+	}
+	loops.stop = make(chan struct{})
+	loops.done = make(chan struct{})
+	go loops.clpRun(configuration, loops.stop, loops.done)
+	loops.logger.Printf("INFO: Closed-loop control started for %d loops", len(states))
+	return nil
+}
+
+// Steps the control loops periodically until stopped
+func (loops *clpController) clpRun(configuration clpConfiguration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Duration(configuration.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if len(configuration.File) != 0 {
+			loops.clpWatch(configuration.File)
+		}
+		if configuration.Simulation != nil {
+			loops.clpSimulate(configuration)
+		}
+		loops.clpTick(configuration)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Steps every control loop once and sets the levels of the fixtures
+func (loops *clpController) clpTick(configuration clpConfiguration) {
+	now := time.Now()
+	loops.lock.Lock()
+	states := append([]clpLoopState{}, loops.status.Loops...)
+	sensors := loops.status.Sensors
+	loops.lock.Unlock()
+	for index, loop := range configuration.Loops {
+		state := states[index]
+		sum, count, latest := 0.0, 0, uint32(0)
+		for _, sensor := range loop.Sensors {
+			reading, present := sensors[sensor]
+			if present && now.Sub(time.Unix(int64(reading.Time), 0)) <= time.Duration(configuration.Stale)*time.Second {
+				sum += reading.Value
+				count++
+				if reading.Time > latest {
+					latest = reading.Time
+				}
+			}
+		}
+		elapsed := float64(configuration.Interval)
+		if state.Updated != 0 {
+			elapsed = now.Sub(time.Unix(int64(state.Updated), 0)).Seconds()
+		}
+		state.Stale = count == 0
+		if !state.Stale {
+			state.Measured = sum / float64(count)
+			state.Measuring = latest
+			clpStep(loop, &state, state.Measured, elapsed)
+		}
+		state.Levels = clpLevels(loop, state.Output)
+		state.Updated = uint32(now.Unix())
+		state.Errors = loops.clpApply(loop, state.Serials, state.Levels)
+		states[index] = state
+	}
+	loops.lock.Lock()
+	defer loops.lock.Unlock()
+	if loops.status.Active {
+		loops.status.Loops = states
+	}
+}
+
+// Sets the levels of the fixtures of a loop (the output is held while the readings are stale)
+func (loops *clpController) clpApply(loop clpLoop, serials schdlSerials, levels schdlLevels) map[schdlSerial]string {
+	errors := make(map[schdlSerial]string)
+	var payload pckt1CommandPayloadSetLEDsIrradiance
+	payload.Config = ctrl1Config(schdlModeIrradiance, loop.Modules)
+	for channel := range payload.Levels {
+		payload.Levels[channel] = float32(levels[channel])
+	}
+	for _, serial := range serials {
+		fail := loops.controller.ctrl1CheckLimits(serial, schdlModeIrradiance, levels)
+		if fail == nil {
+			replies, failSet := loops.controller.ctrl1Dispatch(serial, pckt1FunctionCodeSetLEDs, &payload)
+			fail = dptr1CheckResult(pckt1FunctionCodeSetLEDs, replies, failSet)
+		}
+		if fail != nil {
+			errors[serial] = fail.Error()
+			loops.logger.Printf("ERROR: Loop %s failed to set levels for device with serial number %d (%s)", loop.Name, serial, fail)
+		}
+	}
+	return errors
+}
+
+// Records sensor readings (the time defaults to now)
+func (loops *clpController) clpRecord(readings []clpReading) error {
+	for index, reading := range readings {
+		if len(reading.Sensor) == 0 || reading.Value < 0 || math.IsNaN(reading.Value) || math.IsInf(reading.Value, 0) {
+			return fmt.Errorf("Reading #%d is invalid (a sensor and a non-negative value are required)", index+1)
+		}
+	}
+	now := uint32(time.Now().Unix())
+	loops.lock.Lock()
+	defer loops.lock.Unlock()
+	sensors := make(map[string]clpReading, len(loops.status.Sensors)+len(readings))
+	for sensor, reading := range loops.status.Sensors {
+		sensors[sensor] = reading
+	}
+	for _, reading := range readings {
+		if reading.Time == 0 {
+			reading.Time = now
+		}
+		if previous, present := sensors[reading.Sensor]; !present || previous.Time <= reading.Time {
+			sensors[reading.Sensor] = reading
+		}
+	}
+	loops.status.Sensors = sensors
+	return nil
+}
+
+// Records the readings appended to the watched file (lines of sensor, value & optional time)
+func (loops *clpController) clpWatch(name string) {
+	file, fail := os.Open(name)
+	if fail != nil {
+		loops.logger.Printf("ERROR: Failed to open the readings file %s (%s)", name, fail)
+		return
+	}
+	defer file.Close()
+	if info, fail := file.Stat(); fail == nil && info.Size() < loops.offset {
+		loops.offset = 0 // The file got truncated or replaced
+	}
+	if _, fail := file.Seek(loops.offset, io.SeekStart); fail != nil {
+		loops.logger.Printf("ERROR: Failed to read the readings file %s (%s)", name, fail)
+		return
+	}
+	readings := make([]clpReading, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, fail := reader.ReadString('\n')
+		if fail != nil {
+			break // An incomplete line is read again once completed
+		}
+		loops.offset += int64(len(line))
+		if reading, valid := clpParseLine(line); valid {
+			readings = append(readings, reading)
+		}
+	}
+	if fail := loops.clpRecord(readings); fail != nil {
+		loops.logger.Printf("ERROR: Failed to record the readings from %s (%s)", name, fail)
+	}
+}
+
+// Calculates the PPFD measured by a simulated sensor at the given second of the simulation
+func clpSimulated(simulation clpSimulation, output float64, elapsed float64) float64 {
+	sunlight := simulation.Sunlight + simulation.Amplitude*math.Sin(2*math.Pi*elapsed/float64(simulation.Period))
+	return math.Max(0, sunlight) + simulation.Gain*output
+}
+
+// Records the readings of the simulated sensors (a sensor shared by loops measures the light of all of them)
+func (loops *clpController) clpSimulate(configuration clpConfiguration) {
+	loops.lock.Lock()
+	states := append([]clpLoopState{}, loops.status.Loops...)
+	elapsed := time.Since(time.Unix(int64(loops.status.Started), 0)).Seconds()
+	loops.lock.Unlock()
+	supplemental := make(map[string]float64)
+	for index, loop := range configuration.Loops {
+		for _, sensor := range loop.Sensors {
+			supplemental[sensor] += states[index].Output
+		}
+	}
+	readings := make([]clpReading, 0, len(supplemental))
+	for sensor, output := range supplemental {
+		readings = append(readings, clpReading{sensor, clpSimulated(*configuration.Simulation, output, elapsed), 0})
+	}
+	if fail := loops.clpRecord(readings); fail != nil {
+		loops.logger.Printf("ERROR: Failed to record the simulated readings (%s)", fail)
+	}
+}
+
+// Parses a line of the readings file (headers, comments & malformed lines are skipped)
+func clpParseLine(line string) (clpReading, bool) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+		return clpReading{}, false
+	}
+	value, fail := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	if fail != nil || value < 0 {
+		return clpReading{}, false
+	}
+	reading := clpReading{strings.TrimSpace(fields[0]), value, 0}
+	if len(fields) > 2 {
+		at, fail := tmlnParseTime(strings.TrimSpace(fields[2]))
+		if fail != nil {
+			return clpReading{}, false
+		}
+		reading.Time = at
+	}
+	return reading, len(reading.Sensor) != 0
+}
+
+// Stops the control loops and resumes the fixture-resident scheduling (nothing happens if not running)
+func (loops *clpController) clpStop() error {
+	loops.lock.Lock()
+	if !loops.status.Active {
+		loops.lock.Unlock()
+		return nil
+	}
+	close(loops.stop)
+	done := loops.done
+	loops.lock.Unlock()
+	<-done
+	fail := loops.controller.ctrl1ToggleScheduling(clpSerials(loops.status.Loops), true)
+	loops.lock.Lock()
+	defer loops.lock.Unlock()
+	loops.status.Active = false
+	if failRemove := dataRemove(clpStorage); failRemove != nil {
+		loops.logger.Printf("ERROR: Failed to remove the closed-loop control state (%s)", failRemove)
+	}
+	loops.logger.Printf("INFO: Closed-loop control stopped")
+	return fail
+}
+
+// Lists the fixtures driven by the loops
+func clpSerials(states []clpLoopState) schdlSerials {
+	serials := make(schdlSerials, 0)
+	for _, state := range states {
+		serials = append(serials, state.Serials...)
+	}
+	return planUniqueSerials(serials)
+}
+
+// Lists the fixtures currently driven by the loops
+func (loops *clpController) clpDriven() schdlSerials {
+	loops.lock.Lock()
+	defer loops.lock.Unlock()
+	if !loops.status.Active {
+		return schdlSerials{}
+	}
+	return clpSerials(loops.status.Loops)
+}
+
+// Restores the fixture-resident scheduling if the previous run ended without stopping the control loops
+func (loops *clpController) clpRecover() {
+	var previous clpStatus
+	if fail := dataRead(clpStorage, &previous); fail != nil {
+		if !os.IsNotExist(fail) {
+			loops.logger.Printf("ERROR: Failed to load the closed-loop control state (%s)", fail)
+		}
+		return
+	}
+	if previous.Active {
+		serials := clpSerials(previous.Loops)
+		if !loops.controller.discoverer.dscvr1WaitForSerials(context.Background(), serials, time.Minute) {
+			loops.logger.Printf("WARNING: Not all the fixtures driven by the loops were discovered")
+		}
+		loops.logger.Printf("INFO: Closed-loop control was not stopped, falling back to the fixture-resident schedules")
+		if fail := loops.controller.ctrl1ToggleScheduling(serials, true); fail != nil {
+			return
+		}
+	}
+	if fail := dataRemove(clpStorage); fail != nil {
+		loops.logger.Printf("ERROR: Failed to remove the closed-loop control state (%s)", fail)
+	}
+}
+
+// Returns a copy of the state of the closed-loop control
+func (loops *clpController) clpStatus() clpStatus {
+	loops.lock.Lock()
+	defer loops.lock.Unlock()
+	return loops.status
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestClpSimulated(t *testing.T) {
+	simulation := clpSimulation{Sunlight: 300, Amplitude: 100, Period: 600, Gain: 0.5}
+	cases := []struct {
+		output   float64
+		elapsed  float64
+		expected float64
+	}{
+		{0, 0, 300},
+		{0, 150, 400},
+		{0, 450, 200},
+		{100, 450, 250},
+		{100, 600, 350},
+	}
+	for _, tested := range cases {
+		if measured := clpSimulated(simulation, tested.output, tested.elapsed); math.Abs(measured-tested.expected) > 1e-9 {
+			t.Errorf("Output %g at %gs: measured %g (expecting %g)", tested.output, tested.elapsed, measured, tested.expected)
+		}
+	}
+	night := clpSimulation{Sunlight: 50, Amplitude: 100, Period: 600, Gain: 1}
+	if measured := clpSimulated(night, 20, 450); measured != 20 {
+		t.Errorf("Negative sunlight measured as %g", measured)
+	}
+}
+
+func TestClpStep(t *testing.T) {
+	loop := clpLoop{Target: 500, Proportional: 0.1, Integral: 0.01, Minimum: 0, Maximum: 100}
+	limited := loop
+	limited.Rate = 1
+	cases := []struct {
+		loop      clpLoop
+		state     clpLoopState
+		measured  float64
+		elapsed   float64
+		output    float64
+		integral  float64
+		saturated bool
+	}{
+		{loop, clpLoopState{}, 400, 10, 20, 10, false},
+		{loop, clpLoopState{Integral: 10, Output: 20}, 500, 10, 10, 10, false},
+		{loop, clpLoopState{}, 0, 20, 100, 50, true},
+		{loop, clpLoopState{Integral: 5, Output: 5}, 600, 10, 0, 10, true},
+		{limited, clpLoopState{Integral: 30, Output: 20}, 400, 10, 30, 20, true},
+		{limited, clpLoopState{Integral: 40, Output: 50}, 500, 5, 45, 45, true},
+		{limited, clpLoopState{Integral: 40, Output: 45}, 500, 5, 40, 40, false},
+	}
+	for index, tested := range cases {
+		state := tested.state
+		clpStep(tested.loop, &state, tested.measured, tested.elapsed)
+		if state.Error != tested.loop.Target-tested.measured {
+			t.Errorf("Case %d: error %g (expecting %g)", index, state.Error, tested.loop.Target-tested.measured)
+		}
+		if math.Abs(state.Output-tested.output) > 1e-9 || math.Abs(state.Integral-tested.integral) > 1e-9 || state.Saturated != tested.saturated {
+			t.Errorf("Case %d: output %g, integral %g, saturated %t (expecting %g, %g, %t)", index, state.Output, state.Integral, state.Saturated, tested.output, tested.integral, tested.saturated)
+		}
+	}
+}
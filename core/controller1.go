@@ -3,10 +3,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,19 +50,87 @@ var ctrl1NameToFunctionCode map[string]pckt1FunctionCode = map[string]pckt1Funct
 	"confirm-reset-for-firmware-update": pckt1FunctionCodeConfirmResetForFirmwareUpdate,
 }
 
+const (
+	ctrl1ImportAttempts     = 3
+	ctrl1DefaultConcurrency = 8             // Buses (adapter ports) served at the same time
+	ctrl1MaximaLifetime     = time.Hour     // Bounds how long the maxima are cached (invalidations may be missed)
+	ctrl1DefaultPolling     = time.Minute   // Interval of reading the temperatures & clocks of the fixtures for the metrics
+	ctrl1ImportApplied      = "applied"     // The fixture got the new schedules
+	ctrl1ImportRolledBack   = "rolled-back" // The fixture got its previous schedules back
+	ctrl1ImportUntouched    = "untouched"   // The fixture was not modified
+	ctrl1ImportFailed       = "failed"      // The fixture could not get its previous schedules back
+)
+
+// Tells what became of a fixture during an import
+type ctrl1ImportOutcome struct {
+	Serial    schdlSerial `json:"serial"`
+	State     string      `json:"state"`
+	Error     string      `json:"error,omitempty"`
+	Attempts  int         `json:"attempts"`
+	Broadcast bool        `json:"broadcast,omitempty"` // The schedules were uploaded to the whole bus at once
+}
+
+// Tells what became of every fixture during an import
+type ctrl1ImportOutcomes []ctrl1ImportOutcome
+
+func (outcomes ctrl1ImportOutcomes) String() string {
+	states := make([]string, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		states = append(states, fmt.Sprintf("%d %s", outcome.Serial, outcome.State))
+	}
+	return strings.Join(states, ", ")
+}
+
 // Controls the PHYTOFY RL v1 fixtures
 type ctrl1Controller struct {
-	logger     *log.Logger
-	discoverer *dscvr1Discoverer
+	logger      *log.Logger
+	discoverer  *dscvr1Discoverer
+	maxima      sync.Map
+	concurrency int
+	polling     time.Duration // Zero if the fixtures are not polled
 }
 
 // Creates an instance of PHYTOFY RL v0 controller
 func ctrl1Init(logger *log.Logger, conditioning bool) *ctrl1Controller {
 	discoverer := dscvr1Init(logger, conditioning)
-	controller := &ctrl1Controller{logger, discoverer}
+	controller := &ctrl1Controller{logger: logger, discoverer: discoverer, concurrency: ctrl1DefaultConcurrency, polling: ctrl1DefaultPolling}
+	if concurrency, fail := strconv.Atoi(os.Getenv("PHYTOFY_IMPORT_CONCURRENCY")); fail == nil && concurrency > 0 {
+		controller.concurrency = concurrency
+	}
+	if seconds, fail := strconv.Atoi(os.Getenv("PHYTOFY_POLL_INTERVAL")); fail == nil && seconds >= 0 {
+		controller.polling = time.Duration(seconds) * time.Second
+	}
+	go controller.ctrl1WatchAddresses()
 	return controller
 }
 
+// Reads periodically the module temperatures & the clock of every seen fixture (recorded as metrics when replied)
+func (controller *ctrl1Controller) ctrl1Poll() {
+	if controller.polling == 0 {
+		return
+	}
+	for {
+		time.Sleep(controller.polling)
+		controller.ctrl1ForEachFixture(controller.ctrl1GetSerials(), func(index int, serial schdlSerial) {
+			for _, functionCode := range []pckt1FunctionCode{pckt1FunctionCodeGetModuleTemperature, pckt1FunctionCodeGetTimeReference} {
+				replies, fail := controller.ctrl1Dispatch(serial, functionCode, nil)
+				if fail := dptr1CheckResult(functionCode, replies, fail); fail != nil {
+					controller.logger.Printf("WARNING: Failed to poll device with serial number %d (%s)", serial, fail)
+					return
+				}
+			}
+		})
+	}
+}
+
+// Forgets the cached maxima of the fixtures readdressed or lost (they may be other fixtures when seen again)
+func (controller *ctrl1Controller) ctrl1WatchAddresses() {
+	subscription := evntSubscribe([]string{evntTopicFixtureReaddressed, evntTopicFixtureLost})
+	for event := range subscription.events {
+		controller.ctrl1ForgetMaxima(event.Serial)
+	}
+}
+
 // Parse arguments
 func ctrl1ParseGenericArguments(name string, jsonArguments []byte) (schdlSerial, pckt1FunctionCode, pckt1Payload, error) {
 	functionCode, present := ctrl1NameToFunctionCode[name]
@@ -67,6 +142,20 @@ func ctrl1ParseGenericArguments(name string, jsonArguments []byte) (schdlSerial,
 		return 0, 0xFF, nil, fmt.Errorf("Failed to parse arguments (%s) - %s", fail, string(jsonArguments))
 	}
 	var payload pckt1Payload
+	if len(arguments.Recipe) != 0 {
+		recipe, fail := rcpGet(arguments.Recipe)
+		if fail != nil {
+			return 0, 0xFF, nil, fail
+		}
+		if payload, fail = ctrl1RecipeToLEDsPayload(name, recipe); fail != nil {
+			return 0, 0xFF, nil, fail
+		}
+		return arguments.Serial, functionCode, payload, nil
+	}
+	units, fail := phtnParseUnits(arguments.Units)
+	if fail != nil {
+		return 0, 0xFF, nil, fail
+	}
 	switch name {
 	case "set-module-calibration":
 		payload = new(pckt1CommandPayloadSetModuleCalibration)
@@ -130,9 +219,62 @@ func ctrl1ParseGenericArguments(name string, jsonArguments []byte) (schdlSerial,
 			return 0, 0xFF, nil, fmt.Errorf("Failed to parse payload (%s) - %s", fail, string(arguments.Payload))
 		}
 	}
+	if fail := ctrl1ConvertPayloadUnits(payload, units); fail != nil {
+		return 0, 0xFF, nil, fail
+	}
 	return arguments.Serial, functionCode, payload, nil
 }
 
+// Converts the irradiance levels of a command payload given in other units to the units of the fixtures
+func ctrl1ConvertPayloadUnits(payload pckt1Payload, units string) error {
+	if units == phtnUnitsEnergy {
+		return nil
+	}
+	var levels *[6]float32
+	switch specificPayload := payload.(type) {
+	case *pckt1CommandPayloadSetLEDsIrradiance:
+		levels = &specificPayload.Levels
+	case *pckt1CommandPayloadSetScheduleIrradiance:
+		levels = &specificPayload.Levels
+	default:
+		return fmt.Errorf("Units %s only apply to irradiance levels", units)
+	}
+	widened := make(schdlLevels, 6)
+	for i := 0; i < 6; i++ {
+		widened[i] = ctrl1WidenLevel(levels[i])
+	}
+	converted, fail := phtnConvert(widened, units, phtnUnitsEnergy)
+	if fail != nil {
+		return fail
+	}
+	for i := 0; i < 6; i++ {
+		levels[i] = float32(converted[i])
+	}
+	return nil
+}
+
+// Reports the irradiance levels carried by the replies in both units
+func ctrl1ReportLevels(replies []pckt1Packet) []phtnReport {
+	reports := make([]phtnReport, 0)
+	for _, reply := range replies {
+		var levels [6]float32
+		switch specificPayload := reply.Payload.(type) {
+		case *pckt1ReplyPayloadGetLEDsIrradiance:
+			levels = specificPayload.Levels
+		case *pckt1ReplyPayloadGetScheduleIrradiance:
+			levels = specificPayload.Levels
+		default:
+			continue
+		}
+		widened := make(schdlLevels, 6)
+		for i := 0; i < 6; i++ {
+			widened[i] = ctrl1WidenLevel(levels[i])
+		}
+		reports = append(reports, phtnReportLevels(widened))
+	}
+	return reports
+}
+
 // Lists all seen serials
 func (controller *ctrl1Controller) ctrl1GetSerials() schdlSerials {
 	serialsSet := make(map[schdlSerial]struct{})
@@ -152,15 +294,27 @@ func (controller *ctrl1Controller) ctrl1GetSerials() schdlSerials {
 
 // Dispatches a call to adapter(s)
 func (controller *ctrl1Controller) ctrl1Dispatch(serial schdlSerial, functionCode pckt1FunctionCode, payload pckt1Payload) ([]pckt1Packet, error) {
-	if !controller.discoverer.dscvr1WaitForSerial(serial, time.Minute) {
+	return controller.ctrl1DispatchContext(context.Background(), serial, functionCode, payload)
+}
+
+// Dispatches a call to adapter(s) (until canceled)
+func (controller *ctrl1Controller) ctrl1DispatchContext(ctx context.Context, serial schdlSerial, functionCode pckt1FunctionCode, payload pckt1Payload) ([]pckt1Packet, error) {
+	if fail := ctx.Err(); fail != nil {
+		return nil, fail
+	}
+	if !controller.discoverer.dscvr1WaitForSerial(ctx, serial, time.Minute) {
+		if fail := ctx.Err(); fail != nil {
+			return nil, fail
+		}
 		return nil, fmt.Errorf("Timed out waiting for device with serial number %d", serial)
 	}
+	defer controller.ctrl1ForgetModified(serial, functionCode, payload)
 	adapters := controller.discoverer.dscvr1LookUp(serial)
 	result := make([]pckt1Packet, 0)
 	for _, adapter := range adapters {
 		shortAddress := adapter.dptr1LookUp(serial)
 		if shortAddress != pckt1ShortAddressUnassigned {
-			replies, fail := adapter.dptr1AssembleAndExchange(shortAddress, functionCode, payload)
+			replies, fail := adapter.dptr1AssembleAndExchangeContext(ctx, shortAddress, functionCode, payload)
 			if fail != nil {
 				return nil, fmt.Errorf("Failed to communicate with device with serial number %d (%s)", serial, fail)
 			}
@@ -173,76 +327,617 @@ func (controller *ctrl1Controller) ctrl1Dispatch(serial schdlSerial, functionCod
 	return result, fail
 }
 
-// Import schedules
-func (controller *ctrl1Controller) ctrl1ImportSchedules(schedules []schdlAttached) error {
+// Import schedules (transactionally - the schedules of every fixture are snapshotted before modification
+// and if a fixture keeps failing, all the modified fixtures get their previous schedules back)
+func (controller *ctrl1Controller) ctrl1ImportSchedules(ctx context.Context, schedules []schdlAttached) (ctrl1ImportOutcomes, error) {
 	aggregated, fail := schdlAggregateSchedules(schedules, false)
 	if fail != nil {
-		controller.logger.Printf("ERROR: Failed to aggregate schedules (%s)", fail)
-		return fail
+		jobLogf(ctx, controller.logger, "ERROR: Failed to aggregate schedules (%s)", fail)
+		return nil, fail
 	}
+	return controller.ctrl1ImportProgramme(ctx, aggregated)
+}
+
+// Imports the (aggregated) schedules of every fixture like ctrl1ImportSchedules - a fixture with no schedules gets cleared
+func (controller *ctrl1Controller) ctrl1ImportProgramme(ctx context.Context, aggregated schdlAggregated) (ctrl1ImportOutcomes, error) {
 	serials := make(schdlSerials, 0)
 	for serial := range aggregated {
 		serials = append(serials, serial)
 	}
-	if !controller.discoverer.dscvr1WaitForSerials(serials, time.Minute) {
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	outcomes := make(ctrl1ImportOutcomes, 0, len(serials))
+	for _, serial := range serials {
+		outcomes = append(outcomes, ctrl1ImportOutcome{serial, ctrl1ImportUntouched, "", 0, false})
+	}
+	if !controller.discoverer.dscvr1WaitForSerials(ctx, serials, time.Minute) {
 		fail := fmt.Errorf("Failed to locate all fixtures")
-		controller.logger.Printf("ERROR: %s", fail)
-		return fail
+		jobLogf(ctx, controller.logger, "ERROR: %s", fail)
+		return outcomes, fail
 	}
-	for serial := range aggregated {
-		repliesDelete, failDelete := controller.ctrl1Dispatch(serial, pckt1FunctionCodeDeleteAllSchedules, nil)
-		if fail := dptr1CheckResult(pckt1FunctionCodeDeleteAllSchedules, repliesDelete, failDelete); fail != nil {
-			fail := fmt.Errorf("Failed to delete schedule for device with serial number %d (%s)", serial, fail)
-			controller.logger.Printf("ERROR: %s", fail)
-			return fail
+	violations := make(lmtViolations, 0)
+	for serial, entries := range aggregated {
+		for _, schedule := range entries {
+			fail := controller.ctrl1CheckLimits(serial, schdlModeOf(schedule), schedule.Levels)
+			if found, isViolation := fail.(lmtViolations); isViolation {
+				violations = append(violations, found...)
+			} else if fail != nil {
+				jobLogf(ctx, controller.logger, "ERROR: %s", fail)
+				return outcomes, fail
+			}
 		}
-		repliesSync, failSync := controller.ctrl1Dispatch(serial, pckt1FunctionCodeSetTimeReference, &pckt1CommandPayloadSetTimeReference{uint32(time.Now().Unix())})
-		if fail := dptr1CheckResult(pckt1FunctionCodeSetTimeReference, repliesSync, failSync); fail != nil {
-			fail := fmt.Errorf("Failed to sync time for device with serial number %d (%s)", serial, fail)
-			controller.logger.Printf("ERROR: %s", fail)
-			return fail
+	}
+	if len(violations) != 0 {
+		jobLogf(ctx, controller.logger, "ERROR: %s", violations)
+		return outcomes, violations
+	}
+	snapshots := make([][]schdlDetached, len(serials))
+	failures := make([]error, len(serials))
+	controller.ctrl1ForEachFixture(serials, func(index int, serial schdlSerial) {
+		snapshots[index], failures[index] = controller.ctrl1FetchSchedules(ctx, serial)
+	})
+	for index, fail := range failures {
+		if fail != nil {
+			fail = fmt.Errorf("Failed to snapshot schedules for device with serial number %d (%s)", serials[index], fail)
+			jobLogf(ctx, controller.logger, "ERROR: %s", fail)
+			outcomes[index].Error = fail.Error()
+			return outcomes, fail
 		}
-		for scheduleID, schedule := range aggregated[serial] {
-			config := pckt1UseIrradiance | pckt1LEDsModule0Enabled | pckt1LEDsModule1Enabled
-			var levels [6]float32
-			for i := 0; i < 6; i++ {
-				levels[i] = float32(schedule.Levels[i])
+	}
+	var aborted int32
+	touched := make([]bool, len(serials))
+	controller.ctrl1ForEachBus(serials, func(bus ctrl1Bus) {
+		unicast := bus.indices
+		if atomic.LoadInt32(&aborted) == 0 && ctrl1Broadcastable(bus, serials, aggregated) {
+			for _, index := range bus.indices {
+				touched[index] = true
 			}
-			payload := &pckt1CommandPayloadSetScheduleIrradiance{pckt1CommandPayloadSetSchedulePreamble{uint32(scheduleID), schedule.Start, schedule.Stop, config}, levels}
-			repliesSet, failSet := controller.ctrl1Dispatch(serial, pckt1FunctionCodeSetSchedule, payload)
-			if fail := dptr1CheckResult(pckt1FunctionCodeSetSchedule, repliesSet, failSet); fail != nil {
-				fail := fmt.Errorf("Failed to set schedule %d for device with serial number %d (%s)", scheduleID, serial, fail)
-				controller.logger.Printf("ERROR: %s", fail)
-				return fail
+			unicast = controller.ctrl1UploadBroadcast(ctx, bus, serials, aggregated[serials[bus.indices[0]]], outcomes)
+		}
+		for _, index := range unicast {
+			if atomic.LoadInt32(&aborted) != 0 {
+				return
+			}
+			touched[index] = true
+			jobReport(ctx, serials[index], "uploading")
+			attempts, fail := controller.ctrl1UploadRetrying(ctx, serials[index], aggregated[serials[index]])
+			outcomes[index].Attempts = attempts
+			if fail != nil {
+				failures[index] = fail
+				outcomes[index].Error = fail.Error()
+				atomic.StoreInt32(&aborted, 1)
+				jobReport(ctx, serials[index], ctrl1ImportFailed)
+				return
 			}
+			outcomes[index].State = ctrl1ImportApplied
+			jobReport(ctx, serials[index], ctrl1ImportApplied)
 		}
-		repliesResume, failResume := controller.ctrl1Dispatch(serial, pckt1FunctionCodeResumeScheduling, nil)
-		if fail := dptr1CheckResult(pckt1FunctionCodeResumeScheduling, repliesResume, failResume); fail != nil {
-			fail := fmt.Errorf("Failed to resume scheduling for device with serial number %d (%s)", serial, fail)
-			controller.logger.Printf("ERROR: %s", fail)
-			return fail
+	})
+	var failure error
+	for _, fail := range failures {
+		if fail != nil {
+			failure = fail
+			break
 		}
-		repliesCalibration0, failCalibration0 := controller.ctrl1Dispatch(serial, pckt1FunctionCodeGetModuleCalibration, &pckt1CommandPayloadGetModuleCalibration{0})
-		if fail := dptr1CheckResult(pckt1FunctionCodeGetModuleCalibration, repliesCalibration0, failCalibration0); fail != nil {
-			fail := fmt.Errorf("Failed to fetch module 0 calibration for device with serial number %d (%s)", serial, fail)
-			controller.logger.Printf("ERROR: %s", fail)
-			return fail
+	}
+	if failure == nil {
+		return outcomes, nil
+	}
+	// The previous schedules get restored even if the import got canceled
+	restore := jobDetach(ctx)
+	controller.ctrl1ForEachFixture(serials, func(index int, serial schdlSerial) {
+		if !touched[index] {
+			return
 		}
-		repliesCalibration1, failCalibration1 := controller.ctrl1Dispatch(serial, pckt1FunctionCodeGetModuleCalibration, &pckt1CommandPayloadGetModuleCalibration{1})
-		if fail := dptr1CheckResult(pckt1FunctionCodeGetModuleCalibration, repliesCalibration1, failCalibration1); fail != nil {
-			fail := fmt.Errorf("Failed to fetch module 1 calibration for device with serial number %d (%s)", serial, fail)
-			controller.logger.Printf("ERROR: %s", fail)
-			return fail
+		jobReport(ctx, serial, "restoring")
+		jobLogf(ctx, controller.logger, "INFO: Restoring %d previous schedules for device with serial number %d", len(snapshots[index]), serial)
+		if _, fail := controller.ctrl1UploadRetrying(restore, serial, snapshots[index]); fail != nil {
+			outcomes[index].State = ctrl1ImportFailed
+			outcomes[index].Error = fmt.Sprintf("Failed to restore previous schedules (%s)", fail)
+		} else {
+			outcomes[index].State = ctrl1ImportRolledBack
 		}
-		calibration0 := repliesCalibration0[0].Payload.(*pckt1ReplyPayloadGetModuleCalibration).Calibration
-		calibration1 := repliesCalibration1[0].Payload.(*pckt1ReplyPayloadGetModuleCalibration).Calibration
-		configuration := dptr1IlluminanceConfiguration(calibration0, calibration1)
-		repliesIlluminance, failIlluminance := controller.ctrl1Dispatch(serial, pckt1FunctionCodeSetIlluminanceConfiguration, &pckt1CommandPayloadSetIlluminanceConfiguration{configuration})
-		if fail := dptr1CheckResult(pckt1FunctionCodeSetIlluminanceConfiguration, repliesIlluminance, failIlluminance); fail != nil {
-			fail := fmt.Errorf("Failed to set illuminance configuration for device with serial number %d (%s)", serial, fail)
-			controller.logger.Printf("ERROR: %s", fail)
+		jobReport(ctx, serial, outcomes[index].State)
+	})
+	jobLogf(ctx, controller.logger, "ERROR: Import failed, fixtures ended up %s", outcomes)
+	return outcomes, failure
+}
+
+// Holds the fixtures (indices of the imported serials) reached over the same bus (adapter port)
+type ctrl1Bus struct {
+	adapter *dptr1Adapter // Nil if the fixtures are not seen
+	indices []int
+}
+
+// Groups the fixtures by bus (in the order of the serials)
+func (controller *ctrl1Controller) ctrl1GroupByBus(serials schdlSerials) []ctrl1Bus {
+	buses := make([]ctrl1Bus, 0)
+	positions := make(map[dptr1Identifier]int)
+	for index, serial := range serials {
+		bus := ctrl1Bus{nil, []int{index}}
+		identifier := dptr1Identifier(fmt.Sprintf("unknown:%d", serial))
+		if adapters := controller.discoverer.dscvr1LookUp(serial); len(adapters) != 0 {
+			bus.adapter = adapters[0]
+			identifier = adapters[0].adapterID
+		}
+		if position, present := positions[identifier]; present {
+			buses[position].indices = append(buses[position].indices, index)
+			continue
+		}
+		positions[identifier] = len(buses)
+		buses = append(buses, bus)
+	}
+	return buses
+}
+
+// Runs the work for every bus concurrently (up to the concurrency limit)
+func (controller *ctrl1Controller) ctrl1ForEachBus(serials schdlSerials, work func(bus ctrl1Bus)) {
+	limit := make(chan struct{}, controller.concurrency)
+	var group sync.WaitGroup
+	for _, bus := range controller.ctrl1GroupByBus(serials) {
+		group.Add(1)
+		go func(bus ctrl1Bus) {
+			defer group.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			work(bus)
+		}(bus)
+	}
+	group.Wait()
+}
+
+// Runs the work for every fixture - one after another on the same bus and concurrently across buses
+func (controller *ctrl1Controller) ctrl1ForEachFixture(serials schdlSerials, work func(index int, serial schdlSerial)) {
+	controller.ctrl1ForEachBus(serials, func(bus ctrl1Bus) {
+		for _, index := range bus.indices {
+			work(index, serials[index])
+		}
+	})
+}
+
+// Tells if every fixture on the bus is targeted with the same schedules (so they can be broadcast) - the bus must hold
+// no fixture without an address of its own as it would get the schedules without being verified
+func ctrl1Broadcastable(bus ctrl1Bus, serials schdlSerials, aggregated schdlAggregated) bool {
+	if bus.adapter == nil || len(bus.indices) < 2 || !bus.adapter.dptr1Settled() || len(bus.adapter.dptr1ListSeenSerials()) != len(bus.indices) {
+		return false
+	}
+	first := aggregated[serials[bus.indices[0]]]
+	for _, index := range bus.indices[1:] {
+		other := aggregated[serials[index]]
+		if len(other) != len(first) {
+			return false
+		}
+		for position := range other {
+			if schdlKey(other[position]) != schdlKey(first[position]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Uploads the schedules to every fixture on the bus at once (broadcast) and verifies each fixture by counting its schedules
+// (returns the fixtures which still need the schedules uploaded one by one) - the broadcasts only wait briefly and fail on
+// the NACKs received meanwhile, the acknowledgements are not counted as the verification establishes the outcome
+func (controller *ctrl1Controller) ctrl1UploadBroadcast(ctx context.Context, bus ctrl1Bus, serials schdlSerials, schedules []schdlDetached, outcomes ctrl1ImportOutcomes) []int {
+	adapter := bus.adapter
+	broadcast := func(functionCode pckt1FunctionCode, payload pckt1Payload) error {
+		replies, fail := adapter.dptr1AssembleAndExchangeTimeout(ctx, pckt1ShortAddressBroadcast, functionCode, payload, dptr1BroadcastWait)
+		return dptr1CheckResult(functionCode, replies, fail)
+	}
+	for _, index := range bus.indices {
+		jobReport(ctx, serials[index], "broadcasting")
+	}
+	jobLogf(ctx, controller.logger, "INFO: [%s] Broadcasting %d schedules to %d fixtures", adapter.adapterID, len(schedules), len(bus.indices))
+	fail := broadcast(pckt1FunctionCodeDeleteAllSchedules, nil)
+	if fail == nil {
+		fail = broadcast(pckt1FunctionCodeSetTimeReference, &pckt1CommandPayloadSetTimeReference{uint32(time.Now().Unix())})
+	}
+	for scheduleID := 0; scheduleID < len(schedules) && fail == nil; scheduleID++ {
+		fail = broadcast(pckt1FunctionCodeSetSchedule, ctrl1ScheduleToPayload(uint32(scheduleID), schedules[scheduleID]))
+	}
+	if fail == nil {
+		fail = broadcast(pckt1FunctionCodeResumeScheduling, nil)
+	}
+	if fail != nil {
+		jobLogf(ctx, controller.logger, "ERROR: [%s] Broadcast failed, uploading the schedules one by one (%s)", adapter.adapterID, fail)
+		return bus.indices
+	}
+	unicast := make([]int, 0)
+	for _, index := range bus.indices {
+		serial := serials[index]
+		replies, fail := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeGetScheduleCount, nil)
+		fail = dptr1CheckResult(pckt1FunctionCodeGetScheduleCount, replies, fail)
+		if fail == nil {
+			if count := replies[0].Payload.(*pckt1ReplyPayloadGetScheduleCount).ScheduleCount; count != uint32(len(schedules)) {
+				fail = fmt.Errorf("Holds %d schedules instead of %d", count, len(schedules))
+			}
+		}
+		if fail == nil {
+			fail = controller.ctrl1ConfigureIlluminance(ctx, serial)
+		}
+		if fail != nil {
+			jobLogf(ctx, controller.logger, "ERROR: Broadcast not verified for device with serial number %d, uploading the schedules to it alone (%s)", serial, fail)
+			unicast = append(unicast, index)
+			continue
+		}
+		outcomes[index].State = ctrl1ImportApplied
+		outcomes[index].Attempts = 1
+		outcomes[index].Broadcast = true
+		jobReport(ctx, serial, ctrl1ImportApplied)
+	}
+	return unicast
+}
+
+// Uploads the schedules of a fixture retrying on failure (returns the number of attempts)
+func (controller *ctrl1Controller) ctrl1UploadRetrying(ctx context.Context, serial schdlSerial, schedules []schdlDetached) (int, error) {
+	var fail error
+	for attempt := 1; attempt <= ctrl1ImportAttempts; attempt++ {
+		if fail = controller.ctrl1UploadProgramme(ctx, serial, schedules); fail == nil {
+			return attempt, nil
+		}
+		jobLogf(ctx, controller.logger, "ERROR: Attempt %d of %d failed (%s)", attempt, ctrl1ImportAttempts, fail)
+		if ctx.Err() != nil {
+			// No point retrying once canceled
+			return attempt, fail
+		}
+	}
+	return ctrl1ImportAttempts, fail
+}
+
+// Replaces the schedules of a fixture
+func (controller *ctrl1Controller) ctrl1UploadProgramme(ctx context.Context, serial schdlSerial, schedules []schdlDetached) error {
+	repliesDelete, failDelete := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeDeleteAllSchedules, nil)
+	if fail := dptr1CheckResult(pckt1FunctionCodeDeleteAllSchedules, repliesDelete, failDelete); fail != nil {
+		return fmt.Errorf("Failed to delete schedule for device with serial number %d (%s)", serial, fail)
+	}
+	repliesSync, failSync := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeSetTimeReference, &pckt1CommandPayloadSetTimeReference{uint32(time.Now().Unix())})
+	if fail := dptr1CheckResult(pckt1FunctionCodeSetTimeReference, repliesSync, failSync); fail != nil {
+		return fmt.Errorf("Failed to sync time for device with serial number %d (%s)", serial, fail)
+	}
+	for scheduleID, schedule := range schedules {
+		payload := ctrl1ScheduleToPayload(uint32(scheduleID), schedule)
+		repliesSet, failSet := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeSetSchedule, payload)
+		if fail := dptr1CheckResult(pckt1FunctionCodeSetSchedule, repliesSet, failSet); fail != nil {
+			return fmt.Errorf("Failed to set schedule %d for device with serial number %d (%s)", scheduleID, serial, fail)
+		}
+	}
+	repliesResume, failResume := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeResumeScheduling, nil)
+	if fail := dptr1CheckResult(pckt1FunctionCodeResumeScheduling, repliesResume, failResume); fail != nil {
+		return fmt.Errorf("Failed to resume scheduling for device with serial number %d (%s)", serial, fail)
+	}
+	return controller.ctrl1ConfigureIlluminance(ctx, serial)
+}
+
+// Configures the illuminance of a fixture (based on the calibration of its modules)
+func (controller *ctrl1Controller) ctrl1ConfigureIlluminance(ctx context.Context, serial schdlSerial) error {
+	repliesCalibration0, failCalibration0 := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeGetModuleCalibration, &pckt1CommandPayloadGetModuleCalibration{0})
+	if fail := dptr1CheckResult(pckt1FunctionCodeGetModuleCalibration, repliesCalibration0, failCalibration0); fail != nil {
+		return fmt.Errorf("Failed to fetch module 0 calibration for device with serial number %d (%s)", serial, fail)
+	}
+	repliesCalibration1, failCalibration1 := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeGetModuleCalibration, &pckt1CommandPayloadGetModuleCalibration{1})
+	if fail := dptr1CheckResult(pckt1FunctionCodeGetModuleCalibration, repliesCalibration1, failCalibration1); fail != nil {
+		return fmt.Errorf("Failed to fetch module 1 calibration for device with serial number %d (%s)", serial, fail)
+	}
+	calibration0 := repliesCalibration0[0].Payload.(*pckt1ReplyPayloadGetModuleCalibration).Calibration
+	calibration1 := repliesCalibration1[0].Payload.(*pckt1ReplyPayloadGetModuleCalibration).Calibration
+	configuration := dptr1IlluminanceConfiguration(calibration0, calibration1)
+	repliesIlluminance, failIlluminance := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeSetIlluminanceConfiguration, &pckt1CommandPayloadSetIlluminanceConfiguration{configuration})
+	if fail := dptr1CheckResult(pckt1FunctionCodeSetIlluminanceConfiguration, repliesIlluminance, failIlluminance); fail != nil {
+		return fmt.Errorf("Failed to set illuminance configuration for device with serial number %d (%s)", serial, fail)
+	}
+	return nil
+}
+
+// Export schedules (from all seen fixtures if no serials are given)
+func (controller *ctrl1Controller) ctrl1ExportSchedules(ctx context.Context, serials schdlSerials) ([]schdlAttached, error) {
+	aggregated, fail := controller.ctrl1ReadBackSchedules(ctx, serials)
+	if fail != nil {
+		return nil, fail
+	}
+	return schdlMergeBySchedule(aggregated), nil
+}
+
+// Reads back schedules per serial (from all seen fixtures if no serials are given)
+func (controller *ctrl1Controller) ctrl1ReadBackSchedules(ctx context.Context, serials schdlSerials) (schdlAggregated, error) {
+	if len(serials) == 0 {
+		serials = controller.ctrl1GetSerials()
+	} else if !controller.discoverer.dscvr1WaitForSerials(ctx, serials, time.Minute) {
+		fail := fmt.Errorf("Failed to locate all fixtures")
+		jobLogf(ctx, controller.logger, "ERROR: %s", fail)
+		return nil, fail
+	}
+	aggregated := make(schdlAggregated)
+	for _, serial := range serials {
+		schedules, fail := controller.ctrl1FetchSchedules(ctx, serial)
+		if fail != nil {
+			jobLogf(ctx, controller.logger, "ERROR: %s", fail)
+			return nil, fail
+		}
+		jobReport(ctx, serial, "read")
+		if len(schedules) != 0 {
+			aggregated[serial] = schedules
+		}
+	}
+	return aggregated, nil
+}
+
+// Fetches all schedules stored on a fixture
+func (controller *ctrl1Controller) ctrl1FetchSchedules(ctx context.Context, serial schdlSerial) ([]schdlDetached, error) {
+	repliesCount, failCount := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeGetScheduleCount, nil)
+	if fail := dptr1CheckResult(pckt1FunctionCodeGetScheduleCount, repliesCount, failCount); fail != nil {
+		return nil, fmt.Errorf("Failed to count schedules for device with serial number %d (%s)", serial, fail)
+	}
+	count := repliesCount[0].Payload.(*pckt1ReplyPayloadGetScheduleCount).ScheduleCount
+	schedules := make([]schdlDetached, 0, count)
+	for index := uint32(0); index < count; index++ {
+		payload := &pckt1CommandPayloadGetSchedule{index, pckt1ScheduleSearchByIndex}
+		repliesGet, failGet := controller.ctrl1DispatchContext(ctx, serial, pckt1FunctionCodeGetSchedule, payload)
+		if fail := dptr1CheckResult(pckt1FunctionCodeGetSchedule, repliesGet, failGet); fail != nil {
+			return nil, fmt.Errorf("Failed to get schedule at index %d for device with serial number %d (%s)", index, serial, fail)
+		}
+		schedule, fail := ctrl1ScheduleFromReply(repliesGet[0].Payload)
+		if fail != nil {
+			return nil, fmt.Errorf("Failed to convert schedule at index %d for device with serial number %d (%s)", index, serial, fail)
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+// Converts a schedule read back from a fixture into the scheduling model
+func ctrl1ScheduleFromReply(payload pckt1Payload) (schdlDetached, error) {
+	var preamble pckt1ReplyPayloadGetSchedulePreamble
+	levels := make(schdlLevels, 6)
+	switch specificPayload := payload.(type) {
+	case *pckt1ReplyPayloadGetScheduleIrradiance:
+		preamble = specificPayload.pckt1ReplyPayloadGetSchedulePreamble
+		for i := 0; i < 6; i++ {
+			levels[i] = ctrl1WidenLevel(specificPayload.Levels[i])
+		}
+	case *pckt1ReplyPayloadGetSchedulePWM:
+		preamble = specificPayload.pckt1ReplyPayloadGetSchedulePreamble
+		for i := 0; i < 6; i++ {
+			levels[i] = float64(specificPayload.Levels[i])
+		}
+	default:
+		return schdlDetached{}, fmt.Errorf("Unexpected reply payload - %+v", payload)
+	}
+	schedule := schdlDetached{schdlTiming: schdlTiming{preamble.Start, preamble.Stop}, Levels: levels}
+	if preamble.Config&pckt1UseMask == pckt1UsePWM {
+		schedule.Mode = schdlModePWM
+	}
+	modules := schdlModules{preamble.Config&pckt1LEDsModule0Mask == pckt1LEDsModule0Enabled, preamble.Config&pckt1LEDsModule1Mask == pckt1LEDsModule1Enabled}
+	schedule.Modules = schdlNormalizeModules(modules)
+	return schedule, nil
+}
+
+// Converts a schedule from the scheduling model into a command payload
+func ctrl1ScheduleToPayload(scheduleID uint32, schedule schdlDetached) pckt1Payload {
+	config := ctrl1Config(schdlModeOf(schedule), schedule.Modules)
+	preamble := pckt1CommandPayloadSetSchedulePreamble{scheduleID, schedule.Start, schedule.Stop, config}
+	if schdlModeOf(schedule) == schdlModePWM {
+		var levels [6]uint32
+		for i := 0; i < 6; i++ {
+			levels[i] = uint32(math.Round(schedule.Levels[i]))
+		}
+		return &pckt1CommandPayloadSetSchedulePWM{preamble, levels}
+	}
+	var levels [6]float32
+	for i := 0; i < 6; i++ {
+		levels[i] = float32(schedule.Levels[i])
+	}
+	return &pckt1CommandPayloadSetScheduleIrradiance{preamble, levels}
+}
+
+// Converts a recipe into a payload of the "set-leds-pwm" or "set-leds-irradiance" command
+func ctrl1RecipeToLEDsPayload(name string, recipe rcpRecipe) (pckt1Payload, error) {
+	mode := schdlModeOf(schdlDetached{Mode: recipe.Mode})
+	config := ctrl1Config(mode, recipe.Modules)
+	switch {
+	case name == "set-leds-pwm" && mode == schdlModePWM:
+		var levels [6]uint32
+		for i := 0; i < 6; i++ {
+			levels[i] = uint32(math.Round(recipe.Levels[i]))
+		}
+		return &pckt1CommandPayloadSetLEDsPWM{config, levels}, nil
+	case name == "set-leds-irradiance" && mode == schdlModeIrradiance:
+		converted, fail := phtnConvert(recipe.Levels, recipe.Units, phtnUnitsEnergy)
+		if fail != nil {
+			return nil, fail
+		}
+		var levels [6]float32
+		for i := 0; i < 6; i++ {
+			levels[i] = float32(converted[i])
+		}
+		return &pckt1CommandPayloadSetLEDsIrradiance{config, levels}, nil
+	}
+	return nil, fmt.Errorf("Recipe %s (mode %s) cannot be used with %s", recipe.Name, mode, name)
+}
+
+// Assembles the configuration bits for the given mode and module enablement
+func ctrl1Config(mode schdlMode, modules schdlModules) uint8 {
+	config := pckt1UseIrradiance
+	if mode == schdlModePWM {
+		config = pckt1UsePWM
+	}
+	if schdlModuleEnabled(modules, 0) {
+		config |= pckt1LEDsModule0Enabled
+	}
+	if schdlModuleEnabled(modules, 1) {
+		config |= pckt1LEDsModule1Enabled
+	}
+	return config
+}
+
+// Widens a level keeping its shortest decimal representation (e.g. 50.1 rather than 50.099998)
+func ctrl1WidenLevel(level float32) float64 {
+	widened, fail := strconv.ParseFloat(strconv.FormatFloat(float64(level), 'f', -1, 32), 64)
+	if fail != nil {
+		return float64(level)
+	}
+	return widened
+}
+
+// Holds the per-channel maxima reported by a fixture along with when they were fetched
+type ctrl1Maxima struct {
+	values  [6]float64
+	fetched time.Time
+}
+
+// Fetches the per-channel maxima reported by the fixture (cached for a while, forgotten once the fixture is modified)
+func (controller *ctrl1Controller) ctrl1FetchMaxima(serial schdlSerial) ([6]float64, error) {
+	if cached, present := controller.maxima.Load(serial); present && time.Since(cached.(ctrl1Maxima).fetched) < ctrl1MaximaLifetime {
+		return cached.(ctrl1Maxima).values, nil
+	}
+	var maxima [6]float64
+	replies, fail := controller.ctrl1Dispatch(serial, pckt1FunctionCodeGetFixtureInfo, nil)
+	if fail := dptr1CheckResult(pckt1FunctionCodeGetFixtureInfo, replies, fail); fail != nil {
+		return maxima, fmt.Errorf("Failed to get fixture info for device with serial number %d (%s)", serial, fail)
+	}
+	for i, maximum := range replies[0].Payload.(*pckt1ReplyPayloadGetFixtureInfo).Max {
+		maxima[i] = ctrl1WidenLevel(maximum)
+	}
+	controller.maxima.Store(serial, ctrl1Maxima{maxima, time.Now()})
+	return maxima, nil
+}
+
+// Forgets the cached maxima of the fixture the command (even failing) may have modified or readdressed
+func (controller *ctrl1Controller) ctrl1ForgetModified(serial schdlSerial, functionCode pckt1FunctionCode, payload pckt1Payload) {
+	switch functionCode {
+	case pckt1FunctionCodeSetFixtureInfo:
+		controller.ctrl1ForgetMaxima(serial)
+	case pckt1FunctionCodeSetSerialNumber:
+		controller.ctrl1ForgetMaxima(serial, payload.(*pckt1CommandPayloadSetSerialNumber).Serial)
+	case pckt1FunctionCodeSetShortAddress:
+		controller.ctrl1ForgetMaxima(serial, payload.(*pckt1CommandPayloadSetShortAddress).Serial)
+	}
+}
+
+// Forgets the cached maxima of the fixtures
+func (controller *ctrl1Controller) ctrl1ForgetMaxima(serials ...schdlSerial) {
+	for _, serial := range serials {
+		controller.maxima.Delete(serial)
+	}
+}
+
+// Checks the levels against the limits of the fixture (violations are reported as lmtViolations)
+func (controller *ctrl1Controller) ctrl1CheckLimits(serial schdlSerial, mode schdlMode, levels schdlLevels) error {
+	var maxima [6]float64
+	if mode != schdlModePWM {
+		var fail error
+		if maxima, fail = controller.ctrl1FetchMaxima(serial); fail != nil {
 			return fail
 		}
 	}
+	if violations := lmtCheck(serial, mode, levels, maxima); len(violations) != 0 {
+		return violations
+	}
 	return nil
 }
+
+// Checks the levels carried by a command payload (if any) against the limits of the fixture
+func (controller *ctrl1Controller) ctrl1CheckPayloadLimits(serial schdlSerial, payload pckt1Payload) error {
+	levels := make(schdlLevels, 6)
+	mode := schdlModeIrradiance
+	switch specificPayload := payload.(type) {
+	case *pckt1CommandPayloadSetLEDsPWM:
+		mode = schdlModePWM
+		for i := 0; i < 6; i++ {
+			levels[i] = float64(specificPayload.Levels[i])
+		}
+	case *pckt1CommandPayloadSetSchedulePWM:
+		mode = schdlModePWM
+		for i := 0; i < 6; i++ {
+			levels[i] = float64(specificPayload.Levels[i])
+		}
+	case *pckt1CommandPayloadSetLEDsIrradiance:
+		for i := 0; i < 6; i++ {
+			levels[i] = ctrl1WidenLevel(specificPayload.Levels[i])
+		}
+	case *pckt1CommandPayloadSetScheduleIrradiance:
+		for i := 0; i < 6; i++ {
+			levels[i] = ctrl1WidenLevel(specificPayload.Levels[i])
+		}
+	default:
+		return nil
+	}
+	return controller.ctrl1CheckLimits(serial, mode, levels)
+}
+
+// Tells the outcome of a command sent to a fixture as a part of a batch
+type ctrl1BatchOutcome struct {
+	Replies []pckt1Packet
+	Error   error
+}
+
+// Sends commands to many fixtures (one after another on the same bus and concurrently across buses)
+// waiting for all of them to be seen just once (the fixtures not seen by then fail right away)
+func (controller *ctrl1Controller) ctrl1DispatchBatch(ctx context.Context, serials schdlSerials, command func(serial schdlSerial) (pckt1FunctionCode, pckt1Payload, error)) []ctrl1BatchOutcome {
+	outcomes := make([]ctrl1BatchOutcome, len(serials))
+	controller.discoverer.dscvr1WaitForSerials(ctx, serials, time.Minute)
+	controller.ctrl1ForEachFixture(serials, func(index int, serial schdlSerial) {
+		if fail := ctx.Err(); fail != nil {
+			outcomes[index].Error = fail
+			jobReport(ctx, serial, "failed")
+			return
+		}
+		if len(controller.discoverer.dscvr1LookUp(serial)) == 0 {
+			outcomes[index].Error = fmt.Errorf("Device with serial number %d not seen", serial)
+			jobReport(ctx, serial, "failed")
+			return
+		}
+		functionCode, payload, fail := command(serial)
+		if fail == nil {
+			outcomes[index].Replies, fail = controller.ctrl1DispatchContext(ctx, serial, functionCode, payload)
+		}
+		outcomes[index].Error = fail
+		if fail != nil {
+			jobReport(ctx, serial, "failed")
+		} else {
+			jobReport(ctx, serial, "succeeded")
+		}
+	})
+	return outcomes
+}
+
+// Stops or resumes scheduling of the fixtures (reports the first failure)
+func (controller *ctrl1Controller) ctrl1ToggleScheduling(serials schdlSerials, resume bool) error {
+	functionCode, action := pckt1FunctionCodeStopScheduling, "stop"
+	if resume {
+		functionCode, action = pckt1FunctionCodeResumeScheduling, "resume"
+	}
+	var first error
+	for _, serial := range serials {
+		replies, fail := controller.ctrl1Dispatch(serial, functionCode, nil)
+		if fail := dptr1CheckResult(functionCode, replies, fail); fail != nil {
+			fail = fmt.Errorf("Failed to %s scheduling for device with serial number %d (%s)", action, serial, fail)
+			controller.logger.Printf("ERROR: %s", fail)
+			if first == nil {
+				first = fail
+			}
+		}
+	}
+	return first
+}
+
+// Finds the seen fixtures belonging to any of the groups
+func (controller *ctrl1Controller) ctrl1SerialsOfGroups(groups []uint32) (schdlSerials, error) {
+	serials := make(schdlSerials, 0)
+	if len(groups) == 0 {
+		return serials, nil
+	}
+	wanted := make(map[uint32]struct{})
+	for _, group := range groups {
+		wanted[group] = struct{}{}
+	}
+	for _, serial := range controller.ctrl1GetSerials() {
+		replies, fail := controller.ctrl1Dispatch(serial, pckt1FunctionCodeGetGroupID, nil)
+		if fail := dptr1CheckResult(pckt1FunctionCodeGetGroupID, replies, fail); fail != nil {
+			return nil, fmt.Errorf("Failed to get group ID for device with serial number %d (%s)", serial, fail)
+		}
+		if _, present := wanted[replies[0].Payload.(*pckt1ReplyPayloadGetGroupID).GroupID]; present {
+			serials = append(serials, serial)
+		}
+	}
+	return serials, nil
+}
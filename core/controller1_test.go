@@ -0,0 +1,283 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCtrl1ForgetModified(t *testing.T) {
+	cases := []struct {
+		functionCode pckt1FunctionCode
+		payload      pckt1Payload
+		forgotten    schdlSerials
+	}{
+		{pckt1FunctionCodeGetFixtureInfo, nil, schdlSerials{}},
+		{pckt1FunctionCodeSetFixtureInfo, &pckt1CommandPayloadSetFixtureInfo{1, 1}, schdlSerials{1}},
+		{pckt1FunctionCodeSetSerialNumber, &pckt1CommandPayloadSetSerialNumber{2}, schdlSerials{1, 2}},
+		{pckt1FunctionCodeSetShortAddress, &pckt1CommandPayloadSetShortAddress{3, 7}, schdlSerials{1, 3}},
+	}
+	for _, tested := range cases {
+		controller := &ctrl1Controller{}
+		for _, serial := range []schdlSerial{1, 2, 3} {
+			controller.maxima.Store(serial, ctrl1Maxima{[6]float64{1, 1, 1, 1, 1, 1}, time.Now()})
+		}
+		controller.ctrl1ForgetModified(1, tested.functionCode, tested.payload)
+		forgotten := make(schdlSerials, 0)
+		for _, serial := range []schdlSerial{1, 2, 3} {
+			if _, present := controller.maxima.Load(serial); !present {
+				forgotten = append(forgotten, serial)
+			}
+		}
+		if !reflect.DeepEqual(forgotten, tested.forgotten) {
+			t.Errorf("Function code %d: forgot %v (expecting %v)", tested.functionCode, forgotten, tested.forgotten)
+		}
+	}
+}
+
+// Stands for the fixtures on a bus (keeps the schedules set & refuses those reaching the level of the first channel)
+type ctrl1TestBus struct {
+	lock      sync.Mutex
+	schedules map[pckt1ShortAddress][]pckt1CommandPayloadSetSchedulePWM
+	refusing  map[pckt1ShortAddress]uint32
+}
+
+// Serves the commands of an adapter (one at a time - every command is awaited before the next one is sent)
+func (bus *ctrl1TestBus) serve(connection net.Conn) {
+	defer connection.Close()
+	octets := make([]byte, 1024)
+	for {
+		read, fail := connection.Read(octets)
+		if fail != nil {
+			return
+		}
+		if read < pckt1HeaderSize+pckt1CRC16Size {
+			continue
+		}
+		header, fail := pckt1DecodeHeader(octets)
+		if fail != nil {
+			continue
+		}
+		payload := bus.reply(*header, bytes.NewBuffer(octets[pckt1HeaderSize:read-pckt1CRC16Size]))
+		if !pckt1IsReplying(header.FunctionCode) {
+			continue
+		}
+		if encoded, fail := pckt1Encode(pckt1Packet{Header: *header, Payload: payload}); fail == nil {
+			connection.Write(encoded)
+		}
+	}
+}
+
+// Acts upon a command and returns the reply payload
+func (bus *ctrl1TestBus) reply(header pckt1Header, payload *bytes.Buffer) pckt1Payload {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	acknowledged := &pckt1ReplyPayloadGenericOK{pckt1ReplyPayloadPreamble{true}}
+	schedules := bus.schedules[header.ShortAddress]
+	switch header.FunctionCode {
+	case pckt1FunctionCodeGetScheduleCount:
+		return &pckt1ReplyPayloadGetScheduleCount{uint32(len(schedules))}
+	case pckt1FunctionCodeGetSchedule:
+		var command pckt1CommandPayloadGetSchedule
+		binary.Read(payload, binary.LittleEndian, &command)
+		index := bus.find(schedules, command.ScheduleKey, command.ScheduleKeyType)
+		if index < 0 {
+			return &pckt1ReplyPayloadGenericNOK{pckt1ReplyPayloadPreamble{false}, 1}
+		}
+		schedule := schedules[index]
+		return &pckt1ReplyPayloadGetSchedulePWM{pckt1ReplyPayloadGetSchedulePreamble(schedule.pckt1CommandPayloadSetSchedulePreamble), schedule.Levels}
+	case pckt1FunctionCodeDeleteSchedule:
+		var command pckt1CommandPayloadDeleteSchedule
+		binary.Read(payload, binary.LittleEndian, &command)
+		index := bus.find(schedules, command.ScheduleID, pckt1ScheduleSearchByID)
+		if index < 0 {
+			return &pckt1ReplyPayloadGenericNOK{pckt1ReplyPayloadPreamble{false}, 1}
+		}
+		bus.schedules[header.ShortAddress] = append(schedules[:index:index], schedules[index+1:]...)
+	case pckt1FunctionCodeDeleteAllSchedules:
+		bus.schedules[header.ShortAddress] = nil
+	case pckt1FunctionCodeSetSchedule:
+		var command pckt1CommandPayloadSetSchedulePWM
+		binary.Read(payload, binary.LittleEndian, &command)
+		if refusing, present := bus.refusing[header.ShortAddress]; present && command.Levels[0] >= refusing {
+			return &pckt1ReplyPayloadGenericNOK{pckt1ReplyPayloadPreamble{false}, 1}
+		}
+		bus.schedules[header.ShortAddress] = append(schedules, command)
+	case pckt1FunctionCodeGetFixtureInfo:
+		return &pckt1ReplyPayloadGetFixtureInfo{Max: [6]float32{100, 100, 100, 100, 100, 100}}
+	case pckt1FunctionCodeGetModuleCalibration:
+		var command pckt1CommandPayloadGetModuleCalibration
+		binary.Read(payload, binary.LittleEndian, &command)
+		reply := &pckt1ReplyPayloadGetModuleCalibration{ModuleID: command.ModuleID}
+		for channel := range reply.Calibration {
+			reply.Calibration[channel].CoefficientM = 1
+		}
+		return reply
+	}
+	return acknowledged
+}
+
+// Looks up a schedule by ID or by index (-1 if there is none)
+func (bus *ctrl1TestBus) find(schedules []pckt1CommandPayloadSetSchedulePWM, key uint32, keyType uint8) int {
+	if keyType == pckt1ScheduleSearchByIndex {
+		if key < uint32(len(schedules)) {
+			return int(key)
+		}
+		return -1
+	}
+	for index, schedule := range schedules {
+		if schedule.ScheduleID == key {
+			return index
+		}
+	}
+	return -1
+}
+
+// Starts a controller reaching the fixtures on the bus through a single adapter (serial numbers 1 to 3)
+func ctrl1TestController(t *testing.T, bus *ctrl1TestBus) *ctrl1Controller {
+	listener, fail := net.Listen("tcp4", "127.0.0.1:0")
+	if fail != nil {
+		t.Fatalf("Failed to listen (%s)", fail)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			connection, fail := listener.Accept()
+			if fail != nil {
+				return
+			}
+			go bus.serve(connection)
+		}
+	}()
+	logger := log.New(ioutil.Discard, "", 0)
+	adapter := dptr1Init(logger, net.IPv4(127, 0, 0, 1), listener.Addr().(*net.TCPAddr).Port)
+	adapter.dptr1ReassociateAll(map[schdlSerial]pckt1ShortAddress{1: 1, 2: 2, 3: 3})
+	go adapter.dptr1Conduit()
+	go adapter.dptr1Connector()
+	discoverer := &dscvr1Discoverer{logger: logger}
+	discoverer.adapters.Store(adapter.adapterID, adapter)
+	return &ctrl1Controller{logger: logger, discoverer: discoverer, concurrency: 1}
+}
+
+func TestCtrl1ImportProgramme(t *testing.T) {
+	bus := &ctrl1TestBus{}
+	controller := ctrl1TestController(t, bus)
+	start, _ := schdlParseDate("2021-03-15", "06:00")
+	stop, _ := schdlParseDate("2021-04-30", "22:00")
+	programme := func(level float64) schdlDetached {
+		return schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{level, 0, 0, 0, 0, 0}, Mode: schdlModePWM}
+	}
+	previous := *ctrl1ScheduleToPayload(0, programme(10)).(*pckt1CommandPayloadSetSchedulePWM)
+	cases := []struct {
+		refusing map[pckt1ShortAddress]uint32
+		states   []string
+		levels   []uint32 // Level of the first channel kept by each fixture
+	}{
+		{map[pckt1ShortAddress]uint32{}, []string{ctrl1ImportApplied, ctrl1ImportApplied, ctrl1ImportApplied}, []uint32{20, 20, 20}},
+		{map[pckt1ShortAddress]uint32{2: 20}, []string{ctrl1ImportRolledBack, ctrl1ImportRolledBack, ctrl1ImportUntouched}, []uint32{10, 10, 10}},
+		{map[pckt1ShortAddress]uint32{2: 0}, []string{ctrl1ImportRolledBack, ctrl1ImportFailed, ctrl1ImportUntouched}, []uint32{10, 0, 10}},
+	}
+	for index, tested := range cases {
+		bus.lock.Lock()
+		bus.refusing = tested.refusing
+		bus.schedules = make(map[pckt1ShortAddress][]pckt1CommandPayloadSetSchedulePWM)
+		for shortAddress := pckt1ShortAddress(1); shortAddress <= 3; shortAddress++ {
+			bus.schedules[shortAddress] = []pckt1CommandPayloadSetSchedulePWM{previous}
+		}
+		bus.lock.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		outcomes, fail := controller.ctrl1ImportProgramme(ctx, schdlAggregated{1: {programme(20)}, 2: {programme(20)}, 3: {programme(20)}})
+		cancel()
+		if (fail == nil) != (len(tested.refusing) == 0) {
+			t.Errorf("Case %d: import failed with %v", index, fail)
+		}
+		states := make([]string, 0, len(outcomes))
+		for _, outcome := range outcomes {
+			states = append(states, outcome.State)
+		}
+		if !reflect.DeepEqual(states, tested.states) {
+			t.Errorf("Case %d: fixtures ended up %v (expecting %v)", index, states, tested.states)
+		}
+		bus.lock.Lock()
+		levels := make([]uint32, 0, 3)
+		for shortAddress := pckt1ShortAddress(1); shortAddress <= 3; shortAddress++ {
+			level := uint32(0)
+			if schedules := bus.schedules[shortAddress]; len(schedules) != 0 {
+				level = schedules[len(schedules)-1].Levels[0]
+			}
+			levels = append(levels, level)
+		}
+		bus.lock.Unlock()
+		if !reflect.DeepEqual(levels, tested.levels) {
+			t.Errorf("Case %d: fixtures kept levels %v (expecting %v)", index, levels, tested.levels)
+		}
+	}
+}
+
+func TestCtrl1ExportRoundTrip(t *testing.T) {
+	start, _ := schdlParseDate("2021-03-15", "06:00")
+	stop, _ := schdlParseDate("2021-04-30", "22:30")
+	preamble := func(scheduleID uint32, config uint8) pckt1ReplyPayloadGetSchedulePreamble {
+		return pckt1ReplyPayloadGetSchedulePreamble{ScheduleID: scheduleID, Start: start, Stop: stop, Config: config}
+	}
+	both := pckt1LEDsModule0Enabled | pckt1LEDsModule1Enabled
+	shared := &pckt1ReplyPayloadGetScheduleIrradiance{preamble(0, pckt1UseIrradiance|both), [6]float32{0, 50.1, 12.25, 80, 3.3, 0.7}}
+	read := map[schdlSerial][]pckt1Payload{
+		206001: {shared, &pckt1ReplyPayloadGetSchedulePWM{preamble(1, pckt1UsePWM|pckt1LEDsModule0Enabled), [6]uint32{0, 10, 20, 30, 40, 0}}},
+		206002: {shared, &pckt1ReplyPayloadGetScheduleIrradiance{preamble(1, pckt1UseIrradiance|pckt1LEDsModule1Enabled), [6]float32{1.5, 0, 0, 0, 0.1, 0}}},
+	}
+	aggregated := make(schdlAggregated)
+	for serial, payloads := range read {
+		for _, payload := range payloads {
+			schedule, fail := ctrl1ScheduleFromReply(payload)
+			if fail != nil {
+				t.Fatalf("Fixture %d: %s", serial, fail)
+			}
+			aggregated[serial] = append(aggregated[serial], schedule)
+		}
+	}
+	exported := schdlMergeBySchedule(aggregated)
+	if len(exported) != 3 {
+		t.Errorf("Merged into %d schedules (expecting 3) - %+v", len(exported), exported)
+	}
+	path := filepath.Join(t.TempDir(), "exported.csv")
+	if fail := schdlWriteSchedulesToFile(path, exported, 6); fail != nil {
+		t.Fatalf("Failed to export (%s)", fail)
+	}
+	imported, fail := schdlReadSchedulesFromFile(path, 6)
+	if fail != nil {
+		t.Fatalf("Failed to read the export back (%s)", fail)
+	}
+	if !reflect.DeepEqual(imported, exported) {
+		t.Fatalf("Read back as %+v (expecting %+v)", imported, exported)
+	}
+	// The schedules imported back must program the fixtures exactly as they were read
+	reimported := schdlAggregateBySerial(imported)
+	for serial, payloads := range read {
+		for index, payload := range payloads {
+			expected := payload
+			switch specificPayload := payload.(type) {
+			case *pckt1ReplyPayloadGetScheduleIrradiance:
+				expected = &pckt1CommandPayloadSetScheduleIrradiance{pckt1CommandPayloadSetSchedulePreamble(specificPayload.pckt1ReplyPayloadGetSchedulePreamble), specificPayload.Levels}
+			case *pckt1ReplyPayloadGetSchedulePWM:
+				expected = &pckt1CommandPayloadSetSchedulePWM{pckt1CommandPayloadSetSchedulePreamble(specificPayload.pckt1ReplyPayloadGetSchedulePreamble), specificPayload.Levels}
+			}
+			if index >= len(reimported[serial]) {
+				t.Errorf("Fixture %d lost schedule %d", serial, index)
+				continue
+			}
+			if encoded := ctrl1ScheduleToPayload(uint32(index), reimported[serial][index]); !reflect.DeepEqual(encoded, expected) {
+				t.Errorf("Fixture %d: schedule %d encoded as %+v (expecting %+v)", serial, index, encoded, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for randomised assignment of fixtures to treatments
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dsgnStorage     = "design.json"
+	dsgnBlocks      = "rcbd"
+	dsgnLatinSquare = "latin-square"
+)
+
+// Holds a fixture taking part in the experiment (block - or row - and column labels are optional)
+type dsgnUnit struct {
+	Serial schdlSerial `json:"serial"`
+	Block  string      `json:"block,omitempty"`
+	Column string      `json:"column,omitempty"`
+}
+
+// Holds a treatment (a recipe applied daily from start time to stop time)
+type dsgnTreatment struct {
+	Name      string `json:"name"`
+	Recipe    string `json:"recipe"`
+	StartDate string `json:"start_date"`
+	StopDate  string `json:"stop_date"`
+	StartTime string `json:"start_time"`
+	StopTime  string `json:"stop_time"`
+}
+
+// Holds the experimental design (the seen fixtures are used if no inventory is given)
+type dsgnDesign struct {
+	Design     string          `json:"design"`
+	Seed       int64           `json:"seed,omitempty"`
+	Blocks     int             `json:"blocks,omitempty"`
+	Inventory  []dsgnUnit      `json:"inventory,omitempty"`
+	Treatments []dsgnTreatment `json:"treatments"`
+}
+
+// Holds the treatment assigned to a fixture
+type dsgnAssignment struct {
+	dsgnUnit
+	Treatment string `json:"treatment"`
+}
+
+// Holds the outcome of the randomisation (along with everything needed to reproduce it)
+type dsgnOutcome struct {
+	dsgnDesign
+	Assignments []dsgnAssignment `json:"assignments"`
+	Schedules   []schdlAttached  `json:"schedules"`
+	Created     uint32           `json:"created"`
+}
+
+// Randomises the assignment of fixtures to treatments and compiles the schedules
+func dsgnRandomise(design dsgnDesign, seen schdlSerials) (*dsgnOutcome, error) {
+	if len(design.Treatments) == 0 {
+		return nil, fmt.Errorf("No treatments given")
+	}
+	names := make(map[string]struct{})
+	for _, treatment := range design.Treatments {
+		if _, present := names[treatment.Name]; present || len(treatment.Name) == 0 {
+			return nil, fmt.Errorf("Treatment names must be unique and not empty (got %q)", treatment.Name)
+		}
+		names[treatment.Name] = struct{}{}
+	}
+	if design.Seed == 0 {
+		design.Seed = time.Now().UnixNano()
+	}
+	if len(design.Inventory) == 0 {
+		design.Inventory = dsgnInventory(design, seen)
+	}
+	if len(design.Inventory) == 0 {
+		return nil, fmt.Errorf("No fixtures to assign treatments to")
+	}
+	random := rand.New(rand.NewSource(design.Seed))
+	var assignments []dsgnAssignment
+	var fail error
+	switch design.Design {
+	case dsgnBlocks:
+		assignments, fail = dsgnAssignBlocks(design, random)
+	case dsgnLatinSquare:
+		assignments, fail = dsgnAssignLatinSquare(design, random)
+	default:
+		fail = fmt.Errorf("Unknown design %s (must be %s or %s)", design.Design, dsgnBlocks, dsgnLatinSquare)
+	}
+	if fail != nil {
+		return nil, fail
+	}
+	schedules, fail := dsgnCompile(design, assignments)
+	if fail != nil {
+		return nil, fail
+	}
+	return &dsgnOutcome{design, assignments, schedules, uint32(time.Now().Unix())}, nil
+}
+
+// Builds the inventory from the seen fixtures (split into consecutive blocks or laid out in a square)
+func dsgnInventory(design dsgnDesign, seen schdlSerials) []dsgnUnit {
+	serials := planUniqueSerials(append(schdlSerials{}, seen...))
+	units := make([]dsgnUnit, 0, len(serials))
+	if len(serials) == 0 {
+		return units
+	}
+	side := len(design.Treatments)
+	blocks := design.Blocks
+	if blocks <= 0 {
+		blocks = 1
+	}
+	size := (len(serials) + blocks - 1) / blocks
+	for index, serial := range serials {
+		unit := dsgnUnit{serial, strconv.Itoa(index/size + 1), ""}
+		if design.Design == dsgnLatinSquare {
+			unit = dsgnUnit{serial, strconv.Itoa(index/side + 1), strconv.Itoa(index%side + 1)}
+		}
+		units = append(units, unit)
+	}
+	return units
+}
+
+// Groups the units by a label (labels and units sorted)
+func dsgnGroup(units []dsgnUnit, label func(dsgnUnit) string) ([]string, map[string][]dsgnUnit) {
+	groups := make(map[string][]dsgnUnit)
+	labels := make([]string, 0)
+	for _, unit := range units {
+		key := label(unit)
+		if _, present := groups[key]; !present {
+			labels = append(labels, key)
+		}
+		groups[key] = append(groups[key], unit)
+	}
+	sort.Strings(labels)
+	for _, key := range labels {
+		group := groups[key]
+		sort.Slice(group, func(i, j int) bool { return group[i].Serial < group[j].Serial })
+	}
+	return labels, groups
+}
+
+// Assigns treatments by a randomised complete block design (each treatment equally often within every block)
+func dsgnAssignBlocks(design dsgnDesign, random *rand.Rand) ([]dsgnAssignment, error) {
+	count := len(design.Treatments)
+	labels, blocks := dsgnGroup(design.Inventory, func(unit dsgnUnit) string { return unit.Block })
+	assignments := make([]dsgnAssignment, 0, len(design.Inventory))
+	for _, label := range labels {
+		units := blocks[label]
+		if len(units)%count != 0 {
+			return nil, fmt.Errorf("Block %s has %d fixtures which is not a multiple of %d treatments", label, len(units), count)
+		}
+		order := make([]int, len(units))
+		for index := range order {
+			order[index] = index % count
+		}
+		random.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		for index, unit := range units {
+			assignments = append(assignments, dsgnAssignment{unit, design.Treatments[order[index]].Name})
+		}
+	}
+	return assignments, nil
+}
+
+// Assigns treatments by a Latin square design (each treatment once in every row and every column)
+func dsgnAssignLatinSquare(design dsgnDesign, random *rand.Rand) ([]dsgnAssignment, error) {
+	side := len(design.Treatments)
+	rows, _ := dsgnGroup(design.Inventory, func(unit dsgnUnit) string { return unit.Block })
+	columns, _ := dsgnGroup(design.Inventory, func(unit dsgnUnit) string { return unit.Column })
+	if len(rows) != side || len(columns) != side {
+		return nil, fmt.Errorf("Latin square of %d treatments needs %d rows & columns (got %d rows & %d columns)", side, side, len(rows), len(columns))
+	}
+	_, cells := dsgnGroup(design.Inventory, func(unit dsgnUnit) string { return unit.Block + "\x00" + unit.Column })
+	rowPermutation := random.Perm(side)
+	columnPermutation := random.Perm(side)
+	treatmentPermutation := random.Perm(side)
+	assignments := make([]dsgnAssignment, 0, len(design.Inventory))
+	for row, rowLabel := range rows {
+		for column, columnLabel := range columns {
+			units, present := cells[rowLabel+"\x00"+columnLabel]
+			if !present {
+				return nil, fmt.Errorf("Latin square has no fixture in row %s & column %s", rowLabel, columnLabel)
+			}
+			treatment := design.Treatments[treatmentPermutation[(rowPermutation[row]+columnPermutation[column])%side]]
+			for _, unit := range units {
+				assignments = append(assignments, dsgnAssignment{unit, treatment.Name})
+			}
+		}
+	}
+	return assignments, nil
+}
+
+// Compiles the assignment into schedules (one per treatment)
+func dsgnCompile(design dsgnDesign, assignments []dsgnAssignment) ([]schdlAttached, error) {
+	issues := make(planIssues, 0)
+	schedules := make([]schdlAttached, 0, len(design.Treatments))
+	for _, treatment := range design.Treatments {
+		start, failStart := schdlParseDate(treatment.StartDate, treatment.StartTime)
+		if failStart != nil {
+			issues.add("Treatment %s has invalid start (%s)", treatment.Name, failStart)
+		}
+		stop, failStop := schdlParseDate(treatment.StopDate, treatment.StopTime)
+		if failStop != nil {
+			issues.add("Treatment %s has invalid stop (%s)", treatment.Name, failStop)
+		}
+		recipe, fail := rcpGet(treatment.Recipe)
+		if fail != nil {
+			issues.add("Treatment %s refers to unknown recipe %s", treatment.Name, treatment.Recipe)
+		}
+		serials := make(schdlSerials, 0)
+		for _, assignment := range assignments {
+			if assignment.Treatment == treatment.Name {
+				serials = append(serials, assignment.Serial)
+			}
+		}
+		if len(serials) == 0 {
+			continue
+		}
+		schedule := schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: recipe.Levels, Mode: recipe.Mode, Modules: recipe.Modules, Recipe: treatment.Recipe, Units: recipe.Units}
+		schedules = append(schedules, schdlAttached{schdlDetached: schedule, Serials: planUniqueSerials(serials)})
+	}
+	if len(issues) != 0 {
+		return nil, issues
+	}
+	schedules, fail := phtnResolveSchedules(schedules)
+	if fail != nil {
+		return nil, fail
+	}
+	if _, fail := schdlAggregateSchedules(schedules, false); fail != nil {
+		return nil, fail
+	}
+	return schedules, nil
+}
+
+// Describes the outcome as comments of a schedule file
+func dsgnDescribe(outcome *dsgnOutcome) []string {
+	lines := []string{fmt.Sprintf("# Design %s, seed %d", outcome.Design, outcome.Seed)}
+	for _, assignment := range outcome.Assignments {
+		labels := []string{fmt.Sprintf("block %s", assignment.Block)}
+		if len(assignment.Column) != 0 {
+			labels = []string{fmt.Sprintf("row %s", assignment.Block), fmt.Sprintf("column %s", assignment.Column)}
+		}
+		lines = append(lines, fmt.Sprintf("# %d (%s): %s", assignment.Serial, strings.Join(labels, ", "), assignment.Treatment))
+	}
+	return lines
+}
+
+// Stores the outcome of the latest randomisation
+func dsgnStore(outcome *dsgnOutcome) error {
+	return dataWrite(dsgnStorage, outcome)
+}
+
+// Loads the outcome of the latest randomisation
+func dsgnLoad() (*dsgnOutcome, error) {
+	var outcome dsgnOutcome
+	if fail := dataRead(dsgnStorage, &outcome); fail != nil {
+		return nil, fail
+	}
+	return &outcome, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDsgnRandomise(t *testing.T) {
+	for _, recipe := range []rcpRecipe{{Name: "low", Levels: schdlLevels{0, 10, 10, 20, 5, 5}, Mode: schdlModePWM}, {Name: "high", Levels: schdlLevels{0, 40, 20, 80, 10, 30}, Mode: schdlModePWM}} {
+		if fail := rcpSave(recipe); fail != nil {
+			t.Fatalf("Failed to save recipe %s (%s)", recipe.Name, fail)
+		}
+	}
+	treatment := func(name, recipe string) dsgnTreatment {
+		return dsgnTreatment{name, recipe, "2021-03-15", "2021-04-30", "06:00", "22:00"}
+	}
+	two := []dsgnTreatment{treatment("control", "low"), treatment("boosted", "high")}
+	three := []dsgnTreatment{treatment("control", "low"), treatment("boosted", "high"), treatment("mixed", "low")}
+	seen := func(count int) schdlSerials {
+		serials := make(schdlSerials, 0, count)
+		for serial := schdlSerial(206001); len(serials) < count; serial++ {
+			serials = append(serials, serial)
+		}
+		return serials
+	}
+	cases := []struct {
+		design dsgnDesign
+		seen   schdlSerials
+		valid  bool
+	}{
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Blocks: 2, Treatments: two}, seen(8), true},
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Blocks: 3, Treatments: three}, seen(9), true},
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Inventory: []dsgnUnit{{206001, "A", ""}, {206002, "B", ""}, {206003, "A", ""}, {206004, "B", ""}}, Treatments: two}, nil, true},
+		{dsgnDesign{Design: dsgnLatinSquare, Seed: 7, Treatments: three}, seen(9), true},
+		{dsgnDesign{Design: dsgnLatinSquare, Seed: 11, Treatments: two}, seen(4), true},
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Blocks: 2, Treatments: two}, seen(6), false},
+		{dsgnDesign{Design: dsgnLatinSquare, Seed: 7, Treatments: three}, seen(8), false},
+		{dsgnDesign{Design: "split-plot", Seed: 7, Treatments: two}, seen(4), false},
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Treatments: []dsgnTreatment{treatment("control", "low"), treatment("control", "high")}}, seen(4), false},
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Treatments: []dsgnTreatment{treatment("control", "unknown")}}, seen(4), false},
+		{dsgnDesign{Design: dsgnBlocks, Seed: 7, Treatments: two}, nil, false},
+	}
+	for index, tested := range cases {
+		outcome, fail := dsgnRandomise(tested.design, tested.seen)
+		if !tested.valid {
+			if fail == nil {
+				t.Errorf("Case %d: assigned %v (expecting a failure)", index, outcome.Assignments)
+			}
+			continue
+		}
+		if fail != nil {
+			t.Errorf("Case %d: %s", index, fail)
+			continue
+		}
+		if again, _ := dsgnRandomise(tested.design, tested.seen); again == nil || !reflect.DeepEqual(again.Assignments, outcome.Assignments) {
+			t.Errorf("Case %d: the same seed assigned differently", index)
+		}
+		// Every treatment must be assigned equally often within each block (and each column of a square)
+		count := len(tested.design.Treatments)
+		assigned := make(map[string]schdlSerials)
+		blocks := make(map[string]map[string]int)
+		columns := make(map[string]map[string]int)
+		for _, assignment := range outcome.Assignments {
+			assigned[assignment.Treatment] = append(assigned[assignment.Treatment], assignment.Serial)
+			if blocks[assignment.Block] == nil {
+				blocks[assignment.Block] = make(map[string]int)
+			}
+			blocks[assignment.Block][assignment.Treatment]++
+			if tested.design.Design == dsgnLatinSquare {
+				if columns[assignment.Column] == nil {
+					columns[assignment.Column] = make(map[string]int)
+				}
+				columns[assignment.Column][assignment.Treatment]++
+			}
+		}
+		for _, groups := range []map[string]map[string]int{blocks, columns} {
+			for label, treatments := range groups {
+				size := 0
+				for _, times := range treatments {
+					size += times
+				}
+				for _, times := range treatments {
+					if len(treatments) != count || times != size/count {
+						t.Errorf("Case %d: group %s got treatments %v", index, label, treatments)
+						break
+					}
+				}
+			}
+		}
+		if len(outcome.Schedules) != count {
+			t.Errorf("Case %d: compiled %d schedules (expecting %d)", index, len(outcome.Schedules), count)
+			continue
+		}
+		for position, schedule := range outcome.Schedules {
+			treated := tested.design.Treatments[position]
+			if schedule.Recipe != treated.Recipe || !reflect.DeepEqual(schedule.Serials, planUniqueSerials(assigned[treated.Name])) {
+				t.Errorf("Case %d: treatment %s compiled into %+v", index, treated.Name, schedule)
+			}
+		}
+	}
+}
@@ -3,9 +3,11 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"log"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
@@ -46,6 +48,7 @@ func dscvr1Init(logger *log.Logger, conditioning bool) *dscvr1Discoverer {
 	go discoverer.dscvr1Process()
 	go discoverer.dscvr1ProbeRoutine()
 	go discoverer.dscvr1ForgettingRoutine()
+	mtrcRegister(discoverer.dscvr1Collect)
 	return discoverer
 }
 
@@ -64,6 +67,7 @@ func (discoverer *dscvr1Discoverer) dscvr1Process() {
 				adapter := dptr1Init(discoverer.logger, observation.address, port)
 				if _, loaded := discoverer.adapters.LoadOrStore(identifier, adapter); !loaded {
 					adapter.dptr1Activate(discoverer.conditioning)
+					evntPublish(evntTopicAdapterDiscovered, identifier, 0, nil)
 				}
 			}
 		}
@@ -111,7 +115,7 @@ func dscvr1Count(buffer *[]byte) int {
 }
 
 // Waits for any fixtures to be present
-func (discoverer *dscvr1Discoverer) dscvr1WaitForAnySerials(timeout time.Duration) bool {
+func (discoverer *dscvr1Discoverer) dscvr1WaitForAnySerials(ctx context.Context, timeout time.Duration) bool {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
 		found := false
@@ -122,13 +126,42 @@ func (discoverer *dscvr1Discoverer) dscvr1WaitForAnySerials(timeout time.Duratio
 		if found {
 			return true
 		}
-		time.Sleep(time.Second)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
 	}
 	return false
 }
 
-// Waits for fixtures with given serial numbers to be present
-func (discoverer *dscvr1Discoverer) dscvr1WaitForSerials(serials schdlSerials, timeout time.Duration) bool {
+// Waits for the fixtures to be reported before they get listed - for any to be present and then (for a discovery
+// interval at most) for every adapter discovered to have probed its bus, instead of listing those of the first one only
+func (discoverer *dscvr1Discoverer) dscvr1WaitForDiscovery(ctx context.Context) bool {
+	if !discoverer.dscvr1WaitForAnySerials(ctx, dscvr1DiscoveryInterval) {
+		return false
+	}
+	deadline := time.Now().Add(dscvr1DiscoveryInterval)
+	for time.Now().Before(deadline) {
+		settled := true
+		discoverer.adapters.Range(func(key, value interface{}) bool {
+			settled = value.(*dptr1Adapter).dptr1Settled()
+			return settled
+		})
+		if settled {
+			break
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Waits for fixtures with given serial numbers to be present (gives up once canceled)
+func (discoverer *dscvr1Discoverer) dscvr1WaitForSerials(ctx context.Context, serials schdlSerials, timeout time.Duration) bool {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
 		seenSetAll := make(map[schdlSerial]struct{})
@@ -149,17 +182,21 @@ func (discoverer *dscvr1Discoverer) dscvr1WaitForSerials(serials schdlSerials, t
 		if seenAll {
 			return true
 		}
-		time.Sleep(time.Second)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
 	}
 	return false
 }
 
 // Waits for fixtures to be present
-func (discoverer *dscvr1Discoverer) dscvr1WaitForSerial(serial schdlSerial, timeout time.Duration) bool {
+func (discoverer *dscvr1Discoverer) dscvr1WaitForSerial(ctx context.Context, serial schdlSerial, timeout time.Duration) bool {
 	if serial == 0 {
-		return discoverer.dscvr1WaitForAnySerials(timeout)
+		return discoverer.dscvr1WaitForAnySerials(ctx, timeout)
 	}
-	return discoverer.dscvr1WaitForSerials(schdlSerials{serial}, timeout)
+	return discoverer.dscvr1WaitForSerials(ctx, schdlSerials{serial}, timeout)
 }
 
 // Looks up the adapter where fixture with given serial is attached to
@@ -175,6 +212,17 @@ func (discoverer *dscvr1Discoverer) dscvr1LookUp(serial schdlSerial) []*dptr1Ada
 	return adapters
 }
 
+// Lists the known adapters (ordered by identifier)
+func (discoverer *dscvr1Discoverer) dscvr1ListAdapters() []*dptr1Adapter {
+	adapters := make([]*dptr1Adapter, 0)
+	discoverer.adapters.Range(func(key, value interface{}) bool {
+		adapters = append(adapters, value.(*dptr1Adapter))
+		return true
+	})
+	sort.Slice(adapters, func(i, j int) bool { return adapters[i].adapterID < adapters[j].adapterID })
+	return adapters
+}
+
 // Used by the discoverer to send periodically a discovery request
 func (discoverer *dscvr1Discoverer) dscvr1ProbeRoutine() {
 	hexedDiscoveryRequest := hex.EncodeToString(dscvr1DiscoveryRequest)
@@ -203,11 +251,24 @@ func (discoverer *dscvr1Discoverer) dscvr1ForgettingRoutine() {
 			now := time.Now()
 			// Removes adapters which did not make contact for too long
 			discoverer.adapters.Range(func(key, value interface{}) bool {
-				if now.Sub(value.(*dptr1Adapter).lastSeen) > 5*dscvr1DiscoveryInterval {
+				if adapter := value.(*dptr1Adapter); now.Sub(adapter.dptr1LastSeen()) > 5*dscvr1DiscoveryInterval {
 					discoverer.adapters.Delete(key)
+					adapter.dptr1ReassociateAll(make(map[schdlSerial]pckt1ShortAddress))
+					evntPublish(evntTopicAdapterForgotten, adapter.adapterID, 0, nil)
+					mtrcForget("adapter", string(adapter.adapterID))
 				}
 				return true
 			})
 		}
 	}
 }
+
+// Reports the adapters along with the fixtures seen & the packets queued (when the metrics get scraped)
+func (discoverer *dscvr1Discoverer) dscvr1Collect(report mtrcReport) {
+	adapters := discoverer.dscvr1ListAdapters()
+	report(mtrcAdapters, float64(len(adapters)))
+	for _, adapter := range adapters {
+		report(mtrcFixturesSeen, float64(len(adapter.dptr1ListSeenSerials())), "adapter", string(adapter.adapterID))
+		report(mtrcOutboxDepth, float64(len(adapter.outbox)), "adapter", string(adapter.adapterID))
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDscvr1WaitCanceled(t *testing.T) {
+	discoverer := &dscvr1Discoverer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	if discoverer.dscvr1WaitForSerial(ctx, 206001, time.Minute) {
+		t.Errorf("Unseen fixture reported as present")
+	}
+	if waited := time.Since(started); waited > 5*time.Second {
+		t.Errorf("Waited %s once canceled", waited)
+	}
+	if discoverer.dscvr1WaitForAnySerials(ctx, time.Minute) {
+		t.Errorf("Fixtures reported as present")
+	}
+}
+
+func TestDscvr1WaitForDiscovery(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	discoverer := &dscvr1Discoverer{logger: logger}
+	first := dptr1Init(logger, net.IPv4(127, 0, 0, 1), 1)
+	first.dptr1ReassociateAll(map[schdlSerial]pckt1ShortAddress{206001: 1})
+	atomic.StoreInt32(&first.settled, 1)
+	second := dptr1Init(logger, net.IPv4(127, 0, 0, 2), 1)
+	discoverer.adapters.Store(first.adapterID, first)
+	discoverer.adapters.Store(second.adapterID, second)
+	time.AfterFunc(1500*time.Millisecond, func() {
+		second.dptr1ReassociateAll(map[schdlSerial]pckt1ShortAddress{206002: 1})
+		atomic.StoreInt32(&second.settled, 1)
+	})
+	started := time.Now()
+	if !discoverer.dscvr1WaitForDiscovery(context.Background()) {
+		t.Errorf("Fixtures reported as missing")
+	}
+	if waited := time.Since(started); waited < time.Second || waited > dscvr1DiscoveryInterval/2 {
+		t.Errorf("Waited %s for the second adapter to probe its bus", waited)
+	}
+	if serials := len(second.dptr1ListSeenSerials()); serials != 1 {
+		t.Errorf("Second adapter reported %d fixtures", serials)
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code publishes the internal events and streams them to the clients (over SSE or WebSocket)
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	evntTopicAdapterDiscovered  = "adapter.discovered"
+	evntTopicAdapterForgotten   = "adapter.forgotten"
+	evntTopicFixtureSeen        = "fixture.seen"
+	evntTopicFixtureLost        = "fixture.lost"
+	evntTopicFixtureReaddressed = "fixture.readdressed"
+	evntTopicCommandSent        = "command.sent"
+	evntTopicCommandReplied     = "command.replied"
+	evntTopicCommandFailed      = "command.failed"
+	evntTopicTemperature        = "temperature"
+	evntTopicConditioning       = "conditioning"
+	evntTopicDropped            = "events.dropped"
+	evntBuffer                  = 256              // Events queued per client (the further ones get dropped)
+	evntKeepAlive               = 15 * time.Second // Interval of the keep-alive messages
+	evntWebSocketGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	evntWebSocketLimit          = 1 << 16 // Largest frame accepted from a client
+)
+
+// Holds an event
+type evntEvent struct {
+	Topic   string          `json:"topic"`
+	Time    uint32          `json:"time"`
+	Adapter dptr1Identifier `json:"adapter,omitempty"`
+	Serial  schdlSerial     `json:"serial,omitempty"`
+	Data    interface{}     `json:"data,omitempty"`
+}
+
+// Details of a fixture (re)addressed on the bus
+type evntAddress struct {
+	ShortAddress pckt1ShortAddress `json:"short_address"`
+	Previous     pckt1ShortAddress `json:"previous,omitempty"`
+}
+
+// Details of a failed command
+type evntFailure struct {
+	ShortAddress pckt1ShortAddress `json:"short_address"`
+	FunctionCode pckt1FunctionCode `json:"function_code"`
+	Error        string            `json:"error"`
+}
+
+// Outcome of the conditioning of a fixture
+type evntConditioning struct {
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Holds a client listening to the events
+type evntSubscription struct {
+	topics  []string
+	events  chan evntEvent
+	dropped uint32
+}
+
+// Delivers the events to the subscriptions
+type evntBus struct {
+	lock          sync.Mutex
+	subscriptions map[*evntSubscription]struct{}
+}
+
+var evntDefault = &evntBus{subscriptions: make(map[*evntSubscription]struct{})}
+
+// Tells if the topic is among the ones requested (a topic also matches its sub-topics, all match if none are requested)
+func evntMatch(topics []string, topic string) bool {
+	if len(topics) == 0 {
+		return true
+	}
+	for _, filter := range topics {
+		if filter == "*" || filter == topic || strings.HasPrefix(topic, filter+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Publishes an event (never blocks - slow clients miss events)
+func evntPublish(topic string, adapterID dptr1Identifier, serial schdlSerial, data interface{}) {
+	evntDefault.lock.Lock()
+	defer evntDefault.lock.Unlock()
+	if len(evntDefault.subscriptions) == 0 {
+		return
+	}
+	event := evntEvent{topic, uint32(time.Now().Unix()), adapterID, serial, data}
+	for subscription := range evntDefault.subscriptions {
+		if !evntMatch(subscription.topics, topic) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint32(&subscription.dropped, 1)
+		}
+	}
+}
+
+// Subscribes to the events of the given topics
+func evntSubscribe(topics []string) *evntSubscription {
+	subscription := &evntSubscription{topics, make(chan evntEvent, evntBuffer), 0}
+	evntDefault.lock.Lock()
+	evntDefault.subscriptions[subscription] = struct{}{}
+	evntDefault.lock.Unlock()
+	return subscription
+}
+
+// Unsubscribes from the events
+func evntUnsubscribe(subscription *evntSubscription) {
+	evntDefault.lock.Lock()
+	delete(evntDefault.subscriptions, subscription)
+	evntDefault.lock.Unlock()
+}
+
+// Reports the events dropped since the last report (if any)
+func (subscription *evntSubscription) evntTakeDropped() (evntEvent, bool) {
+	dropped := atomic.SwapUint32(&subscription.dropped, 0)
+	if dropped == 0 {
+		return evntEvent{}, false
+	}
+	return evntEvent{evntTopicDropped, uint32(time.Now().Unix()), "", 0, dropped}, true
+}
+
+// Parses the requested topics (comma separated, possibly repeated)
+func evntParseTopics(request *http.Request) []string {
+	topics := make([]string, 0)
+	for _, value := range request.URL.Query()["topics"] {
+		for _, topic := range strings.Split(value, ",") {
+			if topic = strings.TrimSpace(topic); len(topic) != 0 {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	return topics
+}
+
+// Lists the origins of the web pages allowed to open the WebSocket besides the API's own (comma-separated, "*" for any)
+func evntAllowedOrigins() []string {
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(os.Getenv("PHYTOFY_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); len(origin) != 0 {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// Tells if the web page opening the WebSocket may do so - browsers do not restrict WebSocket to the same origin (clients
+// other than browsers send no origin)
+func evntOriginAllowed(request *http.Request, allowed []string) bool {
+	origin := request.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if parsed, fail := url.Parse(origin); fail == nil && strings.EqualFold(parsed.Host, request.Host) {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Streams the events to a client (over WebSocket if the client asks for an upgrade, otherwise over SSE)
+func evntHandler(logger *log.Logger) http.HandlerFunc {
+	allowed := evntAllowedOrigins()
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		logger.Printf("INFO: %s %s events", request.Method, request.URL.Path) // The query may hold a token
+		topics := evntParseTopics(request)
+		if strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+			if !evntOriginAllowed(request, allowed) {
+				logger.Printf("WARNING: WebSocket refused to origin %s", request.Header.Get("Origin"))
+				http.Error(response, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			evntServeWebSocket(response, request, topics, logger)
+		} else {
+			evntServeSSE(response, request, topics, logger)
+		}
+	})
+}
+
+// Streams the events as Server-Sent Events
+func evntServeSSE(response http.ResponseWriter, request *http.Request, topics []string, logger *log.Logger) {
+	flusher, canFlush := response.(http.Flusher)
+	if !canFlush {
+		http.Error(response, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	subscription := evntSubscribe(topics)
+	defer evntUnsubscribe(subscription)
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("Connection", "keep-alive")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(evntKeepAlive)
+	defer keepAlive.Stop()
+	send := func(event evntEvent) error {
+		data, fail := json.Marshal(&event)
+		if fail != nil {
+			return fail
+		}
+		_, fail = fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event.Topic, data)
+		return fail
+	}
+	for {
+		var fail error
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, fail = io.WriteString(response, ": keep-alive\n\n")
+		case event := <-subscription.events:
+			if dropped, present := subscription.evntTakeDropped(); present {
+				fail = send(dropped)
+			}
+			if fail == nil {
+				fail = send(event)
+			}
+		}
+		if fail != nil {
+			logger.Printf("INFO: Event stream closed (%s)", fail)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Streams the events over WebSocket as text messages (the messages from the client are ignored)
+func evntServeWebSocket(response http.ResponseWriter, request *http.Request, topics []string, logger *log.Logger) {
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 || request.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(response, "Unsupported WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	hijacker, canHijack := response.(http.Hijacker)
+	if !canHijack {
+		http.Error(response, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	connection, buffered, fail := hijacker.Hijack()
+	if fail != nil {
+		logger.Printf("ERROR: Failed to take over the connection (%s)", fail)
+		return
+	}
+	defer connection.Close()
+	digest := sha1.Sum([]byte(key + evntWebSocketGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(digest[:]) + "\r\n\r\n"
+	if _, fail := buffered.WriteString(handshake); fail != nil {
+		return
+	}
+	if fail := buffered.Flush(); fail != nil {
+		return
+	}
+	subscription := evntSubscribe(topics)
+	defer evntUnsubscribe(subscription)
+	var lock sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if fail := evntWriteFrame(buffered.Writer, opcode, payload); fail != nil {
+			return fail
+		}
+		return buffered.Flush()
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, fail := evntReadFrame(buffered.Reader)
+			if fail != nil {
+				return
+			}
+			switch opcode {
+			case 0x8:
+				write(0x8, payload)
+				return
+			case 0x9:
+				write(0xA, payload)
+			}
+		}
+	}()
+	keepAlive := time.NewTicker(evntKeepAlive)
+	defer keepAlive.Stop()
+	send := func(event evntEvent) error {
+		data, fail := json.Marshal(&event)
+		if fail != nil {
+			return fail
+		}
+		return write(0x1, data)
+	}
+	for {
+		var fail error
+		select {
+		case <-closed:
+			return
+		case <-keepAlive.C:
+			fail = write(0x9, nil)
+		case event := <-subscription.events:
+			if dropped, present := subscription.evntTakeDropped(); present {
+				fail = send(dropped)
+			}
+			if fail == nil {
+				fail = send(event)
+			}
+		}
+		if fail != nil {
+			logger.Printf("INFO: Event stream closed (%s)", fail)
+			return
+		}
+	}
+}
+
+// Writes an unfragmented & unmasked WebSocket frame
+func evntWriteFrame(writer *bufio.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, fail := writer.Write(header); fail != nil {
+		return fail
+	}
+	_, fail := writer.Write(payload)
+	return fail
+}
+
+// Reads a WebSocket frame sent by a client (unmasking its payload)
+func evntReadFrame(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, fail := io.ReadFull(reader, header); fail != nil {
+		return 0, nil, fail
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, fail := io.ReadFull(reader, extended); fail != nil {
+			return 0, nil, fail
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, fail := io.ReadFull(reader, extended); fail != nil {
+			return 0, nil, fail
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > evntWebSocketLimit {
+		return 0, nil, fmt.Errorf("Frame of %d bytes too large", length)
+	}
+	mask := make([]byte, 4)
+	if masked {
+		if _, fail := io.ReadFull(reader, mask); fail != nil {
+			return 0, nil, fail
+		}
+	}
+	payload := make([]byte, length)
+	if _, fail := io.ReadFull(reader, payload); fail != nil {
+		return 0, nil, fail
+	}
+	for index := range payload {
+		payload[index] ^= mask[index%4]
+	}
+	return opcode, payload, nil
+}
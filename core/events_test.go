@@ -0,0 +1,80 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestEvntFrameRoundTrip(t *testing.T) {
+	for _, length := range []int{0, 1, 125, 126, 0xFFFF, 0x10000} {
+		payload := bytes.Repeat([]byte{'x'}, length)
+		var buffer bytes.Buffer
+		writer := bufio.NewWriter(&buffer)
+		if fail := evntWriteFrame(writer, 0x1, payload); fail != nil {
+			t.Fatalf("%d bytes: %s", length, fail)
+		}
+		writer.Flush()
+		opcode, read, fail := evntReadFrame(bufio.NewReader(&buffer))
+		if fail != nil {
+			t.Errorf("%d bytes: %s", length, fail)
+		} else if opcode != 0x1 || !bytes.Equal(read, payload) {
+			t.Errorf("%d bytes: read opcode %d & %d bytes", length, opcode, len(read))
+		}
+	}
+}
+
+func TestEvntReadFrame(t *testing.T) {
+	cases := []struct {
+		frame   []byte
+		opcode  byte
+		payload []byte // Nil if failing
+	}{
+		{[]byte{0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1}, 0x1, []byte("hello")},
+		{[]byte{0x89, 0x80, 1, 2, 3, 4}, 0x9, []byte{}},
+		{[]byte{0x88, 0x02, 0x03, 0xE8}, 0x8, []byte{0x03, 0xE8}},
+		{[]byte{0x81, 0xFF, 0, 0, 0, 0, 0, 1, 0, 1}, 0, nil},
+		{[]byte{0x81, 0x85, 1, 2}, 0, nil},
+		{[]byte{0x81}, 0, nil},
+	}
+	for index, tested := range cases {
+		opcode, payload, fail := evntReadFrame(bufio.NewReader(bytes.NewReader(tested.frame)))
+		switch {
+		case tested.payload == nil && fail == nil:
+			t.Errorf("Case #%d: read %d bytes (expecting a failure)", index+1, len(payload))
+		case tested.payload != nil && fail != nil:
+			t.Errorf("Case #%d: %s", index+1, fail)
+		case tested.payload != nil && (opcode != tested.opcode || !bytes.Equal(payload, tested.payload)):
+			t.Errorf("Case #%d: read opcode %d & %v (expecting %d & %v)", index+1, opcode, payload, tested.opcode, tested.payload)
+		}
+	}
+}
+
+func TestEvntOriginAllowed(t *testing.T) {
+	cases := []struct {
+		origin  string
+		allowed []string
+		expect  bool
+	}{
+		{"", nil, true},
+		{"http://greenhouse-pc:8080", nil, true},
+		{"https://GREENHOUSE-PC:8080", nil, true},
+		{"http://greenhouse-pc:9090", nil, false},
+		{"https://evil.example", nil, false},
+		{"https://dashboard.example", []string{"https://dashboard.example"}, true},
+		{"https://evil.example", []string{"https://dashboard.example"}, false},
+		{"https://evil.example", []string{"*"}, true},
+		{"null", nil, false},
+	}
+	for _, tested := range cases {
+		request, _ := http.NewRequest(http.MethodGet, "http://greenhouse-pc:8080/api/events", nil)
+		if len(tested.origin) != 0 {
+			request.Header.Set("Origin", tested.origin)
+		}
+		if allowed := evntOriginAllowed(request, tested.allowed); allowed != tested.expect {
+			t.Errorf("%q %v: allowed %t (expecting %t)", tested.origin, tested.allowed, allowed, tested.expect)
+		}
+	}
+}
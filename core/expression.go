@@ -0,0 +1,233 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for arithmetic expressions of the host scheduler programs
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Holds the variables (and the source of randomness) an expression is evaluated with
+type exprEnvironment struct {
+	variables map[string]float64
+	random    *rand.Rand
+}
+
+// Evaluates a compiled expression
+type exprNode func(environment *exprEnvironment) float64
+
+// Describes a function available in the expressions
+type exprFunction struct {
+	arity    int
+	evaluate func(arguments []float64, environment *exprEnvironment) float64
+}
+
+// Variables available in the expressions
+var exprVariables = map[string]struct{}{
+	"t":   {}, // Seconds since midnight (UTC)
+	"h":   {}, // Hours since midnight (UTC, fractional)
+	"d":   {}, // Days since the program started
+	"doy": {}, // Day of the year
+	"pi":  {},
+}
+
+// Functions available in the expressions
+var exprFunctions = map[string]exprFunction{
+	"min":   {2, func(a []float64, _ *exprEnvironment) float64 { return math.Min(a[0], a[1]) }},
+	"max":   {2, func(a []float64, _ *exprEnvironment) float64 { return math.Max(a[0], a[1]) }},
+	"clamp": {3, func(a []float64, _ *exprEnvironment) float64 { return math.Max(a[1], math.Min(a[2], a[0])) }},
+	"abs":   {1, func(a []float64, _ *exprEnvironment) float64 { return math.Abs(a[0]) }},
+	"floor": {1, func(a []float64, _ *exprEnvironment) float64 { return math.Floor(a[0]) }},
+	"sin":   {1, func(a []float64, _ *exprEnvironment) float64 { return math.Sin(a[0]) }},
+	"cos":   {1, func(a []float64, _ *exprEnvironment) float64 { return math.Cos(a[0]) }},
+	// Linear ramp of x from (x0, y0) to (x1, y1), constant outside
+	"ramp": {5, func(a []float64, _ *exprEnvironment) float64 {
+		x, x0, x1, y0, y1 := a[0], a[1], a[2], a[3], a[4]
+		if x <= x0 || x1 <= x0 {
+			return y0
+		}
+		if x >= x1 {
+			return y1
+		}
+		return y0 + (y1-y0)*(x-x0)/(x1-x0)
+	}},
+	// 1 if from <= x < to, 0 otherwise
+	"pulse": {3, func(a []float64, _ *exprEnvironment) float64 {
+		if a[0] >= a[1] && a[0] < a[2] {
+			return 1
+		}
+		return 0
+	}},
+	// Uniformly distributed value from low to high
+	"rand": {2, func(a []float64, environment *exprEnvironment) float64 {
+		return a[0] + (a[1]-a[0])*environment.random.Float64()
+	}},
+}
+
+// Parses the text of an expression
+type exprParser struct {
+	text     string
+	position int
+}
+
+// Compiles an expression (e.g. "ramp(h, 6, 7, 0, 50) * pulse(h, 6, 22)")
+func exprCompile(text string) (exprNode, error) {
+	parser := &exprParser{text, 0}
+	node, fail := parser.parseSum()
+	if fail == nil && parser.peek() != 0 {
+		fail = parser.failure("Unexpected %q", string(parser.peek()))
+	}
+	if fail != nil {
+		return nil, fmt.Errorf("Invalid expression %q (%s)", text, fail)
+	}
+	return node, nil
+}
+
+// Returns the next significant character (0 at the end)
+func (parser *exprParser) peek() byte {
+	for parser.position < len(parser.text) && parser.text[parser.position] == ' ' {
+		parser.position++
+	}
+	if parser.position == len(parser.text) {
+		return 0
+	}
+	return parser.text[parser.position]
+}
+
+func (parser *exprParser) failure(format string, arguments ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, arguments...), parser.position+1)
+}
+
+func (parser *exprParser) parseSum() (exprNode, error) {
+	left, fail := parser.parseProduct()
+	for fail == nil && (parser.peek() == '+' || parser.peek() == '-') {
+		operator := parser.peek()
+		parser.position++
+		var right exprNode
+		if right, fail = parser.parseProduct(); fail == nil {
+			leftOperand := left
+			if operator == '+' {
+				left = func(environment *exprEnvironment) float64 { return leftOperand(environment) + right(environment) }
+			} else {
+				left = func(environment *exprEnvironment) float64 { return leftOperand(environment) - right(environment) }
+			}
+		}
+	}
+	return left, fail
+}
+
+func (parser *exprParser) parseProduct() (exprNode, error) {
+	left, fail := parser.parseUnary()
+	for fail == nil && (parser.peek() == '*' || parser.peek() == '/') {
+		operator := parser.peek()
+		parser.position++
+		var right exprNode
+		if right, fail = parser.parseUnary(); fail == nil {
+			leftOperand := left
+			if operator == '*' {
+				left = func(environment *exprEnvironment) float64 { return leftOperand(environment) * right(environment) }
+			} else {
+				left = func(environment *exprEnvironment) float64 {
+					divisor := right(environment)
+					if divisor == 0 {
+						return 0
+					}
+					return leftOperand(environment) / divisor
+				}
+			}
+		}
+	}
+	return left, fail
+}
+
+func (parser *exprParser) parseUnary() (exprNode, error) {
+	if parser.peek() == '-' {
+		parser.position++
+		operand, fail := parser.parseUnary()
+		if fail != nil {
+			return nil, fail
+		}
+		return func(environment *exprEnvironment) float64 { return -operand(environment) }, nil
+	}
+	return parser.parsePrimary()
+}
+
+func (parser *exprParser) parsePrimary() (exprNode, error) {
+	next := parser.peek()
+	switch {
+	case next == '(':
+		parser.position++
+		node, fail := parser.parseSum()
+		if fail != nil {
+			return nil, fail
+		}
+		if parser.peek() != ')' {
+			return nil, parser.failure("Missing )")
+		}
+		parser.position++
+		return node, nil
+	case next == '.' || unicode.IsDigit(rune(next)):
+		start := parser.position
+		for parser.position < len(parser.text) && (parser.text[parser.position] == '.' || unicode.IsDigit(rune(parser.text[parser.position]))) {
+			parser.position++
+		}
+		value, fail := strconv.ParseFloat(parser.text[start:parser.position], 64)
+		if fail != nil {
+			return nil, parser.failure("Invalid number %s", parser.text[start:parser.position])
+		}
+		return func(*exprEnvironment) float64 { return value }, nil
+	case unicode.IsLetter(rune(next)):
+		start := parser.position
+		for parser.position < len(parser.text) && (unicode.IsLetter(rune(parser.text[parser.position])) || unicode.IsDigit(rune(parser.text[parser.position]))) {
+			parser.position++
+		}
+		name := strings.ToLower(parser.text[start:parser.position])
+		if parser.peek() == '(' {
+			return parser.parseCall(name)
+		}
+		if _, present := exprVariables[name]; !present {
+			return nil, parser.failure("Unknown variable %s", name)
+		}
+		return func(environment *exprEnvironment) float64 { return environment.variables[name] }, nil
+	case next == 0:
+		return nil, parser.failure("Unexpected end")
+	}
+	return nil, parser.failure("Unexpected %q", string(next))
+}
+
+func (parser *exprParser) parseCall(name string) (exprNode, error) {
+	function, present := exprFunctions[name]
+	if !present {
+		return nil, parser.failure("Unknown function %s", name)
+	}
+	parser.position++
+	arguments := make([]exprNode, 0)
+	for parser.peek() != ')' {
+		if len(arguments) != 0 {
+			if parser.peek() != ',' {
+				return nil, parser.failure("Missing , or )")
+			}
+			parser.position++
+		}
+		argument, fail := parser.parseSum()
+		if fail != nil {
+			return nil, fail
+		}
+		arguments = append(arguments, argument)
+	}
+	parser.position++
+	if len(arguments) != function.arity {
+		return nil, parser.failure("Function %s takes %d arguments (got %d)", name, function.arity, len(arguments))
+	}
+	return func(environment *exprEnvironment) float64 {
+		values := make([]float64, len(arguments))
+		for index, argument := range arguments {
+			values[index] = argument(environment)
+		}
+		return function.evaluate(values, environment)
+	}, nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for the version history of the schedules applied to the fixtures
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hstrDirectory   = "history"
+	hstrStorageLock = "history.lock" // Shared with the other processes (e.g. the CLI importing while the daemon applies)
+)
+
+// Guards the version history (within the process)
+var hstrLock sync.Mutex
+
+// Holds a version of the schedules of the fleet (the resulting schedules of every fixture after applying a schedule set)
+type hstrVersion struct {
+	Version   uint32          `json:"version"`
+	Author    string          `json:"author,omitempty"`
+	Created   uint32          `json:"created"`
+	Source    string          `json:"source,omitempty"`
+	Serials   schdlSerials    `json:"serials"`
+	Programme schdlAggregated `json:"programme"`
+}
+
+// Summarizes a version (without the schedules)
+type hstrSummary struct {
+	Version   uint32       `json:"version"`
+	Author    string       `json:"author,omitempty"`
+	Created   uint32       `json:"created"`
+	Source    string       `json:"source,omitempty"`
+	Serials   schdlSerials `json:"serials"`
+	Fixtures  int          `json:"fixtures"`
+	Schedules int          `json:"schedules"`
+}
+
+// Describes how the schedules of a fixture differ between versions
+type hstrChange struct {
+	Serial  schdlSerial     `json:"serial"`
+	Added   []schdlDetached `json:"added"`
+	Removed []schdlDetached `json:"removed"`
+}
+
+// Describes how two versions differ
+type hstrDiff struct {
+	From      uint32       `json:"from"`
+	To        uint32       `json:"to"`
+	Changes   []hstrChange `json:"changes"`
+	Unchanged schdlSerials `json:"unchanged"`
+}
+
+// Describes how to bring the fixtures to a version (fixtures already matching are left alone)
+type hstrReconciliation struct {
+	Apply     schdlSerials `json:"apply"`
+	Clear     schdlSerials `json:"clear"`
+	Unchanged schdlSerials `json:"unchanged"`
+}
+
+// Names the file holding a version
+func hstrFile(version uint32) string {
+	return path.Join(hstrDirectory, fmt.Sprintf("%06d.json", version))
+}
+
+// Lists the stored version numbers (ascending)
+func hstrVersions() ([]uint32, error) {
+	names, fail := dataList(hstrDirectory)
+	if fail != nil {
+		return nil, fail
+	}
+	versions := make([]uint32, 0, len(names))
+	for _, name := range names {
+		if version, fail := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 32); fail == nil && strings.HasSuffix(name, ".json") {
+			versions = append(versions, uint32(version))
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// Loads a version (the latest one if zero - an empty version if there is none)
+func hstrLoad(version uint32) (*hstrVersion, error) {
+	if version == 0 {
+		versions, fail := hstrVersions()
+		if fail != nil {
+			return nil, fail
+		}
+		if len(versions) == 0 {
+			return &hstrVersion{Serials: schdlSerials{}, Programme: schdlAggregated{}}, nil
+		}
+		version = versions[len(versions)-1]
+	}
+	var loaded hstrVersion
+	if fail := dataRead(hstrFile(version), &loaded); fail != nil {
+		if os.IsNotExist(fail) {
+			return nil, fmt.Errorf("Unknown version %d", version)
+		}
+		return nil, fail
+	}
+	return &loaded, nil
+}
+
+// Tells who applies the schedules (the user running the application unless given)
+func hstrAuthor(author string) string {
+	if len(author) != 0 {
+		return author
+	}
+	if current, fail := user.Current(); fail == nil {
+		return current.Username
+	}
+	return ""
+}
+
+// Records a version with the programme of the given fixtures replaced (the schedules of the other fixtures are kept)
+func hstrRecord(schedules []schdlAttached, source, author string) (*hstrVersion, error) {
+	aggregated, fail := schdlAggregateSchedules(schedules, false)
+	if fail != nil {
+		return nil, fail
+	}
+	return hstrStore(aggregated, false, source, author)
+}
+
+// Stores the next version (the programme either replaces the one of the listed fixtures or the whole one)
+func hstrStore(programme schdlAggregated, whole bool, source, author string) (*hstrVersion, error) {
+	hstrLock.Lock()
+	defer hstrLock.Unlock()
+	release, fail := dataLock(hstrStorageLock)
+	if fail != nil {
+		return nil, fail
+	}
+	defer release()
+	latest, fail := hstrLoad(0)
+	if fail != nil {
+		return nil, fail
+	}
+	serials := make(schdlSerials, 0, len(programme))
+	for serial := range programme {
+		serials = append(serials, serial)
+	}
+	merged := make(schdlAggregated)
+	if !whole {
+		for serial, entries := range latest.Programme {
+			merged[serial] = entries
+		}
+	} else {
+		for serial := range latest.Programme {
+			if _, present := programme[serial]; !present {
+				serials = append(serials, serial)
+			}
+		}
+	}
+	for serial, entries := range programme {
+		merged[serial] = entries
+	}
+	version := hstrVersion{latest.Version + 1, author, uint32(time.Now().Unix()), source, planUniqueSerials(serials), merged}
+	if fail := dataWrite(hstrFile(version.Version), &version); fail != nil {
+		return nil, fail
+	}
+	return &version, nil
+}
+
+// Lists the versions (latest first)
+func hstrList() ([]hstrSummary, error) {
+	hstrLock.Lock()
+	defer hstrLock.Unlock()
+	versions, fail := hstrVersions()
+	if fail != nil {
+		return nil, fail
+	}
+	summaries := make([]hstrSummary, 0, len(versions))
+	for index := len(versions) - 1; index >= 0; index-- {
+		version, fail := hstrLoad(versions[index])
+		if fail != nil {
+			return nil, fail
+		}
+		summary := hstrSummary{version.Version, version.Author, version.Created, version.Source, version.Serials, len(version.Programme), 0}
+		for _, entries := range version.Programme {
+			summary.Schedules += len(entries)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// Normalizes a schedule the way a fixture stores it (e.g. levels of limited precision, no recipe)
+func hstrNormalize(schedule schdlDetached) schdlDetached {
+	levels := make(schdlLevels, len(schedule.Levels))
+	for channel, level := range schedule.Levels {
+		levels[channel] = ctrl1WidenLevel(float32(level))
+		if schdlModeOf(schedule) == schdlModePWM {
+			levels[channel] = float64(uint32(level + 0.5))
+		}
+	}
+	mode := schdlMode("")
+	if schdlModeOf(schedule) == schdlModePWM {
+		mode = schdlModePWM
+	}
+	return schdlDetached{schdlTiming: schedule.schdlTiming, Levels: levels, Mode: mode, Modules: schdlNormalizeModules(schedule.Modules)}
+}
+
+// Compares the schedules of a fixture (the ones elapsed before the given time are ignored)
+func hstrCompare(serial schdlSerial, from, to []schdlDetached, since uint32) hstrChange {
+	keys := func(schedules []schdlDetached) map[string]schdlDetached {
+		keyed := make(map[string]schdlDetached)
+		for _, schedule := range schedules {
+			if schedule.Stop > since {
+				keyed[schdlKey(hstrNormalize(schedule))] = schedule
+			}
+		}
+		return keyed
+	}
+	fromKeys, toKeys := keys(from), keys(to)
+	change := hstrChange{serial, []schdlDetached{}, []schdlDetached{}}
+	for key, schedule := range toKeys {
+		if _, present := fromKeys[key]; !present {
+			change.Added = append(change.Added, schedule)
+		}
+	}
+	for key, schedule := range fromKeys {
+		if _, present := toKeys[key]; !present {
+			change.Removed = append(change.Removed, schedule)
+		}
+	}
+	sort.Slice(change.Added, func(i, j int) bool { return change.Added[i].Start < change.Added[j].Start })
+	sort.Slice(change.Removed, func(i, j int) bool { return change.Removed[i].Start < change.Removed[j].Start })
+	return change
+}
+
+// Lists the fixtures of either programme
+func hstrUnion(programmes ...schdlAggregated) schdlSerials {
+	serials := make(schdlSerials, 0)
+	for _, programme := range programmes {
+		for serial := range programme {
+			serials = append(serials, serial)
+		}
+	}
+	return planUniqueSerials(serials)
+}
+
+// Compares two versions
+func hstrCompareVersions(from, to *hstrVersion) hstrDiff {
+	diff := hstrDiff{from.Version, to.Version, []hstrChange{}, schdlSerials{}}
+	for _, serial := range hstrUnion(from.Programme, to.Programme) {
+		change := hstrCompare(serial, from.Programme[serial], to.Programme[serial], 0)
+		if len(change.Added) == 0 && len(change.Removed) == 0 {
+			diff.Unchanged = append(diff.Unchanged, serial)
+		} else {
+			diff.Changes = append(diff.Changes, change)
+		}
+	}
+	return diff
+}
+
+// Works out which fixtures need their schedules replaced (or cleared) to match the programme
+// by comparing the schedules read back from the fixtures (those failing to be read back are replaced)
+func hstrReconcile(ctx context.Context, controller *ctrl1Controller, programme, current schdlAggregated) hstrReconciliation {
+	reconciliation := hstrReconciliation{schdlSerials{}, schdlSerials{}, schdlSerials{}}
+	now := uint32(time.Now().Unix())
+	for _, serial := range hstrUnion(programme, current) {
+		wanted := programme[serial]
+		stored, fail := controller.ctrl1FetchSchedules(ctx, serial)
+		if fail == nil {
+			change := hstrCompare(serial, stored, wanted, now)
+			if len(change.Added) == 0 && len(change.Removed) == 0 {
+				reconciliation.Unchanged = append(reconciliation.Unchanged, serial)
+				continue
+			}
+		}
+		if len(wanted) == 0 {
+			reconciliation.Clear = append(reconciliation.Clear, serial)
+		} else {
+			reconciliation.Apply = append(reconciliation.Apply, serial)
+		}
+	}
+	return reconciliation
+}
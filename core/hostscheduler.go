@@ -0,0 +1,418 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for driving the fixtures from the host (instead of the fixture-resident schedules)
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	hschStorage         = "scheduler.json"
+	hschDefaultInterval = 60
+	hschLeaseIntervals  = 5 // Intervals without a heartbeat after which the fixtures fall back to their schedules (unless a lease is given)
+)
+
+// Maps expressions (one per channel) to fixtures
+type hschEntry struct {
+	Serials schdlSerials `json:"serials"`
+	Levels  []string     `json:"levels"`
+	Units   string       `json:"units,omitempty"`
+	Modules schdlModules `json:"modules,omitempty"`
+}
+
+// Holds the program evaluated by the host scheduler
+// (the fallback schedules are uploaded to the fixtures to be run whenever the host stops driving them
+// - including once the heartbeat is missing for longer than the lease)
+type hschProgram struct {
+	Interval uint32          `json:"interval,omitempty"`
+	Lease    uint32          `json:"lease,omitempty"`
+	Seed     int64           `json:"seed,omitempty"`
+	Entries  []hschEntry     `json:"entries"`
+	Fallback []schdlAttached `json:"fallback,omitempty"`
+}
+
+// Holds the state of the host scheduler
+type hschStatus struct {
+	Active   bool                        `json:"active"`
+	Program  *hschProgram                `json:"program,omitempty"`
+	Started  uint32                      `json:"started,omitempty"`
+	Ticks    uint64                      `json:"ticks"`
+	LastTick uint32                      `json:"last_tick,omitempty"`
+	Levels   map[schdlSerial]schdlLevels `json:"levels"`
+	Errors   map[schdlSerial]string      `json:"errors"`
+}
+
+// Holds a compiled entry
+type hschCompiled struct {
+	entry  hschEntry
+	levels []exprNode
+	units  string
+}
+
+// Drives the fixtures from the host
+type hschScheduler struct {
+	logger     *log.Logger
+	controller *ctrl1Controller
+	lock       sync.Mutex
+	status     hschStatus
+	stop       chan struct{}
+	done       chan struct{}
+	activating chan struct{} // Set while starting (closed once the fixtures are handed over or the start failed)
+	starting   schdlSerials  // The fixtures being handed over meanwhile
+}
+
+// Creates an instance of the host scheduler (stopped on exit to restore the fixture-resident schedules)
+func hschInit(logger *log.Logger, controller *ctrl1Controller) *hschScheduler {
+	scheduler := &hschScheduler{logger: logger, controller: controller}
+	scheduler.status = hschStatus{Levels: map[schdlSerial]schdlLevels{}, Errors: map[schdlSerial]string{}}
+	exitRegister(func() {
+		if fail := scheduler.hschStop(); fail != nil {
+			logger.Printf("ERROR: Failed to stop the host scheduler on exit (%s)", fail)
+		}
+	})
+	return scheduler
+}
+
+// Compiles the program reporting the first problem found
+func hschCompile(program *hschProgram) ([]hschCompiled, error) {
+	if len(program.Entries) == 0 {
+		return nil, fmt.Errorf("Program has no entries")
+	}
+	compiled := make([]hschCompiled, 0, len(program.Entries))
+	assigned := make(map[schdlSerial]struct{})
+	for index, entry := range program.Entries {
+		if len(entry.Serials) == 0 {
+			return nil, fmt.Errorf("Entry #%d has no serials", index+1)
+		}
+		for _, serial := range entry.Serials {
+			if _, present := assigned[serial]; present {
+				return nil, fmt.Errorf("Entry #%d drives fixture %d driven by another entry", index+1, serial)
+			}
+			assigned[serial] = struct{}{}
+		}
+		if len(entry.Levels) != 6 {
+			return nil, fmt.Errorf("Entry #%d must have 6 level expressions (has %d)", index+1, len(entry.Levels))
+		}
+		units, fail := phtnParseUnits(entry.Units)
+		if fail != nil {
+			return nil, fmt.Errorf("Entry #%d is invalid (%s)", index+1, fail)
+		}
+		levels := make([]exprNode, 0, len(entry.Levels))
+		for _, text := range entry.Levels {
+			node, fail := exprCompile(text)
+			if fail != nil {
+				return nil, fmt.Errorf("Entry #%d is invalid (%s)", index+1, fail)
+			}
+			levels = append(levels, node)
+		}
+		compiled = append(compiled, hschCompiled{entry, levels, units})
+	}
+	return compiled, nil
+}
+
+// Lists the fixtures driven by the program
+func hschSerials(program *hschProgram) schdlSerials {
+	serials := make(schdlSerials, 0)
+	for _, entry := range program.Entries {
+		serials = append(serials, entry.Serials...)
+	}
+	return planUniqueSerials(serials)
+}
+
+// Starts driving the fixtures (uploads the fallback schedules and stops the fixture-resident scheduling)
+func (scheduler *hschScheduler) hschStart(program hschProgram) error {
+	compiled, fail := hschCompile(&program)
+	if fail != nil {
+		return fail
+	}
+	if program.Interval == 0 {
+		program.Interval = hschDefaultInterval
+	}
+	if program.Lease == 0 {
+		program.Lease = hschLeaseIntervals * program.Interval
+	}
+	if program.Lease <= program.Interval {
+		return fmt.Errorf("Lease must be longer than the interval")
+	}
+	if program.Seed == 0 {
+		program.Seed = time.Now().UnixNano()
+	}
+	scheduler.lock.Lock()
+	if scheduler.activating != nil {
+		scheduler.lock.Unlock()
+		return fmt.Errorf("Host scheduler is being started already")
+	}
+	if scheduler.status.Active {
+		scheduler.lock.Unlock()
+		return fmt.Errorf("Host scheduler is already running (stop it first)")
+	}
+	activating := make(chan struct{})
+	scheduler.activating, scheduler.starting = activating, hschSerials(&program)
+	scheduler.lock.Unlock()
+	serials, fail := scheduler.hschActivate(&program)
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.activating, scheduler.starting = nil, nil
+	close(activating)
+	if fail != nil {
+		return fail
+	}
+	scheduler.status = hschStatus{true, &program, uint32(time.Now().Unix()), 0, 0, map[schdlSerial]schdlLevels{}, map[schdlSerial]string{}}
+	if fail := dataWrite(hschStorage, &scheduler.status); fail != nil {
+		scheduler.logger.Printf("ERROR: Failed to store the host scheduler state (%s)", fail)
+	}
+	scheduler.stop = make(chan struct{})
+	scheduler.done = make(chan struct{})
+	go scheduler.hschRun(compiled, program, scheduler.stop, scheduler.done)
+	scheduler.logger.Printf("INFO: Host scheduler started for %d fixtures", len(serials))
+	return nil
+}
+
+// Hands the fixtures over to the host - uploads the fallback schedules & stops the fixture-resident scheduling
+// (without holding the lock, so that the status can be queried meanwhile)
+func (scheduler *hschScheduler) hschActivate(program *hschProgram) (schdlSerials, error) {
+	if len(program.Fallback) != 0 {
+		fallback, fail := rcpResolveSchedules(program.Fallback)
+		if fail == nil {
+			fallback, fail = phtnResolveSchedules(fallback)
+		}
+		if fail == nil {
+			var release func()
+			if release, fail = stgLockImports(); fail == nil {
+				_, fail = scheduler.controller.ctrl1ImportSchedules(context.Background(), fallback)
+				release()
+			}
+		}
+		if fail != nil {
+			return nil, fmt.Errorf("Failed to upload the fallback schedules (%s)", fail)
+		}
+		if _, fail := hstrRecord(fallback, "host scheduler fallback", ""); fail != nil {
+			scheduler.logger.Printf("ERROR: Failed to record the schedules in the history (%s)", fail)
+		}
+		program.Fallback = fallback
+	}
+	serials := hschSerials(program)
+	if fail := scheduler.controller.ctrl1ToggleScheduling(serials, false); fail != nil {
+		scheduler.controller.ctrl1ToggleScheduling(serials, true)
+		return nil, fail
+	}
+	return serials, nil
+}
+
+// Evaluates the program periodically until stopped
+func (scheduler *hschScheduler) hschRun(compiled []hschCompiled, program hschProgram, stop, done chan struct{}) {
+	defer close(done)
+	random := rand.New(rand.NewSource(program.Seed))
+	started := time.Now().UTC()
+	ticker := time.NewTicker(time.Duration(program.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		if !scheduler.hschBeat() {
+			scheduler.logger.Printf("WARNING: Host scheduler stalled beyond its lease, falling back to the fixture-resident schedules")
+			go scheduler.hschStop()
+			<-stop
+			return
+		}
+		scheduler.hschTick(compiled, started, random)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tells whether the heartbeat of a running host scheduler is missing for longer than its lease
+func hschLapsed(status *hschStatus, now uint32) bool {
+	if !status.Active || status.Program == nil {
+		return false
+	}
+	heartbeat := status.LastTick
+	if heartbeat == 0 {
+		heartbeat = status.Started
+	}
+	return now > heartbeat+status.Program.Lease
+}
+
+// Records the heartbeat (stored for the watchdog) unless the lease lapsed already - the watchdog may have taken over then
+func (scheduler *hschScheduler) hschBeat() bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	now := uint32(time.Now().Unix())
+	if hschLapsed(&scheduler.status, now) {
+		return false
+	}
+	scheduler.status.LastTick = now
+	if fail := dataWrite(hschStorage, &scheduler.status); fail != nil {
+		scheduler.logger.Printf("ERROR: Failed to store the host scheduler heartbeat (%s)", fail)
+	}
+	return true
+}
+
+// Evaluates the program once and sets the levels of the fixtures (concurrently across the buses, the fixtures not seen are skipped)
+func (scheduler *hschScheduler) hschTick(compiled []hschCompiled, started time.Time, random *rand.Rand) {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	seconds := now.Sub(midnight).Seconds()
+	environment := &exprEnvironment{map[string]float64{
+		"t":   seconds,
+		"h":   seconds / 3600,
+		"d":   math.Floor(now.Sub(started).Hours() / 24),
+		"doy": float64(now.YearDay()),
+		"pi":  math.Pi,
+	}, random}
+	levels := make(map[schdlSerial]schdlLevels)
+	errors := make(map[schdlSerial]string)
+	payloads := make(map[schdlSerial]*pckt1CommandPayloadSetLEDsIrradiance)
+	serials := make(schdlSerials, 0)
+	for _, entry := range compiled {
+		values := make(schdlLevels, len(entry.levels))
+		for channel, node := range entry.levels {
+			if value := node(environment); value > 0 && !math.IsInf(value, 0) {
+				values[channel] = value
+			}
+		}
+		converted, _ := phtnConvert(values, entry.units, phtnUnitsEnergy)
+		var payload pckt1CommandPayloadSetLEDsIrradiance
+		payload.Config = ctrl1Config(schdlModeIrradiance, entry.entry.Modules)
+		for channel := range payload.Levels {
+			payload.Levels[channel] = float32(converted[channel])
+		}
+		for _, serial := range entry.entry.Serials {
+			levels[serial] = converted
+			payloads[serial] = &payload
+			serials = append(serials, serial)
+		}
+	}
+	var lock sync.Mutex
+	scheduler.controller.ctrl1ForEachFixture(serials, func(index int, serial schdlSerial) {
+		var fail error
+		if len(scheduler.controller.discoverer.dscvr1LookUp(serial)) == 0 {
+			fail = fmt.Errorf("Device with serial number %d not seen", serial)
+		} else {
+			fail = scheduler.controller.ctrl1CheckLimits(serial, schdlModeIrradiance, levels[serial])
+		}
+		if fail == nil {
+			replies, failSet := scheduler.controller.ctrl1Dispatch(serial, pckt1FunctionCodeSetLEDs, payloads[serial])
+			fail = dptr1CheckResult(pckt1FunctionCodeSetLEDs, replies, failSet)
+		}
+		if fail != nil {
+			lock.Lock()
+			errors[serial] = fail.Error()
+			lock.Unlock()
+			scheduler.logger.Printf("ERROR: Host scheduler failed to set levels for device with serial number %d (%s)", serial, fail)
+		}
+	})
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.status.Ticks++
+	scheduler.status.Levels = levels
+	scheduler.status.Errors = errors
+}
+
+// Stops driving the fixtures and resumes the fixture-resident scheduling (nothing happens if not running)
+func (scheduler *hschScheduler) hschStop() error {
+	scheduler.lock.Lock()
+	for scheduler.activating != nil {
+		// A start under way is awaited (the fixtures it takes over are then given back)
+		activating := scheduler.activating
+		scheduler.lock.Unlock()
+		<-activating
+		scheduler.lock.Lock()
+	}
+	if !scheduler.status.Active {
+		scheduler.lock.Unlock()
+		return nil
+	}
+	close(scheduler.stop)
+	done := scheduler.done
+	program := scheduler.status.Program
+	scheduler.lock.Unlock()
+	<-done
+	fail := scheduler.controller.ctrl1ToggleScheduling(hschSerials(program), true)
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	scheduler.status.Active = false
+	if failRemove := dataRemove(hschStorage); failRemove != nil {
+		scheduler.logger.Printf("ERROR: Failed to remove the host scheduler state (%s)", failRemove)
+	}
+	scheduler.logger.Printf("INFO: Host scheduler stopped")
+	return fail
+}
+
+// Restores the fixture-resident scheduling if the previous run ended without stopping the host scheduler
+func (scheduler *hschScheduler) hschRecover() {
+	var previous hschStatus
+	if fail := dataRead(hschStorage, &previous); fail != nil {
+		if !os.IsNotExist(fail) {
+			scheduler.logger.Printf("ERROR: Failed to load the host scheduler state (%s)", fail)
+		}
+		return
+	}
+	if previous.Active && previous.Program != nil {
+		scheduler.controller.discoverer.dscvr1WaitForDiscovery(context.Background())
+		scheduler.logger.Printf("INFO: Host scheduler was not stopped, falling back to the fixture-resident schedules")
+		if fail := scheduler.controller.ctrl1ToggleScheduling(hschSerials(previous.Program), true); fail != nil {
+			return
+		}
+	}
+	if fail := dataRemove(hschStorage); fail != nil {
+		scheduler.logger.Printf("ERROR: Failed to remove the host scheduler state (%s)", fail)
+	}
+}
+
+// Watches the heartbeat of a host scheduler run by another process and resumes the fixture-resident scheduling
+// once its lease lapsed (the resuming function sets up the controller only then - the adapters are left to the scheduler otherwise)
+func hschWatch(logger *log.Logger, period time.Duration, resume func(serials schdlSerials) error) {
+	logger.Printf("INFO: Watching the host scheduler heartbeat every %s", period)
+	for ; ; time.Sleep(period) {
+		var status hschStatus
+		if fail := dataRead(hschStorage, &status); fail != nil {
+			if !os.IsNotExist(fail) {
+				logger.Printf("ERROR: Failed to load the host scheduler state (%s)", fail)
+			}
+			continue
+		}
+		if !hschLapsed(&status, uint32(time.Now().Unix())) {
+			continue
+		}
+		logger.Printf("WARNING: Host scheduler heartbeat missing for longer than its lease, falling back to the fixture-resident schedules")
+		if fail := resume(hschSerials(status.Program)); fail != nil {
+			continue
+		}
+		// Unless the scheduler came back meanwhile (it gives up on its own then)
+		var current hschStatus
+		if fail := dataRead(hschStorage, &current); fail == nil && current.Started == status.Started && current.LastTick == status.LastTick {
+			if fail := dataRemove(hschStorage); fail != nil {
+				logger.Printf("ERROR: Failed to remove the host scheduler state (%s)", fail)
+			}
+		}
+	}
+}
+
+// Returns a copy of the state of the host scheduler
+func (scheduler *hschScheduler) hschStatus() hschStatus {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	return scheduler.status
+}
+
+// Lists the fixtures driven by the host scheduler (including the ones of a start under way)
+func (scheduler *hschScheduler) hschDriven() schdlSerials {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if scheduler.activating != nil {
+		return scheduler.starting
+	}
+	if scheduler.status.Active {
+		return hschSerials(scheduler.status.Program)
+	}
+	return schdlSerials{}
+}
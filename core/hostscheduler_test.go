@@ -0,0 +1,71 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestHschLapsed(t *testing.T) {
+	program := &hschProgram{Interval: 60, Lease: 300}
+	cases := []struct {
+		status hschStatus
+		now    uint32
+		lapsed bool
+	}{
+		{hschStatus{Active: false, Program: program, Started: 1000}, 5000, false},
+		{hschStatus{Active: true, Program: program, Started: 1000}, 1300, false},
+		{hschStatus{Active: true, Program: program, Started: 1000}, 1301, true},
+		{hschStatus{Active: true, Program: program, Started: 1000, LastTick: 2000}, 2300, false},
+		{hschStatus{Active: true, Program: program, Started: 1000, LastTick: 2000}, 2301, true},
+		{hschStatus{Active: true, Started: 1000}, 5000, false},
+	}
+	for index, tested := range cases {
+		if lapsed := hschLapsed(&tested.status, tested.now); lapsed != tested.lapsed {
+			t.Errorf("Case #%d: lapsed %t (expecting %t)", index+1, lapsed, tested.lapsed)
+		}
+	}
+}
+
+func TestHschStartActivating(t *testing.T) {
+	bus := &ctrl1TestBus{schedules: map[pckt1ShortAddress][]pckt1CommandPayloadSetSchedulePWM{}}
+	scheduler := &hschScheduler{logger: log.New(ioutil.Discard, "", 0), controller: ctrl1TestController(t, bus)}
+	start, _ := schdlParseDate("2021-03-15", "06:00")
+	stop, _ := schdlParseDate("2021-04-30", "22:00")
+	fallback := schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{10, 0, 0, 0, 0, 0}, Mode: schdlModePWM}
+	program := hschProgram{
+		Entries:  []hschEntry{{Serials: schdlSerials{1}, Levels: []string{"1", "0", "0", "0", "0", "0"}}},
+		Fallback: []schdlAttached{{schdlDetached: fallback, Serials: schdlSerials{1}}},
+	}
+	// The fixtures do not reply until released, so the start stalls while uploading the fallback schedules
+	bus.lock.Lock()
+	started := make(chan error, 1)
+	go func() { started <- scheduler.hschStart(program) }()
+	for deadline := time.Now().Add(5 * time.Second); len(scheduler.hschDriven()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			bus.lock.Unlock()
+			t.Fatalf("Start not under way")
+		}
+	}
+	if fail := scheduler.hschStart(program); fail == nil {
+		t.Errorf("Started again while starting")
+	}
+	if status := scheduler.hschStatus(); status.Active {
+		t.Errorf("Reported as running while starting")
+	}
+	bus.lock.Unlock()
+	if fail := <-started; fail != nil {
+		t.Fatalf("Failed to start (%s)", fail)
+	}
+	if status := scheduler.hschStatus(); !status.Active {
+		t.Errorf("Not running once started")
+	}
+	if fail := scheduler.hschStop(); fail != nil {
+		t.Errorf("Failed to stop (%s)", fail)
+	}
+	if driven := scheduler.hschDriven(); len(driven) != 0 {
+		t.Errorf("Fixtures %v still driven once stopped", driven)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for running long operations in the background as jobs
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	jobStateRunning   = "running"
+	jobStateSucceeded = "succeeded"
+	jobStateFailed    = "failed"
+	jobStateCanceled  = "canceled"
+	jobRetained       = 100  // Finished jobs kept (the oldest ones are forgotten)
+	jobLogLimit       = 1000 // Log lines kept per job
+)
+
+// Holds a job (an API command run in the background)
+type jobJob struct {
+	ID       uint32                 `json:"id"`
+	Command  string                 `json:"command"`
+	State    string                 `json:"state"`
+	Created  uint32                 `json:"created"`
+	Finished uint32                 `json:"finished,omitempty"`
+	Progress map[schdlSerial]string `json:"progress"`
+	Logs     []string               `json:"logs"`
+	Result   json.RawMessage        `json:"result,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	cancel   context.CancelFunc
+}
+
+// Runs the jobs (kept in memory only)
+type jobRunner struct {
+	logger *log.Logger
+	lock   sync.Mutex
+	jobs   map[uint32]*jobJob
+	next   uint32
+}
+
+// Links the context of a job to the job
+type jobContextKey struct{}
+
+// Identifies the job a context belongs to
+type jobTrack struct {
+	runner *jobRunner
+	id     uint32
+}
+
+// Creates an instance of the job runner
+func jobInit(logger *log.Logger) *jobRunner {
+	return &jobRunner{logger: logger, jobs: make(map[uint32]*jobJob), next: 1}
+}
+
+// Copies a job (so it can be read without the lock)
+func jobCopy(job *jobJob) jobJob {
+	copied := *job
+	copied.Progress = make(map[schdlSerial]string, len(job.Progress))
+	for serial, state := range job.Progress {
+		copied.Progress[serial] = state
+	}
+	copied.Logs = append([]string{}, job.Logs...)
+	return copied
+}
+
+// Starts a job (the context passed to the function gets canceled when the job is)
+func (runner *jobRunner) jobStart(command string, run func(ctx context.Context) ([]byte, error)) jobJob {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &jobJob{runner.next, command, jobStateRunning, uint32(time.Now().Unix()), 0, map[schdlSerial]string{}, []string{}, nil, "", cancel}
+	runner.next++
+	runner.jobs[job.ID] = job
+	runner.jobForget()
+	go runner.jobRun(context.WithValue(ctx, jobContextKey{}, &jobTrack{runner, job.ID}), job.ID, run)
+	runner.logger.Printf("INFO: Job %d started (%s)", job.ID, command)
+	return jobCopy(job)
+}
+
+// Runs a job and records its outcome
+func (runner *jobRunner) jobRun(ctx context.Context, id uint32, run func(ctx context.Context) ([]byte, error)) {
+	result, fail := run(ctx)
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	job := runner.jobs[id]
+	if job == nil {
+		return
+	}
+	// Whether the job got canceled must be told before its context gets released
+	canceled := ctx.Err() != nil
+	job.cancel()
+	job.Finished = uint32(time.Now().Unix())
+	if len(result) != 0 {
+		if json.Valid(result) {
+			job.Result = result
+		} else {
+			job.Result, _ = json.Marshal(string(result))
+		}
+	}
+	switch {
+	case canceled && fail != nil:
+		job.State = jobStateCanceled
+		job.Error = fail.Error()
+	case fail != nil:
+		job.State = jobStateFailed
+		job.Error = fail.Error()
+	default:
+		job.State = jobStateSucceeded
+	}
+	runner.logger.Printf("INFO: Job %d %s", id, job.State)
+}
+
+// Forgets the oldest finished jobs beyond the retained number (under the lock)
+func (runner *jobRunner) jobForget() {
+	finished := make([]uint32, 0)
+	for id, job := range runner.jobs {
+		if job.State != jobStateRunning {
+			finished = append(finished, id)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i] < finished[j] })
+	for index := 0; index < len(finished)-jobRetained; index++ {
+		delete(runner.jobs, finished[index])
+	}
+}
+
+// Returns a job
+func (runner *jobRunner) jobGet(id uint32) (jobJob, error) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	job, present := runner.jobs[id]
+	if !present {
+		return jobJob{}, fmt.Errorf("Unknown job %d", id)
+	}
+	return jobCopy(job), nil
+}
+
+// Lists the jobs (latest first)
+func (runner *jobRunner) jobList() []jobJob {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	jobs := make([]jobJob, 0, len(runner.jobs))
+	for _, job := range runner.jobs {
+		jobs = append(jobs, jobCopy(job))
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	return jobs
+}
+
+// Cancels a running job (the exchanges in progress are abandoned and the command winds down as it does on failure)
+func (runner *jobRunner) jobCancel(id uint32) (jobJob, error) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	job, present := runner.jobs[id]
+	if !present {
+		return jobJob{}, fmt.Errorf("Unknown job %d", id)
+	}
+	if job.State != jobStateRunning {
+		return jobJob{}, fmt.Errorf("Job %d is %s already", id, job.State)
+	}
+	job.cancel()
+	job.Logs = append(job.Logs, fmt.Sprintf("%s INFO: Cancellation requested", time.Now().UTC().Format(time.RFC3339)))
+	runner.logger.Printf("INFO: Job %d cancellation requested", id)
+	return jobCopy(job), nil
+}
+
+// Modifies the job the context belongs to (nothing happens outside of jobs)
+func jobModify(ctx context.Context, modify func(job *jobJob)) {
+	track, isJob := ctx.Value(jobContextKey{}).(*jobTrack)
+	if !isJob {
+		return
+	}
+	track.runner.lock.Lock()
+	defer track.runner.lock.Unlock()
+	if job := track.runner.jobs[track.id]; job != nil {
+		modify(job)
+	}
+}
+
+// Detaches the context from the cancellation of the job (keeping the progress & logs reported to the job)
+func jobDetach(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), jobContextKey{}, ctx.Value(jobContextKey{}))
+}
+
+// Reports the progress of a fixture to the job the context belongs to
+func jobReport(ctx context.Context, serial schdlSerial, state string) {
+	jobModify(ctx, func(job *jobJob) { job.Progress[serial] = state })
+}
+
+// Logs a message also to the job the context belongs to
+func jobLogf(ctx context.Context, logger *log.Logger, format string, arguments ...interface{}) {
+	logger.Printf(format, arguments...)
+	jobModify(ctx, func(job *jobJob) {
+		if len(job.Logs) < jobLogLimit {
+			job.Logs = append(job.Logs, fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), fmt.Sprintf(format, arguments...)))
+		}
+	})
+}
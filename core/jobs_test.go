@@ -0,0 +1,42 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestJobRun(t *testing.T) {
+	runner := jobInit(log.New(ioutil.Discard, "", 0))
+	cases := []struct {
+		command  string
+		run      func(ctx context.Context) ([]byte, error)
+		canceled bool
+		state    string
+		error    string
+	}{
+		{"succeeding", func(ctx context.Context) ([]byte, error) { return []byte(`{"applied": 2}`), nil }, false, jobStateSucceeded, ""},
+		{"failing", func(ctx context.Context) ([]byte, error) { return nil, errors.New("boom") }, false, jobStateFailed, "boom"},
+		{"canceled", func(ctx context.Context) ([]byte, error) { <-ctx.Done(); return nil, ctx.Err() }, true, jobStateCanceled, context.Canceled.Error()},
+	}
+	for _, tested := range cases {
+		started := runner.jobStart(tested.command, tested.run)
+		if tested.canceled {
+			if _, fail := runner.jobCancel(started.ID); fail != nil {
+				t.Errorf("%s: %s", tested.command, fail)
+			}
+		}
+		job := started
+		for deadline := time.Now().Add(5 * time.Second); job.State == jobStateRunning && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			job, _ = runner.jobGet(started.ID)
+		}
+		if job.State != tested.state || job.Error != tested.error {
+			t.Errorf("%s: ended %s with error %q (expecting %s with %q)", tested.command, job.State, job.Error, tested.state, tested.error)
+		}
+	}
+}
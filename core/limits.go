@@ -0,0 +1,68 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for checking levels against the limits of the fixtures
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	lmtChannelTotal = "Total"
+	lmtShareLimit   = 300 // The channels together may draw up to 300% of a single channel at full power
+	lmtPWMLimit     = 100
+)
+
+// Describes a level exceeding the limit of a fixture
+type lmtViolation struct {
+	Serial  schdlSerial `json:"serial"`
+	Channel string      `json:"channel"`
+	Mode    schdlMode   `json:"mode"`
+	Level   float64     `json:"level"`
+	Limit   float64     `json:"limit"`
+}
+
+// Collects all levels exceeding the limits
+type lmtViolations []lmtViolation
+
+func (violation lmtViolation) String() string {
+	if violation.Channel == lmtChannelTotal {
+		return fmt.Sprintf("Fixture %d: Total load %.1f%% exceeds %.0f%% (%s)", violation.Serial, violation.Level, violation.Limit, violation.Mode)
+	}
+	return fmt.Sprintf("Fixture %d: Channel %s level %g exceeds %g (%s)", violation.Serial, violation.Channel, violation.Level, violation.Limit, violation.Mode)
+}
+
+func (violations lmtViolations) Error() string {
+	messages := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		messages = append(messages, violation.String())
+	}
+	return fmt.Sprintf("Levels exceed the limits of the fixtures (%d violations) - %s", len(violations), strings.Join(messages, "; "))
+}
+
+// Checks the levels against the per-channel maxima reported by the fixture (irradiance)
+// or the duty cycle range (PWM) as well as the total load of all channels
+func lmtCheck(serial schdlSerial, mode schdlMode, levels schdlLevels, maxima [6]float64) lmtViolations {
+	violations := make(lmtViolations, 0)
+	share := 0.0
+	for channel, level := range levels {
+		limit := float64(lmtPWMLimit)
+		if mode != schdlModePWM {
+			limit = maxima[channel]
+		}
+		name := fmt.Sprintf("#%d", channel)
+		if channel < len(schdlChannelNames) {
+			name = schdlChannelNames[channel]
+		}
+		if level > limit {
+			violations = append(violations, lmtViolation{serial, name, mode, level, limit})
+		}
+		if limit > 0 {
+			share += 100 * level / limit
+		}
+	}
+	if share > lmtShareLimit {
+		violations = append(violations, lmtViolation{serial, lmtChannelTotal, mode, share, lmtShareLimit})
+	}
+	return violations
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code keeps the metrics of the lighting system and exposes them in the Prometheus text format
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	mtrcAdapters        = "phytofy_adapters"
+	mtrcFixturesSeen    = "phytofy_fixtures_seen"
+	mtrcOutboxDepth     = "phytofy_outbox_depth"
+	mtrcCommandDuration = "phytofy_command_duration_seconds"
+	mtrcCommandTimeouts = "phytofy_command_timeouts_total"
+	mtrcCommandNACKs    = "phytofy_command_nacks_total"
+	mtrcPacketErrors    = "phytofy_packet_errors_total"
+	mtrcReconnects      = "phytofy_reconnects_total"
+	mtrcTemperature     = "phytofy_module_temperature_celsius"
+	mtrcClockDrift      = "phytofy_clock_drift_seconds"
+	mtrcContentType     = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Describes a metric family
+type mtrcFamily struct {
+	name    string
+	kind    string
+	help    string
+	buckets []float64 // Upper bounds of the histogram buckets
+}
+
+var mtrcFamilies = []mtrcFamily{
+	{mtrcAdapters, "gauge", "Serial port adapters known (discovered and not forgotten)", nil},
+	{mtrcFixturesSeen, "gauge", "Fixtures seen on the bus of an adapter", nil},
+	{mtrcOutboxDepth, "gauge", "Packets queued for transmission to an adapter", nil},
+	{mtrcCommandDuration, "histogram", "Time taken by the command exchanges (including waiting for the replies - broadcasts wait a fixed time)", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}},
+	{mtrcCommandTimeouts, "counter", "Commands addressed to a single fixture left without a reply", nil},
+	{mtrcCommandNACKs, "counter", "Replies reporting that a command was not acknowledged", nil},
+	{mtrcPacketErrors, "counter", "Octets skipped while parsing the replies (by reason)", nil},
+	{mtrcReconnects, "counter", "Attempts to reconnect to an adapter", nil},
+	{mtrcTemperature, "gauge", "Module temperatures last reported by the fixtures", nil},
+	{mtrcClockDrift, "gauge", "Clock of a fixture ahead of the host (negative if behind) when last checked", nil},
+}
+
+// Holds a labeled series of a metric family
+type mtrcSeries struct {
+	labels []string // Label names & values alternating
+	value  float64  // Value of a counter or a gauge (sum of a histogram)
+	counts []uint64 // Cumulative bucket counts of a histogram (the last one counts all)
+}
+
+// Reports a value collected when scraped
+type mtrcReport func(name string, value float64, labels ...string)
+
+// Holds the series of all the metric families along with the collectors of the values taken when scraped
+type mtrcRegistry struct {
+	lock       sync.Mutex
+	series     map[string]map[string]*mtrcSeries
+	collectors []func(mtrcReport)
+}
+
+var mtrcDefault = &mtrcRegistry{series: make(map[string]map[string]*mtrcSeries)}
+
+// Formats the labels of a series (also used as its key)
+func mtrcFormatLabels(labels []string) string {
+	parts := make([]string, 0, len(labels)/2)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for index := 0; index+1 < len(labels); index += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", labels[index], escaper.Replace(labels[index+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Looks up a series (creating it if needed) - the lock must be held
+func (registry *mtrcRegistry) mtrcLookUp(name string, labels []string) *mtrcSeries {
+	family, present := registry.series[name]
+	if !present {
+		family = make(map[string]*mtrcSeries)
+		registry.series[name] = family
+	}
+	key := mtrcFormatLabels(labels)
+	series, present := family[key]
+	if !present {
+		series = &mtrcSeries{labels: labels}
+		family[key] = series
+	}
+	return series
+}
+
+// Increases a counter
+func mtrcAdd(name string, delta float64, labels ...string) {
+	mtrcDefault.lock.Lock()
+	defer mtrcDefault.lock.Unlock()
+	mtrcDefault.mtrcLookUp(name, labels).value += delta
+}
+
+// Sets a gauge
+func mtrcSet(name string, value float64, labels ...string) {
+	mtrcDefault.lock.Lock()
+	defer mtrcDefault.lock.Unlock()
+	mtrcDefault.mtrcLookUp(name, labels).value = value
+}
+
+// Observes a value of a histogram
+func mtrcObserve(name string, value float64, labels ...string) {
+	var buckets []float64
+	for _, family := range mtrcFamilies {
+		if family.name == name {
+			buckets = family.buckets
+		}
+	}
+	mtrcDefault.lock.Lock()
+	defer mtrcDefault.lock.Unlock()
+	series := mtrcDefault.mtrcLookUp(name, labels)
+	if series.counts == nil {
+		series.counts = make([]uint64, len(buckets)+1)
+	}
+	for index, bound := range buckets {
+		if value <= bound {
+			series.counts[index]++
+		}
+	}
+	series.counts[len(buckets)]++
+	series.value += value
+}
+
+// Drops the series carrying all the given labels (e.g. of a fixture which is gone)
+func mtrcForget(labels ...string) {
+	mtrcDefault.lock.Lock()
+	defer mtrcDefault.lock.Unlock()
+	for _, family := range mtrcDefault.series {
+		for key, series := range family {
+			matching := true
+			for index := 0; index+1 < len(labels) && matching; index += 2 {
+				found := false
+				for own := 0; own+1 < len(series.labels); own += 2 {
+					if series.labels[own] == labels[index] && series.labels[own+1] == labels[index+1] {
+						found = true
+					}
+				}
+				matching = found
+			}
+			if matching {
+				delete(family, key)
+			}
+		}
+	}
+}
+
+// Registers a collector of the values taken when scraped (e.g. the queue depths)
+func mtrcRegister(collector func(mtrcReport)) {
+	mtrcDefault.lock.Lock()
+	defer mtrcDefault.lock.Unlock()
+	mtrcDefault.collectors = append(mtrcDefault.collectors, collector)
+}
+
+// Labels a function code
+func mtrcCode(functionCode pckt1FunctionCode) string {
+	return strconv.Itoa(int(functionCode))
+}
+
+func mtrcFormatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Writes all the metrics in the Prometheus text format
+func (registry *mtrcRegistry) mtrcExpose() []byte {
+	registry.lock.Lock()
+	collectors := append([]func(mtrcReport){}, registry.collectors...)
+	registry.lock.Unlock()
+	// The collected values are held apart from the series kept between the scrapes
+	collected := make(map[string]map[string]*mtrcSeries)
+	for _, collector := range collectors {
+		collector(func(name string, value float64, labels ...string) {
+			if collected[name] == nil {
+				collected[name] = make(map[string]*mtrcSeries)
+			}
+			collected[name][mtrcFormatLabels(labels)] = &mtrcSeries{labels: labels, value: value}
+		})
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	var buffer bytes.Buffer
+	for _, family := range mtrcFamilies {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		series := registry.series[family.name]
+		if values, present := collected[family.name]; present {
+			series = values
+		}
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := series[key]
+			if family.kind != "histogram" {
+				if len(key) != 0 {
+					key = "{" + key + "}"
+				}
+				fmt.Fprintf(&buffer, "%s%s %s\n", family.name, key, mtrcFormatValue(entry.value))
+				continue
+			}
+			for index, bound := range append(append([]float64{}, family.buckets...), math.Inf(1)) {
+				labels := mtrcFormatLabels(append(append([]string{}, entry.labels...), "le", mtrcFormatValue(bound)))
+				fmt.Fprintf(&buffer, "%s_bucket{%s} %d\n", family.name, labels, entry.counts[index])
+			}
+			if len(key) != 0 {
+				key = "{" + key + "}"
+			}
+			fmt.Fprintf(&buffer, "%s_sum%s %s\n", family.name, key, mtrcFormatValue(entry.value))
+			fmt.Fprintf(&buffer, "%s_count%s %d\n", family.name, key, entry.counts[len(family.buckets)])
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Serves the metrics to the scrapers (not logged since scraped every few seconds)
+func mtrcHandler(logger *log.Logger) http.HandlerFunc {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", mtrcContentType)
+		if _, fail := response.Write(mtrcDefault.mtrcExpose()); fail != nil {
+			logger.Printf("ERROR: Failed to write the metrics (%s)", fail)
+		}
+	})
+}
@@ -0,0 +1,463 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code serves the OpenAPI specification of the API (along with its docs page) and validates the requests against it
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The specification is maintained in ../api - the copies embedded here are refreshed by go generate
+//go:generate cp ../api/hw1.yaml ../api/api.yaml ../api/v2.yaml openapi/
+
+//go:embed openapi/*
+var oapiFiles embed.FS
+
+var oapiDocuments = []string{"openapi/hw1.yaml", "openapi/api.yaml", "openapi/v2.yaml"}
+
+var oapiMethods = []string{"get", "put", "post", "delete", "patch"}
+
+var oapiTypeNames = map[string]string{
+	"object":  "an object",
+	"array":   "an array",
+	"string":  "a string",
+	"integer": "an integer",
+	"number":  "a number",
+	"boolean": "a boolean",
+}
+
+// Holds the specification of all the APIs (merged into a single document)
+type oapiSpec struct {
+	document   map[string]interface{}
+	operations map[string]map[string]interface{} // Keyed by the method & the full path
+	yaml       []byte
+	json       []byte
+}
+
+func oapiMap(value interface{}) map[string]interface{} {
+	mapping, _ := value.(map[string]interface{})
+	return mapping
+}
+
+func oapiList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+// Replaces the references to the renamed components
+func oapiRename(value interface{}, renames map[string]string) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range typed {
+			if reference, isString := nested.(string); isString && key == "$ref" {
+				if renamed, present := renames[reference]; present {
+					typed[key] = renamed
+				}
+			} else {
+				oapiRename(nested, renames)
+			}
+		}
+	case []interface{}:
+		for _, nested := range typed {
+			oapiRename(nested, renames)
+		}
+	}
+}
+
+// Loads the specifications of all the APIs & merges them (the paths get prefixed with the server URLs)
+func oapiLoad() (*oapiSpec, error) {
+	paths := make(map[string]interface{})
+	components := make(map[string]interface{})
+	tags := make([]interface{}, 0)
+	document := map[string]interface{}{
+		"openapi":    "3.0.0",
+		"info":       map[string]interface{}{"title": "OSRAM PHYTOFY RL API", "version": "1.0.0"},
+		"servers":    []interface{}{map[string]interface{}{"url": "/"}},
+		"paths":      paths,
+		"components": components,
+	}
+	for _, name := range oapiDocuments {
+		content, fail := oapiFiles.ReadFile(name)
+		if fail != nil {
+			return nil, fail
+		}
+		parsed, fail := yamlParse(content)
+		if fail != nil {
+			return nil, fmt.Errorf("Failed to parse %s (%s)", name, fail)
+		}
+		root := oapiMap(parsed)
+		prefix := ""
+		if servers := oapiList(root["servers"]); len(servers) != 0 {
+			prefix = strings.TrimSuffix(fmt.Sprint(oapiMap(servers[0])["url"]), "/")
+		}
+		if _, present := document["security"]; !present && root["security"] != nil {
+			document["security"] = root["security"]
+		}
+		tags = append(tags, oapiList(root["tags"])...)
+		// Components clashing with the ones of the previous documents get renamed after the server (e.g. V2Serial)
+		renames := make(map[string]string)
+		for kind, entries := range oapiMap(root["components"]) {
+			merged := oapiMap(components[kind])
+			if merged == nil {
+				merged = make(map[string]interface{})
+				components[kind] = merged
+			}
+			for entry, definition := range oapiMap(entries) {
+				if existing, present := merged[entry]; present {
+					if kind == "securitySchemes" || reflect.DeepEqual(existing, definition) {
+						continue
+					}
+					renamed := strings.ToUpper(strings.TrimPrefix(prefix, "/")) + entry
+					renames["#/components/"+kind+"/"+entry] = "#/components/" + kind + "/" + renamed
+					entry = renamed
+				}
+				merged[entry] = definition
+			}
+		}
+		oapiRename(root, renames)
+		for path, item := range oapiMap(root["paths"]) {
+			paths[prefix+path] = item
+		}
+	}
+	if len(tags) != 0 {
+		document["tags"] = tags
+	}
+	spec := &oapiSpec{document: document, operations: make(map[string]map[string]interface{})}
+	for path, item := range paths {
+		for _, method := range oapiMethods {
+			if operation := oapiMap(oapiMap(item)[method]); operation != nil {
+				spec.operations[strings.ToUpper(method)+" "+path] = operation
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	yamlEmit(&buffer, document, 0)
+	spec.yaml = buffer.Bytes()
+	var fail error
+	if spec.json, fail = json.Marshal(document); fail != nil {
+		return nil, fail
+	}
+	return spec, nil
+}
+
+// Lists the routes missing from the specification
+func (spec *oapiSpec) oapiMissingRoutes(routes []webRoute) []string {
+	missing := make([]string, 0)
+	for _, route := range routes {
+		if _, present := spec.operations[route.Method+" "+route.Path]; !present {
+			missing = append(missing, fmt.Sprintf("%s %s (%s)", route.Method, route.Path, route.Name))
+		}
+	}
+	return missing
+}
+
+// Returns the schema of the JSON body of an operation (nil if there is none)
+func (spec *oapiSpec) oapiBodySchema(method, path string) map[string]interface{} {
+	operation := spec.operations[method+" "+path]
+	content := oapiMap(oapiMap(operation["requestBody"])["content"])
+	return oapiMap(oapiMap(content["application/json"])["schema"])
+}
+
+// Follows the references of a schema
+func (spec *oapiSpec) oapiResolve(schema map[string]interface{}) map[string]interface{} {
+	for depth := 0; depth < 16; depth++ {
+		reference, isReference := schema["$ref"].(string)
+		if !isReference || !strings.HasPrefix(reference, "#/components/") {
+			return schema
+		}
+		parts := strings.SplitN(strings.TrimPrefix(reference, "#/components/"), "/", 2)
+		if len(parts) != 2 {
+			return schema
+		}
+		schema = oapiMap(oapiMap(oapiMap(spec.document["components"])[parts[0]])[parts[1]])
+	}
+	return schema
+}
+
+// Flattens the schemas combined with allOf into a single one (the properties & the required ones are united)
+func (spec *oapiSpec) oapiFlatten(schema map[string]interface{}) map[string]interface{} {
+	schema = spec.oapiResolve(schema)
+	parts := oapiList(schema["allOf"])
+	if len(parts) == 0 {
+		return schema
+	}
+	flat := make(map[string]interface{})
+	properties := make(map[string]interface{})
+	required := make([]interface{}, 0)
+	merge := func(part map[string]interface{}) {
+		for key, value := range part {
+			if _, present := flat[key]; !present && key != "allOf" {
+				flat[key] = value
+			}
+		}
+		for name, property := range oapiMap(part["properties"]) {
+			properties[name] = property
+		}
+		required = append(required, oapiList(part["required"])...)
+	}
+	merge(schema)
+	for _, part := range parts {
+		merge(spec.oapiFlatten(oapiMap(part)))
+	}
+	flat["properties"] = properties
+	flat["required"] = required
+	return flat
+}
+
+// Converts a number held by a schema or decoded from a request
+func oapiNumber(value interface{}) (float64, bool) {
+	switch typed := value.(type) {
+	case json.Number:
+		number, fail := typed.Float64()
+		return number, fail == nil
+	case int64:
+		return float64(typed), true
+	case float64:
+		return typed, true
+	}
+	return 0, false
+}
+
+// Tells if a value is of a schema type
+func oapiIsType(kind string, value interface{}) bool {
+	switch kind {
+	case "object":
+		_, isObject := value.(map[string]interface{})
+		return isObject
+	case "array":
+		_, isArray := value.([]interface{})
+		return isArray
+	case "string":
+		_, isString := value.(string)
+		return isString
+	case "boolean":
+		_, isBoolean := value.(bool)
+		return isBoolean
+	case "number":
+		_, isNumber := oapiNumber(value)
+		return isNumber
+	case "integer":
+		number, isNumber := oapiNumber(value)
+		return isNumber && number == float64(int64(number))
+	}
+	return true
+}
+
+// Names a field nested in another one
+func oapiField(parent, name string) string {
+	if len(parent) == 0 {
+		return name
+	}
+	return parent + "." + name
+}
+
+// Validates a value against a schema (the problems get collected along with the paths of the fields)
+func (spec *oapiSpec) oapiValidate(schema map[string]interface{}, value interface{}, field string, problems *[]string) {
+	schema = spec.oapiFlatten(schema)
+	report := func(format string, arguments ...interface{}) {
+		name := field
+		if len(name) == 0 {
+			name = "body"
+		}
+		*problems = append(*problems, name+": "+fmt.Sprintf(format, arguments...))
+	}
+	if kind, present := schema["type"].(string); present && !oapiIsType(kind, value) {
+		if value == nil && schema["nullable"] == true {
+			return
+		}
+		report("expected %s", oapiTypeNames[kind])
+		return
+	}
+	if enum := oapiList(schema["enum"]); len(enum) != 0 {
+		allowed := make([]string, 0, len(enum))
+		for _, option := range enum {
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				allowed = nil
+				break
+			}
+			allowed = append(allowed, fmt.Sprint(option))
+		}
+		if allowed != nil {
+			report("expected one of %s", strings.Join(allowed, ", "))
+		}
+	}
+	if number, isNumber := oapiNumber(value); isNumber {
+		if minimum, present := oapiNumber(schema["minimum"]); present && number < minimum {
+			report("expected at least %v", minimum)
+		}
+		if maximum, present := oapiNumber(schema["maximum"]); present && number > maximum {
+			report("expected at most %v", maximum)
+		}
+	}
+	switch typed := value.(type) {
+	case []interface{}:
+		if minimum, present := oapiNumber(schema["minItems"]); present && float64(len(typed)) < minimum {
+			report("expected at least %v items (got %d)", minimum, len(typed))
+		}
+		if maximum, present := oapiNumber(schema["maxItems"]); present && float64(len(typed)) > maximum {
+			report("expected at most %v items (got %d)", maximum, len(typed))
+		}
+		if items := oapiMap(schema["items"]); items != nil {
+			for index, item := range typed {
+				spec.oapiValidate(items, item, fmt.Sprintf("%s[%d]", field, index), problems)
+			}
+		}
+	case map[string]interface{}:
+		properties := oapiMap(schema["properties"])
+		for _, name := range oapiList(schema["required"]) {
+			if _, present := typed[fmt.Sprint(name)]; !present {
+				*problems = append(*problems, oapiField(field, fmt.Sprint(name))+": required field missing")
+			}
+		}
+		names := make([]string, 0, len(typed))
+		for name := range typed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property := oapiMap(properties[name]); property != nil {
+				spec.oapiValidate(property, typed[name], oapiField(field, name), problems)
+				continue
+			}
+			// Unknown fields are rejected unless the schema allows any (or defines no properties at all)
+			switch additional := schema["additionalProperties"].(type) {
+			case map[string]interface{}:
+				spec.oapiValidate(additional, typed[name], oapiField(field, name), problems)
+			case bool:
+				if !additional {
+					*problems = append(*problems, oapiField(field, name)+": unknown field")
+				}
+			default:
+				if len(properties) != 0 {
+					*problems = append(*problems, oapiField(field, name)+": unknown field")
+				}
+			}
+		}
+	}
+}
+
+// Lists the parameters of an operation (the ones of the path included) by name
+func (spec *oapiSpec) oapiParameters(method, path string) map[string]map[string]interface{} {
+	item := oapiMap(oapiMap(spec.document["paths"])[path])
+	declared := append(oapiList(item["parameters"]), oapiList(spec.operations[method+" "+path]["parameters"])...)
+	parameters := make(map[string]map[string]interface{})
+	for _, parameter := range declared {
+		parameter := spec.oapiResolve(oapiMap(parameter))
+		if where := parameter["in"]; where == "path" || where == "query" {
+			parameters[fmt.Sprint(parameter["name"])] = parameter
+		}
+	}
+	return parameters
+}
+
+// Converts the text of a parameter to the type of its schema (kept as is if it does not convert)
+func (spec *oapiSpec) oapiConvert(schema map[string]interface{}, text string) interface{} {
+	switch spec.oapiFlatten(schema)["type"] {
+	case "integer", "number":
+		if _, fail := strconv.ParseFloat(text, 64); fail == nil {
+			return json.Number(text)
+		}
+	case "boolean":
+		if parsed, fail := strconv.ParseBool(text); fail == nil {
+			return parsed
+		}
+	}
+	return text
+}
+
+// Validates the arguments of a request - the body along with the path & query variables merged into it
+// (the declared parameters are checked against their schemas, the other variables become fields of the body)
+func (spec *oapiSpec) oapiValidateArguments(method, path string, body []byte, variables map[string]string) error {
+	problems := make([]string, 0)
+	parameters := spec.oapiParameters(method, path)
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parameter := parameters[name]
+		text, present := variables[name]
+		if !present {
+			if parameter["required"] == true {
+				problems = append(problems, name+": required parameter missing")
+			}
+			continue
+		}
+		schema := oapiMap(parameter["schema"])
+		spec.oapiValidate(schema, spec.oapiConvert(schema, text), name, &problems)
+	}
+	schema := spec.oapiBodySchema(method, path)
+	merged := make(map[string]interface{})
+	for name, text := range variables {
+		if _, declared := parameters[name]; !declared {
+			merged[name] = text
+		}
+	}
+	if schema != nil && (len(bytes.TrimSpace(body)) != 0 || len(merged) != 0) {
+		var value interface{} = map[string]interface{}{}
+		if len(bytes.TrimSpace(body)) != 0 {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			if fail := decoder.Decode(&value); fail != nil {
+				return webFail(http.StatusBadRequest, "Malformed JSON body (%s)", fail)
+			}
+		}
+		if object, isObject := value.(map[string]interface{}); isObject {
+			for name, text := range merged {
+				object[name] = text
+			}
+			// The declared parameters replace the fields of the body (left out unless the body has such a field)
+			properties := oapiMap(spec.oapiFlatten(schema)["properties"])
+			for name, parameter := range parameters {
+				if text, present := variables[name]; !present {
+					continue
+				} else if _, isField := properties[name]; isField {
+					object[name] = spec.oapiConvert(oapiMap(parameter["schema"]), text)
+				} else {
+					delete(object, name)
+				}
+			}
+		}
+		spec.oapiValidate(schema, value, "", &problems)
+	}
+	if len(problems) != 0 {
+		return webFail(http.StatusBadRequest, "Invalid request - %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Serves the specification (as YAML or JSON) & the docs page
+func (spec *oapiSpec) oapiHandler(kind string, logger *log.Logger) http.HandlerFunc {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		logger.Printf("INFO: %s %s", request.Method, request.RequestURI)
+		var content []byte
+		switch kind {
+		case "yaml":
+			response.Header().Set("Content-Type", "application/yaml; charset=UTF-8")
+			content = spec.yaml
+		case "json":
+			response.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			content = spec.json
+		default:
+			page, fail := oapiFiles.ReadFile("openapi/docs.html")
+			if fail != nil {
+				http.Error(response, fail.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			content = page
+		}
+		if _, fail := response.Write(content); fail != nil {
+			logger.Printf("ERROR: Failed to write a reply (%s)", fail)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOapiRoutesSpecified(t *testing.T) {
+	spec, fail := oapiLoad()
+	if fail != nil {
+		t.Fatalf("Failed to load the specification (%s)", fail)
+	}
+	api := &api1{}
+	routes := append(webCommonRoutes(log.New(ioutil.Discard, "", 0)), api.api1Routes()...)
+	routes = append(routes, api.rest1Routes()...)
+	if missing := spec.oapiMissingRoutes(routes); len(missing) != 0 {
+		t.Errorf("Routes missing from the specification:\n%s", strings.Join(missing, "\n"))
+	}
+}
+
+func TestOapiDocumentsCurrent(t *testing.T) {
+	for _, document := range oapiDocuments {
+		embedded, fail := oapiFiles.ReadFile(document)
+		if fail != nil {
+			t.Fatalf("Failed to read the embedded %s (%s)", document, fail)
+		}
+		maintained, fail := ioutil.ReadFile(filepath.Join("..", "api", filepath.Base(document)))
+		if fail != nil {
+			t.Fatalf("Failed to read the maintained %s (%s)", document, fail)
+		}
+		if !bytes.Equal(embedded, maintained) {
+			t.Errorf("The embedded %s differs from the one in ../api (run go generate)", document)
+		}
+	}
+}
+
+func TestOapiSpecRoundTrip(t *testing.T) {
+	spec, fail := oapiLoad()
+	if fail != nil {
+		t.Fatalf("Failed to load the specification (%s)", fail)
+	}
+	parsed, fail := yamlParse(spec.yaml)
+	if fail != nil {
+		t.Fatalf("Failed to parse the served YAML (%s)", fail)
+	}
+	var fromJSON interface{}
+	if fail := json.Unmarshal(spec.json, &fromJSON); fail != nil {
+		t.Fatalf("Failed to parse the served JSON (%s)", fail)
+	}
+	if !yamlSameJSON(t, parsed, fromJSON) {
+		t.Errorf("Served YAML & JSON differ")
+	}
+	if _, present := oapiMap(oapiMap(spec.document["components"])["schemas"])["V2Levels"]; !present {
+		t.Errorf("Clashing component not renamed")
+	}
+}
+
+func TestOapiValidateArguments(t *testing.T) {
+	spec, fail := oapiLoad()
+	if fail != nil {
+		t.Fatalf("Failed to load the specification (%s)", fail)
+	}
+	cases := []struct {
+		method    string
+		path      string
+		body      string
+		variables map[string]string
+		problem   string // Empty if valid
+	}{
+		{http.MethodPost, "/v1/set-leds-pwm", `{"serial": 1, "payload": {"config": 3, "levels": [0, 0, 0, 0, 0, 0]}}`, nil, ""},
+		{http.MethodPost, "/v1/set-leds-pwm", `{"serial": 1, "payload": {"config": 3, "levels": [0, 0, 0, 0, 0, 0, 0]}}`, nil, "payload.levels: expected at most 6 items (got 7)"},
+		{http.MethodPost, "/v1/set-leds-pwm", `{"serial": "1", "payload": {"config": 3, "levels": [0, 0, 0, 0, 0, 0]}}`, nil, "serial: expected an integer"},
+		{http.MethodPost, "/v1/set-leds-pwm", `{"serial": 1, "payload": {"config": 3, "levels": [0, 0, 0, 0, 0, 0]}, "extra": 1}`, nil, "extra: unknown field"},
+		{http.MethodPost, "/v1/set-leds-pwm", `{"serial": 1`, nil, "Malformed JSON body"},
+		{http.MethodGet, "/api/jobs/{id}", "", map[string]string{"id": "7"}, ""},
+		{http.MethodGet, "/api/jobs/{id}", "", map[string]string{"id": "seven"}, "id: expected an integer"},
+		{http.MethodGet, "/api/history/diff", "", map[string]string{"to": "3"}, "from: required parameter missing"},
+		{http.MethodGet, "/api/history/diff", "", map[string]string{"from": "1", "to": "3"}, ""},
+		{http.MethodGet, "/v2/fixtures/{serial}/leds", "", map[string]string{"serial": "12", "mode": "dim"}, "mode: expected one of irradiance, pwm"},
+		{http.MethodPost, "/api/import-schedules", `{"schedules": []}`, map[string]string{"dry_run": "true"}, "dry_run: expected a boolean"},
+	}
+	for _, tested := range cases {
+		fail := spec.oapiValidateArguments(tested.method, tested.path, []byte(tested.body), tested.variables)
+		switch {
+		case len(tested.problem) == 0 && fail != nil:
+			t.Errorf("%s %s %s %v: %s", tested.method, tested.path, tested.body, tested.variables, fail)
+		case len(tested.problem) != 0 && (fail == nil || !strings.Contains(fail.Error(), tested.problem)):
+			t.Errorf("%s %s %s %v: %v (expecting %q)", tested.method, tested.path, tested.body, tested.variables, fail, tested.problem)
+		case fail != nil && fail.(*webStatusError).status != http.StatusBadRequest:
+			t.Errorf("%s %s: status %d", tested.method, tested.path, fail.(*webStatusError).status)
+		}
+	}
+}
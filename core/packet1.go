@@ -96,6 +96,12 @@ const (
 	pckt1ScheduleSearchByIndex = 1
 )
 
+// The fixture refuses (NACKs) schedules beyond 200 but no more than 190 are to be stored - see FC14 (Set Schedule) and
+// "Scheduled Lighting Control" in docs/ProtocolSpecificationAndSystemIntegration.md (the fixtures cannot be queried)
+const (
+	pckt1ScheduleCapacity = 190
+)
+
 const (
 	pckt1LEDsModule0Mask     = uint8(0x1)
 	pckt1LEDsModule0Enabled  = uint8(0x1)
@@ -515,26 +521,30 @@ func pckt1Parse(buffer *bytes.Buffer, identifier string, logger *log.Logger) []p
 		header, fail := pckt1DecodeHeader(octets)
 		if fail != nil {
 			logger.Printf("ERROR: [%s] Failed to decode header (%s); Skipping %02x", identifier, fail, octets[0])
+			mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "header")
 			pckt1Skip(buffer, 1, logger)
 			continue
 		}
 		code := header.FunctionCode
 		if !pckt1KnownCode(code) {
 			logger.Printf("WARNING: [%s] Bad function code (%d); Skipping %02x", identifier, code, octets[0])
+			mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "function_code")
 			pckt1Skip(buffer, 1, logger)
 			continue
 		}
-		if len(octets) < pckt1HeaderSize+pckt1LookupPayloadSizeUntilVariantDifferentiator(code) {
+		if len(octets) < pckt1HeaderSize+pckt1LookupPayloadSizeUntilVariantDifferentiator(code) && !pckt1CheckShortNACK(octets[pckt1HeaderSize:], *header) {
 			break
 		}
 		prepared, payloadSize, fail := pckt1PrepareReplyPayload(octets[pckt1HeaderSize:], *header)
 		if fail != nil {
 			logger.Printf("WARNING: [%s] Bad variant (%s); Skipping %02x", identifier, fail, octets[0])
+			mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "variant")
 			pckt1Skip(buffer, 1, logger)
 			continue
 		}
 		if prepared == nil {
 			logger.Printf("WARNING: [%s] Bad variant; Skipping %02x", identifier, octets[0])
+			mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "variant")
 			pckt1Skip(buffer, 1, logger)
 			continue
 		}
@@ -545,6 +555,7 @@ func pckt1Parse(buffer *bytes.Buffer, identifier string, logger *log.Logger) []p
 		crc16, fail := pckt1DecodeCRC16(octets[size-pckt1CRC16Size:])
 		if fail != nil {
 			logger.Printf("ERROR: [%s] Failed to decode CRC (%s); Skipping %02x", identifier, fail, octets[0])
+			mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "checksum")
 			pckt1Skip(buffer, 1, logger)
 			continue
 		}
@@ -552,6 +563,7 @@ func pckt1Parse(buffer *bytes.Buffer, identifier string, logger *log.Logger) []p
 			packet, fail := pckt1Decode(octets)
 			if fail != nil {
 				logger.Printf("ERROR: [%s] Failed to decode packet (%s); Skipping %02x", identifier, fail, octets[0])
+				mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "decode")
 				pckt1Skip(buffer, 1, logger)
 				continue
 			}
@@ -560,6 +572,7 @@ func pckt1Parse(buffer *bytes.Buffer, identifier string, logger *log.Logger) []p
 			pckt1Skip(buffer, size, logger)
 		} else {
 			logger.Printf("WARNING: [%s] Bad checksum; Skipping %02x", identifier, octets[0])
+			mtrcAdd(mtrcPacketErrors, 1, "adapter", identifier, "reason", "checksum")
 			pckt1Skip(buffer, 1, logger)
 		}
 	}
@@ -577,6 +590,21 @@ func pckt1PrepareGenericReplyPayload(octets []byte) (pckt1Payload, int) {
 	return nil, 0
 }
 
+// Tells if the payload is a NACK of a command replying with a longer payload otherwise (no variant differentiator
+// precedes the error code, so the checksum following it is what tells it apart)
+func pckt1CheckShortNACK(octets []byte, header pckt1Header) bool {
+	size := binary.Size(pckt1ReplyPayloadGenericNOK{})
+	if header.FunctionCode != pckt1FunctionCodeGetSchedule || len(octets) < size+pckt1CRC16Size || octets[0] != 0 {
+		return false
+	}
+	encoded, fail := pckt1EncodeHeader(header)
+	if fail != nil {
+		return false
+	}
+	crc16, fail := pckt1DecodeCRC16(octets[size:])
+	return fail == nil && pckt1CRC16(append(encoded, octets[:size]...)) == crc16
+}
+
 func pckt1PrepareReplyPayload(octets []byte, header pckt1Header) (pckt1Payload, int, error) {
 	payload := pckt1Payload(nil)
 	size := 0
@@ -627,7 +655,9 @@ func pckt1PrepareReplyPayload(octets []byte, header pckt1Header) (pckt1Payload,
 	case pckt1FunctionCodeSetSchedule:
 		payload, size = pckt1PrepareGenericReplyPayload(octets)
 	case pckt1FunctionCodeGetSchedule:
-		if len(octets) > 12 {
+		if pckt1CheckShortNACK(octets, header) {
+			payload, size = new(pckt1ReplyPayloadGenericNOK), binary.Size(pckt1ReplyPayloadGenericNOK{})
+		} else if len(octets) > 12 {
 			switch octets[12] & pckt1UseMask {
 			case pckt1UsePWM:
 				payload = new(pckt1ReplyPayloadGetSchedulePWM)
@@ -692,6 +722,9 @@ func pckt1LookupPayloadSizeUntilVariantDifferentiator(code pckt1FunctionCode) in
 		return 1
 	case pckt1FunctionCodeGetSchedule:
 		return 13
+	case pckt1FunctionCodeSetModuleCalibration, pckt1FunctionCodeSetSerialNumber, pckt1FunctionCodeSetShortAddress, pckt1FunctionCodeSetGroupID, pckt1FunctionCodeSetFixtureInfo, pckt1FunctionCodeSetTimeReference, pckt1FunctionCodeSetSchedule, pckt1FunctionCodeDeleteSchedule, pckt1FunctionCodeDeleteAllSchedules, pckt1FunctionCodeStopScheduling, pckt1FunctionCodeResumeScheduling, pckt1FunctionCodeSetIlluminanceConfiguration, pckt1FunctionCodeResetForFirmwareUpdate:
+		// A NACK is told apart by the error code following the first octet (an ACK is followed by the CRC anyway)
+		return 2
 	default:
 		return 0
 	}
@@ -0,0 +1,162 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for conversions between energy (W/m²) and photon (µmol/m²/s) units
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	phtnUnitsEnergy  = "W/m2"      // Units of the irradiance as used by the fixtures
+	phtnUnitsPhotons = "umol/m2/s" // Units of the photon flux density
+	phtnMolarEnergy  = 119.6266    // Energy (J) of a micromole of photons times the wavelength (nm)
+	phtnPARFirst     = 400.0
+	phtnPARLast      = 700.0
+	phtnStep         = 5.0
+)
+
+// Holds a sample of a spectral distribution (relative energy at the wavelength in nm)
+type phtnSample struct {
+	Wavelength float64 `json:"wavelength"`
+	Weight     float64 `json:"weight"`
+}
+
+// Holds the spectral metadata of a channel
+type phtnChannel struct {
+	Name        string       `json:"name"`
+	Peak        float64      `json:"peak"`
+	Width       float64      `json:"width,omitempty"`
+	Spectrum    []phtnSample `json:"spectrum"`
+	Factor      float64      `json:"factor"`
+	PARFraction float64      `json:"par_fraction"`
+}
+
+// Holds levels in both units along with the totals
+type phtnReport struct {
+	Energy  schdlLevels `json:"w_m2"`
+	Photons schdlLevels `json:"umol_m2_s"`
+	PPFD    float64     `json:"ppfd"`
+	Total   float64     `json:"photon_flux"`
+}
+
+// Spectral metadata of the channels (narrow band channels are described by the peak & full width at half maximum)
+var phtnChannels = []phtnChannel{
+	phtnNarrowBand("UVA", 385, 12),
+	phtnNarrowBand("Blue", 450, 20),
+	phtnNarrowBand("Green", 521, 32),
+	phtnNarrowBand("HyperRed", 660, 20),
+	phtnNarrowBand("FarRed", 735, 30),
+	phtnBroadBand("White", 450, []phtnSample{
+		{400, 0.05}, {420, 0.25}, {440, 0.75}, {450, 1.00}, {460, 0.70}, {480, 0.25}, {500, 0.30},
+		{520, 0.45}, {540, 0.55}, {560, 0.60}, {580, 0.60}, {600, 0.57}, {620, 0.50}, {640, 0.40},
+		{660, 0.30}, {680, 0.20}, {700, 0.13}, {720, 0.08}, {740, 0.05}, {760, 0.03}, {780, 0.02},
+	}),
+}
+
+// Describes a narrow band channel by a Gaussian spectral distribution
+func phtnNarrowBand(name string, peak, width float64) phtnChannel {
+	sigma := width / (2 * math.Sqrt(2*math.Ln2))
+	spectrum := make([]phtnSample, 0)
+	for wavelength := peak - 3*width; wavelength <= peak+3*width; wavelength += phtnStep {
+		spectrum = append(spectrum, phtnSample{wavelength, math.Exp(-math.Pow(wavelength-peak, 2) / (2 * sigma * sigma))})
+	}
+	channel := phtnBroadBand(name, peak, spectrum)
+	channel.Width = width
+	return channel
+}
+
+// Describes a broad band channel by its spectral distribution
+func phtnBroadBand(name string, peak float64, spectrum []phtnSample) phtnChannel {
+	energy, photons, photonsPAR := 0.0, 0.0, 0.0
+	for _, sample := range spectrum {
+		energy += sample.Weight
+		photons += sample.Weight * sample.Wavelength
+		if sample.Wavelength >= phtnPARFirst && sample.Wavelength <= phtnPARLast {
+			photonsPAR += sample.Weight * sample.Wavelength
+		}
+	}
+	return phtnChannel{name, peak, 0, spectrum, photons / energy / phtnMolarEnergy, photonsPAR / photons}
+}
+
+// Normalizes the name of the units (W/m2 if empty)
+func phtnParseUnits(units string) (string, error) {
+	normalized := strings.NewReplacer("µ", "u", "μ", "u", "²", "2", " ", "", "·", "/").Replace(strings.ToLower(units))
+	switch normalized {
+	case "", "w/m2":
+		return phtnUnitsEnergy, nil
+	case "umol/m2/s", "umol/m2s", "umol/s/m2":
+		return phtnUnitsPhotons, nil
+	}
+	return "", fmt.Errorf("Unknown units %s (must be %s or %s)", units, phtnUnitsEnergy, phtnUnitsPhotons)
+}
+
+// Converts levels between the units
+func phtnConvert(levels schdlLevels, from, to string) (schdlLevels, error) {
+	from, failFrom := phtnParseUnits(from)
+	if failFrom != nil {
+		return nil, failFrom
+	}
+	to, failTo := phtnParseUnits(to)
+	if failTo != nil {
+		return nil, failTo
+	}
+	converted := make(schdlLevels, len(levels))
+	for channel, level := range levels {
+		converted[channel] = level
+		if from != to && channel < len(phtnChannels) {
+			factor := phtnChannels[channel].Factor
+			if from == phtnUnitsPhotons {
+				factor = 1 / factor
+			}
+			converted[channel] = phtnRound(level * factor)
+		}
+	}
+	return converted, nil
+}
+
+// Reports the levels (in W/m²) in both units along with the PPFD (400-700 nm) and the total photon flux density
+func phtnReportLevels(levels schdlLevels) phtnReport {
+	photons, _ := phtnConvert(levels, phtnUnitsEnergy, phtnUnitsPhotons)
+	report := phtnReport{levels, photons, 0, 0}
+	for channel, flux := range photons {
+		report.Total += flux
+		if channel < len(phtnChannels) {
+			report.PPFD += flux * phtnChannels[channel].PARFraction
+		}
+	}
+	report.PPFD = phtnRound(report.PPFD)
+	report.Total = phtnRound(report.Total)
+	return report
+}
+
+// Rounds the value to a precision meaningful for the fixtures
+func phtnRound(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
+
+// Converts the levels of the schedules given in photon units to the units of the fixtures
+func phtnResolveSchedules(schedules []schdlAttached) ([]schdlAttached, error) {
+	resolved := make([]schdlAttached, 0, len(schedules))
+	problems := make([]string, 0)
+	for index, schedule := range schedules {
+		if len(schedule.Units) != 0 {
+			units, fail := phtnParseUnits(schedule.Units)
+			switch {
+			case fail != nil:
+				problems = append(problems, fmt.Sprintf("Schedule #%d: %s", index+1, fail))
+			case units == phtnUnitsPhotons && schdlModeOf(schedule.schdlDetached) == schdlModePWM:
+				problems = append(problems, fmt.Sprintf("Schedule #%d: Units %s cannot be used in %s mode", index+1, units, schdlModePWM))
+			default:
+				schedule.Levels, _ = phtnConvert(schedule.Levels, units, phtnUnitsEnergy)
+				schedule.Units = ""
+			}
+		}
+		resolved = append(resolved, schedule)
+	}
+	if len(problems) != 0 {
+		return resolved, fmt.Errorf("Failed to convert units (%s)", strings.Join(problems, "; "))
+	}
+	return resolved, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPhtnParseUnits(t *testing.T) {
+	cases := []struct {
+		units    string
+		expected string // Empty if failing
+	}{
+		{"", phtnUnitsEnergy},
+		{"W/m²", phtnUnitsEnergy},
+		{"µmol/m²/s", phtnUnitsPhotons},
+		{"umol / m2 s", phtnUnitsPhotons},
+		{"μmol·m²/s", phtnUnitsPhotons},
+		{"lux", ""},
+	}
+	for _, tested := range cases {
+		units, fail := phtnParseUnits(tested.units)
+		if len(tested.expected) == 0 {
+			if fail == nil {
+				t.Errorf("%q: parsed as %s (expecting a failure)", tested.units, units)
+			}
+		} else if fail != nil {
+			t.Errorf("%q: %s", tested.units, fail)
+		} else if units != tested.expected {
+			t.Errorf("%q: parsed as %s (expecting %s)", tested.units, units, tested.expected)
+		}
+	}
+}
+
+func TestPhtnConvert(t *testing.T) {
+	cases := []struct {
+		levels   schdlLevels
+		from     string
+		to       string
+		expected schdlLevels // Nil if failing
+	}{
+		{schdlLevels{0, 1, 0, 1, 0, 0}, phtnUnitsEnergy, phtnUnitsPhotons, schdlLevels{0, 3.762, 0, 5.517, 0, 0}},
+		{schdlLevels{0, 3.762, 0, 5.517, 0, 0}, "umol/m2/s", "", schdlLevels{0, 1, 0, 1, 0, 0}},
+		{schdlLevels{1, 2, 3, 4, 5, 6}, "W/m2", "", schdlLevels{1, 2, 3, 4, 5, 6}},
+		{schdlLevels{1}, "lux", phtnUnitsEnergy, nil},
+	}
+	for _, tested := range cases {
+		converted, fail := phtnConvert(tested.levels, tested.from, tested.to)
+		if tested.expected == nil {
+			if fail == nil {
+				t.Errorf("%v %s: converted to %v (expecting a failure)", tested.levels, tested.from, converted)
+			}
+			continue
+		}
+		if fail != nil {
+			t.Errorf("%v %s: %s", tested.levels, tested.from, fail)
+			continue
+		}
+		for channel := range tested.expected {
+			if math.Abs(converted[channel]-tested.expected[channel]) > 0.002 {
+				t.Errorf("%v %s: converted to %v (expecting %v)", tested.levels, tested.from, converted, tested.expected)
+				break
+			}
+		}
+	}
+	levels := schdlLevels{0.5, 10, 20, 40, 5, 30}
+	photons, _ := phtnConvert(levels, phtnUnitsEnergy, phtnUnitsPhotons)
+	energy, _ := phtnConvert(photons, phtnUnitsPhotons, phtnUnitsEnergy)
+	for channel := range levels {
+		if math.Abs(energy[channel]-levels[channel]) > 0.001 {
+			t.Errorf("Levels %v converted back as %v", levels, energy)
+			break
+		}
+	}
+}
@@ -5,6 +5,7 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,11 +15,43 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+const (
+	dataLockRefresh = 5 * time.Second
+	dataLockStale   = 30 * time.Second // A lock not refreshed for so long was left behind by a crashed process
+)
+
+// Functions to be called before the application exits
+var exitHooks []func()
+
+// Guards the functions to be called before the application exits
+var exitLock sync.Mutex
+
+// Registers a function to be called before the application exits
+func exitRegister(hook func()) {
+	exitLock.Lock()
+	defer exitLock.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+// Calls the registered functions (in reverse order) and exits
+func exitRun(code int) {
+	exitLock.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitLock.Unlock()
+	for index := len(hooks) - 1; index >= 0; index-- {
+		hooks[index]()
+	}
+	os.Exit(code)
+}
+
 // Registers a handler for terminating signals
 func signalHandling() {
 	signals := make(chan os.Signal, 1)
@@ -28,7 +61,7 @@ func signalHandling() {
 		// Closes the CLI if any terminating signal occurs
 		<-signals
 		fmt.Printf("\nExiting\n")
-		os.Exit(0)
+		exitRun(0)
 	}()
 }
 
@@ -83,6 +116,105 @@ func logBase() string {
 	return path.Join(path.Dir(os.Args[0]), "logs")
 }
 
+// Returns the base directory for persisted data (next to the logs)
+func dataBase() string {
+	return path.Join(path.Dir(os.Args[0]), "data")
+}
+
+// Persists a value as JSON file in the data directory
+func dataWrite(name string, value interface{}) error {
+	content, fail := json.MarshalIndent(value, "", "  ")
+	if fail != nil {
+		return fail
+	}
+	if fail := os.MkdirAll(dataBase(), 0755); fail != nil {
+		return fail
+	}
+	target := path.Join(dataBase(), name)
+	if fail := os.MkdirAll(path.Dir(target), 0755); fail != nil {
+		return fail
+	}
+	temporary := target + ".tmp"
+	if fail := ioutil.WriteFile(temporary, content, 0644); fail != nil {
+		return fail
+	}
+	return os.Rename(temporary, target)
+}
+
+// Loads a value from JSON file in the data directory
+func dataRead(name string, value interface{}) error {
+	content, fail := ioutil.ReadFile(path.Join(dataBase(), name))
+	if fail != nil {
+		return fail
+	}
+	return json.Unmarshal(content, value)
+}
+
+// Removes a file from the data directory (if present)
+func dataRemove(name string) error {
+	if fail := os.Remove(path.Join(dataBase(), name)); fail != nil && !os.IsNotExist(fail) {
+		return fail
+	}
+	return nil
+}
+
+// Lists the files of a subdirectory of the data directory (empty if missing)
+func dataList(directory string) ([]string, error) {
+	files, fail := ioutil.ReadDir(path.Join(dataBase(), directory))
+	if fail != nil && !os.IsNotExist(fail) {
+		return nil, fail
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasSuffix(file.Name(), ".tmp") {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+// Takes a lock file in the data directory shared by all the processes (waits until free) and returns its release - the
+// holder keeps refreshing it so the lock left behind by a crashed process turns stale and gets taken over
+func dataLock(name string) (func(), error) {
+	if fail := os.MkdirAll(dataBase(), 0755); fail != nil {
+		return nil, fail
+	}
+	target := path.Join(dataBase(), name)
+	for {
+		handle, fail := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if fail == nil {
+			fmt.Fprintf(handle, "%d\n", os.Getpid())
+			handle.Close()
+			break
+		}
+		if !os.IsExist(fail) {
+			return nil, fail
+		}
+		if info, fail := os.Stat(target); fail == nil && time.Since(info.ModTime()) > dataLockStale {
+			os.Remove(target)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(dataLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				os.Chtimes(target, now, now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(target)
+	}, nil
+}
+
 // Initializes logging for the application
 func logInit() *log.Logger {
 	var output io.Writer
@@ -0,0 +1,215 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for experiment plans (recipes, fixture sets, treatments & phases)
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	planStorage = "plan.json"
+)
+
+// Maps a recipe to fixture sets
+type planTreatment struct {
+	Recipe      string   `json:"recipe"`
+	FixtureSets []string `json:"fixture_sets"`
+}
+
+// Holds a period of the experiment (daily from start time to stop time, overriding phases of lower priority)
+type planPhase struct {
+	Name       string            `json:"name"`
+	StartDate  string            `json:"start_date"`
+	StopDate   string            `json:"stop_date"`
+	StartTime  string            `json:"start_time"`
+	StopTime   string            `json:"stop_time"`
+	Treatments []string          `json:"treatments,omitempty"`
+	Recipes    map[string]string `json:"recipes,omitempty"`
+	Priority   int               `json:"priority,omitempty"`
+}
+
+// Holds the experiment plan
+type planDocument struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Recipes     map[string]rcpRecipe     `json:"recipes"`
+	FixtureSets map[string]schdlSerials  `json:"fixture_sets"`
+	Treatments  map[string]planTreatment `json:"treatments"`
+	Phases      []planPhase              `json:"phases"`
+}
+
+// Holds the experiment plan attached to the upload
+type planAttached struct {
+	Plan      planDocument    `json:"plan"`
+	Schedules []schdlAttached `json:"schedules"`
+	Imported  uint32          `json:"imported"`
+}
+
+// Collects all problems found in an experiment plan
+type planIssues []string
+
+func (issues planIssues) Error() string {
+	return fmt.Sprintf("Invalid plan (%d problems) - %s", len(issues), strings.Join(issues, "; "))
+}
+
+// Adds a problem to the list
+func (issues *planIssues) add(format string, arguments ...interface{}) {
+	*issues = append(*issues, fmt.Sprintf(format, arguments...))
+}
+
+// Parses an experiment plan (JSON, or YAML unless it starts as a JSON object)
+func planParse(content []byte) (*planDocument, error) {
+	if trimmed := bytes.TrimSpace(content); len(trimmed) != 0 && trimmed[0] != '{' {
+		document, fail := yamlParse(content)
+		if fail != nil {
+			return nil, fmt.Errorf("Failed to parse plan (%s)", fail)
+		}
+		if content, fail = json.Marshal(document); fail != nil {
+			return nil, fmt.Errorf("Failed to parse plan (%s)", fail)
+		}
+	}
+	var plan planDocument
+	if fail := json.Unmarshal(content, &plan); fail != nil {
+		return nil, fmt.Errorf("Failed to parse plan (%s)", fail)
+	}
+	return &plan, nil
+}
+
+// Returns a sorted copy of the names
+func planSorted(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Compiles the experiment plan into schedules (reports all problems found at once)
+func planCompile(plan *planDocument) ([]schdlAttached, error) {
+	issues := make(planIssues, 0)
+	for name, recipe := range plan.Recipes {
+		recipe.Name = name
+		if fail := rcpCheck(recipe); fail != nil {
+			issues.add("%s", fail)
+		}
+	}
+	for name, treatment := range plan.Treatments {
+		if _, fail := planLookUpRecipe(plan, treatment.Recipe); fail != nil {
+			issues.add("Treatment %s refers to unknown recipe %s", name, treatment.Recipe)
+		}
+		if len(treatment.FixtureSets) == 0 {
+			issues.add("Treatment %s has no fixture sets", name)
+		}
+		for _, set := range treatment.FixtureSets {
+			if _, present := plan.FixtureSets[set]; !present {
+				issues.add("Treatment %s refers to unknown fixture set %s", name, set)
+			}
+		}
+	}
+	schedules := make([]schdlAttached, 0)
+	for index, phase := range plan.Phases {
+		label := phase.Name
+		if len(label) == 0 {
+			label = fmt.Sprintf("#%d", index+1)
+		}
+		start, failStart := schdlParseDate(phase.StartDate, phase.StartTime)
+		if failStart != nil {
+			issues.add("Phase %s has invalid start (%s)", label, failStart)
+		}
+		stop, failStop := schdlParseDate(phase.StopDate, phase.StopTime)
+		if failStop != nil {
+			issues.add("Phase %s has invalid stop (%s)", label, failStop)
+		}
+		if failStart == nil && failStop == nil && stop <= start {
+			issues.add("Phase %s must stop after it starts", label)
+		}
+		treatments := phase.Treatments
+		if len(treatments) == 0 {
+			treatments = make([]string, 0, len(plan.Treatments))
+			for name := range plan.Treatments {
+				treatments = append(treatments, name)
+			}
+		}
+		for treatment := range phase.Recipes {
+			if _, present := plan.Treatments[treatment]; !present {
+				issues.add("Phase %s overrides recipe of unknown treatment %s", label, treatment)
+			}
+		}
+		for _, name := range planSorted(treatments) {
+			treatment, present := plan.Treatments[name]
+			if !present {
+				issues.add("Phase %s refers to unknown treatment %s", label, name)
+				continue
+			}
+			recipeName := treatment.Recipe
+			if override, present := phase.Recipes[name]; present {
+				recipeName = override
+			}
+			recipe, fail := planLookUpRecipe(plan, recipeName)
+			if fail != nil {
+				issues.add("Phase %s refers to unknown recipe %s (treatment %s)", label, recipeName, name)
+				continue
+			}
+			serials := make(schdlSerials, 0)
+			for _, set := range treatment.FixtureSets {
+				serials = append(serials, plan.FixtureSets[set]...)
+			}
+			schedule := schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: recipe.Levels, Mode: recipe.Mode, Modules: recipe.Modules, Recipe: recipeName, Priority: phase.Priority, Units: recipe.Units}
+			schedules = append(schedules, schdlAttached{schdlDetached: schedule, Serials: planUniqueSerials(serials)})
+		}
+	}
+	if len(issues) != 0 {
+		return nil, issues
+	}
+	schedules, fail := phtnResolveSchedules(schedules)
+	if fail != nil {
+		return nil, fail
+	}
+	if _, fail := schdlAggregateSchedules(schedules, false); fail != nil {
+		return nil, fail
+	}
+	return schedules, nil
+}
+
+// Looks up a recipe in the plan falling back to the recipe library
+func planLookUpRecipe(plan *planDocument, name string) (rcpRecipe, error) {
+	if recipe, present := plan.Recipes[name]; present {
+		return recipe, nil
+	}
+	return rcpGet(name)
+}
+
+// Sorts serials dropping duplicates
+func planUniqueSerials(serials schdlSerials) schdlSerials {
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	unique := make(schdlSerials, 0, len(serials))
+	for index, serial := range serials {
+		if index == 0 || serials[index-1] != serial {
+			unique = append(unique, serial)
+		}
+	}
+	return unique
+}
+
+// Stores the experiment plan attached to the upload
+func planStore(plan *planDocument, schedules []schdlAttached) error {
+	attached := planAttached{*plan, schedules, uint32(time.Now().Unix())}
+	return dataWrite(planStorage, &attached)
+}
+
+// Loads the experiment plan attached to the latest upload
+func planLoad() (*planAttached, error) {
+	var attached planAttached
+	if fail := dataRead(planStorage, &attached); fail != nil {
+		return nil, fail
+	}
+	return &attached, nil
+}
+
+// Detaches the experiment plan (e.g. when schedules are uploaded without one)
+func planDetach() error {
+	return dataRemove(planStorage)
+}
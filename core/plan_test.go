@@ -0,0 +1,50 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanParse(t *testing.T) {
+	fromJSON, fail := planParse([]byte(`{
+  "name": "Trial 12",
+  "recipes": {"baseline": {"levels": [0, 20, 20, 40, 10, 30]}},
+  "fixture_sets": {"bench-a": [206001, 206002]},
+  "treatments": {"control": {"recipe": "baseline", "fixture_sets": ["bench-a"]}},
+  "phases": [{"name": "growth", "start_date": "2021-03-15", "stop_date": "2021-04-30", "start_time": "06:00:00", "stop_time": "22:00:00"}]
+}`))
+	if fail != nil {
+		t.Fatalf("Failed to parse the JSON plan (%s)", fail)
+	}
+	fromYAML, fail := planParse([]byte(`# Same plan
+name: Trial 12
+recipes:
+  baseline:
+    levels: [0, 20, 20, 40, 10, 30]
+fixture_sets:
+  bench-a: [206001, 206002]
+treatments:
+  control:
+    recipe: baseline
+    fixture_sets:
+      - bench-a
+phases:
+  - name: growth
+    start_date: "2021-03-15"
+    stop_date: 2021-04-30
+    start_time: "06:00:00"
+    stop_time: 22:00:00
+`))
+	if fail != nil {
+		t.Fatalf("Failed to parse the YAML plan (%s)", fail)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("Plans differ:\n%+v\n%+v", fromJSON, fromYAML)
+	}
+	for _, content := range []string{`{"name": 1}`, "name: [1", "phases: 3"} {
+		if _, fail := planParse([]byte(content)); fail == nil {
+			t.Errorf("%q: parsed (expecting a failure)", content)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for the library of light recipes
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	rcpStorage = "recipes.json"
+)
+
+// Holds a named light recipe
+type rcpRecipe struct {
+	Name        string       `json:"name,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Levels      schdlLevels  `json:"levels"`
+	Mode        schdlMode    `json:"mode,omitempty"`
+	Modules     schdlModules `json:"modules,omitempty"`
+	Units       string       `json:"units,omitempty"`
+}
+
+// Guards the recipe library on disk
+var rcpLock sync.Mutex
+
+// Checks if the recipe is valid
+func rcpCheck(recipe rcpRecipe) error {
+	if len(strings.TrimSpace(recipe.Name)) == 0 {
+		return fmt.Errorf("Recipe name must not be empty")
+	}
+	if len(recipe.Levels) != 6 {
+		return fmt.Errorf("Recipe %s must have 6 levels (has %d)", recipe.Name, len(recipe.Levels))
+	}
+	switch recipe.Mode {
+	case "", schdlModeIrradiance, schdlModePWM:
+	default:
+		return fmt.Errorf("Recipe %s has unknown mode %s", recipe.Name, recipe.Mode)
+	}
+	if units, fail := phtnParseUnits(recipe.Units); fail != nil {
+		return fmt.Errorf("Recipe %s is invalid (%s)", recipe.Name, fail)
+	} else if units == phtnUnitsPhotons && recipe.Mode == schdlModePWM {
+		return fmt.Errorf("Recipe %s cannot use units %s in %s mode", recipe.Name, units, schdlModePWM)
+	}
+	if fail := schdlCheckLevelsFor(recipe.Levels, recipe.Mode); fail != nil {
+		return fmt.Errorf("Recipe %s is invalid (%s)", recipe.Name, fail)
+	}
+	return nil
+}
+
+// Loads the recipe library (empty if not created yet)
+func rcpLoad() (map[string]rcpRecipe, error) {
+	recipes := make(map[string]rcpRecipe)
+	if fail := dataRead(rcpStorage, &recipes); fail != nil && !os.IsNotExist(fail) {
+		return nil, fmt.Errorf("Failed to load recipes (%s)", fail)
+	}
+	return recipes, nil
+}
+
+// Lists all recipes ordered by name
+func rcpList() ([]rcpRecipe, error) {
+	rcpLock.Lock()
+	defer rcpLock.Unlock()
+	recipes, fail := rcpLoad()
+	if fail != nil {
+		return nil, fail
+	}
+	list := make([]rcpRecipe, 0, len(recipes))
+	for _, recipe := range recipes {
+		list = append(list, recipe)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Looks up a recipe by name
+func rcpGet(name string) (rcpRecipe, error) {
+	rcpLock.Lock()
+	defer rcpLock.Unlock()
+	recipes, fail := rcpLoad()
+	if fail != nil {
+		return rcpRecipe{}, fail
+	}
+	recipe, present := recipes[name]
+	if !present {
+		return rcpRecipe{}, fmt.Errorf("Unknown recipe - %s", name)
+	}
+	return recipe, nil
+}
+
+// Validates and saves (creates or replaces) a recipe
+func rcpSave(recipe rcpRecipe) error {
+	if fail := rcpCheck(recipe); fail != nil {
+		return fail
+	}
+	recipe.Modules = schdlNormalizeModules(recipe.Modules)
+	rcpLock.Lock()
+	defer rcpLock.Unlock()
+	recipes, fail := rcpLoad()
+	if fail != nil {
+		return fail
+	}
+	recipes[recipe.Name] = recipe
+	return dataWrite(rcpStorage, &recipes)
+}
+
+// Deletes a recipe
+func rcpDelete(name string) error {
+	rcpLock.Lock()
+	defer rcpLock.Unlock()
+	recipes, fail := rcpLoad()
+	if fail != nil {
+		return fail
+	}
+	if _, present := recipes[name]; !present {
+		return fmt.Errorf("Unknown recipe - %s", name)
+	}
+	delete(recipes, name)
+	return dataWrite(rcpStorage, &recipes)
+}
+
+// Fills in the levels (and configuration) of the schedules referring to recipes
+// (the schedules referring to unknown recipes are returned unresolved along with an error)
+func rcpResolveSchedules(schedules []schdlAttached) ([]schdlAttached, error) {
+	resolved := make([]schdlAttached, 0, len(schedules))
+	unknown := make([]string, 0)
+	for _, schedule := range schedules {
+		if len(schedule.Recipe) != 0 {
+			if recipe, fail := rcpGet(schedule.Recipe); fail == nil {
+				schedule.Levels = recipe.Levels
+				schedule.Mode = recipe.Mode
+				schedule.Modules = recipe.Modules
+				schedule.Units = recipe.Units
+			} else {
+				unknown = append(unknown, fail.Error())
+			}
+		}
+		resolved = append(resolved, schedule)
+	}
+	if len(unknown) != 0 {
+		return resolved, fmt.Errorf("Failed to resolve recipes (%s)", strings.Join(unknown, "; "))
+	}
+	return resolved, nil
+}
@@ -0,0 +1,487 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code handles the resource-oriented REST API (v2) for PHYTOFY RL v1
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Identifies the fixture (and the schedule) addressed by the path
+type rest1Target struct {
+	Serial json.Number `json:"serial,omitempty"`
+	ID     json.Number `json:"id,omitempty"`
+	Units  string      `json:"units,omitempty"`
+}
+
+// Tells which adapter (bus) reaches a fixture under which short address
+type rest1Address struct {
+	Adapter      dptr1Identifier   `json:"adapter"`
+	ShortAddress pckt1ShortAddress `json:"short_address"`
+}
+
+// Represents a fixture
+type rest1Fixture struct {
+	Serial    schdlSerial                      `json:"serial"`
+	Addresses []rest1Address                   `json:"addresses"`
+	Info      *pckt1ReplyPayloadGetFixtureInfo `json:"info,omitempty"`
+	GroupID   *uint32                          `json:"group_id,omitempty"`
+}
+
+// Represents a fixture reached by an adapter
+type rest1Member struct {
+	Serial       schdlSerial       `json:"serial"`
+	ShortAddress pckt1ShortAddress `json:"short_address"`
+}
+
+// Represents an adapter (one bus)
+type rest1Adapter struct {
+	ID       dptr1Identifier `json:"id"`
+	Address  string          `json:"address"`
+	Port     int             `json:"port"`
+	LastSeen uint32          `json:"last_seen"`
+	Fixtures []rest1Member   `json:"fixtures"`
+}
+
+// Represents the LED channels of a fixture
+type rest1LEDs struct {
+	Levels  schdlLevels  `json:"levels"`
+	Mode    schdlMode    `json:"mode,omitempty"`
+	Modules schdlModules `json:"modules,omitempty"`
+	Recipe  string       `json:"recipe,omitempty"`
+	Units   string       `json:"units,omitempty"`
+}
+
+// Represents a schedule stored on a fixture
+type rest1Schedule struct {
+	ID uint32 `json:"id"`
+	schdlDetached
+}
+
+// Parses the fixture (and the schedule if requested) addressed by the path
+func rest1ParseTarget(jsonArguments []byte, withID bool) (rest1Target, schdlSerial, uint32, error) {
+	var target rest1Target
+	if fail := json.Unmarshal(jsonArguments, &target); fail != nil {
+		return target, 0, 0, webFail(http.StatusBadRequest, "Failed to parse arguments (%s)", fail)
+	}
+	serial, fail := strconv.ParseUint(target.Serial.String(), 10, 32)
+	if fail != nil || serial == 0 {
+		return target, 0, 0, webFail(http.StatusBadRequest, "Invalid serial number %q", target.Serial)
+	}
+	if _, fail := phtnParseUnits(target.Units); fail != nil {
+		return target, 0, 0, webFail(http.StatusBadRequest, "%s", fail)
+	}
+	if !withID {
+		return target, schdlSerial(serial), 0, nil
+	}
+	id, fail := strconv.ParseUint(target.ID.String(), 10, 32)
+	if fail != nil {
+		return target, 0, 0, webFail(http.StatusBadRequest, "Invalid schedule ID %q", target.ID)
+	}
+	return target, schdlSerial(serial), uint32(id), nil
+}
+
+// Lists the adapters reaching a fixture
+func (api *api1) rest1Addresses(serial schdlSerial) []rest1Address {
+	addresses := make([]rest1Address, 0)
+	for _, adapter := range api.controller.discoverer.dscvr1ListAdapters() {
+		if shortAddress := adapter.dptr1LookUp(serial); shortAddress != pckt1ShortAddressUnassigned {
+			addresses = append(addresses, rest1Address{adapter.adapterID, shortAddress})
+		}
+	}
+	return addresses
+}
+
+// Fails unless the fixture is seen (instead of waiting for it to show up like the v1 API does)
+func (api *api1) rest1CheckSeen(serial schdlSerial) error {
+	if len(api.controller.discoverer.dscvr1LookUp(serial)) == 0 {
+		return webFail(http.StatusNotFound, "Fixture %d not seen", serial)
+	}
+	return nil
+}
+
+// Exchanges a command with a seen fixture (the given status code is reported if the fixture rejects the command)
+func (api *api1) rest1Exchange(serial schdlSerial, functionCode pckt1FunctionCode, payload pckt1Payload, rejected int) ([]pckt1Packet, error) {
+	if fail := api.rest1CheckSeen(serial); fail != nil {
+		return nil, fail
+	}
+	replies, fail := api.controller.ctrl1Dispatch(serial, functionCode, payload)
+	switch {
+	case fail == nil:
+		return replies, nil
+	case replies == nil:
+		// The adapter could not be communicated with at all
+		return nil, webFail(http.StatusBadGateway, "%s", fail)
+	case len(replies) == 0:
+		return nil, webFail(http.StatusGatewayTimeout, "Fixture %d did not reply", serial)
+	}
+	return nil, webFail(rejected, "Fixture %d rejected the command (%s)", serial, fail)
+}
+
+// Checks the levels against the limits of a fixture
+func (api *api1) rest1CheckLimits(serial schdlSerial, mode schdlMode, levels schdlLevels) error {
+	fail := api.controller.ctrl1CheckLimits(serial, mode, levels)
+	if _, isViolation := fail.(lmtViolations); isViolation {
+		return webFail(http.StatusUnprocessableEntity, "%s", fail)
+	}
+	if fail != nil {
+		return webFail(http.StatusBadGateway, "%s", fail)
+	}
+	return nil
+}
+
+// Converts the irradiance levels to the requested units
+func rest1ConvertLevels(levels schdlLevels, mode schdlMode, units string) (schdlLevels, string) {
+	if units, _ = phtnParseUnits(units); units != phtnUnitsPhotons || mode == schdlModePWM {
+		return levels, ""
+	}
+	converted, _ := phtnConvert(levels, phtnUnitsEnergy, units)
+	return converted, units
+}
+
+// Converts a schedule read back from a fixture (keeping its ID)
+func rest1ScheduleFromReply(payload pckt1Payload, units string) (rest1Schedule, error) {
+	schedule, fail := ctrl1ScheduleFromReply(payload)
+	if fail != nil {
+		return rest1Schedule{}, webFail(http.StatusBadGateway, "%s", fail)
+	}
+	var id uint32
+	switch specificPayload := payload.(type) {
+	case *pckt1ReplyPayloadGetScheduleIrradiance:
+		id = specificPayload.ScheduleID
+	case *pckt1ReplyPayloadGetSchedulePWM:
+		id = specificPayload.ScheduleID
+	}
+	schedule.Levels, schedule.Units = rest1ConvertLevels(schedule.Levels, schdlModeOf(schedule), units)
+	return rest1Schedule{id, schedule}, nil
+}
+
+// Resolves the recipe & the units of a schedule
+func rest1Resolve(schedule schdlDetached, serial schdlSerial) (schdlDetached, error) {
+	resolved, fail := rcpResolveSchedules([]schdlAttached{{schdlDetached: schedule, Serials: schdlSerials{serial}}})
+	if fail == nil {
+		resolved, fail = phtnResolveSchedules(resolved)
+	}
+	if fail != nil {
+		return schedule, webFail(http.StatusBadRequest, "%s", fail)
+	}
+	return resolved[0].schdlDetached, nil
+}
+
+// Handles the "v2-list-fixtures" request
+func (api *api1) rest1ListFixtures(jsonArguments []byte) ([]byte, error) {
+	fixtures := make([]rest1Fixture, 0)
+	for _, serial := range api.controller.ctrl1GetSerials() {
+		fixtures = append(fixtures, rest1Fixture{serial, api.rest1Addresses(serial), nil, nil})
+	}
+	return json.Marshal(&fixtures)
+}
+
+// Handles the "v2-get-fixture" request
+func (api *api1) rest1GetFixture(jsonArguments []byte) ([]byte, error) {
+	_, serial, _, fail := rest1ParseTarget(jsonArguments, false)
+	if fail != nil {
+		return nil, fail
+	}
+	repliesInfo, fail := api.rest1Exchange(serial, pckt1FunctionCodeGetFixtureInfo, nil, http.StatusBadGateway)
+	if fail != nil {
+		return nil, fail
+	}
+	repliesGroup, fail := api.rest1Exchange(serial, pckt1FunctionCodeGetGroupID, nil, http.StatusBadGateway)
+	if fail != nil {
+		return nil, fail
+	}
+	info := repliesInfo[0].Payload.(*pckt1ReplyPayloadGetFixtureInfo)
+	group := repliesGroup[0].Payload.(*pckt1ReplyPayloadGetGroupID).GroupID
+	return json.Marshal(&rest1Fixture{serial, api.rest1Addresses(serial), info, &group})
+}
+
+// Handles the "v2-get-leds" request (the levels are read in the given mode - irradiance by default)
+func (api *api1) rest1GetLEDs(jsonArguments []byte) ([]byte, error) {
+	target, serial, _, fail := rest1ParseTarget(jsonArguments, false)
+	if fail != nil {
+		return nil, fail
+	}
+	var query rest1LEDs
+	if fail := json.Unmarshal(jsonArguments, &query); fail != nil {
+		return nil, webFail(http.StatusBadRequest, "Failed to parse arguments (%s)", fail)
+	}
+	mode := schdlModeOf(schdlDetached{Mode: query.Mode})
+	if mode != schdlModeIrradiance && mode != schdlModePWM {
+		return nil, webFail(http.StatusBadRequest, "Unknown mode %s", query.Mode)
+	}
+	replies, fail := api.rest1Exchange(serial, pckt1FunctionCodeGetLEDs, &pckt1CommandPayloadGetLEDs{ctrl1Config(mode, nil)}, http.StatusBadGateway)
+	if fail != nil {
+		return nil, fail
+	}
+	var config uint8
+	levels := make(schdlLevels, 6)
+	switch specificPayload := replies[0].Payload.(type) {
+	case *pckt1ReplyPayloadGetLEDsIrradiance:
+		config = specificPayload.Config
+		for i := 0; i < 6; i++ {
+			levels[i] = ctrl1WidenLevel(specificPayload.Levels[i])
+		}
+	case *pckt1ReplyPayloadGetLEDsPWM:
+		config = specificPayload.Config
+		for i := 0; i < 6; i++ {
+			levels[i] = float64(specificPayload.Levels[i])
+		}
+	default:
+		return nil, webFail(http.StatusBadGateway, "Unexpected reply payload - %+v", replies[0].Payload)
+	}
+	modules := schdlModules{config&pckt1LEDsModule0Mask == pckt1LEDsModule0Enabled, config&pckt1LEDsModule1Mask == pckt1LEDsModule1Enabled}
+	leds := rest1LEDs{nil, mode, schdlNormalizeModules(modules), "", ""}
+	leds.Levels, leds.Units = rest1ConvertLevels(levels, mode, target.Units)
+	return json.Marshal(&leds)
+}
+
+// Handles the "v2-set-leds" request (the levels are set right away, the fixture-resident scheduling takes over at the next schedule)
+func (api *api1) rest1SetLEDs(jsonArguments []byte) ([]byte, error) {
+	_, serial, _, fail := rest1ParseTarget(jsonArguments, false)
+	if fail != nil {
+		return nil, fail
+	}
+	var leds rest1LEDs
+	if fail := json.Unmarshal(jsonArguments, &leds); fail != nil {
+		return nil, webFail(http.StatusBadRequest, "Failed to parse arguments (%s)", fail)
+	}
+	resolved, fail := rest1Resolve(schdlDetached{Levels: leds.Levels, Mode: leds.Mode, Modules: leds.Modules, Recipe: leds.Recipe, Units: leds.Units}, serial)
+	if fail != nil {
+		return nil, fail
+	}
+	mode := schdlModeOf(resolved)
+	switch {
+	case mode != schdlModeIrradiance && mode != schdlModePWM:
+		return nil, webFail(http.StatusBadRequest, "Unknown mode %s", resolved.Mode)
+	case len(resolved.Levels) != 6:
+		return nil, webFail(http.StatusBadRequest, "Levels must have 6 values (has %d)", len(resolved.Levels))
+	}
+	if fail := schdlCheckLevelsFor(resolved.Levels, mode); fail != nil {
+		return nil, webFail(http.StatusUnprocessableEntity, "%s", fail)
+	}
+	if fail := api.rest1CheckSeen(serial); fail != nil {
+		return nil, fail
+	}
+	if fail := api.rest1CheckLimits(serial, mode, resolved.Levels); fail != nil {
+		return nil, fail
+	}
+	var payload pckt1Payload
+	config := ctrl1Config(mode, resolved.Modules)
+	if mode == schdlModePWM {
+		var levels [6]uint32
+		for i := 0; i < 6; i++ {
+			levels[i] = uint32(math.Round(resolved.Levels[i]))
+		}
+		payload = &pckt1CommandPayloadSetLEDsPWM{config, levels}
+	} else {
+		var levels [6]float32
+		for i := 0; i < 6; i++ {
+			levels[i] = float32(resolved.Levels[i])
+		}
+		payload = &pckt1CommandPayloadSetLEDsIrradiance{config, levels}
+	}
+	if _, fail := api.rest1Exchange(serial, pckt1FunctionCodeSetLEDs, payload, http.StatusBadGateway); fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&rest1LEDs{resolved.Levels, resolved.Mode, schdlNormalizeModules(resolved.Modules), "", ""})
+}
+
+// Handles the "v2-list-schedules" request
+func (api *api1) rest1ListSchedules(jsonArguments []byte) ([]byte, error) {
+	target, serial, _, fail := rest1ParseTarget(jsonArguments, false)
+	if fail != nil {
+		return nil, fail
+	}
+	repliesCount, fail := api.rest1Exchange(serial, pckt1FunctionCodeGetScheduleCount, nil, http.StatusBadGateway)
+	if fail != nil {
+		return nil, fail
+	}
+	count := repliesCount[0].Payload.(*pckt1ReplyPayloadGetScheduleCount).ScheduleCount
+	schedules := make([]rest1Schedule, 0, count)
+	for index := uint32(0); index < count; index++ {
+		payload := &pckt1CommandPayloadGetSchedule{index, pckt1ScheduleSearchByIndex}
+		replies, fail := api.rest1Exchange(serial, pckt1FunctionCodeGetSchedule, payload, http.StatusBadGateway)
+		if fail != nil {
+			return nil, fail
+		}
+		schedule, fail := rest1ScheduleFromReply(replies[0].Payload, target.Units)
+		if fail != nil {
+			return nil, fail
+		}
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Start < schedules[j].Start })
+	return json.Marshal(&schedules)
+}
+
+// Records the programme a fixture was left with by a v2 request in the history
+func (api *api1) rest1Record(ctx context.Context, serial schdlSerial, source string) {
+	schedules, fail := api.controller.ctrl1FetchSchedules(ctx, serial)
+	if fail == nil {
+		_, fail = hstrStore(schdlAggregated{serial: schedules}, false, source, authAuthor(ctx, ""))
+	}
+	if fail != nil {
+		api.logger.Printf("ERROR: Failed to record the schedules of fixture %d in the history (%s)", serial, fail)
+	}
+}
+
+// Handles the "v2-delete-schedules" request
+func (api *api1) rest1DeleteSchedules(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	_, serial, _, fail := rest1ParseTarget(jsonArguments, false)
+	if fail != nil {
+		return nil, fail
+	}
+	if _, fail := api.rest1Exchange(serial, pckt1FunctionCodeDeleteAllSchedules, nil, http.StatusBadGateway); fail != nil {
+		return nil, fail
+	}
+	api.rest1Record(ctx, serial, fmt.Sprintf("v2 schedules of fixture %d", serial))
+	return nil, nil
+}
+
+// Handles the "v2-get-schedule" request
+func (api *api1) rest1GetSchedule(jsonArguments []byte) ([]byte, error) {
+	target, serial, id, fail := rest1ParseTarget(jsonArguments, true)
+	if fail != nil {
+		return nil, fail
+	}
+	replies, fail := api.rest1Exchange(serial, pckt1FunctionCodeGetSchedule, &pckt1CommandPayloadGetSchedule{id, pckt1ScheduleSearchByID}, http.StatusNotFound)
+	if fail != nil {
+		return nil, fail
+	}
+	schedule, fail := rest1ScheduleFromReply(replies[0].Payload, target.Units)
+	if fail != nil {
+		return nil, fail
+	}
+	return json.Marshal(&schedule)
+}
+
+// Handles the "v2-set-schedule" request (a schedule with the same ID is replaced)
+func (api *api1) rest1SetSchedule(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	_, serial, id, fail := rest1ParseTarget(jsonArguments, true)
+	if fail != nil {
+		return nil, fail
+	}
+	var schedule schdlDetached
+	if fail := json.Unmarshal(jsonArguments, &schedule); fail != nil {
+		return nil, webFail(http.StatusBadRequest, "Failed to parse arguments (%s)", fail)
+	}
+	if schedule, fail = rest1Resolve(schedule, serial); fail != nil {
+		return nil, fail
+	}
+	if fail := schdlCheckForValidity(schdlAttached{schdlDetached: schedule, Serials: schdlSerials{serial}}); fail != nil {
+		return nil, webFail(http.StatusBadRequest, "%s", fail)
+	}
+	if fail := schdlCheckLevelsFor(schedule.Levels, schdlModeOf(schedule)); fail != nil {
+		return nil, webFail(http.StatusUnprocessableEntity, "%s", fail)
+	}
+	if fail := api.rest1CheckSeen(serial); fail != nil {
+		return nil, fail
+	}
+	if fail := api.rest1CheckLimits(serial, schdlModeOf(schedule), schedule.Levels); fail != nil {
+		return nil, fail
+	}
+	// The schedule replaced is kept so that the fixture can be restored if the new one is rejected
+	var replaced pckt1Payload
+	if replies, fail := api.controller.ctrl1Dispatch(serial, pckt1FunctionCodeGetSchedule, &pckt1CommandPayloadGetSchedule{id, pckt1ScheduleSearchByID}); fail == nil {
+		previous, fail := ctrl1ScheduleFromReply(replies[0].Payload)
+		if fail != nil {
+			return nil, webFail(http.StatusBadGateway, "%s", fail)
+		}
+		replaced = ctrl1ScheduleToPayload(id, previous)
+		if _, fail := api.rest1Exchange(serial, pckt1FunctionCodeDeleteSchedule, &pckt1CommandPayloadDeleteSchedule{id}, http.StatusConflict); fail != nil {
+			return nil, fail
+		}
+	} else if len(replies) == 0 {
+		// Without knowing whether there is a schedule with the ID, nothing is touched
+		return nil, webFail(http.StatusBadGateway, "Failed to look up schedule %d of fixture %d (%s)", id, serial, fail)
+	}
+	if _, fail := api.rest1Exchange(serial, pckt1FunctionCodeSetSchedule, ctrl1ScheduleToPayload(id, schedule), http.StatusConflict); fail != nil {
+		if replaced != nil {
+			replies, failRestore := api.controller.ctrl1Dispatch(serial, pckt1FunctionCodeSetSchedule, replaced)
+			if failRestore = dptr1CheckResult(pckt1FunctionCodeSetSchedule, replies, failRestore); failRestore != nil {
+				api.logger.Printf("ERROR: Failed to restore schedule %d of fixture %d (%s)", id, serial, failRestore)
+			}
+		}
+		return nil, fail
+	}
+	api.rest1Record(ctx, serial, fmt.Sprintf("v2 schedule %d of fixture %d", id, serial))
+	schedule.Modules = schdlNormalizeModules(schedule.Modules)
+	schedule.Recipe, schedule.Priority = "", 0
+	return json.Marshal(&rest1Schedule{id, schedule})
+}
+
+// Handles the "v2-delete-schedule" request
+func (api *api1) rest1DeleteSchedule(ctx context.Context, jsonArguments []byte) ([]byte, error) {
+	_, serial, id, fail := rest1ParseTarget(jsonArguments, true)
+	if fail != nil {
+		return nil, fail
+	}
+	if _, fail := api.rest1Exchange(serial, pckt1FunctionCodeDeleteSchedule, &pckt1CommandPayloadDeleteSchedule{id}, http.StatusNotFound); fail != nil {
+		return nil, fail
+	}
+	api.rest1Record(ctx, serial, fmt.Sprintf("v2 schedule %d of fixture %d", id, serial))
+	return nil, nil
+}
+
+// Handles the "v2-list-adapters" request
+func (api *api1) rest1ListAdapters(jsonArguments []byte) ([]byte, error) {
+	adapters := make([]rest1Adapter, 0)
+	for _, adapter := range api.controller.discoverer.dscvr1ListAdapters() {
+		members := make([]rest1Member, 0)
+		for _, serial := range adapter.dptr1ListSeenSerials() {
+			members = append(members, rest1Member{serial, adapter.dptr1LookUp(serial)})
+		}
+		sort.Slice(members, func(i, j int) bool { return members[i].Serial < members[j].Serial })
+		adapters = append(adapters, rest1Adapter{adapter.adapterID, adapter.address.String(), adapter.port, uint32(adapter.dptr1LastSeen().Unix()), members})
+	}
+	return json.Marshal(&adapters)
+}
+
+// Dispatches v2 API request
+func (api *api1) rest1Dispatch(ctx context.Context, name string, jsonArguments []byte) ([]byte, error) {
+	switch name {
+	case "v2-list-fixtures":
+		return api.rest1ListFixtures(jsonArguments)
+	case "v2-get-fixture":
+		return api.rest1GetFixture(jsonArguments)
+	case "v2-get-leds":
+		return api.rest1GetLEDs(jsonArguments)
+	case "v2-set-leds":
+		return api.rest1SetLEDs(jsonArguments)
+	case "v2-list-schedules":
+		return api.rest1ListSchedules(jsonArguments)
+	case "v2-delete-schedules":
+		return api.rest1DeleteSchedules(ctx, jsonArguments)
+	case "v2-get-schedule":
+		return api.rest1GetSchedule(jsonArguments)
+	case "v2-set-schedule":
+		return api.rest1SetSchedule(ctx, jsonArguments)
+	case "v2-delete-schedule":
+		return api.rest1DeleteSchedule(ctx, jsonArguments)
+	case "v2-list-adapters":
+		return api.rest1ListAdapters(jsonArguments)
+	}
+	return nil, webFail(http.StatusNotFound, "Unknown API function - %s", name)
+}
+
+// Lists the routes of the v2 API
+func (api *api1) rest1Routes() []webRoute {
+	return []webRoute{
+		{"v2-list-fixtures", http.MethodGet, "/v2/fixtures", api.rest1Dispatch},
+		{"v2-get-fixture", http.MethodGet, "/v2/fixtures/{serial}", api.rest1Dispatch},
+		{"v2-get-leds", http.MethodGet, "/v2/fixtures/{serial}/leds", api.rest1Dispatch},
+		{"v2-set-leds", http.MethodPut, "/v2/fixtures/{serial}/leds", api.rest1Dispatch},
+		{"v2-list-schedules", http.MethodGet, "/v2/fixtures/{serial}/schedules", api.rest1Dispatch},
+		{"v2-delete-schedules", http.MethodDelete, "/v2/fixtures/{serial}/schedules", api.rest1Dispatch},
+		{"v2-get-schedule", http.MethodGet, "/v2/fixtures/{serial}/schedules/{id}", api.rest1Dispatch},
+		{"v2-set-schedule", http.MethodPut, "/v2/fixtures/{serial}/schedules/{id}", api.rest1Dispatch},
+		{"v2-delete-schedule", http.MethodDelete, "/v2/fixtures/{serial}/schedules/{id}", api.rest1Dispatch},
+		{"v2-list-adapters", http.MethodGet, "/v2/adapters", api.rest1Dispatch},
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRest1SetSchedule(t *testing.T) {
+	bus := &ctrl1TestBus{}
+	api := &api1{logger: log.New(ioutil.Discard, "", 0), controller: ctrl1TestController(t, bus)}
+	start, _ := schdlParseDate("2021-03-15", "06:00")
+	stop, _ := schdlParseDate("2021-04-30", "22:00")
+	stored := func(id uint32, level float64) pckt1CommandPayloadSetSchedulePWM {
+		schedule := schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{level, 0, 0, 0, 0, 0}, Mode: schdlModePWM}
+		return *ctrl1ScheduleToPayload(id, schedule).(*pckt1CommandPayloadSetSchedulePWM)
+	}
+	cases := []struct {
+		id       uint32
+		level    float64
+		status   int // Zero if succeeding
+		expected []pckt1CommandPayloadSetSchedulePWM
+	}{
+		{5, 15, 0, []pckt1CommandPayloadSetSchedulePWM{stored(6, 10), stored(5, 15)}},
+		{7, 15, 0, []pckt1CommandPayloadSetSchedulePWM{stored(5, 10), stored(6, 10), stored(7, 15)}},
+		{5, 30, http.StatusConflict, []pckt1CommandPayloadSetSchedulePWM{stored(6, 10), stored(5, 10)}},
+		{7, 30, http.StatusConflict, []pckt1CommandPayloadSetSchedulePWM{stored(5, 10), stored(6, 10)}},
+	}
+	for index, tested := range cases {
+		bus.lock.Lock()
+		bus.refusing = map[pckt1ShortAddress]uint32{1: 20}
+		bus.schedules = map[pckt1ShortAddress][]pckt1CommandPayloadSetSchedulePWM{1: {stored(5, 10), stored(6, 10)}}
+		bus.lock.Unlock()
+		arguments := fmt.Sprintf(`{"serial": 1, "id": %d, "start": %d, "stop": %d, "levels": [%g, 0, 0, 0, 0, 0], "mode": %q}`, tested.id, start, stop, tested.level, schdlModePWM)
+		_, fail := api.rest1SetSchedule(context.Background(), []byte(arguments))
+		status := 0
+		if fail != nil {
+			status = http.StatusInternalServerError
+			if failStatus, isStatus := fail.(*webStatusError); isStatus {
+				status = failStatus.status
+			}
+		}
+		if status != tested.status {
+			t.Errorf("Case %d: failed with %v (expecting status %d)", index, fail, tested.status)
+		}
+		bus.lock.Lock()
+		schedules := bus.schedules[1]
+		bus.lock.Unlock()
+		if !reflect.DeepEqual(schedules, tested.expected) {
+			t.Errorf("Case %d: the fixture kept %+v (expecting %+v)", index, schedules, tested.expected)
+		}
+		if tested.status != 0 {
+			continue
+		}
+		latest, fail := hstrLoad(0)
+		if fail != nil {
+			t.Errorf("Case %d: %s", index, fail)
+		} else if recorded := latest.Programme[1]; len(recorded) != len(tested.expected) || recorded[len(recorded)-1].Levels[0] != tested.level {
+			t.Errorf("Case %d: recorded %+v in the history", index, recorded)
+		}
+	}
+}
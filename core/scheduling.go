@@ -7,19 +7,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	indexStartDate = 0
-	indexStopDate  = 1
-	indexStartTime = 2
-	indexStopTime  = 3
-	indexLevels    = 4
+	schdlModeIrradiance = schdlMode("irradiance")
+	schdlModePWM        = schdlMode("pwm")
 )
 
 type schdlTiming struct {
@@ -29,9 +27,20 @@ type schdlTiming struct {
 
 type schdlLevels []float64
 
+// Tells how the levels are interpreted (irradiance if empty)
+type schdlMode string
+
+// Tells which modules are enabled (all if empty)
+type schdlModules []bool
+
 type schdlDetached struct {
 	schdlTiming
-	Levels schdlLevels `json:"levels"`
+	Levels   schdlLevels  `json:"levels"`
+	Mode     schdlMode    `json:"mode,omitempty"`
+	Modules  schdlModules `json:"modules,omitempty"`
+	Recipe   string       `json:"recipe,omitempty"`
+	Priority int          `json:"priority,omitempty"`
+	Units    string       `json:"units,omitempty"`
 }
 
 type schdlSerial uint32
@@ -51,6 +60,16 @@ type schdlBlock struct {
 
 type schdlAggregated map[schdlSerial][]schdlDetached
 
+// Holds the outcome of validating schedules without applying them
+type schdlValidation struct {
+	Valid      bool                `json:"valid"`
+	Problems   []string            `json:"problems"`
+	Slots      map[schdlSerial]int `json:"slots"`
+	Missing    schdlSerials        `json:"missing"`
+	Flattened  []schdlAttached     `json:"flattened"`
+	Violations lmtViolations       `json:"violations"`
+}
+
 // Reads lines from a file
 func schdlReadLinesFromFile(path string) ([]string, error) {
 	file, fail := os.Open(path)
@@ -94,39 +113,30 @@ func schdlReadSchedulesFromFile(path string, channelCount int) ([]schdlAttached,
 	return schedules, nil
 }
 
-// Parses CSV lines into entries
+// Writes schedules to CSV file
+func schdlWriteSchedulesToFile(path string, schedules []schdlAttached, channelCount int) error {
+	lines := schdlCSVFormat(schedules, channelCount)
+	content := strings.Join(lines, "\n") + "\n"
+	if fail := ioutil.WriteFile(path, []byte(content), 0644); fail != nil {
+		return fmt.Errorf("Failed writing file %s: %s", path, fail)
+	}
+	return nil
+}
+
+// Parses CSV lines into entries (reports all problems found at once)
 func schdlParseLines(lines []string, channelCount int) ([]schdlAttached, error) {
-	indexSerials := indexLevels + channelCount
-	schedules := make([]schdlAttached, 0)
-	for index, line := range lines {
-		if len(line) == 0 && index == len(lines)-1 {
-			continue
-		}
-		items := strings.Split(line, ",")
-		count := len(items)
-		if count < indexSerials {
-			return nil, fmt.Errorf("Too few columns (%d) in line %d (%s)", count, index+1, line)
-		}
-		parsedLevels, fail := schdlParseLevels(items, channelCount)
-		if fail != nil {
-			return nil, fail
-		}
-		parsedSerials, fail := schdlParseSerials(items, indexSerials)
-		if fail != nil {
-			return nil, fail
-		}
-		parsedScheduling, fail := schdlParseScheduling(items)
-		if fail != nil {
-			return nil, fail
-		}
-		schedule := schdlAttached{schdlDetached{parsedScheduling, parsedLevels}, parsedSerials}
-		schedules = append(schedules, schedule)
+	schedules, issues := schdlCSVParse(lines, channelCount)
+	if len(issues) != 0 {
+		return nil, issues
 	}
 	return schedules, nil
 }
 
 // Converts human readable date and time to a timestamp
 func schdlParseDate(atDate, atTime string) (uint32, error) {
+	if strings.Count(atTime, ":") == 1 {
+		atTime += ":00"
+	}
 	stampUtc := fmt.Sprintf("%sT%s.000Z", atDate, atTime)
 	stamp, fail := time.Parse(time.RFC3339, stampUtc)
 	if fail != nil {
@@ -135,54 +145,10 @@ func schdlParseDate(atDate, atTime string) (uint32, error) {
 	return uint32(stamp.Unix()), nil
 }
 
-// Parses the scheduling portion of the schedule
-func schdlParseScheduling(items []string) (schdlTiming, error) {
-	start, fail := schdlParseDate(items[indexStartDate], items[indexStartTime])
-	if fail != nil {
-		return schdlTiming{0, 0}, fail
-	}
-	stop, fail := schdlParseDate(items[indexStopDate], items[indexStopTime])
-	if fail != nil {
-		return schdlTiming{0, 0}, fail
-	}
-	return schdlTiming{start, stop}, nil
-}
-
-// Parses the channel level portion of the schedule
-func schdlParseLevels(items []string, channelCount int) (schdlLevels, error) {
-	result := make(schdlLevels, channelCount)
-	for i := 0; i < channelCount; i++ {
-		level, fail := strconv.ParseInt(items[indexLevels+i], 10, 8)
-		if fail != nil {
-			return nil, fmt.Errorf("Cannot parse channel level: %s", items[indexLevels+i])
-		}
-		if level > 100 {
-			return nil, fmt.Errorf("Invalid channel level (must be 0-100): %d", level)
-		}
-		result[i] = float64(level)
-	}
-	return result, nil
-}
-
-// Parses the serials portion of the schedule
-func schdlParseSerials(items []string, indexSerials int) (schdlSerials, error) {
-	serialsTextual := items[indexSerials:]
-	serialsCount := len(serialsTextual)
-	collection := make(map[schdlSerial]struct{})
-	exists := struct{}{}
-	for i := 0; i < serialsCount; i++ {
-		serial, fail := strconv.ParseUint(serialsTextual[i], 10, 32)
-		if fail != nil {
-			return nil, fmt.Errorf("Cannot parse serial: %s", serialsTextual[i])
-		}
-		collection[schdlSerial(serial)] = exists
-	}
-	result := make(schdlSerials, 0, len(collection))
-	for serial := range collection {
-		result = append(result, serial)
-	}
-	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
-	return result, nil
+// Converts a timestamp to human readable date and time
+func schdlFormatDate(timestamp uint32) (string, string) {
+	stamp := time.Unix(int64(timestamp), 0).UTC()
+	return stamp.Format("2006-01-02"), stamp.Format("15:04:05")
 }
 
 // Splits the schedules by day
@@ -197,7 +163,8 @@ func schdlSplitSchedulesByDay(schedules []schdlAttached) []schdlAttached {
 			date := schdlShiftByDays(start, day)
 			start := date + startTime
 			stop := date + stopTime
-			single := schdlAttached{schdlDetached{schdlTiming{start, stop}, schedule.Levels}, schedule.Serials}
+			single := schedule
+			single.schdlTiming = schdlTiming{start, stop}
 			daily = append(daily, single)
 		}
 	}
@@ -207,7 +174,7 @@ func schdlSplitSchedulesByDay(schedules []schdlAttached) []schdlAttached {
 // Organizes schedules, checks for validity and possible overlap
 func schdlCheckAllForValidity(schedules []schdlAttached) error {
 	for _, schedule := range schedules {
-		if fail := schdlCheckLevels(schedule.Levels); fail != nil {
+		if fail := schdlCheckLevelsFor(schedule.Levels, schedule.Mode); fail != nil {
 			return fail
 		}
 		if fail := schdlCheckForValidity(schedule); fail != nil {
@@ -222,6 +189,20 @@ func schdlCheckForValidity(schedule schdlAttached) error {
 	if schedule.Stop <= schedule.Start {
 		return fmt.Errorf("Timespan invalid for schedule %+v", schedule)
 	}
+	if len(schedule.Levels) != 6 {
+		if len(schedule.Recipe) != 0 {
+			return fmt.Errorf("Recipe %s not resolved for schedule %+v", schedule.Recipe, schedule)
+		}
+		return fmt.Errorf("Levels missing for schedule %+v", schedule)
+	}
+	if len(schedule.Units) != 0 && schedule.Units != phtnUnitsEnergy {
+		return fmt.Errorf("Levels in units %s not converted for schedule %+v", schedule.Units, schedule)
+	}
+	switch schedule.Mode {
+	case "", schdlModeIrradiance, schdlModePWM:
+	default:
+		return fmt.Errorf("Unknown mode %s for schedule %+v", schedule.Mode, schedule)
+	}
 	return nil
 }
 
@@ -246,6 +227,74 @@ func schdlCheckAllForOverlap(aggregated schdlAggregated) error {
 	return nil
 }
 
+// Collects all overlaps of aggregated schedules (within the same priority)
+func schdlCollectOverlaps(aggregated schdlAggregated) []string {
+	problems := make([]string, 0)
+	serials := make(schdlSerials, 0, len(aggregated))
+	for serial := range aggregated {
+		serials = append(serials, serial)
+	}
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	for _, serial := range serials {
+		_, _, _, overlaps := schdlLayerPieces(aggregated[serial])
+		for _, overlap := range overlaps {
+			problems = append(problems, fmt.Sprintf("Fixture %d: %s", serial, overlap))
+		}
+	}
+	return problems
+}
+
+// Validates schedules against the seen fixtures reporting every problem found
+func schdlValidate(schedules []schdlAttached, seen schdlSerials, problems []string) schdlValidation {
+	valid := make([]schdlAttached, 0, len(schedules))
+	for index, schedule := range schedules {
+		failLevels := schdlCheckLevelsFor(schedule.Levels, schedule.Mode)
+		failValidity := schdlCheckForValidity(schedule)
+		if failLevels != nil {
+			problems = append(problems, fmt.Sprintf("Schedule #%d: %s", index+1, failLevels))
+		}
+		if failValidity != nil {
+			problems = append(problems, fmt.Sprintf("Schedule #%d: %s", index+1, failValidity))
+		}
+		if len(schedule.Serials) == 0 {
+			problems = append(problems, fmt.Sprintf("Schedule #%d: No serials given", index+1))
+		}
+		if failLevels == nil && failValidity == nil {
+			valid = append(valid, schedule)
+		}
+	}
+	aggregated := schdlAggregateBySerial(valid)
+	problems = append(problems, schdlCollectOverlaps(aggregated)...)
+	seenSet := make(map[schdlSerial]struct{})
+	for _, serial := range seen {
+		seenSet[serial] = struct{}{}
+	}
+	// The overlapping schedules are already reported and stay as they are
+	flattened := make(schdlAggregated)
+	for serial, entries := range aggregated {
+		flattened[serial] = entries
+		if layers, fail := schdlFlattenLayers(entries); fail == nil {
+			flattened[serial] = layers
+		}
+	}
+	slots := make(map[schdlSerial]int)
+	missing := make(schdlSerials, 0)
+	for serial, entries := range flattened {
+		slots[serial] = len(entries)
+		if len(entries) > pckt1ScheduleCapacity {
+			problems = append(problems, fmt.Sprintf("Fixture %d: %d schedules exceed the capacity of %d", serial, len(entries), pckt1ScheduleCapacity))
+		}
+		if _, present := seenSet[serial]; !present {
+			missing = append(missing, serial)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	for _, serial := range missing {
+		problems = append(problems, fmt.Sprintf("Fixture %d: Not found on the network", serial))
+	}
+	return schdlValidation{len(problems) == 0, problems, slots, missing, schdlMergeBySchedule(flattened), lmtViolations{}}
+}
+
 // Checks two schedules for possible overlap
 func schdlCheckForOverlap(blockX, blockY schdlBlock) error {
 	if blockX.Begin < blockY.End && blockY.Begin < blockX.End {
@@ -310,7 +359,7 @@ func schdlShiftByDays(timestamp uint32, days uint32) uint32 {
 func schdlAggregateBySerial(schedules []schdlAttached) schdlAggregated {
 	aggregated := make(schdlAggregated)
 	for _, schedule := range schedules {
-		inverted := schdlDetached{schedule.schdlTiming, schedule.Levels}
+		inverted := schedule.schdlDetached
 		for _, serial := range schedule.Serials {
 			merged, present := aggregated[serial]
 			if present {
@@ -324,15 +373,94 @@ func schdlAggregateBySerial(schedules []schdlAttached) schdlAggregated {
 	return aggregated
 }
 
+// Merges identical schedules across serials (the inverse of schdlAggregateBySerial)
+func schdlMergeBySchedule(aggregated schdlAggregated) []schdlAttached {
+	keys := make([]string, 0)
+	merged := make(map[string]*schdlAttached)
+	for serial, schedules := range aggregated {
+		for _, schedule := range schedules {
+			key := schdlKey(schedule)
+			entry, present := merged[key]
+			if !present {
+				entry = &schdlAttached{schdlDetached: schedule, Serials: make(schdlSerials, 0)}
+				merged[key] = entry
+				keys = append(keys, key)
+			}
+			entry.Serials = append(entry.Serials, serial)
+		}
+	}
+	schedules := make([]schdlAttached, 0, len(keys))
+	for _, key := range keys {
+		entry := merged[key]
+		sort.Slice(entry.Serials, func(i, j int) bool { return entry.Serials[i] < entry.Serials[j] })
+		schedules = append(schedules, *entry)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].Start != schedules[j].Start {
+			return schedules[i].Start < schedules[j].Start
+		}
+		if schedules[i].Stop != schedules[j].Stop {
+			return schedules[i].Stop < schedules[j].Stop
+		}
+		return schedules[i].Serials[0] < schedules[j].Serials[0]
+	})
+	return schedules
+}
+
+// Returns a key identifying the contents of the schedule
+func schdlKey(schedule schdlDetached) string {
+	modules := make([]bool, 0)
+	for module := 0; module < len(schedule.Modules) || module < 2; module++ {
+		modules = append(modules, schdlModuleEnabled(schedule.Modules, module))
+	}
+	return fmt.Sprintf("%d-%d-%v-%s-%v-%d", schedule.Start, schedule.Stop, schedule.Levels, schdlModeOf(schedule), modules, schedule.Priority)
+}
+
+// Returns the mode of the schedule (irradiance if not specified)
+func schdlModeOf(schedule schdlDetached) schdlMode {
+	if schedule.Mode == "" {
+		return schdlModeIrradiance
+	}
+	return schedule.Mode
+}
+
+// Tells if a module is enabled (modules not specified are)
+func schdlModuleEnabled(modules schdlModules, module int) bool {
+	return module >= len(modules) || modules[module]
+}
+
+// Drops the module enablement if all modules are enabled
+func schdlNormalizeModules(modules schdlModules) schdlModules {
+	for _, enabled := range modules {
+		if !enabled {
+			return modules
+		}
+	}
+	return nil
+}
+
 // Aggregates schedules per serial
 func schdlAggregateSchedules(schedules []schdlAttached, splitSchedules bool) (schdlAggregated, error) {
 	if fail := schdlCheckAllForValidity(schedules); fail != nil {
 		return nil, fail
 	}
+	aggregated, fail := schdlFlattenAll(schdlAggregateBySerial(schedules))
+	if fail != nil {
+		return nil, fail
+	}
 	if splitSchedules {
-		schedules = schdlSplitSchedulesByDay(schedules)
+		for serial, entries := range aggregated {
+			attached := make([]schdlAttached, 0, len(entries))
+			for _, schedule := range entries {
+				attached = append(attached, schdlAttached{schdlDetached: schedule, Serials: schdlSerials{serial}})
+			}
+			daily := make([]schdlDetached, 0, len(entries))
+			for _, schedule := range schdlSplitSchedulesByDay(attached) {
+				daily = append(daily, schedule.schdlDetached)
+			}
+			aggregated[serial] = daily
+		}
 	}
-	aggregated := schdlAggregateBySerial(schedules)
 	if fail := schdlCheckAllForOverlap(aggregated); fail != nil {
 		return nil, fail
 	}
@@ -356,3 +484,16 @@ func schdlCheckLevels(levels schdlLevels) error {
 	}
 	return nil
 }
+
+// Checks channels validity for the mode (the irradiance limits depend on the fixture, see lmtCheck)
+func schdlCheckLevelsFor(levels schdlLevels, mode schdlMode) error {
+	if mode == schdlModePWM {
+		return schdlCheckLevels(levels)
+	}
+	for index := 0; index < len(levels); index++ {
+		if levels[index] < 0 || math.IsNaN(levels[index]) || math.IsInf(levels[index], 0) {
+			return fmt.Errorf("Level at index %d out of bounds for levels - %v", index, levels)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for the CSV dialects of the schedule files
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	schdlCSVVersion        = 2
+	schdlCSVComment        = '#'
+	schdlCSVSeparator      = ','
+	schdlCSVQuote          = '"'
+	schdlCSVColumnStart    = "startdate"
+	schdlCSVColumnStop     = "stopdate"
+	schdlCSVColumnBegin    = "starttime"
+	schdlCSVColumnEnd      = "stoptime"
+	schdlCSVColumnMode     = "mode"
+	schdlCSVColumnRecipe   = "recipe"
+	schdlCSVColumnPriority = "priority"
+	schdlCSVColumnUnits    = "units"
+	schdlCSVColumnModule   = "module"
+	schdlCSVColumnSerials  = "serials"
+	schdlCSVColumnSerial   = "serialnumber"
+)
+
+// Names of the channels as used in the header row
+var schdlChannelNames = []string{"UVA", "Blue", "Green", "HyperRed", "FarRed", "White"}
+
+// Describes a single problem found in a schedule file
+type schdlIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// Collects all problems found in a schedule file
+type schdlIssues []schdlIssue
+
+// Holds the positions of the columns of a schedule file
+type schdlCSVLayout struct {
+	version  int
+	start    int
+	stop     int
+	begin    int
+	end      int
+	mode     int
+	recipe   int
+	priority int
+	units    int
+	levels   []int
+	modules  []int
+	serials  int
+	columns  int
+}
+
+func (issue schdlIssue) String() string {
+	if issue.Column == 0 {
+		return fmt.Sprintf("line %d: %s", issue.Line, issue.Message)
+	}
+	return fmt.Sprintf("line %d, column %d: %s", issue.Line, issue.Column, issue.Message)
+}
+
+func (issues schdlIssues) Error() string {
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+	return fmt.Sprintf("Invalid schedules (%d problems) - %s", len(issues), strings.Join(messages, "; "))
+}
+
+// Adds a problem to the list
+func (issues *schdlIssues) add(line, column int, format string, arguments ...interface{}) {
+	*issues = append(*issues, schdlIssue{line, column, fmt.Sprintf(format, arguments...)})
+}
+
+// Splits a CSV line into (unquoted) fields, reports unterminated quotes
+func schdlCSVSplit(line string) ([]string, bool) {
+	fields := make([]string, 0)
+	var field strings.Builder
+	quoted := false
+	for index := 0; index < len(line); index++ {
+		character := line[index]
+		switch {
+		case quoted && character == schdlCSVQuote && index+1 < len(line) && line[index+1] == schdlCSVQuote:
+			field.WriteByte(schdlCSVQuote)
+			index++
+		case character == schdlCSVQuote:
+			quoted = !quoted
+		case !quoted && character == schdlCSVSeparator:
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+		default:
+			field.WriteByte(character)
+		}
+	}
+	fields = append(fields, strings.TrimSpace(field.String()))
+	return fields, !quoted
+}
+
+// Quotes a CSV field if necessary
+func schdlCSVQuoteField(field string) string {
+	if strings.ContainsAny(field, string([]byte{schdlCSVSeparator, schdlCSVQuote, schdlCSVComment})) {
+		return string(schdlCSVQuote) + strings.ReplaceAll(field, string(schdlCSVQuote), `""`) + string(schdlCSVQuote)
+	}
+	return field
+}
+
+// Tells if the line carries no data
+func schdlCSVIsBlank(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return len(trimmed) == 0 || trimmed[0] == schdlCSVComment
+}
+
+// Normalizes a column name from the header row
+func schdlCSVNormalizeName(name string) string {
+	replacer := strings.NewReplacer(" ", "", "_", "", "-", "")
+	return strings.ToLower(replacer.Replace(name))
+}
+
+// Returns the layout of the original (v1) dialect without a header row
+func schdlCSVLegacyLayout(channelCount int) schdlCSVLayout {
+	layout := schdlCSVLayout{1, 0, 1, 2, 3, -1, -1, -1, -1, make([]int, channelCount), []int{}, 4 + channelCount, 4 + channelCount}
+	for i := range layout.levels {
+		layout.levels[i] = 4 + i
+	}
+	return layout
+}
+
+// Parses the header row (v2 dialect) into the layout
+func schdlCSVParseHeader(fields []string, channelCount int, line int, issues *schdlIssues) schdlCSVLayout {
+	layout := schdlCSVLayout{schdlCSVVersion, -1, -1, -1, -1, -1, -1, -1, -1, make([]int, channelCount), []int{}, -1, len(fields)}
+	for i := range layout.levels {
+		layout.levels[i] = -1
+	}
+	channels := make(map[string]int)
+	for index := 0; index < channelCount && index < len(schdlChannelNames); index++ {
+		channels[schdlCSVNormalizeName(schdlChannelNames[index])] = index
+	}
+	for column, field := range fields {
+		name := schdlCSVNormalizeName(field)
+		if channel, present := channels[name]; present {
+			if layout.levels[channel] != -1 {
+				issues.add(line, column+1, "Duplicated column %s", field)
+			}
+			layout.levels[channel] = column
+			continue
+		}
+		switch {
+		case name == schdlCSVColumnStart:
+			layout.start = column
+		case name == schdlCSVColumnStop:
+			layout.stop = column
+		case name == schdlCSVColumnBegin:
+			layout.begin = column
+		case name == schdlCSVColumnEnd:
+			layout.end = column
+		case name == schdlCSVColumnMode:
+			layout.mode = column
+		case name == schdlCSVColumnRecipe:
+			layout.recipe = column
+		case name == schdlCSVColumnPriority:
+			layout.priority = column
+		case name == schdlCSVColumnUnits:
+			layout.units = column
+		case strings.HasPrefix(name, schdlCSVColumnModule):
+			module, fail := strconv.ParseUint(name[len(schdlCSVColumnModule):], 10, 8)
+			if fail != nil || int(module) != len(layout.modules) {
+				issues.add(line, column+1, "Module columns must be named Module0, Module1, ... in order (got %s)", field)
+				continue
+			}
+			layout.modules = append(layout.modules, column)
+		case name == schdlCSVColumnSerials || name == schdlCSVColumnSerial:
+			if column != len(fields)-1 {
+				issues.add(line, column+1, "Column %s must be the last one", field)
+			}
+			layout.serials = column
+		default:
+			issues.add(line, column+1, "Unknown column %s", field)
+		}
+	}
+	required := map[string]int{"StartDate": layout.start, "StopDate": layout.stop, "StartTime": layout.begin, "StopTime": layout.end, "Serials": layout.serials}
+	for _, name := range []string{"StartDate", "StopDate", "StartTime", "StopTime", "Serials"} {
+		if required[name] == -1 {
+			issues.add(line, 0, "Missing column %s", name)
+		}
+	}
+	for channel, column := range layout.levels {
+		if column == -1 && layout.recipe == -1 {
+			issues.add(line, 0, "Missing column %s (or Recipe)", schdlChannelNames[channel])
+		}
+	}
+	return layout
+}
+
+// Parses schedule records (v1 or v2 dialect) reporting every problem found (along with the valid records)
+func schdlCSVParse(lines []string, channelCount int) ([]schdlAttached, schdlIssues) {
+	issues := make(schdlIssues, 0)
+	schedules := make([]schdlAttached, 0)
+	var layout *schdlCSVLayout
+	for index, line := range lines {
+		number := index + 1
+		if schdlCSVIsBlank(line) {
+			continue
+		}
+		fields, terminated := schdlCSVSplit(line)
+		if !terminated {
+			issues.add(number, len(fields), "Unterminated quoted field")
+			continue
+		}
+		if layout == nil {
+			detected := schdlCSVLegacyLayout(channelCount)
+			if _, fail := strconv.ParseUint(strings.SplitN(fields[0], "-", 2)[0], 10, 32); fail != nil {
+				detected = schdlCSVParseHeader(fields, channelCount, number, &issues)
+				layout = &detected
+				if len(issues) != 0 {
+					return nil, issues
+				}
+				continue
+			}
+			layout = &detected
+		}
+		if schedule, valid := schdlCSVParseRecord(fields, *layout, number, &issues); valid {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return schedules, issues
+}
+
+// Parses a single record according to the layout
+func schdlCSVParseRecord(fields []string, layout schdlCSVLayout, line int, issues *schdlIssues) (schdlAttached, bool) {
+	count := len(*issues)
+	if len(fields) < layout.columns {
+		issues.add(line, 0, "Too few columns (%d, expected at least %d)", len(fields), layout.columns)
+		return schdlAttached{}, false
+	}
+	var schedule schdlAttached
+	start, failStart := schdlParseDate(fields[layout.start], fields[layout.begin])
+	if failStart != nil {
+		issues.add(line, layout.start+1, "Cannot parse start date & time (%s %s)", fields[layout.start], fields[layout.begin])
+	}
+	stop, failStop := schdlParseDate(fields[layout.stop], fields[layout.end])
+	if failStop != nil {
+		issues.add(line, layout.stop+1, "Cannot parse stop date & time (%s %s)", fields[layout.stop], fields[layout.end])
+	}
+	if failStart == nil && failStop == nil && stop <= start {
+		issues.add(line, layout.stop+1, "Stop (%s %s) must come after start (%s %s)", fields[layout.stop], fields[layout.end], fields[layout.start], fields[layout.begin])
+	}
+	schedule.schdlTiming = schdlTiming{start, stop}
+	if layout.mode != -1 {
+		switch mode := schdlMode(strings.ToLower(fields[layout.mode])); mode {
+		case "", schdlModeIrradiance:
+		case schdlModePWM:
+			schedule.Mode = mode
+		default:
+			issues.add(line, layout.mode+1, "Unknown mode %s (must be %s or %s)", fields[layout.mode], schdlModeIrradiance, schdlModePWM)
+		}
+	}
+	if layout.priority != -1 && len(fields[layout.priority]) != 0 {
+		priority, fail := strconv.ParseInt(fields[layout.priority], 10, 32)
+		if fail != nil {
+			issues.add(line, layout.priority+1, "Cannot parse priority %s (must be a whole number)", fields[layout.priority])
+		}
+		schedule.Priority = int(priority)
+	}
+	if layout.units != -1 {
+		units, fail := phtnParseUnits(fields[layout.units])
+		if fail != nil {
+			issues.add(line, layout.units+1, "%s", fail)
+		} else if units == phtnUnitsPhotons && schedule.Mode == schdlModePWM {
+			issues.add(line, layout.units+1, "Units %s cannot be used in %s mode", units, schdlModePWM)
+		} else if units != phtnUnitsEnergy {
+			schedule.Units = units
+		}
+	}
+	if layout.recipe != -1 && len(fields[layout.recipe]) != 0 {
+		schedule.Recipe = fields[layout.recipe]
+		for _, column := range layout.levels {
+			if column != -1 && len(fields[column]) != 0 {
+				issues.add(line, column+1, "Channel levels must be left empty when recipe %s is given", schedule.Recipe)
+			}
+		}
+	} else {
+		schdlCSVParseLevels(fields, layout, line, &schedule, issues)
+	}
+	if len(layout.modules) != 0 {
+		modules := make(schdlModules, len(layout.modules))
+		for module, column := range layout.modules {
+			enabled, fail := strconv.ParseBool(fields[column])
+			if fail != nil {
+				issues.add(line, column+1, "Cannot parse module enablement %s (must be 1/0 or true/false)", fields[column])
+			}
+			modules[module] = enabled
+		}
+		schedule.Modules = schdlNormalizeModules(modules)
+	}
+	schedule.Serials = schdlCSVParseSerials(fields, layout.serials, line, issues)
+	return schedule, len(*issues) == count
+}
+
+// Parses the channel levels portion of the record
+func schdlCSVParseLevels(fields []string, layout schdlCSVLayout, line int, schedule *schdlAttached, issues *schdlIssues) {
+	schedule.Levels = make(schdlLevels, len(layout.levels))
+	levelsValid := true
+	for channel, column := range layout.levels {
+		if column == -1 {
+			issues.add(line, 0, "Neither recipe nor level of channel %s given", schdlChannelNames[channel])
+			levelsValid = false
+			continue
+		}
+		level, fail := strconv.ParseFloat(fields[column], 64)
+		if fail != nil || math.IsNaN(level) {
+			issues.add(line, column+1, "Cannot parse channel level %s", fields[column])
+			levelsValid = false
+			continue
+		}
+		if level < 0 || (schedule.Mode == schdlModePWM && (level > 100 || level != math.Trunc(level))) {
+			issues.add(line, column+1, "Invalid channel level %s (must not be negative, whole numbers 0-100 in %s mode)", fields[column], schdlModePWM)
+			levelsValid = false
+			continue
+		}
+		schedule.Levels[channel] = level
+	}
+	if levelsValid {
+		if fail := schdlCheckLevelsFor(schedule.Levels, schedule.Mode); fail != nil {
+			issues.add(line, 0, "%s", fail)
+		}
+	}
+}
+
+// Parses the serials portion of the record (trailing columns, possibly quoted lists)
+func schdlCSVParseSerials(fields []string, first int, line int, issues *schdlIssues) schdlSerials {
+	collection := make(map[schdlSerial]struct{})
+	for column := first; column < len(fields); column++ {
+		for _, textual := range strings.FieldsFunc(fields[column], func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+			serial, fail := strconv.ParseUint(textual, 10, 32)
+			if fail != nil {
+				issues.add(line, column+1, "Cannot parse serial %s", textual)
+				continue
+			}
+			collection[schdlSerial(serial)] = struct{}{}
+		}
+	}
+	if len(collection) == 0 {
+		issues.add(line, first+1, "No serials given")
+	}
+	serials := make(schdlSerials, 0, len(collection))
+	for serial := range collection {
+		serials = append(serials, serial)
+	}
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	return serials
+}
+
+// Formats entries into CSV lines of the v2 dialect (the inverse of schdlCSVParse)
+func schdlCSVFormat(schedules []schdlAttached, channelCount int) []string {
+	modulesCount := 0
+	layered, converted := false, false
+	for _, schedule := range schedules {
+		if len(schedule.Modules) > modulesCount {
+			modulesCount = len(schedule.Modules)
+		}
+		layered = layered || schedule.Priority != 0
+		converted = converted || len(schedule.Units) != 0
+	}
+	header := []string{"StartDate", "StopDate", "StartTime", "StopTime", "Mode"}
+	if layered {
+		header = append(header, "Priority")
+	}
+	if converted {
+		header = append(header, "Units")
+	}
+	header = append(header, schdlChannelNames[:channelCount]...)
+	for module := 0; module < modulesCount; module++ {
+		header = append(header, fmt.Sprintf("Module%d", module))
+	}
+	header = append(header, "Serials")
+	lines := []string{fmt.Sprintf("# PHYTOFY RL schedules (format v%d)", schdlCSVVersion), strings.Join(header, ",")}
+	for _, schedule := range schedules {
+		startDate, startTime := schdlFormatDate(schedule.Start)
+		stopDate, stopTime := schdlFormatDate(schedule.Stop)
+		items := []string{startDate, stopDate, startTime, stopTime, string(schdlModeOf(schedule.schdlDetached))}
+		if layered {
+			items = append(items, strconv.Itoa(schedule.Priority))
+		}
+		if converted {
+			units, _ := phtnParseUnits(schedule.Units)
+			items = append(items, units)
+		}
+		for _, level := range schedule.Levels {
+			items = append(items, strconv.FormatFloat(level, 'f', -1, 64))
+		}
+		for module := 0; module < modulesCount; module++ {
+			items = append(items, strconv.FormatBool(schdlModuleEnabled(schedule.Modules, module)))
+		}
+		for _, serial := range schedule.Serials {
+			items = append(items, strconv.FormatUint(uint64(serial), 10))
+		}
+		for index := range items {
+			items[index] = schdlCSVQuoteField(items[index])
+		}
+		lines = append(lines, strings.Join(items, ","))
+	}
+	return lines
+}
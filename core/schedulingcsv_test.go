@@ -0,0 +1,84 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchdlCSVParse(t *testing.T) {
+	start, _ := schdlParseDate("2021-03-15", "06:00:00")
+	stop, _ := schdlParseDate("2021-03-16", "22:00:00")
+	header := "StartDate,StopDate,StartTime,StopTime,Mode,UVA,Blue,Green,HyperRed,FarRed,White,Serials"
+	cases := []struct {
+		lines     []string
+		expected  []schdlAttached
+		positions [][2]int // Line & column of the issues expected
+	}{
+		{
+			[]string{"# Legacy file", "2021-03-15,2021-03-16,06:00:00,22:00:00,0,1,1,2,0.5,0.5,206002,206001"},
+			[]schdlAttached{{schdlDetached: schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{0, 1, 1, 2, 0.5, 0.5}}, Serials: schdlSerials{206001, 206002}}},
+			[][2]int{},
+		},
+		{
+			[]string{header, "", `2021-03-15,2021-03-16,06:00,22:00,PWM,0,10,10,20,5,5,"206001; 206002"`},
+			[]schdlAttached{{schdlDetached: schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{0, 10, 10, 20, 5, 5}, Mode: schdlModePWM}, Serials: schdlSerials{206001, 206002}}},
+			[][2]int{},
+		},
+		{
+			[]string{"Stop Time,Start_Date,Colour,Serials,UVA"},
+			nil,
+			[][2]int{{1, 3}, {1, 4}, {1, 0}, {1, 0}, {1, 0}, {1, 0}, {1, 0}, {1, 0}, {1, 0}},
+		},
+		{
+			[]string{
+				header,
+				"2021-03-15,2021-03-16,06:00,22:00,dim,0,x,10,20,5,5,206001",
+				"2021-03-16,2021-03-15,06:00,22:00,pwm,0,10,10,20,5,5,206001",
+				"2021-03-15,2021-03-16,06:00,22:00,pwm,0,10,10,20,5,5,20600x",
+				`2021-03-15,2021-03-16,06:00,22:00,pwm,0,10,10,20,5,5,"206001`,
+				"2021-03-15,2021-03-16,06:00,22:00,pwm,0,10,10,20,5,5,206003",
+			},
+			[]schdlAttached{{schdlDetached: schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{0, 10, 10, 20, 5, 5}, Mode: schdlModePWM}, Serials: schdlSerials{206003}}},
+			[][2]int{{2, 5}, {2, 7}, {3, 2}, {4, 12}, {4, 12}, {5, 12}},
+		},
+	}
+	for _, tested := range cases {
+		schedules, issues := schdlCSVParse(tested.lines, 6)
+		positions := make([][2]int, 0, len(issues))
+		for _, issue := range issues {
+			positions = append(positions, [2]int{issue.Line, issue.Column})
+		}
+		if !reflect.DeepEqual(positions, tested.positions) {
+			t.Errorf("%q: issues %v (expecting at %v)", tested.lines, issues, tested.positions)
+		}
+		if len(schedules) != 0 || len(tested.expected) != 0 {
+			if !reflect.DeepEqual(schedules, tested.expected) {
+				t.Errorf("%q: parsed as %+v (expecting %+v)", tested.lines, schedules, tested.expected)
+			}
+		}
+	}
+}
+
+func TestSchdlCSVFormat(t *testing.T) {
+	start, _ := schdlParseDate("2021-03-15", "06:00:00")
+	stop, _ := schdlParseDate("2021-04-30", "22:00:00")
+	cases := [][]schdlAttached{
+		{
+			{schdlDetached: schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{0, 1.5, 1, 2, 0.25, 0}}, Serials: schdlSerials{206001}},
+		},
+		{
+			{schdlDetached: schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{0, 10, 10, 20, 5, 5}, Mode: schdlModePWM, Modules: schdlModules{true, false}}, Serials: schdlSerials{206001, 206002}},
+			{schdlDetached: schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: schdlLevels{0, 40, 20, 80, 10, 30}, Priority: 2, Units: phtnUnitsPhotons}, Serials: schdlSerials{206003}},
+		},
+	}
+	for _, tested := range cases {
+		lines := schdlCSVFormat(tested, 6)
+		parsed, issues := schdlCSVParse(lines, 6)
+		if len(issues) != 0 {
+			t.Errorf("%q: %s", lines, issues)
+		} else if !reflect.DeepEqual(parsed, tested) {
+			t.Errorf("%q: parsed back as %+v (expecting %+v)", lines, parsed, tested)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for flattening prioritised (layered) schedules
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Holds a daily occurrence of a schedule along with the position of the schedule
+type schdlLayerBlock struct {
+	schdlBlock
+	index int
+}
+
+// Holds a portion of a daily occurrence which is not overridden by a higher layer
+type schdlLayerPiece struct {
+	Begin uint32
+	End   uint32
+	block int
+}
+
+// Splits the schedules into the visible pieces (reporting overlaps within the same priority)
+func schdlLayerPieces(schedules []schdlDetached) ([]schdlLayerBlock, []schdlLayerPiece, bool, []string) {
+	blocks := make([]schdlLayerBlock, 0)
+	for index, schedule := range schedules {
+		for _, block := range schdlExtractBlocks(schedule) {
+			blocks = append(blocks, schdlLayerBlock{block, index})
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].Begin < blocks[j].Begin })
+	boundaries := make([]uint32, 0, 2*len(blocks))
+	for _, block := range blocks {
+		boundaries = append(boundaries, block.Begin, block.End)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	pieces := make([]schdlLayerPiece, 0)
+	overlaps := make([]string, 0)
+	reported := make(map[[2]int]struct{})
+	layered := false
+	active := make([]int, 0)
+	next := 0
+	for position := 0; position+1 < len(boundaries); position++ {
+		begin, end := boundaries[position], boundaries[position+1]
+		if begin == end {
+			continue
+		}
+		remaining := active[:0]
+		for _, block := range active {
+			if blocks[block].End > begin {
+				remaining = append(remaining, block)
+			}
+		}
+		active = remaining
+		for ; next < len(blocks) && blocks[next].Begin <= begin; next++ {
+			if blocks[next].End > begin {
+				active = append(active, next)
+			}
+		}
+		if len(active) == 0 {
+			continue
+		}
+		top := active[0]
+		for _, block := range active[1:] {
+			layered = true
+			if blocks[block].Schedule.Priority > blocks[top].Schedule.Priority {
+				top = block
+			}
+		}
+		for i, blockX := range active {
+			for _, blockY := range active[i+1:] {
+				x, y := blocks[blockX], blocks[blockY]
+				if x.Schedule.Priority != y.Schedule.Priority {
+					continue
+				}
+				pair := [2]int{x.index, y.index}
+				if pair[0] > pair[1] {
+					pair[0], pair[1] = pair[1], pair[0]
+				}
+				if _, present := reported[pair]; !present {
+					reported[pair] = struct{}{}
+					overlaps = append(overlaps, schdlCheckForOverlap(x.schdlBlock, y.schdlBlock).Error())
+				}
+			}
+		}
+		if last := len(pieces) - 1; last >= 0 && pieces[last].block == top && pieces[last].End == begin {
+			pieces[last].End = end
+		} else {
+			pieces = append(pieces, schdlLayerPiece{begin, end, top})
+		}
+	}
+	return blocks, pieces, layered, overlaps
+}
+
+// Flattens prioritised schedules of a fixture into non-overlapping ones
+// (a higher priority schedule overrides the lower ones during its window,
+// schedules of the same priority must not overlap)
+func schdlFlattenLayers(schedules []schdlDetached) ([]schdlDetached, error) {
+	blocks, pieces, layered, overlaps := schdlLayerPieces(schedules)
+	if len(overlaps) != 0 {
+		return nil, fmt.Errorf("%s", overlaps[0])
+	}
+	if !layered {
+		return schedules, nil
+	}
+	// Pieces repeating daily at the same time of day are joined back into a single schedule
+	type shape struct {
+		index    int
+		offset   uint32
+		duration uint32
+	}
+	runs := make(map[shape][]schdlLayerPiece)
+	shapes := make([]shape, 0)
+	for _, piece := range pieces {
+		key := shape{blocks[piece.block].index, schdlDropDate(piece.Begin), piece.End - piece.Begin}
+		if _, present := runs[key]; !present {
+			shapes = append(shapes, key)
+		}
+		runs[key] = append(runs[key], piece)
+	}
+	flattened := make([]schdlDetached, 0)
+	for _, key := range shapes {
+		run := runs[key]
+		first := 0
+		for current := range run {
+			if current+1 < len(run) && run[current+1].Begin == schdlShiftByDays(run[current].Begin, 1) {
+				continue
+			}
+			schedule := schedules[key.index]
+			schedule.schdlTiming = schdlTiming{run[first].Begin, run[current].End}
+			schedule.Priority = 0
+			flattened = append(flattened, schedule)
+			first = current + 1
+		}
+	}
+	sort.SliceStable(flattened, func(i, j int) bool { return flattened[i].Start < flattened[j].Start })
+	return flattened, nil
+}
+
+// Flattens prioritised schedules of all fixtures
+func schdlFlattenAll(aggregated schdlAggregated) (schdlAggregated, error) {
+	flattened := make(schdlAggregated)
+	for serial, schedules := range aggregated {
+		entries, fail := schdlFlattenLayers(schedules)
+		if fail != nil {
+			return nil, fmt.Errorf("Fixture %d: %s", serial, fail)
+		}
+		flattened[serial] = entries
+	}
+	return flattened, nil
+}
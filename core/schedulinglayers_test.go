@@ -0,0 +1,81 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchdlFlattenLayers(t *testing.T) {
+	at := func(date, time string) uint32 {
+		stamp, _ := schdlParseDate(date, time)
+		return stamp
+	}
+	base := schdlLevels{0, 10, 10, 20, 5, 5}
+	boost := schdlLevels{0, 40, 20, 80, 10, 30}
+	layer := func(start, stop uint32, levels schdlLevels, priority int) schdlDetached {
+		return schdlDetached{schdlTiming: schdlTiming{start, stop}, Levels: levels, Priority: priority}
+	}
+	cases := []struct {
+		name      string
+		schedules []schdlDetached
+		expected  []schdlDetached // Nil if failing
+	}{
+		{
+			"no layers",
+			[]schdlDetached{
+				layer(at("2021-03-15", "06:00"), at("2021-03-17", "12:00"), base, 0),
+				layer(at("2021-03-15", "12:00"), at("2021-03-17", "14:00"), boost, 0),
+			},
+			[]schdlDetached{
+				layer(at("2021-03-15", "06:00"), at("2021-03-17", "12:00"), base, 0),
+				layer(at("2021-03-15", "12:00"), at("2021-03-17", "14:00"), boost, 0),
+			},
+		},
+		{
+			"override on a single day",
+			[]schdlDetached{
+				layer(at("2021-03-15", "06:00"), at("2021-03-17", "22:00"), base, 0),
+				layer(at("2021-03-16", "12:00"), at("2021-03-16", "14:00"), boost, 1),
+			},
+			[]schdlDetached{
+				layer(at("2021-03-15", "06:00"), at("2021-03-15", "22:00"), base, 0),
+				layer(at("2021-03-16", "06:00"), at("2021-03-16", "12:00"), base, 0),
+				layer(at("2021-03-16", "12:00"), at("2021-03-16", "14:00"), boost, 0),
+				layer(at("2021-03-16", "14:00"), at("2021-03-16", "22:00"), base, 0),
+				layer(at("2021-03-17", "06:00"), at("2021-03-17", "22:00"), base, 0),
+			},
+		},
+		{
+			"override every day",
+			[]schdlDetached{
+				layer(at("2021-03-15", "12:00"), at("2021-03-17", "14:00"), boost, 2),
+				layer(at("2021-03-15", "06:00"), at("2021-03-17", "22:00"), base, -1),
+			},
+			[]schdlDetached{
+				layer(at("2021-03-15", "06:00"), at("2021-03-17", "12:00"), base, 0),
+				layer(at("2021-03-15", "12:00"), at("2021-03-17", "14:00"), boost, 0),
+				layer(at("2021-03-15", "14:00"), at("2021-03-17", "22:00"), base, 0),
+			},
+		},
+		{
+			"overlap within a layer",
+			[]schdlDetached{
+				layer(at("2021-03-15", "06:00"), at("2021-03-17", "22:00"), base, 1),
+				layer(at("2021-03-16", "12:00"), at("2021-03-16", "14:00"), boost, 1),
+			},
+			nil,
+		},
+	}
+	for _, tested := range cases {
+		flattened, fail := schdlFlattenLayers(tested.schedules)
+		switch {
+		case tested.expected == nil && fail == nil:
+			t.Errorf("%s: flattened into %+v (expecting a failure)", tested.name, flattened)
+		case tested.expected != nil && fail != nil:
+			t.Errorf("%s: %s", tested.name, fail)
+		case tested.expected != nil && !reflect.DeepEqual(flattened, tested.expected):
+			t.Errorf("%s: flattened into %+v (expecting %+v)", tested.name, flattened, tested.expected)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for staged deployments of schedules applied at a future time
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stgStorage       = "deployments.json"
+	stgStorageLock   = "deployments.lock"  // Guards the deployments modified by the API & the CLI processes
+	stgApplyingLock  = "deployments.apply" // Lets a single import (deployment or not) modify the fixtures at a time
+	stgRetryInterval = time.Minute
+	stgPollInterval  = 30 * time.Second // Picks up deployments changed by the CLI
+	stgStatePending  = "pending"
+	stgStatePartial  = "partial"
+	stgStateApplied  = "applied"
+	stgStateCanceled = "canceled"
+)
+
+// Holds a staged deployment (fixtures failing to get the schedules - e.g. offline - stay pending and are retried)
+type stgDeployment struct {
+	ID         uint32                 `json:"id"`
+	Activation uint32                 `json:"activation"`
+	Created    uint32                 `json:"created"`
+	Author     string                 `json:"author,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	State      string                 `json:"state"`
+	Schedules  []schdlAttached        `json:"schedules"`
+	Pending    schdlSerials           `json:"pending"`
+	Applied    schdlSerials           `json:"applied"`
+	Errors     map[schdlSerial]string `json:"errors"`
+	Attempts   int                    `json:"attempts"`
+	Attempted  uint32                 `json:"attempted,omitempty"`
+}
+
+// Applies staged deployments when due
+type stgStager struct {
+	logger     *log.Logger
+	controller *ctrl1Controller
+	apply      func(schedules []schdlAttached) error
+	lock       sync.Mutex
+	wake       chan struct{}
+}
+
+// Creates an instance of the stager (the deployments are applied by the given function, the stager records the versions)
+func stgInit(logger *log.Logger, controller *ctrl1Controller, apply func([]schdlAttached) error) *stgStager {
+	return &stgStager{logger: logger, controller: controller, apply: apply, wake: make(chan struct{}, 1)}
+}
+
+// Loads the deployments
+func stgLoad() ([]stgDeployment, error) {
+	deployments := make([]stgDeployment, 0)
+	if fail := dataRead(stgStorage, &deployments); fail != nil && !os.IsNotExist(fail) {
+		return nil, fail
+	}
+	return deployments, nil
+}
+
+// Lists the fixtures the schedules are meant for
+func stgSerials(schedules []schdlAttached) schdlSerials {
+	serials := make(schdlSerials, 0)
+	for _, schedule := range schedules {
+		serials = append(serials, schedule.Serials...)
+	}
+	return planUniqueSerials(serials)
+}
+
+// Restricts the schedules to the given fixtures
+func stgRestrict(schedules []schdlAttached, serials schdlSerials) []schdlAttached {
+	wanted := make(map[schdlSerial]struct{})
+	for _, serial := range serials {
+		wanted[serial] = struct{}{}
+	}
+	restricted := make([]schdlAttached, 0)
+	for _, schedule := range schedules {
+		kept := make(schdlSerials, 0)
+		for _, candidate := range schedule.Serials {
+			if _, present := wanted[candidate]; present {
+				kept = append(kept, candidate)
+			}
+		}
+		if len(kept) != 0 {
+			restricted = append(restricted, schdlAttached{schdlDetached: schedule.schdlDetached, Serials: kept})
+		}
+	}
+	return restricted
+}
+
+// Modifies the stored deployments under the lock (shared with the other processes)
+func (stager *stgStager) stgModify(modify func(deployments []stgDeployment) ([]stgDeployment, error)) error {
+	stager.lock.Lock()
+	defer stager.lock.Unlock()
+	release, fail := dataLock(stgStorageLock)
+	if fail != nil {
+		return fail
+	}
+	defer release()
+	deployments, fail := stgLoad()
+	if fail != nil {
+		return fail
+	}
+	if deployments, fail = modify(deployments); fail != nil {
+		return fail
+	}
+	return dataWrite(stgStorage, deployments)
+}
+
+// Stages the (resolved) schedules to be applied at the activation time
+func (stager *stgStager) stgStage(schedules []schdlAttached, activation uint32, source, author string) (*stgDeployment, error) {
+	if _, fail := schdlAggregateSchedules(schedules, false); fail != nil {
+		return nil, fail
+	}
+	now := uint32(time.Now().Unix())
+	deployment := stgDeployment{1, activation, now, author, source, stgStatePending, schedules, stgSerials(schedules), schdlSerials{}, map[schdlSerial]string{}, 0, 0}
+	fail := stager.stgModify(func(deployments []stgDeployment) ([]stgDeployment, error) {
+		for _, existing := range deployments {
+			if existing.ID >= deployment.ID {
+				deployment.ID = existing.ID + 1
+			}
+		}
+		return append(deployments, deployment), nil
+	})
+	if fail != nil {
+		return nil, fail
+	}
+	stager.logger.Printf("INFO: Deployment %d staged for %s", deployment.ID, time.Unix(int64(activation), 0).UTC().Format(time.RFC3339))
+	stager.stgWake()
+	return &deployment, nil
+}
+
+// Finds a deployment
+func (stager *stgStager) stgGet(id uint32) (*stgDeployment, error) {
+	stager.lock.Lock()
+	defer stager.lock.Unlock()
+	deployments, fail := stgLoad()
+	if fail != nil {
+		return nil, fail
+	}
+	for _, deployment := range deployments {
+		if deployment.ID == id {
+			return &deployment, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown deployment %d", id)
+}
+
+// Lists the deployments (by activation time)
+func (stager *stgStager) stgList() ([]stgDeployment, error) {
+	stager.lock.Lock()
+	defer stager.lock.Unlock()
+	deployments, fail := stgLoad()
+	if fail != nil {
+		return nil, fail
+	}
+	sort.SliceStable(deployments, func(i, j int) bool { return deployments[i].Activation < deployments[j].Activation })
+	return deployments, nil
+}
+
+// Modifies a deployment which is not finished yet
+func (stager *stgStager) stgModifyOpen(id uint32, modify func(deployment *stgDeployment)) (*stgDeployment, error) {
+	var modified stgDeployment
+	fail := stager.stgModify(func(deployments []stgDeployment) ([]stgDeployment, error) {
+		for index := range deployments {
+			if deployments[index].ID == id {
+				if state := deployments[index].State; state != stgStatePending && state != stgStatePartial {
+					return nil, fmt.Errorf("Deployment %d is %s already", id, state)
+				}
+				modify(&deployments[index])
+				modified = deployments[index]
+				return deployments, nil
+			}
+		}
+		return nil, fmt.Errorf("Unknown deployment %d", id)
+	})
+	if fail != nil {
+		return nil, fail
+	}
+	return &modified, nil
+}
+
+// Cancels a deployment (fixtures which got the schedules already keep them)
+func (stager *stgStager) stgCancel(id uint32) (*stgDeployment, error) {
+	deployment, fail := stager.stgModifyOpen(id, func(deployment *stgDeployment) { deployment.State = stgStateCanceled })
+	if fail == nil {
+		stager.logger.Printf("INFO: Deployment %d canceled", id)
+	}
+	return deployment, fail
+}
+
+// Makes a deployment due right away (regardless of the activation time) - it is applied in the background by the loop
+func (stager *stgStager) stgApplyNow(id uint32) (*stgDeployment, error) {
+	deployment, fail := stager.stgModifyOpen(id, func(deployment *stgDeployment) {
+		deployment.Activation = uint32(time.Now().Unix())
+		deployment.Attempted = 0
+	})
+	if fail != nil {
+		return nil, fail
+	}
+	stager.logger.Printf("INFO: Deployment %d due right away", id)
+	stager.stgWake()
+	return deployment, nil
+}
+
+// Tells when a deployment is due (zero if finished)
+func stgDue(deployment stgDeployment) time.Time {
+	if deployment.State != stgStatePending && deployment.State != stgStatePartial {
+		return time.Time{}
+	}
+	due := time.Unix(int64(deployment.Activation), 0)
+	if deployment.Attempted != 0 {
+		if retry := time.Unix(int64(deployment.Attempted), 0).Add(stgRetryInterval); retry.After(due) {
+			due = retry
+		}
+	}
+	return due
+}
+
+// Applies the deployments when due until the application exits
+func (stager *stgStager) stgRun() {
+	for {
+		wait := stgPollInterval
+		if deployments, fail := stager.stgList(); fail != nil {
+			stager.logger.Printf("ERROR: Failed to load the staged deployments (%s)", fail)
+		} else {
+			for _, deployment := range deployments {
+				due := stgDue(deployment)
+				if due.IsZero() {
+					continue
+				}
+				if until := time.Until(due); until > 0 {
+					if until < wait {
+						wait = until
+					}
+					continue
+				}
+				stager.stgAttempt(deployment.ID)
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-stager.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// Wakes the loop up to reconsider the deployments
+func (stager *stgStager) stgWake() {
+	select {
+	case stager.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Takes the lock the deployments get applied under (every import takes it so the imports of the processes do not
+// interleave on the same fixtures) and returns its release
+func stgLockImports() (func(), error) {
+	return dataLock(stgApplyingLock)
+}
+
+// Applies a deployment to the pending fixtures which are seen - all at once, then one by one if that fails so a failing
+// fixture does not hold up the others (the processes take turns applying the deployments)
+func (stager *stgStager) stgAttempt(id uint32) {
+	release, fail := stgLockImports()
+	if fail != nil {
+		stager.logger.Printf("ERROR: Failed to lock the deployments (%s)", fail)
+		return
+	}
+	defer release()
+	deployment, fail := stager.stgGet(id)
+	if fail != nil || stgDue(*deployment).IsZero() {
+		return
+	}
+	seen := make(map[schdlSerial]struct{})
+	for _, serial := range stager.controller.ctrl1GetSerials() {
+		seen[serial] = struct{}{}
+	}
+	online := make(schdlSerials, 0)
+	errors := make(map[schdlSerial]string)
+	for _, serial := range deployment.Pending {
+		if _, present := seen[serial]; !present {
+			errors[serial] = "Fixture not seen (offline)"
+			continue
+		}
+		online = append(online, serial)
+	}
+	applied := make(schdlSerials, 0)
+	if len(online) != 0 {
+		fail := stager.apply(stgRestrict(deployment.Schedules, online))
+		if fail == nil {
+			applied = append(applied, online...)
+		} else if len(online) == 1 {
+			errors[online[0]] = fail.Error()
+		} else {
+			stager.logger.Printf("WARNING: Deployment %d failed to apply at once, applying it fixture by fixture (%s)", id, fail)
+			for _, serial := range online {
+				if fail := stager.apply(stgRestrict(deployment.Schedules, schdlSerials{serial})); fail != nil {
+					errors[serial] = fail.Error()
+					continue
+				}
+				applied = append(applied, serial)
+			}
+		}
+	}
+	if len(applied) != 0 {
+		if _, fail := hstrRecord(stgRestrict(deployment.Schedules, applied), fmt.Sprintf("deployment %d", id), deployment.Author); fail != nil {
+			stager.logger.Printf("ERROR: Failed to record deployment %d in the history (%s)", id, fail)
+		}
+	}
+	_, fail = stager.stgModifyOpen(id, func(deployment *stgDeployment) {
+		done := make(map[schdlSerial]struct{})
+		for _, serial := range applied {
+			done[serial] = struct{}{}
+		}
+		pending := make(schdlSerials, 0)
+		for _, serial := range deployment.Pending {
+			if _, present := done[serial]; !present {
+				pending = append(pending, serial)
+			}
+		}
+		deployment.Pending = pending
+		deployment.Applied = planUniqueSerials(append(deployment.Applied, applied...))
+		deployment.Errors = errors
+		deployment.Attempts++
+		deployment.Attempted = uint32(time.Now().Unix())
+		deployment.State = stgStatePartial
+		if len(pending) == 0 {
+			deployment.State = stgStateApplied
+		}
+	})
+	if fail != nil {
+		stager.logger.Printf("ERROR: Failed to update deployment %d (%s)", id, fail)
+		return
+	}
+	stager.logger.Printf("INFO: Deployment %d applied to %d fixtures (%d pending)", id, len(applied), len(errors))
+}
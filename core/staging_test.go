@@ -0,0 +1,30 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStgRestrict(t *testing.T) {
+	first := schdlDetached{schdlTiming: schdlTiming{Start: 100, Stop: 200}}
+	second := schdlDetached{schdlTiming: schdlTiming{Start: 300, Stop: 400}}
+	schedules := []schdlAttached{
+		{schdlDetached: first, Serials: schdlSerials{1, 2, 3}},
+		{schdlDetached: second, Serials: schdlSerials{3, 4}},
+	}
+	cases := []struct {
+		serials  schdlSerials
+		expected []schdlAttached
+	}{
+		{schdlSerials{2}, []schdlAttached{{schdlDetached: first, Serials: schdlSerials{2}}}},
+		{schdlSerials{1, 3}, []schdlAttached{{schdlDetached: first, Serials: schdlSerials{1, 3}}, {schdlDetached: second, Serials: schdlSerials{3}}}},
+		{schdlSerials{4, 5}, []schdlAttached{{schdlDetached: second, Serials: schdlSerials{4}}}},
+		{schdlSerials{5}, []schdlAttached{}},
+	}
+	for _, tested := range cases {
+		if restricted := stgRestrict(schedules, tested.serials); !reflect.DeepEqual(restricted, tested.expected) {
+			t.Errorf("%v: restricted to %v (expecting %v)", tested.serials, restricted, tested.expected)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code is responsible for answering what the fixtures emit at a given time
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tmlnGap            = -1
+	tmlnSourceFixtures = "fixtures"
+	tmlnSourcePlan     = "plan"
+	tmlnDefaultSpan    = 24 * 60 * 60
+	tmlnMaximumSerials = 4096 // Bounds the serials listed (a bus holds 255 fixtures at most)
+)
+
+// Holds a period during which the fixture emits constant light (or nothing - a gap)
+type tmlnSegment struct {
+	From       uint32      `json:"from"`
+	To         uint32      `json:"to"`
+	ScheduleID int         `json:"schedule_id"`
+	Levels     schdlLevels `json:"levels"`
+	Mode       schdlMode   `json:"mode,omitempty"`
+	Recipe     string      `json:"recipe,omitempty"`
+	Conversion *phtnReport `json:"conversion,omitempty"`
+}
+
+// Holds the timeline of a single fixture
+type tmlnTimeline struct {
+	Serial   schdlSerial   `json:"serial"`
+	Segments []tmlnSegment `json:"segments"`
+}
+
+// Holds a daily occurrence of a schedule along with its identifier
+type tmlnBlock struct {
+	schdlBlock
+	ScheduleID int
+}
+
+// Parses a list of serials with ranges (e.g. 206001-206024,206030) - refusing to list more than the maximum
+func tmlnParseSerials(textual string) (schdlSerials, error) {
+	serials := make(schdlSerials, 0)
+	for _, item := range strings.FieldsFunc(textual, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+		bounds := strings.SplitN(item, "-", 2)
+		first, fail := strconv.ParseUint(bounds[0], 10, 32)
+		if fail != nil {
+			return nil, fmt.Errorf("Cannot parse serial %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, fail = strconv.ParseUint(bounds[1], 10, 32); fail != nil || last < first {
+				return nil, fmt.Errorf("Cannot parse serial range %s", item)
+			}
+		}
+		if uint64(len(serials))+last-first+1 > tmlnMaximumSerials {
+			return nil, fmt.Errorf("Cannot list more than %d serials", tmlnMaximumSerials)
+		}
+		for serial := first; serial <= last; serial++ {
+			serials = append(serials, schdlSerial(serial))
+		}
+	}
+	return planUniqueSerials(serials), nil
+}
+
+// Parses a point in time (Linux/UNIX epoch or RFC3339, UTC if no zone given)
+func tmlnParseTime(textual string) (uint32, error) {
+	if stamp, fail := strconv.ParseUint(textual, 10, 32); fail == nil {
+		return uint32(stamp), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if stamp, fail := time.Parse(layout, textual); fail == nil {
+			return uint32(stamp.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("Cannot parse time %s", textual)
+}
+
+// Parses the queried range (a single second if a point in time is given, a day from now by default)
+func tmlnParseRange(from, to, at string, now uint32) (uint32, uint32, error) {
+	if len(at) != 0 {
+		if len(from) != 0 || len(to) != 0 {
+			return 0, 0, fmt.Errorf("Either a point in time or a range can be queried")
+		}
+		stamp, fail := tmlnParseTime(at)
+		return stamp, stamp + 1, fail
+	}
+	begin := now
+	var fail error
+	if len(from) != 0 {
+		if begin, fail = tmlnParseTime(from); fail != nil {
+			return 0, 0, fail
+		}
+	}
+	end := begin + tmlnDefaultSpan
+	if len(to) != 0 {
+		if end, fail = tmlnParseTime(to); fail != nil {
+			return 0, 0, fail
+		}
+	}
+	if end <= begin {
+		return 0, 0, fmt.Errorf("Range must end after it begins")
+	}
+	return begin, end, nil
+}
+
+// Extracts the daily occurrences of the schedules of a fixture (schedule ID being the position)
+func tmlnExtractBlocks(schedules []schdlDetached) []tmlnBlock {
+	blocks := make([]tmlnBlock, 0)
+	for scheduleID, schedule := range schedules {
+		for _, block := range schdlExtractBlocks(schedule) {
+			blocks = append(blocks, tmlnBlock{block, scheduleID})
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].Begin < blocks[j].Begin })
+	return blocks
+}
+
+// Builds the timeline of a fixture for the given range [from, to)
+func tmlnBuild(serial schdlSerial, schedules []schdlDetached, from, to uint32) tmlnTimeline {
+	segments := make([]tmlnSegment, 0)
+	cursor := from
+	for _, block := range tmlnExtractBlocks(schedules) {
+		begin, end := block.Begin, block.End
+		if end <= cursor || begin >= to {
+			continue
+		}
+		if begin < cursor {
+			begin = cursor
+		}
+		if end > to {
+			end = to
+		}
+		if begin > cursor {
+			segments = append(segments, tmlnSegment{cursor, begin, tmlnGap, nil, "", "", nil})
+		}
+		schedule := block.Schedule
+		segment := tmlnSegment{begin, end, block.ScheduleID, schedule.Levels, schdlModeOf(schedule), schedule.Recipe, nil}
+		if segment.Mode == schdlModeIrradiance {
+			report := phtnReportLevels(schedule.Levels)
+			segment.Conversion = &report
+		}
+		segments = append(segments, segment)
+		cursor = end
+	}
+	if cursor < to {
+		segments = append(segments, tmlnSegment{cursor, to, tmlnGap, nil, "", "", nil})
+	}
+	return tmlnTimeline{serial, segments}
+}
+
+// Builds the timelines of the given fixtures (all aggregated fixtures if none given)
+func tmlnQuery(aggregated schdlAggregated, serials schdlSerials, from, to uint32) []tmlnTimeline {
+	if len(serials) == 0 {
+		for serial := range aggregated {
+			serials = append(serials, serial)
+		}
+		sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	}
+	timelines := make([]tmlnTimeline, 0, len(serials))
+	for _, serial := range serials {
+		timelines = append(timelines, tmlnBuild(serial, aggregated[serial], from, to))
+	}
+	return timelines
+}
+
+// Summarizes the timelines in a human readable form
+func tmlnSummarize(timelines []tmlnTimeline) string {
+	format := func(stamp uint32) string {
+		return time.Unix(int64(stamp), 0).UTC().Format("2006-01-02 15:04:05")
+	}
+	var summary strings.Builder
+	for _, timeline := range timelines {
+		fmt.Fprintf(&summary, "%d\n", timeline.Serial)
+		for _, segment := range timeline.Segments {
+			if segment.ScheduleID == tmlnGap {
+				fmt.Fprintf(&summary, "  %s - %s  off\n", format(segment.From), format(segment.To))
+			} else {
+				fmt.Fprintf(&summary, "  %s - %s  schedule %d (%s) %v", format(segment.From), format(segment.To), segment.ScheduleID, segment.Mode, segment.Levels)
+				if segment.Conversion != nil {
+					fmt.Fprintf(&summary, " W/m2, %v umol/m2/s, PPFD %g", segment.Conversion.Photons, segment.Conversion.PPFD)
+				}
+				fmt.Fprintln(&summary)
+			}
+		}
+	}
+	return strings.TrimSuffix(summary.String(), "\n")
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTmlnParseSerials(t *testing.T) {
+	cases := []struct {
+		textual  string
+		expected schdlSerials // Nil if failing
+	}{
+		{"206001", schdlSerials{206001}},
+		{"206003-206005,206001; 206004", schdlSerials{206001, 206003, 206004, 206005}},
+		{"", schdlSerials{}},
+		{"206005-206003", nil},
+		{"20600a", nil},
+		{"1-4097", nil},
+		{"0-4294967295", nil},
+		{"1-4000,5001-5100", nil},
+	}
+	for _, tested := range cases {
+		serials, fail := tmlnParseSerials(tested.textual)
+		if tested.expected == nil {
+			if fail == nil {
+				t.Errorf("%q: parsed %d serials (expecting a failure)", tested.textual, len(serials))
+			}
+		} else if fail != nil {
+			t.Errorf("%q: %s", tested.textual, fail)
+		} else if !reflect.DeepEqual(serials, tested.expected) {
+			t.Errorf("%q: parsed as %v (expecting %v)", tested.textual, serials, tested.expected)
+		}
+	}
+}
@@ -3,19 +3,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
 
-type webHandler func(string, []byte) ([]byte, error)
+// Handles a route (the context carries the identity of the client when authenticated)
+type webHandler func(context.Context, string, []byte) ([]byte, error)
 
 type webRoute struct {
 	Name    string
@@ -29,28 +33,81 @@ type webErrorReply struct {
 	Result string `json:"result,omitempty"`
 }
 
+// Carries the HTTP status code of a failure (other failures are reported as internal server errors)
+type webStatusError struct {
+	status  int
+	message string
+}
+
+func (fail *webStatusError) Error() string {
+	return fail.message
+}
+
+// Creates a failure reported with the given HTTP status code
+func webFail(status int, format string, arguments ...interface{}) error {
+	return &webStatusError{status, fmt.Sprintf(format, arguments...)}
+}
+
 //go:embed assets/*
 var assets embed.FS
 
-func webHandlerWrapper(handler webHandler, name string, logger *log.Logger) http.HandlerFunc {
+func webHandlerWrapper(route webRoute, spec *oapiSpec, auth *authConfig, logger *log.Logger) http.HandlerFunc {
+	name, method := route.Name, route.Method
 	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
-		logger.Printf("INFO: %s %s %s", request.Method, request.RequestURI, name)
 		response.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		status := http.StatusOK
 		var bufferOut []byte
-		bufferIn, fail := ioutil.ReadAll(request.Body)
+		var bufferIn []byte
+		var identity authIdentity
+		var fail error
+		if auth != nil {
+			identity, fail = auth.authAuthenticate(request, false)
+			logger.Printf("INFO: %s %s %s (%s)", request.Method, request.RequestURI, name, identity.name)
+		} else {
+			logger.Printf("INFO: %s %s %s", request.Method, request.RequestURI, name)
+		}
 		if fail == nil {
-			bufferOut, fail = handler(name, bufferIn)
+			bufferIn, fail = ioutil.ReadAll(request.Body)
+		}
+		variables := webCollectVariables(request)
+		if fail == nil && spec != nil {
+			fail = spec.oapiValidateArguments(method, route.Path, bufferIn, variables)
+		}
+		if fail == nil {
+			bufferIn, fail = webMergeVariables(bufferIn, variables)
+		}
+		if fail == nil && auth != nil {
+			fail = identity.authAuthorise(authRequiredRole(name, method, bufferIn))
+		}
+		if fail == nil {
+			ctx := context.Background()
+			if auth != nil {
+				ctx = authWithIdentity(ctx, identity)
+			}
+			bufferOut, fail = route.Handler(ctx, name, bufferIn)
+		}
+		if fail == nil && bufferOut == nil {
+			// Nothing to reply with (e.g. a resource got deleted)
+			status = http.StatusNoContent
 		}
 		if fail != nil {
+			status = http.StatusInternalServerError
+			if statusFail, isStatus := fail.(*webStatusError); isStatus {
+				status = statusFail.status
+			}
+			if status == http.StatusUnauthorized {
+				response.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			}
 			reply := webErrorReply{fail.Error(), string(bufferOut)}
 			if bufferOut, fail = json.Marshal(&reply); fail != nil {
 				logger.Printf("ERROR: Failed to marshal an error reply (%s)", fail)
 				bufferOut = []byte(reply.Error)
 			}
-			status = http.StatusInternalServerError
 		}
 		response.WriteHeader(status)
+		if status == http.StatusNoContent {
+			return
+		}
 		written, fail := response.Write(bufferOut)
 		if fail != nil {
 			logger.Printf("ERROR: Failed to write a reply (%s)", fail)
@@ -60,8 +117,41 @@ func webHandlerWrapper(handler webHandler, name string, logger *log.Logger) http
 	})
 }
 
-func webExit(name string, jsonArguments []byte) ([]byte, error) {
-	os.Exit(0)
+// Collects the query & path variables (the latter take precedence)
+func webCollectVariables(request *http.Request) map[string]string {
+	variables := make(map[string]string)
+	for name, values := range request.URL.Query() {
+		if len(values) != 0 {
+			variables[name] = values[len(values)-1]
+		}
+	}
+	for name, value := range mux.Vars(request) {
+		variables[name] = value
+	}
+	return variables
+}
+
+// Merges the query & path variables (as strings) into the JSON arguments
+func webMergeVariables(jsonArguments []byte, variables map[string]string) ([]byte, error) {
+	if len(variables) == 0 {
+		return jsonArguments, nil
+	}
+	arguments := make(map[string]interface{})
+	if len(bytes.TrimSpace(jsonArguments)) != 0 {
+		decoder := json.NewDecoder(bytes.NewReader(jsonArguments))
+		decoder.UseNumber()
+		if fail := decoder.Decode(&arguments); fail != nil {
+			return nil, webFail(http.StatusBadRequest, "Failed to parse arguments (%s)", fail)
+		}
+	}
+	for name, value := range variables {
+		arguments[name] = value
+	}
+	return json.Marshal(&arguments)
+}
+
+func webExit(ctx context.Context, name string, jsonArguments []byte) ([]byte, error) {
+	exitRun(0)
 	return []byte{}, nil
 }
 
@@ -69,23 +159,82 @@ func webLogs(name string, jsonArguments []byte, logger *log.Logger) ([]byte, err
 	return logCollect(logger)
 }
 
-// Launches a web server for PHYTOFY RL
-func webLaunch(port uint16, routes []webRoute, includeUI bool, logger *log.Logger) error {
-	router := mux.NewRouter().StrictSlash(true)
-	commonRoutes := []webRoute{
+// Lists the routes common to all the API versions
+func webCommonRoutes(logger *log.Logger) []webRoute {
+	return []webRoute{
 		{"exit", http.MethodGet, "/api/exit", webExit},
-		{"logs", http.MethodGet, "/api/logs", func(name string, jsonArguments []byte) ([]byte, error) {
+		{"logs", http.MethodGet, "/api/logs", func(ctx context.Context, name string, jsonArguments []byte) ([]byte, error) {
 			return webLogs(name, jsonArguments, logger)
 		}},
 	}
-	for _, route := range commonRoutes {
-		handler := webHandlerWrapper(route.Handler, route.Name, logger)
-		router.Methods(route.Method).Path(route.Path).Name(route.Name).Handler(handler)
+}
+
+// Guards a streaming handler (the clients must hold the viewer role at least)
+func webGuard(handler http.Handler, auth *authConfig) http.Handler {
+	if auth == nil {
+		return handler
 	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		identity, fail := auth.authAuthenticate(request, true)
+		if fail == nil {
+			fail = identity.authAuthorise(authRoleViewer)
+		}
+		if fail != nil {
+			status := fail.(*webStatusError).status
+			if status == http.StatusUnauthorized {
+				response.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			}
+			http.Error(response, fail.Error(), status)
+			return
+		}
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// Parses the address to listen on - a port (on all interfaces) or an address & port
+func webParseAddress(argument string) (string, error) {
+	if port, fail := strconv.ParseUint(argument, 10, 16); fail == nil {
+		return fmt.Sprintf(":%d", port), nil
+	}
+	host, port, fail := net.SplitHostPort(argument)
+	if fail != nil {
+		return "", fmt.Errorf("Invalid address %q (expecting a port or an address & port)", argument)
+	}
+	if _, fail := strconv.ParseUint(port, 10, 16); fail != nil {
+		return "", fmt.Errorf("Invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Launches a web server for PHYTOFY RL
+func webLaunch(address string, routes []webRoute, spec *oapiSpec, includeUI bool, logger *log.Logger) error {
+	auth, fail := authLoad(logger)
+	if fail != nil {
+		return fail
+	}
+	tlsConfig, fail := crtConfigure(address, logger)
+	if fail != nil {
+		return fail
+	}
+	if auth != nil && tlsConfig == nil {
+		logger.Printf("WARNING: Authentication configured without TLS - the credentials are sent in the clear")
+	}
+	router := mux.NewRouter().StrictSlash(true)
+	routes = append(webCommonRoutes(logger), routes...)
 	for _, route := range routes {
-		handler := webHandlerWrapper(route.Handler, route.Name, logger)
+		handler := webHandlerWrapper(route, spec, auth, logger)
 		router.Methods(route.Method).Path(route.Path).Name(route.Name).Handler(handler)
 	}
+	router.Methods(http.MethodGet).Path("/api/events").Name("events").Handler(webGuard(evntHandler(logger), auth))
+	router.Methods(http.MethodGet).Path("/metrics").Name("metrics").Handler(webGuard(mtrcHandler(logger), auth))
+	if spec != nil {
+		for _, missing := range spec.oapiMissingRoutes(routes) {
+			logger.Printf("WARNING: Route %s is missing from the API specification (not validated)", missing)
+		}
+		router.Methods(http.MethodGet).Path("/api/openapi.yaml").Name("openapi-yaml").Handler(spec.oapiHandler("yaml", logger))
+		router.Methods(http.MethodGet).Path("/api/openapi.json").Name("openapi-json").Handler(spec.oapiHandler("json", logger))
+		router.Methods(http.MethodGet).Path("/api/docs").Name("docs").Handler(spec.oapiHandler("docs", logger))
+	}
 	if includeUI {
 		if stripped, fail := fs.Sub(assets, "assets"); fail == nil {
 			router.PathPrefix("/").Handler(http.FileServer(http.FS(stripped)))
@@ -93,5 +242,9 @@ func webLaunch(port uint16, routes []webRoute, includeUI bool, logger *log.Logge
 			logger.Printf("ERROR: Static assets are missing (%s)", fail)
 		}
 	}
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), router)
+	server := &http.Server{Addr: address, Handler: router, TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
 }
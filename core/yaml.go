@@ -0,0 +1,446 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+// This code reads & writes the subset of YAML used by the experiment plans and the OpenAPI specification
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Holds a line of a YAML document
+type yamlLine struct {
+	number int
+	indent int
+	text   string // Without the indentation & the comments
+	raw    string
+	blank  bool
+}
+
+// Parses the subset of YAML used by the plans & the specification (block collections, flow sequences, quoted & block scalars)
+// - anchors, aliases, tags, folded scalars, directives & multiple documents are refused rather than misread
+type yamlParser struct {
+	lines    []yamlLine
+	position int
+}
+
+// Strips a comment trailing a line (outside the quoted strings)
+func yamlStripComment(text string) string {
+	quote := byte(0)
+	for index := 0; index < len(text); index++ {
+		switch character := text[index]; {
+		case quote != 0:
+			if character == '\\' && quote == '"' {
+				index++
+			} else if character == quote {
+				quote = 0
+			}
+		case character == '"' || character == '\'':
+			quote = character
+		case character == '#' && (index == 0 || text[index-1] == ' '):
+			return strings.TrimRight(text[:index], " ")
+		}
+	}
+	return text
+}
+
+// Parses a YAML document
+func yamlParse(content []byte) (interface{}, error) {
+	parser := yamlParser{}
+	started := false
+	for number, raw := range strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n") {
+		text := yamlStripComment(strings.TrimSpace(raw))
+		indent := len(raw) - len(strings.TrimLeft(raw, " "))
+		switch {
+		case strings.HasPrefix(strings.TrimLeft(raw, " "), "\t") && len(text) != 0:
+			return nil, fmt.Errorf("Line %d: tabs cannot indent (%q)", number+1, text)
+		case strings.HasPrefix(text, "%"):
+			return nil, fmt.Errorf("Line %d: directives are not supported (%q)", number+1, text)
+		case (text == "---" || text == "...") && indent == 0:
+			// Only a single document (optionally marked as such) is supported
+			if text == "---" && started {
+				return nil, fmt.Errorf("Line %d: multiple documents are not supported", number+1)
+			}
+			text = ""
+		}
+		started = started || len(text) != 0
+		parser.lines = append(parser.lines, yamlLine{number + 1, indent, text, raw, len(text) == 0})
+	}
+	document, fail := parser.yamlParseNode()
+	if fail != nil {
+		return nil, fail
+	}
+	if parser.yamlSkip(); parser.position < len(parser.lines) {
+		return nil, parser.yamlFail("unexpected content")
+	}
+	return document, nil
+}
+
+func (parser *yamlParser) yamlFail(message string) error {
+	line := parser.lines[parser.position]
+	return fmt.Errorf("Line %d: %s (%q)", line.number, message, line.text)
+}
+
+// Skips the blank lines
+func (parser *yamlParser) yamlSkip() {
+	for parser.position < len(parser.lines) && parser.lines[parser.position].blank {
+		parser.position++
+	}
+}
+
+// Tells if a line starts an item of a sequence
+func yamlIsItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// Splits a line of a mapping into the key & the (inline) value
+func yamlSplitKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := 1
+		for end < len(text) && (text[end] != text[0] || (text[0] == '\'' && strings.HasPrefix(text[end:], "''"))) {
+			if (text[0] == '"' && text[end] == '\\') || (text[0] == '\'' && text[end] == '\'') {
+				// Skips the escaped character (or the quote doubled within a single-quoted key)
+				end++
+			}
+			end++
+		}
+		if end >= len(text) || !strings.HasPrefix(text[end+1:], ":") {
+			return "", "", false
+		}
+		key, fail := yamlParseScalar(text[:end+1])
+		if fail != nil {
+			return "", "", false
+		}
+		rest := text[end+2:]
+		if len(rest) != 0 && rest[0] != ' ' {
+			return "", "", false
+		}
+		return fmt.Sprint(key), strings.TrimSpace(rest), true
+	}
+	if yamlIsUnsupported(text) {
+		return "", "", false
+	}
+	if index := strings.Index(text, ": "); index > 0 {
+		return text[:index], strings.TrimSpace(text[index+2:]), true
+	}
+	if strings.HasSuffix(text, ":") && len(text) > 1 {
+		return text[:len(text)-1], "", true
+	}
+	return "", "", false
+}
+
+// Tells if a plain scalar starts with an indicator of a feature not supported (anchors, aliases, tags, complex keys,
+// folded scalars & the reserved ones)
+func yamlIsUnsupported(text string) bool {
+	return len(text) != 0 && strings.ContainsRune("&*!?|>@`", rune(text[0]))
+}
+
+// Parses the collection starting at the current line
+func (parser *yamlParser) yamlParseNode() (interface{}, error) {
+	if parser.yamlSkip(); parser.position >= len(parser.lines) {
+		return nil, nil
+	}
+	line := parser.lines[parser.position]
+	if yamlIsItem(line.text) {
+		return parser.yamlParseSequence(line.indent)
+	}
+	return parser.yamlParseMapping(line.indent)
+}
+
+func (parser *yamlParser) yamlParseMapping(indent int) (interface{}, error) {
+	mapping := make(map[string]interface{})
+	for {
+		if parser.yamlSkip(); parser.position >= len(parser.lines) {
+			return mapping, nil
+		}
+		line := parser.lines[parser.position]
+		if line.indent < indent {
+			return mapping, nil
+		}
+		if line.indent > indent || yamlIsItem(line.text) {
+			return nil, parser.yamlFail("unexpected indentation")
+		}
+		key, rest, isKey := yamlSplitKey(line.text)
+		if !isKey && yamlIsUnsupported(line.text) {
+			return nil, parser.yamlFail("anchors, tags & complex keys are not supported")
+		}
+		if !isKey {
+			return nil, parser.yamlFail("expecting a key")
+		}
+		if _, present := mapping[key]; present {
+			return nil, parser.yamlFail("duplicate key")
+		}
+		parser.position++
+		value, fail := parser.yamlParseValue(indent, rest)
+		if fail != nil {
+			return nil, fail
+		}
+		mapping[key] = value
+	}
+}
+
+func (parser *yamlParser) yamlParseSequence(indent int) (interface{}, error) {
+	sequence := make([]interface{}, 0)
+	for {
+		if parser.yamlSkip(); parser.position >= len(parser.lines) {
+			return sequence, nil
+		}
+		line := parser.lines[parser.position]
+		if line.indent < indent || (line.indent == indent && !yamlIsItem(line.text)) {
+			return sequence, nil
+		}
+		if line.indent > indent {
+			return nil, parser.yamlFail("unexpected indentation")
+		}
+		item := strings.TrimSpace(line.text[1:])
+		var value interface{}
+		var fail error
+		if _, _, isKey := yamlSplitKey(item); isKey || yamlIsItem(item) {
+			// A compact collection starting on the line of the item
+			offset := line.indent + len(line.text) - len(item)
+			parser.lines[parser.position] = yamlLine{line.number, offset, item, line.raw, false}
+			value, fail = parser.yamlParseNode()
+		} else {
+			parser.position++
+			value, fail = parser.yamlParseValue(indent, item)
+		}
+		if fail != nil {
+			return nil, fail
+		}
+		sequence = append(sequence, value)
+	}
+}
+
+// Parses a value following a key or an item marker (nested on the next lines if not inline)
+func (parser *yamlParser) yamlParseValue(indent int, rest string) (interface{}, error) {
+	switch rest {
+	case "":
+		if parser.yamlSkip(); parser.position < len(parser.lines) {
+			next := parser.lines[parser.position]
+			if next.indent > indent || (next.indent == indent && yamlIsItem(next.text)) {
+				return parser.yamlParseNode()
+			}
+		}
+		return nil, nil
+	case "|", "|-":
+		return parser.yamlParseBlock(indent, rest == "|"), nil
+	}
+	value, fail := yamlParseScalar(rest)
+	if fail != nil {
+		return nil, fmt.Errorf("Line %d: %s", parser.lines[parser.position-1].number, fail)
+	}
+	return value, nil
+}
+
+// Parses a literal block scalar
+func (parser *yamlParser) yamlParseBlock(indent int, keepNewline bool) string {
+	block := make([]string, 0)
+	blockIndent := -1
+	for ; parser.position < len(parser.lines); parser.position++ {
+		line := parser.lines[parser.position]
+		if len(strings.TrimSpace(line.raw)) == 0 {
+			block = append(block, "")
+			continue
+		}
+		if line.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = line.indent
+		}
+		block = append(block, line.raw[blockIndent:])
+	}
+	for len(block) != 0 && len(block[len(block)-1]) == 0 {
+		block = block[:len(block)-1]
+	}
+	text := strings.Join(block, "\n")
+	if keepNewline && len(block) != 0 {
+		text += "\n"
+	}
+	return text
+}
+
+// Splits the content of a flow collection on the top level commas
+func yamlSplitFlow(text string) []string {
+	parts := make([]string, 0)
+	depth, quote, start := 0, byte(0), 0
+	for index := 0; index < len(text); index++ {
+		switch character := text[index]; {
+		case quote != 0:
+			if character == '\\' && quote == '"' {
+				index++
+			} else if character == quote {
+				quote = 0
+			}
+		case character == '"' || character == '\'':
+			quote = character
+		case character == '[' || character == '{':
+			depth++
+		case character == ']' || character == '}':
+			depth--
+		case character == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(text[start:index]))
+			start = index + 1
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); len(last) != 0 {
+		parts = append(parts, last)
+	}
+	return parts
+}
+
+// Parses an inline value
+func yamlParseScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "\""):
+		var value string
+		if fail := json.Unmarshal([]byte(text), &value); fail != nil {
+			return nil, fmt.Errorf("Invalid string %s", text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("Invalid string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("Invalid sequence %s", text)
+		}
+		sequence := make([]interface{}, 0)
+		for _, part := range yamlSplitFlow(text[1 : len(text)-1]) {
+			value, fail := yamlParseScalar(part)
+			if fail != nil {
+				return nil, fail
+			}
+			sequence = append(sequence, value)
+		}
+		return sequence, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, fmt.Errorf("Invalid mapping %s", text)
+		}
+		mapping := make(map[string]interface{})
+		for _, part := range yamlSplitFlow(text[1 : len(text)-1]) {
+			key, rest, isKey := yamlSplitKey(part)
+			if !isKey {
+				return nil, fmt.Errorf("Invalid mapping %s", text)
+			}
+			value, fail := yamlParseScalar(rest)
+			if fail != nil {
+				return nil, fail
+			}
+			mapping[key] = value
+		}
+		return mapping, nil
+	}
+	if yamlIsUnsupported(text) {
+		return nil, fmt.Errorf("Unsupported value %s (anchors, aliases, tags & folded scalars are not supported)", text)
+	}
+	switch text {
+	case "", "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if integer, fail := strconv.ParseInt(text, 10, 64); fail == nil {
+		return integer, nil
+	}
+	if number, fail := strconv.ParseFloat(text, 64); fail == nil {
+		return number, nil
+	}
+	return text, nil
+}
+
+// Quotes a string the YAML way (a JSON string is a valid YAML one)
+func yamlQuote(text string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(text)
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// Tells if a key can be written without quotes
+func yamlIsPlainKey(key string) bool {
+	if len(key) == 0 || strings.ContainsAny(key[:1], "0123456789-") {
+		return false
+	}
+	for _, character := range key {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-$/{}.", character) {
+			return false
+		}
+	}
+	return key != "true" && key != "false" && key != "null"
+}
+
+// Writes a value as YAML (the keys get sorted)
+func yamlEmit(buffer *bytes.Buffer, value interface{}, indent int) {
+	padding := strings.Repeat(" ", indent)
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buffer.WriteString(padding)
+			if yamlIsPlainKey(key) {
+				buffer.WriteString(key)
+			} else {
+				buffer.WriteString(yamlQuote(key))
+			}
+			buffer.WriteString(":")
+			yamlEmitNested(buffer, typed[key], indent)
+		}
+	case []interface{}:
+		for _, item := range typed {
+			buffer.WriteString(padding)
+			buffer.WriteString("-")
+			if mapping, isMap := item.(map[string]interface{}); isMap && len(mapping) != 0 {
+				// The first key goes on the line of the item
+				var nested bytes.Buffer
+				yamlEmit(&nested, mapping, indent+2)
+				buffer.WriteString(" ")
+				buffer.Write(nested.Bytes()[indent+2:])
+			} else {
+				yamlEmitNested(buffer, item, indent)
+			}
+		}
+	}
+}
+
+// Writes the value following a key or an item marker
+func yamlEmitNested(buffer *bytes.Buffer, value interface{}, indent int) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if len(typed) == 0 {
+			buffer.WriteString(" {}\n")
+			return
+		}
+		buffer.WriteString("\n")
+		yamlEmit(buffer, typed, indent+2)
+	case []interface{}:
+		if len(typed) == 0 {
+			buffer.WriteString(" []\n")
+			return
+		}
+		buffer.WriteString("\n")
+		yamlEmit(buffer, typed, indent+2)
+	case string:
+		buffer.WriteString(" " + yamlQuote(typed) + "\n")
+	case nil:
+		buffer.WriteString(" null\n")
+	default:
+		buffer.WriteString(fmt.Sprintf(" %v\n", typed))
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2020 OSRAM; Licensed under the MIT license.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestYamlParse(t *testing.T) {
+	cases := []struct {
+		document string
+		expected interface{}
+	}{
+		{"a: 1\nb: text\nc: true\nd: ~\ne: 1.5", map[string]interface{}{"a": int64(1), "b": "text", "c": true, "d": nil, "e": 1.5}},
+		{"# Comment\na: \"quoted # not a comment\" # comment\nb: 'it''s'", map[string]interface{}{"a": "quoted # not a comment", "b": "it's"}},
+		{"list:\n  - 1\n  - two\n- ignored", nil},
+		{"list:\n- a\n- b\nnext: 2", map[string]interface{}{"list": []interface{}{"a", "b"}, "next": int64(2)}},
+		{"items:\n  - name: a\n    value: 1\n  - name: b", map[string]interface{}{"items": []interface{}{
+			map[string]interface{}{"name": "a", "value": int64(1)},
+			map[string]interface{}{"name": "b"},
+		}}},
+		{"flow: [1, \"a, b\", [x, y]]\nmap: {a: 1, b: [2]}", map[string]interface{}{
+			"flow": []interface{}{int64(1), "a, b", []interface{}{"x", "y"}},
+			"map":  map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2)}},
+		}},
+		{"text: |\n  line 1\n\n  line 2\nstripped: |-\n  line\nafter: 1", map[string]interface{}{"text": "line 1\n\nline 2\n", "stripped": "line", "after": int64(1)}},
+		{"\"200\":\n  description: OK\n/path/{id}:\n  empty:", map[string]interface{}{
+			"200":        map[string]interface{}{"description": "OK"},
+			"/path/{id}": map[string]interface{}{"empty": nil},
+		}},
+		{"\"a: b\": 1\n'it''s': 2\n\"say \\\"hi\\\"\": {\"x, y\": [z]}", map[string]interface{}{
+			"a: b":       int64(1),
+			"it's":       int64(2),
+			"say \"hi\"": map[string]interface{}{"x, y": []interface{}{"z"}},
+		}},
+		{"\"don't\": 1\n'say \"hi\"': 2", map[string]interface{}{"don't": int64(1), "say \"hi\"": int64(2)}},
+		{"empty: []\nnone: {}\nnested: [[], [1, [2]], {a: []}]\nitems:\n  - [a, 'b, c']", map[string]interface{}{
+			"empty":  []interface{}{},
+			"none":   map[string]interface{}{},
+			"nested": []interface{}{[]interface{}{}, []interface{}{int64(1), []interface{}{int64(2)}}, map[string]interface{}{"a": []interface{}{}}},
+			"items":  []interface{}{[]interface{}{"a", "b, c"}},
+		}},
+		{"list:\n  - |\n    indented\n      more\n\n\n  - last\ntext: |-\n  # not a comment\n", map[string]interface{}{
+			"list": []interface{}{"indented\n  more\n", "last"},
+			"text": "# not a comment",
+		}},
+		{"---\n# Marked document\na: 1\n...\n", map[string]interface{}{"a": int64(1)}},
+	}
+	for _, tested := range cases {
+		parsed, fail := yamlParse([]byte(tested.document))
+		if tested.expected == nil {
+			if fail == nil {
+				t.Errorf("%q: parsed as %v (expecting a failure)", tested.document, parsed)
+			}
+			continue
+		}
+		if fail != nil {
+			t.Errorf("%q: %s", tested.document, fail)
+		} else if !reflect.DeepEqual(parsed, tested.expected) {
+			t.Errorf("%q: parsed as %#v (expecting %#v)", tested.document, parsed, tested.expected)
+		}
+	}
+}
+
+func TestYamlParseFailures(t *testing.T) {
+	for _, document := range []string{
+		"a: 1\na: 2",
+		"a: 1\n  b: 2",
+		"a: [1, 2",
+		"a: \"unterminated",
+		"just text",
+		"base: &base {a: 1}\nother: 2",
+		"other: *base",
+		"merged:\n  <<: *base",
+		"&key a: 1",
+		"list:\n  - &item x",
+		"a: !!str 1",
+		"a: [1, !int 2]",
+		"a: >\n  folded\n  text",
+		"a: |+\n  kept",
+		"a: |2\n   indented",
+		"? complex\n: key",
+		"%YAML 1.2\n---\na: 1",
+		"a: 1\n---\nb: 2",
+		"a:\n\tb: 1",
+		"a: [1,\n  2]",
+		"a: \"multi\n  line\"",
+	} {
+		if parsed, fail := yamlParse([]byte(document)); fail == nil {
+			t.Errorf("%q: parsed as %v (expecting a failure)", document, parsed)
+		}
+	}
+}
+
+// Compares values once converted to JSON (the emitted integers & floats are told apart when parsed)
+func yamlSameJSON(t *testing.T, left, right interface{}) bool {
+	leftJSON, failLeft := json.Marshal(left)
+	rightJSON, failRight := json.Marshal(right)
+	if failLeft != nil || failRight != nil {
+		t.Fatalf("Failed to marshal (%v, %v)", failLeft, failRight)
+	}
+	return bytes.Equal(leftJSON, rightJSON)
+}
+
+func TestYamlEmit(t *testing.T) {
+	value := map[string]interface{}{
+		"plain":  "text: with # characters",
+		"200":    "quoted key",
+		"empty":  map[string]interface{}{},
+		"none":   []interface{}{},
+		"null":   nil,
+		"nested": map[string]interface{}{"list": []interface{}{int64(1), map[string]interface{}{"a": "b", "c": []interface{}{true}}, "x"}},
+		"text":   "multi\nline",
+	}
+	var buffer bytes.Buffer
+	yamlEmit(&buffer, value, 0)
+	parsed, fail := yamlParse(buffer.Bytes())
+	if fail != nil {
+		t.Fatalf("Failed to parse the emitted YAML (%s):\n%s", fail, buffer.String())
+	}
+	if !yamlSameJSON(t, parsed, value) {
+		t.Errorf("Round trip changed the value:\n%s", buffer.String())
+	}
+}